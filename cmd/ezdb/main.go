@@ -0,0 +1,176 @@
+// Command ezdb provides administrative operations on ez-file-db databases.
+//
+// Usage:
+//
+//	ezdb [-data dir] <command> [arguments]
+//
+// Commands:
+//
+//	reshard -db name -table table -depth n -width n
+//	    move the records of a table into a new directory sharding
+//	migrate -db name -dir dir [-to version] [-steps n] up|down|status|unlock
+//	    apply, revert or list the SQL migrations in dir
+//
+// Commands operate on the files directly and must not run while the
+// database is open in another process.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tungpsit/ez-file-db/pkg/db"
+	"github.com/tungpsit/ez-file-db/pkg/migrate"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+func main() {
+	dataDir := flag.String("data", db.DefaultConfig().DataDir, "data directory")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "reshard":
+		err = reshard(*dataDir, args)
+	case "migrate":
+		err = runMigrate(*dataDir, args)
+	default:
+		fmt.Fprintf(os.Stderr, "ezdb: unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ezdb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ezdb [-data dir] <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  reshard -db name -table table -depth n -width n\n")
+	fmt.Fprintf(os.Stderr, "  migrate -db name -dir dir [-to version] [-steps n] up|down|status|unlock\n")
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// reshard moves the records of a table into a new directory sharding
+func reshard(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ExitOnError)
+	dbName := flags.String("db", "", "database name")
+	table := flags.String("table", "", "table name")
+	depth := flags.Int("depth", 1, "levels of shard directories (0 = flat)")
+	width := flags.Int("width", 256, "directories per level")
+	flags.Parse(args)
+
+	if *dbName == "" || *table == "" {
+		return fmt.Errorf("reshard: -db and -table are required")
+	}
+
+	dbPath := filepath.Join(dataDir, *dbName)
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("reshard: %w", err)
+	}
+
+	fs, err := storage.NewFileStorage(dbPath, 0)
+	if err != nil {
+		return fmt.Errorf("reshard: %w", err)
+	}
+	defer fs.Close()
+
+	before, err := fs.TableSharding(*table)
+	if err != nil {
+		return fmt.Errorf("reshard: %w", err)
+	}
+
+	after := storage.Sharding{Depth: *depth, Width: *width}
+	if err := fs.Reshard(*table, after); err != nil {
+		return fmt.Errorf("reshard: %w", err)
+	}
+
+	fmt.Printf("resharded %s.%s from depth=%d width=%d to depth=%d width=%d\n",
+		*dbName, *table, before.Depth, before.Width, after.Depth, after.Width)
+	return nil
+}
+
+// runMigrate applies, reverts or lists the SQL migrations in a directory
+func runMigrate(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbName := flags.String("db", "", "database name")
+	dir := flags.String("dir", "migrations", "directory of <version>_<name>.up.sql and .down.sql files")
+	to := flags.Int64("to", 0, "last version to apply with up (0 = all)")
+	steps := flags.Int("steps", 1, "number of migrations to revert with down")
+	flags.Parse(args)
+
+	if *dbName == "" || flags.NArg() != 1 {
+		return fmt.Errorf("migrate: -db and one of up, down, status or unlock are required")
+	}
+	if *steps < 1 {
+		return fmt.Errorf("migrate: -steps must be at least 1")
+	}
+
+	config := db.DefaultConfig()
+	config.DataDir = dataDir
+	database, err := db.New(*dbName, config)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	defer database.Close()
+
+	migrator := migrate.New(database)
+	if err := migrator.RegisterFS(os.DirFS(*dir), "."); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	ctx := context.Background()
+	switch flags.Arg(0) {
+	case "up":
+		applied, err := migrator.UpTo(ctx, *to)
+		for _, version := range applied {
+			fmt.Printf("applied %d\n", version)
+		}
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	case "down":
+		reverted, err := migrator.Down(ctx, *steps)
+		for _, version := range reverted {
+			fmt.Printf("reverted %d\n", version)
+		}
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			switch {
+			case status.Missing:
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05") + " (missing)"
+			case status.Applied:
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%s\t%s\n", status.Version, status.Name, state)
+		}
+	case "unlock":
+		if err := migrator.Unlock(ctx); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	default:
+		return fmt.Errorf("migrate: unknown action %q", flags.Arg(0))
+	}
+	return nil
+}
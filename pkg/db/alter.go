@@ -0,0 +1,1034 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/query"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// rewriteBatch is the number of records rewritten per storage batch after a
+// table is altered
+const rewriteBatch = 256
+
+// AlterKind identifies the schema change made by an AlterOp
+type AlterKind int
+
+const (
+	AlterAddColumn AlterKind = iota
+	AlterDropColumn
+	AlterRenameColumn
+	AlterChangeType
+	AlterAddCheck
+	AlterDropCheck
+	AlterAddForeignKey
+	AlterDropForeignKey
+)
+
+// AlterOp is one schema change applied by AlterTable. Build them with
+// AddColumn, DropColumn, RenameColumn, ChangeType, AddCheck, DropCheck,
+// AddForeignKey and DropForeignKey.
+type AlterOp struct {
+	Kind       AlterKind   `json:"kind"`
+	Column     Column      `json:"column"` // column to add, or the column to change by Name
+	NewName    string      `json:"new_name,omitempty"`
+	Type       DataType    `json:"type,omitempty"`
+	Check      *Check      `json:"check,omitempty"`
+	ForeignKey *ForeignKey `json:"foreign_key,omitempty"`
+}
+
+// AddColumn adds col to a table. Existing records take col.Default.
+func AddColumn(col Column) AlterOp {
+	return AlterOp{Kind: AlterAddColumn, Column: col}
+}
+
+// DropColumn removes a column and every index that uses it
+func DropColumn(name string) AlterOp {
+	return AlterOp{Kind: AlterDropColumn, Column: Column{Name: name}}
+}
+
+// RenameColumn renames a column, keeping its values and indexes
+func RenameColumn(name, newName string) AlterOp {
+	return AlterOp{Kind: AlterRenameColumn, Column: Column{Name: name}, NewName: newName}
+}
+
+// ChangeType converts a column to dataType. Numbers, strings, booleans and
+// times convert where the value allows it; the change fails when any stored
+// value cannot be converted.
+func ChangeType(name string, dataType DataType) AlterOp {
+	return AlterOp{Kind: AlterChangeType, Column: Column{Name: name}, Type: dataType}
+}
+
+// AddCheck adds check to column, or to the table when column is empty. The
+// change fails when a stored record breaks the check.
+func AddCheck(column string, check Check) AlterOp {
+	return AlterOp{Kind: AlterAddCheck, Column: Column{Name: column}, Check: &check}
+}
+
+// DropCheck removes the check called name from a table or its columns
+func DropCheck(name string) AlterOp {
+	return AlterOp{Kind: AlterDropCheck, NewName: name}
+}
+
+// AddForeignKey adds fk to a table. The change fails when a stored record
+// references a missing record.
+func AddForeignKey(fk ForeignKey) AlterOp {
+	return AlterOp{Kind: AlterAddForeignKey, ForeignKey: &fk}
+}
+
+// DropForeignKey removes the foreign key called name and its index
+func DropForeignKey(name string) AlterOp {
+	return AlterOp{Kind: AlterDropForeignKey, NewName: name}
+}
+
+// alteration is a schema change that records stamped with a schema below
+// Version have not been rewritten for yet
+type alteration struct {
+	Version int64     `json:"version"`
+	Ops     []AlterOp `json:"ops"`
+}
+
+// AlterTable implements Database.AlterTable
+func (db *database) AlterTable(name string, ops ...AlterOp) error {
+	return db.AlterTableContext(context.Background(), name, ops...)
+}
+
+// AlterTableContext implements Database.AlterTableContext. The schema and
+// indexes change at once; records are converted as they are read until a
+// background job has rewritten them.
+func (db *database) AlterTableContext(ctx context.Context, name string, ops ...AlterOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("%w: no changes to apply", ErrInvalidOperation)
+	}
+
+	if err := db.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	table, exists := db.tables[name]
+	if !exists {
+		return ErrTableNotFound
+	}
+	if name == schemaTableName {
+		return fmt.Errorf("%w: table %s cannot be altered", ErrInvalidOperation, name)
+	}
+
+	next, err := alterSchema(table, ops)
+	if err != nil {
+		return err
+	}
+	next.schema = table.schema + 1
+	// Blobs of dropped columns are released once the change is persisted
+	dropped, err := db.droppedBlobs(ctx, table, ops)
+	if err != nil {
+		return err
+	}
+	tables := make(map[string]*Table, len(db.tables))
+	for tableName, t := range db.tables {
+		tables[tableName] = t
+	}
+	tables[name] = next
+	resolveForeignKeys(tables, next)
+	if err := validateReferences(tables); err != nil {
+		return err
+	}
+	var added []Column
+	for _, op := range ops {
+		if op.Kind == AlterAddColumn {
+			added = append(added, op.Column)
+		}
+	}
+	if err := db.ensureSequences(ctx, name, added); err != nil {
+		return err
+	}
+
+	// Existing records get one now() for all of them. Other generated
+	// defaults differ per record, so every record is rewritten right away
+	// instead of converting records as they are read.
+	ops = resolveNow(ops, next.UpdatedAt)
+	eager := hasVolatileDefault(ops)
+	if !eager && rewritesRecords(ops) {
+		next.pending = append(append([]alteration(nil), table.pending...), alteration{
+			Version: next.schema,
+			Ops:     ops,
+		})
+	}
+
+	// Converted values and renamed or dropped columns change index entries,
+	// so those indexes are rebuilt before anything is persisted
+	indexManager := db.indexes[name]
+	rebuilt := eager || needsRebuild(ops)
+	if rebuilt {
+		reservation := db.budget.NewReservation()
+		defer reservation.Release()
+		var generated []generatedRow
+		indexManager, generated, err = db.rebuildIndexes(ctx, table, next, ops, eager, reservation)
+		if err != nil {
+			return err
+		}
+		if err := db.rewriteGenerated(table, next, ops, generated); err != nil {
+			indexManager.DropAll()
+			return err
+		}
+	}
+
+	if err := db.updateTableSchema(next); err != nil {
+		if rebuilt {
+			indexManager.DropAll()
+		}
+		return err
+	}
+	if rebuilt {
+		db.indexes[name].DropAll()
+		db.indexes[name] = indexManager
+	}
+	db.tables[name] = next
+	db.cacheReferences()
+	db.blobs.release(dropped)
+
+	if len(next.pending) > 0 {
+		db.startRewrite(name)
+	}
+	return nil
+}
+
+// alterSchema validates ops against table and returns an altered copy
+func alterSchema(table *Table, ops []AlterOp) (*Table, error) {
+	next := *table
+	next.Columns = append([]Column(nil), table.Columns...)
+	next.Indexes = make([]IndexInfo, len(table.Indexes))
+	for i, idx := range table.Indexes {
+		next.Indexes[i] = idx
+		next.Indexes[i].Columns = append([]string(nil), idx.Columns...)
+	}
+
+	find := func(name string) int {
+		for i, col := range next.Columns {
+			if col.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, op := range ops {
+		i := find(op.Column.Name)
+		noColumn := op.Kind == AlterDropCheck || op.Kind == AlterAddForeignKey || op.Kind == AlterDropForeignKey ||
+			(op.Kind == AlterAddCheck && op.Column.Name == "")
+		if op.Kind != AlterAddColumn && !noColumn && i < 0 {
+			return nil, fmt.Errorf("%w: column %s not found", ErrInvalidOperation, op.Column.Name)
+		}
+
+		switch op.Kind {
+		case AlterAddColumn:
+			col := op.Column
+			if col.Name == "" {
+				return nil, fmt.Errorf("%w: column name is required", ErrInvalidOperation)
+			}
+			if i >= 0 {
+				return nil, fmt.Errorf("%w: column %s already exists", ErrInvalidOperation, col.Name)
+			}
+			if col.PrimaryKey {
+				return nil, fmt.Errorf("%w: a primary key cannot be added", ErrInvalidOperation)
+			}
+			if col.AutoIncrement {
+				return nil, fmt.Errorf("%w: an auto-increment column cannot be added", ErrInvalidOperation)
+			}
+			if err := validateColumnType(col); err != nil {
+				return nil, err
+			}
+			if err := validateDefault(col); err != nil {
+				return nil, err
+			}
+			next.Columns = append(next.Columns, col)
+
+		case AlterDropColumn:
+			if next.isKeyColumn(op.Column.Name) {
+				return nil, fmt.Errorf("%w: primary key %s cannot be dropped", ErrInvalidOperation, op.Column.Name)
+			}
+			next.Columns = append(next.Columns[:i], next.Columns[i+1:]...)
+			if name, ok := checkUsing(&next, op.Column.Name); ok {
+				return nil, fmt.Errorf("%w: column %s is used by check %s", ErrInvalidOperation, op.Column.Name, name)
+			}
+			indexes := next.Indexes[:0]
+			for _, idx := range next.Indexes {
+				if !usesColumn(&next, idx.Columns, op.Column.Name) {
+					indexes = append(indexes, idx)
+				}
+			}
+			next.Indexes = indexes
+
+		case AlterRenameColumn:
+			if op.NewName == "" {
+				return nil, fmt.Errorf("%w: new column name is required", ErrInvalidOperation)
+			}
+			if find(op.NewName) >= 0 {
+				return nil, fmt.Errorf("%w: column %s already exists", ErrInvalidOperation, op.NewName)
+			}
+			next.Columns[i].Name = op.NewName
+			if next.PrimaryKey == op.Column.Name {
+				next.PrimaryKey = op.NewName
+			}
+			keys := append([]string(nil), next.keyColumns()...)
+			for j, col := range keys {
+				if col == op.Column.Name {
+					keys[j] = op.NewName
+				}
+			}
+			next.PrimaryKeys = keys
+			for j := range next.Columns {
+				next.Columns[j].Checks = renameCheckColumn(next.Columns[j].Checks, op.Column.Name, op.NewName)
+			}
+			next.Checks = renameCheckColumn(next.Checks, op.Column.Name, op.NewName)
+			next.ForeignKeys = renameForeignKeyColumn(&next, op.Column.Name, op.NewName)
+			for _, idx := range next.Indexes {
+				for j, col := range idx.Columns {
+					if col == op.Column.Name {
+						idx.Columns[j] = op.NewName
+					} else if path, ok := documentPath(&next, col); ok && path.Column == op.Column.Name {
+						idx.Columns[j] = renamePath(col, op.Column.Name, op.NewName)
+					}
+				}
+			}
+
+		case AlterChangeType:
+			// Records are stored under their primary key, so its type is fixed
+			if next.isKeyColumn(op.Column.Name) {
+				return nil, fmt.Errorf("%w: primary key %s cannot change type", ErrInvalidOperation, op.Column.Name)
+			}
+			switch op.Type {
+			case Blob:
+				return nil, fmt.Errorf("%w: cannot convert column %s to a blob", ErrInvalidDataType, op.Column.Name)
+			case Array, Enum, Decimal:
+				// Conversions take no type parameters to convert to
+				return nil, fmt.Errorf("%w: cannot convert column %s to a type with parameters", ErrInvalidDataType, op.Column.Name)
+			}
+			if next.Columns[i].Type == JSON && op.Type != JSON {
+				for _, idx := range next.Indexes {
+					if usesColumn(&next, idx.Columns, op.Column.Name) && !containsString(idx.Columns, op.Column.Name) {
+						return nil, fmt.Errorf("%w: column %s is used by path index %s", ErrInvalidOperation, op.Column.Name, idx.Name)
+					}
+				}
+			}
+			if next.Columns[i].AutoIncrement && op.Type != Int {
+				return nil, fmt.Errorf("%w: auto-increment column %s must stay an int", ErrInvalidDataType, op.Column.Name)
+			}
+			next.Columns[i].Type = op.Type
+
+		case AlterAddCheck:
+			if op.Check == nil {
+				return nil, fmt.Errorf("%w: check is required", ErrInvalidOperation)
+			}
+			if i < 0 {
+				next.Checks = append(append([]Check(nil), next.Checks...), *op.Check)
+			} else {
+				next.Columns[i].Checks = append(append([]Check(nil), next.Columns[i].Checks...), *op.Check)
+			}
+
+		case AlterDropCheck:
+			dropped := false
+			drop := func(checks []Check) []Check {
+				kept := make([]Check, 0, len(checks))
+				for _, check := range checks {
+					if check.Name == op.NewName {
+						dropped = true
+						continue
+					}
+					kept = append(kept, check)
+				}
+				return kept
+			}
+			next.Checks = drop(next.Checks)
+			for j := range next.Columns {
+				next.Columns[j].Checks = drop(next.Columns[j].Checks)
+			}
+			if !dropped {
+				return nil, fmt.Errorf("%w: check %s not found", ErrInvalidOperation, op.NewName)
+			}
+
+		case AlterAddForeignKey:
+			if op.ForeignKey == nil {
+				return nil, fmt.Errorf("%w: foreign key is required", ErrInvalidOperation)
+			}
+			fk := *op.ForeignKey
+			fk.Columns = append([]string(nil), fk.Columns...)
+			fk.RefColumns = append([]string(nil), fk.RefColumns...)
+			if fk.Name == "" {
+				fk.Name = foreignKeyName(next.Name, fk)
+			}
+			next.ForeignKeys = append(append([]ForeignKey(nil), next.ForeignKeys...), fk)
+
+		case AlterDropForeignKey:
+			kept := make([]ForeignKey, 0, len(next.ForeignKeys))
+			for _, fk := range next.ForeignKeys {
+				if fk.Name != op.NewName {
+					kept = append(kept, fk)
+				}
+			}
+			if len(kept) == len(next.ForeignKeys) {
+				return nil, fmt.Errorf("%w: foreign key %s not found", ErrInvalidOperation, op.NewName)
+			}
+			next.ForeignKeys = kept
+
+		default:
+			return nil, fmt.Errorf("%w: unknown alter kind %d", ErrInvalidOperation, op.Kind)
+		}
+	}
+
+	if err := validateChecks(&next); err != nil {
+		return nil, err
+	}
+	next.UpdatedAt = time.Now()
+	return &next, nil
+}
+
+// checkUsing returns the name of a check of table whose conditions use
+// column
+func checkUsing(table *Table, column string) (string, bool) {
+	uses := func(check Check) bool {
+		for _, cond := range check.Conditions {
+			if cond.Column == column || cond.Value == query.Col(column) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, col := range table.Columns {
+		for _, check := range col.Checks {
+			if uses(check) {
+				return check.Name, true
+			}
+		}
+	}
+	for _, check := range table.Checks {
+		if uses(check) {
+			return check.Name, true
+		}
+	}
+	return "", false
+}
+
+// renameForeignKeyColumn returns the foreign keys of table with column
+// renamed to newName, copying what it changes
+func renameForeignKeyColumn(table *Table, column, newName string) []ForeignKey {
+	if len(table.ForeignKeys) == 0 {
+		return table.ForeignKeys
+	}
+	rename := func(columns []string) []string {
+		renamed := append([]string(nil), columns...)
+		for i, col := range renamed {
+			if col == column {
+				renamed[i] = newName
+			}
+		}
+		return renamed
+	}
+	renamed := make([]ForeignKey, len(table.ForeignKeys))
+	for i, fk := range table.ForeignKeys {
+		fk.Columns = rename(fk.Columns)
+		if fk.RefTable == table.Name {
+			fk.RefColumns = rename(fk.RefColumns)
+		}
+		renamed[i] = fk
+	}
+	return renamed
+}
+
+// renameCheckColumn returns checks with the conditions on column moved to
+// newName, copying what it changes
+func renameCheckColumn(checks []Check, column, newName string) []Check {
+	if len(checks) == 0 {
+		return checks
+	}
+	renamed := make([]Check, len(checks))
+	for i, check := range checks {
+		check.Conditions = append([]query.Condition(nil), check.Conditions...)
+		for j, cond := range check.Conditions {
+			if cond.Column == column {
+				check.Conditions[j].Column = newName
+			}
+			if cond.Value == query.Col(column) {
+				check.Conditions[j].Value = query.Col(newName)
+			}
+		}
+		renamed[i] = check
+	}
+	return renamed
+}
+
+// resolveNow returns ops with now() defaults of added columns replaced by t
+func resolveNow(ops []AlterOp, t time.Time) []AlterOp {
+	resolved := append([]AlterOp(nil), ops...)
+	for i, op := range resolved {
+		if op.Kind == AlterAddColumn && op.Column.Default == DefaultNow {
+			resolved[i].Column.Default = t
+		}
+	}
+	return resolved
+}
+
+// hasVolatileDefault reports whether ops add a column whose default differs
+// for every record
+func hasVolatileDefault(ops []AlterOp) bool {
+	for _, op := range ops {
+		if f, ok := op.Column.Default.(DefaultFunc); ok && op.Kind == AlterAddColumn && f.volatile() {
+			return true
+		}
+	}
+	return false
+}
+
+// rewritesRecords reports whether ops change stored records. Adding a column
+// without a default, or adding and dropping checks and foreign keys, leaves
+// them as they are.
+func rewritesRecords(ops []AlterOp) bool {
+	for _, op := range ops {
+		switch op.Kind {
+		case AlterAddCheck, AlterDropCheck, AlterAddForeignKey, AlterDropForeignKey:
+		case AlterAddColumn:
+			if op.Column.Default != nil {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// needsRebuild reports whether ops can change index entries or need the
+// stored records to be checked. Adding a plain column or dropping a check
+// needs neither.
+func needsRebuild(ops []AlterOp) bool {
+	for _, op := range ops {
+		switch op.Kind {
+		case AlterDropCheck:
+		case AlterAddColumn:
+			if op.Column.Unique || (op.Column.NotNull && op.Column.Default == nil) || len(op.Column.Checks) > 0 {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// generatedRow holds the defaults generated for one record while its table
+// is altered, so that the record is stored with the values it was indexed by
+type generatedRow struct {
+	id     interface{}
+	values map[string]interface{}
+}
+
+// rebuildIndexes builds the indexes of the altered table next from every
+// stored record, failing when a value cannot be converted or a unique or
+// required column would be violated. With rewrite set it also evaluates
+// generated defaults and returns them for every record, reserved from
+// reservation.
+func (db *database) rebuildIndexes(ctx context.Context, table, next *Table, ops []AlterOp, rewrite bool, reservation *memory.Reservation) (*IndexManager, []generatedRow, error) {
+	indexManager, err := newTableIndexManager(next, db.budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, idx := range next.Indexes {
+		if err := indexManager.CreateIndex(idx.Name, idx.Columns); err != nil {
+			indexManager.DropAll()
+			return nil, nil, fmt.Errorf("failed to create index %s: %w", idx.Name, err)
+		}
+	}
+
+	var values map[string]interface{}
+	var generate func(Column) (interface{}, error)
+	if rewrite {
+		generate = func(col Column) (interface{}, error) {
+			value, err := db.defaultValue(ctx, col)
+			values[col.Name] = value
+			return value, err
+		}
+	}
+	// References within the table are checked once every record is indexed
+	var selfColumns []string
+	for _, fk := range next.ForeignKeys {
+		if fk.RefTable == next.Name {
+			selfColumns = append(selfColumns, fk.Columns...)
+		}
+	}
+	var selfRows []map[string]interface{}
+
+	var generated []generatedRow
+	err = db.storage.Scan(table.Name, func(record *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		values = make(map[string]interface{})
+		data := copyRow(decodeRecord(table, record), nil)
+		if err := applyAlterOps(data, ops, generate); err != nil {
+			return fmt.Errorf("record %v: %w", record.ID, err)
+		}
+		data = decodeRow(next.Columns, data)
+		if err := checkRow(next, data); err != nil {
+			return fmt.Errorf("record %v: %w", record.ID, err)
+		}
+		if err := db.checkExistingReferences(next, nil, data); err != nil {
+			return fmt.Errorf("record %v: %w", record.ID, err)
+		}
+		if len(selfColumns) > 0 {
+			selfRows = append(selfRows, projectColumns(data, selfColumns))
+		}
+		if rewrite {
+			row := generatedRow{id: record.ID, values: values}
+			if err := reservation.Grow(memory.SizeOf(row.id) + memory.SizeOf(row.values)); err != nil {
+				return err
+			}
+			generated = append(generated, row)
+		}
+		return indexManager.IndexRecord(data)
+	})
+	for _, row := range selfRows {
+		if err != nil {
+			break
+		}
+		err = db.checkExistingReferences(next, indexManager, row)
+	}
+	if err == nil {
+		err = checkUniqueIndexes(next, indexManager)
+	}
+	if err != nil {
+		indexManager.DropAll()
+		return nil, nil, fmt.Errorf("failed to alter table %s: %w", table.Name, err)
+	}
+	return indexManager, generated, nil
+}
+
+// rewriteGenerated stores the records of rows under the altered schema
+// next with their generated defaults, rewriteBatch records per storage batch
+// so that only one batch is held in memory at a time. The records were all
+// validated by rebuildIndexes, so a failure can only come from storage, and
+// it leaves the batches already written in place.
+func (db *database) rewriteGenerated(table, next *Table, ops []AlterOp, rows []generatedRow) error {
+	for start := 0; start < len(rows); start += rewriteBatch {
+		if err := db.rewriteChunk(table, next, ops, rows[start:min(start+rewriteBatch, len(rows))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteChunk writes one batch of rewriteGenerated
+func (db *database) rewriteChunk(table, next *Table, ops []AlterOp, rows []generatedRow) error {
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+
+	writes := make([]storage.Op, 0, len(rows))
+	for _, row := range rows {
+		record, err := db.storage.Read(table.Name, row.id)
+		if err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+		if record == nil {
+			continue
+		}
+		data := copyRow(decodeRecord(table, record), nil)
+		err = applyAlterOps(data, ops, func(col Column) (interface{}, error) {
+			return row.values[col.Name], nil
+		})
+		if err != nil {
+			return fmt.Errorf("record %v: %w", record.ID, err)
+		}
+		data = decodeRow(next.Columns, data)
+		if err := reservation.Grow(memory.SizeOf(data)); err != nil {
+			return err
+		}
+		writes = append(writes, storage.Op{
+			Type:   storage.OpWrite,
+			Table:  table.Name,
+			Record: &storage.Record{ID: record.ID, Data: data, Version: time.Now().UnixNano(), Schema: next.schema},
+		})
+	}
+	if err := db.storage.Batch(writes); err != nil {
+		return fmt.Errorf("failed to rewrite records: %w", err)
+	}
+	return nil
+}
+
+// checkUniqueIndexes returns a DuplicateKeyError when two records share the
+// value of a unique column
+func checkUniqueIndexes(table *Table, indexManager *IndexManager) error {
+	for _, col := range table.Columns {
+		if !table.hasUniqueIndex(col) {
+			continue
+		}
+		index, err := indexManager.GetIndex(uniqueIndexName(table, col.Name))
+		if err != nil {
+			continue
+		}
+		index.mu.RLock()
+		entries := index.entries
+		for i := 1; i < len(entries); i++ {
+			if entries[i].Key != nil && compareValues(entries[i-1].Key, entries[i].Key) == 0 {
+				index.mu.RUnlock()
+				return &DuplicateKeyError{Table: table.Name, Column: col.Name, Value: entries[i].Key}
+			}
+		}
+		index.mu.RUnlock()
+	}
+	return nil
+}
+
+// decodeRecord returns the data of a record under the current schema of
+// table, applying the alterations it has not been rewritten for yet
+func decodeRecord(table *Table, record *storage.Record) map[string]interface{} {
+	data := record.Data
+	copied := false
+	for _, alt := range table.pending {
+		if record.Schema >= alt.Version {
+			continue
+		}
+		// Stored and cached records are never changed in place
+		if !copied {
+			data = copyRow(data, nil)
+			copied = true
+		}
+		// Values were checked when the table was altered
+		_ = applyAlterOps(data, alt.Ops, nil)
+	}
+	return decodeRow(table.Columns, data)
+}
+
+// applyAlterOps rewrites data for ops in order, evaluating generated
+// defaults with generate when it is not nil. Values that cannot be converted
+// are left as they are and reported by the returned error.
+func applyAlterOps(data map[string]interface{}, ops []AlterOp, generate func(Column) (interface{}, error)) error {
+	var firstErr error
+	for _, op := range ops {
+		name := op.Column.Name
+		switch op.Kind {
+		case AlterAddColumn:
+			if _, exists := data[name]; exists {
+				continue
+			}
+			if _, ok := op.Column.Default.(DefaultFunc); ok && generate != nil {
+				value, err := generate(op.Column)
+				if err != nil {
+					return err
+				}
+				data[name] = value
+			} else if op.Column.Default != nil {
+				data[name] = op.Column.Default
+			} else if op.Column.NotNull && firstErr == nil {
+				firstErr = fmt.Errorf("column %s is required", name)
+			}
+		case AlterDropColumn:
+			delete(data, name)
+		case AlterRenameColumn:
+			if value, exists := data[name]; exists {
+				data[op.NewName] = value
+				delete(data, name)
+			}
+		case AlterChangeType:
+			value, exists := data[name]
+			if !exists {
+				continue
+			}
+			converted, err := convertValue(value, op.Type)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("column %s: %w", name, err)
+				}
+				continue
+			}
+			data[name] = converted
+		}
+	}
+	return firstErr
+}
+
+// convertValue converts value to dataType. Conversion depends only on the
+// value itself, so converting an already converted value is a no-op.
+func convertValue(value interface{}, dataType DataType) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	fail := func() (interface{}, error) {
+		return nil, fmt.Errorf("%w: cannot convert %v (%T) to type %d", ErrInvalidDataType, value, value, dataType)
+	}
+
+	switch dataType {
+	case Int:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int32:
+			return int(v), nil
+		case int64:
+			return int(v), nil
+		case float32:
+			return floatToInt(float64(v))
+		case float64:
+			return floatToInt(v)
+		case DecimalValue:
+			if v.scale > 0 {
+				return fail()
+			}
+			return int(v.coef), nil
+		case bool:
+			if v {
+				return 1, nil
+			}
+			return 0, nil
+		case string:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fail()
+			}
+			return int(n), nil
+		}
+	case Float:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float32:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case DecimalValue:
+			return v.Float64(), nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fail()
+			}
+			return f, nil
+		}
+	case String:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int, int32, int64, bool:
+			return fmt.Sprint(v), nil
+		case float32:
+			return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		case DecimalValue:
+			return v.String(), nil
+		case map[string]interface{}, []interface{}:
+			text, err := json.Marshal(v)
+			if err != nil {
+				return fail()
+			}
+			return string(text), nil
+		}
+	case Boolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fail()
+			}
+			return b, nil
+		default:
+			if n, err := convertValue(value, Int); err == nil && (n == 0 || n == 1) {
+				return n == 1, nil
+			}
+		}
+	case DateTime:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return fail()
+			}
+			return t, nil
+		}
+	case JSON:
+		if t, ok := value.(time.Time); ok {
+			return t.Format(time.RFC3339Nano), nil
+		}
+		if validateJSON(value) == nil {
+			return jsonValue(value), nil
+		}
+	}
+	return fail()
+}
+
+// floatToInt converts f to an int when it has no fractional part
+func floatToInt(f float64) (interface{}, error) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("%w: cannot convert %v to an integer without loss", ErrInvalidDataType, f)
+	}
+	return int(f), nil
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// startRewrite rewrites the records of an altered table in the background.
+// An interrupted rewrite resumes the next time the database is opened.
+func (db *database) startRewrite(tableName string) {
+	db.jobs.Add(1)
+	go func() {
+		defer db.jobs.Done()
+		// On failure the alteration stays pending and reads keep applying it
+		_ = db.rewriteTable(db.jobsCtx, tableName)
+	}()
+}
+
+// rewriteTable stores every record of a table under its current schema and
+// then clears the alterations it covered. Stale records are rewritten as the
+// scan finds them, so only one batch of keys is held at a time.
+func (db *database) rewriteTable(ctx context.Context, tableName string) error {
+	cutoff, err := db.rewriteCutoff(ctx, tableName)
+	if err != nil || cutoff == 0 {
+		return err
+	}
+	ids := make([]interface{}, 0, rewriteBatch)
+	err = db.storage.Scan(tableName, func(record *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if record.Schema >= cutoff {
+			return nil
+		}
+		ids = append(ids, record.ID)
+		if len(ids) < rewriteBatch {
+			return nil
+		}
+		err := db.rewriteRecords(ctx, tableName, ids)
+		ids = ids[:0]
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rewrite table %s: %w", tableName, err)
+	}
+	if len(ids) > 0 {
+		if err := db.rewriteRecords(ctx, tableName, ids); err != nil {
+			return err
+		}
+	}
+	return db.finishRewrite(ctx, tableName, cutoff)
+}
+
+// rewriteCutoff returns the version of the latest pending alteration of a
+// table, or zero when nothing is pending
+func (db *database) rewriteCutoff(ctx context.Context, tableName string) (int64, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists || len(table.pending) == 0 {
+		return 0, nil
+	}
+	return table.pending[len(table.pending)-1].Version, nil
+}
+
+// rewriteRecords locks the given records and writes those still stale under
+// the current schema with a single storage batch
+func (db *database) rewriteRecords(ctx context.Context, tableName string, ids []interface{}) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists || len(table.pending) == 0 {
+		return nil
+	}
+	cutoff := table.pending[len(table.pending)-1].Version
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, tableName, LockIntentExclusive); err != nil {
+		return err
+	}
+	sort.Slice(ids, func(i, j int) bool { return compareValues(ids[i], ids[j]) < 0 })
+	for _, id := range ids {
+		if err := locker.LockKey(ctx, tableName, id, LockExclusive); err != nil {
+			return err
+		}
+	}
+
+	var ops []storage.Op
+	for _, id := range ids {
+		record, err := db.storage.Read(tableName, id)
+		if err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+		// Deleted or written again since the scan
+		if record == nil || record.Schema >= cutoff {
+			continue
+		}
+		ops = append(ops, storage.Op{
+			Type:   storage.OpWrite,
+			Table:  tableName,
+			Record: &storage.Record{ID: record.ID, Data: decodeRecord(table, record), Version: time.Now().UnixNano(), Schema: table.schema},
+		})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := db.storage.Batch(ops); err != nil {
+		return fmt.Errorf("failed to rewrite records: %w", err)
+	}
+	return nil
+}
+
+// finishRewrite drops the pending alterations up to cutoff once every record
+// stamped with an older schema has been rewritten
+func (db *database) finishRewrite(ctx context.Context, tableName string, cutoff int64) error {
+	if err := db.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil
+	}
+	var pending []alteration
+	for _, alt := range table.pending {
+		if alt.Version > cutoff {
+			pending = append(pending, alt)
+		}
+	}
+	if len(pending) == len(table.pending) {
+		return nil
+	}
+
+	next := *table
+	next.pending = pending
+	if err := db.updateTableSchema(&next); err != nil {
+		return err
+	}
+	db.tables[tableName] = &next
+	db.cacheReferences()
+	return nil
+}
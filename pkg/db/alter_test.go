@@ -0,0 +1,162 @@
+package db
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+func TestAlterTable(t *testing.T) {
+	t.Run("Lazy Reads", func(t *testing.T) {
+		db := newTestDB(t, 10)
+		// Without the background rewrite every read converts old records
+		db.(*database).stopJobs()
+		assert.NoError(t, db.CreateIndex("users", CreateIndexOptions{Name: "idx_age", Columns: []string{"age"}}))
+
+		err := db.AlterTable("users",
+			AddColumn(Column{Name: "active", Type: Boolean, Default: true}),
+			RenameColumn("age", "years"),
+			ChangeType("years", String),
+			DropColumn("name"),
+		)
+		assert.NoError(t, err)
+
+		rows, err := db.Query("users", nil, map[string]interface{}{"id": 3}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 3, "years": "3", "active": true}}, rows)
+
+		// The renamed index follows the converted values
+		indexes, err := db.ListIndexes("users")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"years"}, indexes[0].Columns)
+		rows, err = db.Query("users", []string{"id"}, map[string]interface{}{"years": "7"}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 7}}, rows)
+
+		// New records are written under the new schema and take its defaults
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 10, "years": "40", "active": false}))
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 11, "years": "41"}))
+		rows, err = db.Query("users", nil, map[string]interface{}{"id": 10}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 10, "years": "40", "active": false}}, rows)
+		rows, err = db.Query("users", []string{"active"}, map[string]interface{}{"id": 11}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"active": true}}, rows)
+	})
+
+	t.Run("Background Rewrite", func(t *testing.T) {
+		config := newTestConfig()
+		store := config.Storage
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("users", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "age", Type: Int},
+		}))
+		for i := 0; i < rewriteBatch+10; i++ {
+			assert.NoError(t, db.Insert("users", map[string]interface{}{"id": i, "age": i}))
+		}
+
+		assert.NoError(t, db.AlterTable("users", RenameColumn("age", "years")))
+		db.(*database).jobs.Wait()
+
+		table, err := db.GetTable("users")
+		assert.NoError(t, err)
+		assert.Empty(t, table.pending)
+		record, err := store.Read("users", 5)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, record.Data["years"])
+		assert.NotContains(t, record.Data, "age")
+
+		// The finished rewrite is persisted with the schema
+		assert.NoError(t, db.Close())
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		table, err = db.GetTable("users")
+		assert.NoError(t, err)
+		assert.Equal(t, "years", table.Columns[1].Name)
+		assert.Empty(t, table.pending)
+	})
+
+	t.Run("Pending Alterations Survive Reopen", func(t *testing.T) {
+		db := newTestDB(t, 5)
+		config := db.(*database).config
+		db.(*database).stopJobs()
+
+		assert.NoError(t, db.AlterTable("users", AddColumn(Column{Name: "score", Type: Float, Default: 1.5})))
+		assert.NoError(t, db.Close())
+
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		db.(*database).jobs.Wait()
+		rows, err := db.Query("users", []string{"score"}, map[string]interface{}{"id": 2}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"score": 1.5}}, rows)
+		table, err := db.GetTable("users")
+		assert.NoError(t, err)
+		assert.Empty(t, table.pending)
+	})
+
+	t.Run("Schema Stamps Ignore The Clock", func(t *testing.T) {
+		db := newTestDB(t, 0)
+		d := db.(*database)
+		d.stopJobs()
+
+		// A record dated after the alteration is still converted
+		err := d.storage.Write("users", &storage.Record{ID: 1, Data: map[string]interface{}{"id": 1, "age": 5}, Version: math.MaxInt64})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("users", RenameColumn("age", "years")))
+		rows, err := db.Query("users", []string{"years"}, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"years": 5}}, rows)
+
+		// A record dated before it, under the new schema, is left alone
+		assert.NoError(t, db.AlterTable("users", AddColumn(Column{Name: "age", Type: Int})))
+		err = d.storage.Write("users", &storage.Record{
+			ID: 2, Data: map[string]interface{}{"id": 2, "years": 6, "age": 7}, Version: 1, Schema: d.tables["users"].schema,
+		})
+		assert.NoError(t, err)
+		rows, err = db.Query("users", []string{"years", "age"}, map[string]interface{}{"id": 2}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"years": 6, "age": 7}}, rows)
+	})
+
+	t.Run("Invalid Changes", func(t *testing.T) {
+		db := newTestDB(t, 5)
+		assert.NoError(t, db.Update("users", map[string]interface{}{"name": "x"}, map[string]interface{}{"id": 1}))
+
+		tests := []struct {
+			name string
+			ops  []AlterOp
+			err  error
+		}{
+			{"Unknown Column", []AlterOp{DropColumn("missing")}, ErrInvalidOperation},
+			{"Drop Primary Key", []AlterOp{DropColumn("id")}, ErrInvalidOperation},
+			{"Existing Column", []AlterOp{AddColumn(Column{Name: "age", Type: Int})}, ErrInvalidOperation},
+			{"Rename Collision", []AlterOp{RenameColumn("age", "name")}, ErrInvalidOperation},
+			{"Bad Default", []AlterOp{AddColumn(Column{Name: "score", Type: Int, Default: "high"})}, nil},
+			{"Lossy Conversion", []AlterOp{ChangeType("name", Int)}, ErrInvalidDataType},
+			{"Unique Violation", []AlterOp{AddColumn(Column{Name: "code", Type: Int, Unique: true, Default: 1})}, ErrDuplicateKey},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := db.AlterTable("users", tt.ops...)
+				assert.Error(t, err)
+				if tt.err != nil {
+					assert.ErrorIs(t, err, tt.err)
+				}
+			})
+		}
+
+		// Failed changes leave the table untouched
+		table, err := db.GetTable("users")
+		assert.NoError(t, err)
+		assert.Len(t, table.Columns, 3)
+		rows, err := db.Query("users", nil, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "x", rows[0]["name"])
+	})
+}
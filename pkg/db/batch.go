@@ -0,0 +1,544 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// BatchMode selects how a batch treats operations that cannot be applied
+type BatchMode int
+
+const (
+	// BatchAtomic applies every operation of a batch or, if any fails, none
+	BatchAtomic BatchMode = iota
+	// BatchBestEffort applies the operations that succeed and reports the rest
+	BatchBestEffort
+)
+
+// BatchOpError reports why one operation of a batch was not applied
+type BatchOpError struct {
+	Index int // Position of the operation in the batch
+	Err   error
+}
+
+func (e BatchOpError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (e BatchOpError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError lists the operations of a batch that were not applied. It
+// matches every error its operations failed with.
+type BatchError struct {
+	Ops []BatchOpError
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Ops) == 1 {
+		return "batch failed: " + e.Ops[0].Error()
+	}
+	return fmt.Sprintf("batch failed: %d operations failed, first %v", len(e.Ops), e.Ops[0])
+}
+
+// Unwrap returns the failures of the individual operations
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Ops))
+	for i, op := range e.Ops {
+		errs[i] = op
+	}
+	return errs
+}
+
+// batchOpType identifies the kind of a batch operation
+type batchOpType int
+
+const (
+	batchInsert batchOpType = iota
+	batchUpdate
+	batchDelete
+)
+
+// batchOp is one queued operation of a Batch
+type batchOp struct {
+	typ   batchOpType
+	table string
+	data  map[string]interface{}
+	where map[string]interface{}
+}
+
+// Batch collects inserts, updates and deletes that ExecBatch validates up
+// front and applies with a single storage write. Updates and deletes select
+// their record by primary key. Later operations see the effect of earlier
+// ones.
+type Batch struct {
+	ops []batchOp
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Insert queues the insertion of a record
+func (b *Batch) Insert(table string, data map[string]interface{}) *Batch {
+	b.ops = append(b.ops, batchOp{typ: batchInsert, table: table, data: data})
+	return b
+}
+
+// Update queues an update of the record whose primary key is in where
+func (b *Batch) Update(table string, data map[string]interface{}, where map[string]interface{}) *Batch {
+	b.ops = append(b.ops, batchOp{typ: batchUpdate, table: table, data: data, where: where})
+	return b
+}
+
+// Delete queues the deletion of the record whose primary key is in where
+func (b *Batch) Delete(table string, where map[string]interface{}) *Batch {
+	b.ops = append(b.ops, batchOp{typ: batchDelete, table: table, where: where})
+	return b
+}
+
+// Len returns the number of queued operations
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// InsertMany implements Database.InsertMany
+func (db *database) InsertMany(tableName string, rows []map[string]interface{}, mode BatchMode) (int, error) {
+	return db.InsertManyContext(context.Background(), tableName, rows, mode)
+}
+
+// InsertManyContext implements Database.InsertManyContext
+func (db *database) InsertManyContext(ctx context.Context, tableName string, rows []map[string]interface{}, mode BatchMode) (int, error) {
+	batch := &Batch{ops: make([]batchOp, 0, len(rows))}
+	for _, row := range rows {
+		batch.Insert(tableName, row)
+	}
+	return db.ExecBatchContext(ctx, batch, mode)
+}
+
+// ExecBatch implements Database.ExecBatch
+func (db *database) ExecBatch(batch *Batch, mode BatchMode) (int, error) {
+	return db.ExecBatchContext(context.Background(), batch, mode)
+}
+
+// ExecBatchContext implements Database.ExecBatchContext
+func (db *database) ExecBatchContext(ctx context.Context, batch *Batch, mode BatchMode) (int, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mu.RUnlock()
+
+	var failed []BatchOpError
+	fail := func(i int, err error) {
+		failed = append(failed, BatchOpError{Index: i, Err: err})
+	}
+
+	// Validate every operation before taking any lock
+	prepared := make([]preparedBatchOp, len(batch.ops))
+	defer func() {
+		for _, p := range prepared {
+			db.blobs.release(p.blobs)
+		}
+	}()
+	for i, op := range batch.ops {
+		p, err := db.prepareBatchOp(ctx, op)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		prepared[i] = p
+	}
+	if mode == BatchAtomic && len(failed) > 0 {
+		return 0, &BatchError{Ops: failed}
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockBatch(ctx, locker, prepared); err != nil {
+		return 0, err
+	}
+
+	// Apply the operations in order to an overlay of the affected records
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+	state := db.newBatchState(reservation)
+	applied := 0
+	for i, p := range prepared {
+		if p.table == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := state.apply(p); err != nil {
+			fail(i, err)
+			continue
+		}
+		applied++
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+	if mode == BatchAtomic && len(failed) > 0 {
+		return 0, &BatchError{Ops: failed}
+	}
+
+	// Foreign keys are enforced once every operation has been applied, so a
+	// batch may insert a record before the record it references
+	for _, p := range prepared {
+		if p.table != nil && db.hasForeignKeys(p.table) {
+			if err := state.enforceReferences(ctx, locker); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+	if err := state.commit(); err != nil {
+		return 0, err
+	}
+	if len(failed) > 0 {
+		return applied, &BatchError{Ops: failed}
+	}
+	return applied, nil
+}
+
+// preparedBatchOp is a validated batch operation. A nil table marks an
+// operation that failed validation.
+type preparedBatchOp struct {
+	batchOp
+	table *Table
+	id    interface{}
+	blobs []string // blobs stored out of line for the operation
+}
+
+// prepareBatchOp fills the defaults of an insert and checks an operation
+// against the schema of its table
+func (db *database) prepareBatchOp(ctx context.Context, op batchOp) (preparedBatchOp, error) {
+	table, exists := db.tables[op.table]
+	if !exists {
+		return preparedBatchOp{}, ErrTableNotFound
+	}
+	p := preparedBatchOp{batchOp: op, table: table}
+
+	var ok bool
+	switch op.typ {
+	case batchInsert:
+		data, err := db.withDefaults(ctx, table, op.data)
+		if err != nil {
+			return preparedBatchOp{}, err
+		}
+		p.data = data
+		if err := validateData(table, p.data); err != nil {
+			return preparedBatchOp{}, err
+		}
+		if err := checkRow(table, p.data); err != nil {
+			return preparedBatchOp{}, err
+		}
+		if p.id, ok = table.recordID(p.data); !ok {
+			return preparedBatchOp{}, fmt.Errorf("primary key %s is required", table.keyName())
+		}
+		if p.data, p.blobs, err = db.storeLargeBlobs(table, p.data); err != nil {
+			return preparedBatchOp{}, err
+		}
+	case batchUpdate, batchDelete:
+		if p.id, ok = table.recordID(op.where); !ok {
+			return preparedBatchOp{}, fmt.Errorf("primary key %s is required in where clause", table.keyName())
+		}
+		if err := validateColumnValues(table, op.data); err != nil {
+			return preparedBatchOp{}, err
+		}
+		for _, col := range table.keyColumns() {
+			if value, ok := op.data[col]; ok && compareValues(value, op.where[col]) != 0 {
+				return preparedBatchOp{}, fmt.Errorf("%w: primary key %s cannot be changed", ErrInvalidOperation, col)
+			}
+		}
+		var err error
+		if p.data, p.blobs, err = db.storeLargeBlobs(table, op.data); err != nil {
+			return preparedBatchOp{}, err
+		}
+	}
+	return p, nil
+}
+
+// lockBatch locks every table, primary key and unique value the batch
+// writes. Tables are locked first, then all primary keys, then unique
+// values, each in sorted order, matching the order of single-record writers.
+func lockBatch(ctx context.Context, locker *Locker, prepared []preparedBatchOp) error {
+	type request struct {
+		resource lockResource
+		value    bool
+	}
+	tables := make(map[string]bool)
+	var requests []request
+	for _, p := range prepared {
+		if p.table == nil {
+			continue
+		}
+		tables[p.table.Name] = true
+		requests = append(requests, request{resource: lockResource{table: p.table.Name, key: lockKeyString(p.id)}})
+		for _, col := range p.table.Columns {
+			if value, exists := p.data[col.Name]; exists && p.table.hasUniqueIndex(col) {
+				key := col.Name + "=" + lockKeyString(value)
+				requests = append(requests, request{resource: lockResource{table: p.table.Name, key: key}, value: true})
+			}
+		}
+	}
+
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := locker.LockTable(ctx, name, LockIntentExclusive); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.value != b.value {
+			return !a.value
+		}
+		if a.resource.table != b.resource.table {
+			return a.resource.table < b.resource.table
+		}
+		return a.resource.key < b.resource.key
+	})
+	for _, r := range requests {
+		if err := locker.lock(ctx, r.resource, LockExclusive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchRow is a record touched by a batch
+type batchRow struct {
+	table *Table
+	id    interface{}
+	old   map[string]interface{} // as stored before the batch, nil if absent
+	data  map[string]interface{} // as the batch leaves it, nil if deleted
+	dirty bool
+}
+
+// batchState tracks the records a batch touches, as the operations applied
+// so far leave them
+type batchState struct {
+	db          *database
+	reservation *memory.Reservation
+	version     int64 // version of the records commit writes
+	rows        map[lockResource]*batchRow
+	order       []*batchRow
+	// values indexes the unique column values of the rows by table and
+	// column, so that duplicates within the batch are found
+	values map[lockResource]map[*batchRow]bool
+}
+
+// newBatchState returns an empty overlay whose rows are reserved from
+// reservation
+func (db *database) newBatchState(reservation *memory.Reservation) *batchState {
+	return &batchState{
+		db:          db,
+		reservation: reservation,
+		version:     time.Now().UnixNano(),
+		rows:        make(map[lockResource]*batchRow),
+		values:      make(map[lockResource]map[*batchRow]bool),
+	}
+}
+
+// apply applies one operation to the overlay, changing nothing on error
+func (s *batchState) apply(p preparedBatchOp) error {
+	row, err := s.load(p.table, p.id)
+	if err != nil {
+		return err
+	}
+
+	switch p.typ {
+	case batchInsert:
+		if row.data != nil {
+			return &DuplicateKeyError{Table: p.table.Name, Column: p.table.keyName(), Value: p.id}
+		}
+		if err := s.checkUnique(row, p.data); err != nil {
+			return err
+		}
+		return s.set(row, copyRow(p.data, nil))
+	case batchUpdate:
+		if row.data == nil {
+			return fmt.Errorf("record not found")
+		}
+		if err := s.checkUnique(row, p.data); err != nil {
+			return err
+		}
+		updated := copyRow(row.data, p.data)
+		if err := checkRow(p.table, updated); err != nil {
+			return err
+		}
+		return s.set(row, updated)
+	default:
+		return s.set(row, nil)
+	}
+}
+
+// load returns the overlay row of a record, reading it on first use
+func (s *batchState) load(table *Table, id interface{}) (*batchRow, error) {
+	key := lockResource{table: table.Name, key: lockKeyString(id)}
+	if row, ok := s.rows[key]; ok {
+		return row, nil
+	}
+
+	record, err := s.db.storage.Read(table.Name, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	row := &batchRow{table: table, id: id}
+	if record != nil {
+		row.id = record.ID
+		row.old = decodeRecord(table, record)
+		row.data = row.old
+		s.trackValues(row, true)
+	}
+	s.rows[key] = row
+	s.order = append(s.order, row)
+	return row, nil
+}
+
+// set replaces the data of a row
+func (s *batchState) set(row *batchRow, data map[string]interface{}) error {
+	if data != nil {
+		if err := s.reservation.Grow(memory.SizeOf(data)); err != nil {
+			return fmt.Errorf("batch on table %s: %w", row.table.Name, err)
+		}
+	}
+	s.trackValues(row, false)
+	row.data = data
+	row.dirty = true
+	s.trackValues(row, true)
+	return nil
+}
+
+// trackValues adds or removes the unique column values of a row
+func (s *batchState) trackValues(row *batchRow, add bool) {
+	for _, col := range row.table.Columns {
+		value, exists := row.data[col.Name]
+		if !exists || !row.table.hasUniqueIndex(col) {
+			continue
+		}
+		key := lockResource{table: row.table.Name, key: col.Name + "=" + lockKeyString(value)}
+		if add {
+			if s.values[key] == nil {
+				s.values[key] = make(map[*batchRow]bool)
+			}
+			s.values[key][row] = true
+		} else {
+			delete(s.values[key], row)
+		}
+	}
+}
+
+// checkUnique returns a DuplicateKeyError when data would give row a unique
+// value that another record holds once the batch so far is applied
+func (s *batchState) checkUnique(row *batchRow, data map[string]interface{}) error {
+	table := row.table
+	indexManager := s.db.indexes[table.Name]
+	for _, col := range table.Columns {
+		value, exists := data[col.Name]
+		if !exists || !table.hasUniqueIndex(col) {
+			continue
+		}
+		duplicate := &DuplicateKeyError{Table: table.Name, Column: col.Name, Value: value}
+
+		// Rows already in the overlay are judged by their overlay values
+		for other := range s.values[lockResource{table: table.Name, key: col.Name + "=" + lockKeyString(value)}] {
+			if other != row {
+				return duplicate
+			}
+		}
+		index, err := indexManager.GetIndex(uniqueIndexName(table, col.Name))
+		if err != nil {
+			continue
+		}
+		holders, _ := index.Find(value)
+		for _, pk := range holders {
+			if _, loaded := s.rows[lockResource{table: table.Name, key: lockKeyString(pk)}]; !loaded {
+				return duplicate
+			}
+		}
+	}
+	return nil
+}
+
+// commit writes every changed row with one storage batch, then updates the
+// indexes, bulk-loading the new entries of each table. A failed storage
+// batch leaves the records as they were, so the indexes are left alone.
+func (s *batchState) commit() error {
+	var ops []storage.Op
+	var held, released []string
+	for _, row := range s.order {
+		if !row.dirty {
+			continue
+		}
+		held = append(held, blobHashes(row.table, row.data)...)
+		released = append(released, blobHashes(row.table, row.old)...)
+		switch {
+		case row.data != nil:
+			ops = append(ops, storage.Op{
+				Type:   storage.OpWrite,
+				Table:  row.table.Name,
+				Record: &storage.Record{ID: row.id, Data: row.data, Version: s.version, Schema: row.table.schema},
+			})
+		case row.old != nil:
+			ops = append(ops, storage.Op{Type: storage.OpDelete, Table: row.table.Name, ID: row.id})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := s.db.blobs.hold(held); err != nil {
+		return err
+	}
+	if err := s.db.storage.Batch(ops); err != nil {
+		s.db.blobs.release(held)
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+	s.db.blobs.release(released)
+
+	added := make(map[string][]map[string]interface{})
+	for _, row := range s.order {
+		if !row.dirty {
+			continue
+		}
+		if row.old != nil {
+			if err := s.db.indexes[row.table.Name].RemoveRecord(row.old); err != nil {
+				return fmt.Errorf("failed to remove old index entries: %w", err)
+			}
+		}
+		if row.data != nil {
+			added[row.table.Name] = append(added[row.table.Name], row.data)
+		}
+	}
+	for tableName, records := range added {
+		if err := s.db.indexes[tableName].IndexRecords(records); err != nil {
+			return fmt.Errorf("failed to update indexes: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyRow returns a copy of data with changes merged in
+func copyRow(data, changes map[string]interface{}) map[string]interface{} {
+	row := make(map[string]interface{}, len(data)+len(changes))
+	for k, v := range data {
+		row[k] = v
+	}
+	for k, v := range changes {
+		row[k] = v
+	}
+	return row
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertMany(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "email", Type: String, Unique: true},
+		{Name: "balance", Type: Int, NotNull: true},
+	}
+
+	t.Run("Bulk Load", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("accounts", columns))
+		err = db.CreateIndex("accounts", CreateIndexOptions{Name: "idx_balance", Columns: []string{"balance"}})
+		assert.NoError(t, err)
+
+		rows := make([]map[string]interface{}, 100)
+		for i := range rows {
+			rows[i] = map[string]interface{}{"id": i, "email": fmt.Sprintf("u%d@example.com", i), "balance": i % 10}
+		}
+		n, err := db.InsertMany("accounts", rows, BatchAtomic)
+		assert.NoError(t, err)
+		assert.Equal(t, 100, n)
+
+		// Every index sees the loaded rows
+		result, err := db.Query("accounts", nil, map[string]interface{}{"balance": 3}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, result, 10)
+		result, err = db.Query("accounts", nil, map[string]interface{}{"email": "u42@example.com"}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, result, 1)
+	})
+
+	t.Run("Atomic", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("accounts", columns))
+		assert.NoError(t, db.Insert("accounts", map[string]interface{}{"id": 1, "email": "a@example.com", "balance": 0}))
+
+		n, err := db.InsertMany("accounts", []map[string]interface{}{
+			{"id": 2, "email": "b@example.com", "balance": 0},
+			{"id": 3, "email": "a@example.com", "balance": 0}, // taken by id 1
+			{"id": 4, "email": "d@example.com", "balance": 0},
+			{"id": 2, "email": "e@example.com", "balance": 0}, // id taken earlier in the batch
+		}, BatchAtomic)
+		assert.Equal(t, 0, n)
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+
+		var batchErr *BatchError
+		if assert.True(t, errors.As(err, &batchErr)) {
+			var indexes []int
+			for _, op := range batchErr.Ops {
+				indexes = append(indexes, op.Index)
+			}
+			assert.Equal(t, []int{1, 3}, indexes)
+		}
+
+		// Schema violations fail the batch before anything is locked
+		_, err = db.InsertMany("accounts", []map[string]interface{}{
+			{"id": 5, "email": "f@example.com", "balance": 0},
+			{"id": 6, "email": "g@example.com"},
+		}, BatchAtomic)
+		assert.ErrorContains(t, err, "operation 1: column balance is required")
+
+		result, err := db.Query("accounts", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, result, 1)
+	})
+
+	t.Run("Best Effort", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("accounts", columns))
+		n, err := db.InsertMany("accounts", []map[string]interface{}{
+			{"id": 1, "email": "a@example.com", "balance": 0},
+			{"id": 2, "email": "a@example.com", "balance": 0},
+			{"id": 3, "email": "c@example.com", "balance": 0},
+		}, BatchBestEffort)
+		assert.Equal(t, 2, n)
+		var batchErr *BatchError
+		if assert.True(t, errors.As(err, &batchErr)) && assert.Len(t, batchErr.Ops, 1) {
+			assert.Equal(t, 1, batchErr.Ops[0].Index)
+		}
+
+		result, err := db.Query("accounts", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, result, 2)
+	})
+}
+
+func TestExecBatch(t *testing.T) {
+	db, err := New("test_db", newTestConfig())
+	assert.NoError(t, err)
+	err = db.CreateTable("accounts", []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "email", Type: String, Unique: true},
+		{Name: "balance", Type: Int, NotNull: true},
+	})
+	assert.NoError(t, err)
+	n, err := db.InsertMany("accounts", []map[string]interface{}{
+		{"id": 1, "email": "a@example.com", "balance": 10},
+		{"id": 2, "email": "b@example.com", "balance": 20},
+	}, BatchAtomic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// Later operations see earlier ones: the freed email can be reused
+	batch := NewBatch().
+		Update("accounts", map[string]interface{}{"balance": 5}, map[string]interface{}{"id": 1}).
+		Update("accounts", map[string]interface{}{"balance": 25}, map[string]interface{}{"id": 2}).
+		Delete("accounts", map[string]interface{}{"id": 1}).
+		Insert("accounts", map[string]interface{}{"id": 3, "email": "a@example.com", "balance": 0})
+	assert.Equal(t, 4, batch.Len())
+
+	n, err = db.ExecBatch(batch, BatchAtomic)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	result, err := db.Query("accounts", []string{"id", "balance"}, nil, 0, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []map[string]interface{}{
+		{"id": 2, "balance": 25},
+		{"id": 3, "balance": 0},
+	}, result)
+
+	result, err = db.Query("accounts", []string{"id"}, map[string]interface{}{"email": "a@example.com"}, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{{"id": 3}}, result)
+
+	// Updates of missing records fail
+	_, err = db.ExecBatch(NewBatch().Update("accounts", map[string]interface{}{"balance": 1}, map[string]interface{}{"id": 9}), BatchAtomic)
+	assert.Error(t, err)
+}
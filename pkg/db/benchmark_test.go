@@ -3,9 +3,13 @@ package db
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
 )
 
+// insertIDBase is the first primary key used by insert benchmarks
+const insertIDBase = 1000000
+
 func BenchmarkDatabase(b *testing.B) {
 	// Setup test database
 	config := Config{
@@ -45,13 +49,18 @@ func BenchmarkDatabase(b *testing.B) {
 		b.Fatal(err)
 	}
 
+	// Inserted ids must stay unique across benchmark runs and clear of the
+	// rows loaded for the query benchmarks
+	nextID := int64(insertIDBase)
+
 	b.Run("Insert", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
+			id := int(atomic.AddInt64(&nextID, 1))
 			err := database.Insert("users", map[string]interface{}{
-				"id":    i,
-				"name":  fmt.Sprintf("User%d", i),
+				"id":    id,
+				"name":  fmt.Sprintf("User%d", id),
 				"age":   i % 100,
-				"email": fmt.Sprintf("user%d@example.com", i),
+				"email": fmt.Sprintf("user%d@example.com", id),
 			})
 			if err != nil {
 				b.Fatal(err)
@@ -59,10 +68,28 @@ func BenchmarkDatabase(b *testing.B) {
 		}
 	})
 
+	b.Run("InsertMany_100", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows := make([]map[string]interface{}, 100)
+			for j := range rows {
+				id := int(atomic.AddInt64(&nextID, 1))
+				rows[j] = map[string]interface{}{
+					"id":    id,
+					"name":  fmt.Sprintf("User%d", id),
+					"age":   j % 100,
+					"email": fmt.Sprintf("user%d@example.com", id),
+				}
+			}
+			if _, err := database.InsertMany("users", rows, BatchAtomic); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
 	// Insert some data for query benchmarks
 	for i := 0; i < 1000; i++ {
 		err := database.Insert("users", map[string]interface{}{
-			"id":    i + b.N,
+			"id":    i,
 			"name":  fmt.Sprintf("User%d", i),
 			"age":   i % 100,
 			"email": fmt.Sprintf("user%d@example.com", i),
@@ -172,15 +199,18 @@ func BenchmarkDatabaseParallel(b *testing.B) {
 		b.Fatal(err)
 	}
 
+	nextID := int64(insertIDBase)
+
 	b.Run("Insert_Parallel", func(b *testing.B) {
 		b.RunParallel(func(pb *testing.PB) {
 			i := 0
 			for pb.Next() {
+				id := int(atomic.AddInt64(&nextID, 1))
 				err := database.Insert("users", map[string]interface{}{
-					"id":    i,
-					"name":  fmt.Sprintf("User%d", i),
+					"id":    id,
+					"name":  fmt.Sprintf("User%d", id),
 					"age":   i % 100,
-					"email": fmt.Sprintf("user%d@example.com", i),
+					"email": fmt.Sprintf("user%d@example.com", id),
 				})
 				if err != nil {
 					b.Fatal(err)
@@ -0,0 +1,399 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// ErrBlobNotFound is matched by errors returned for blobs that do not exist
+var ErrBlobNotFound = storage.ErrBlobNotFound
+
+// maxInlineBlob is the largest []byte value stored inside its record. Larger
+// values written by inserts and updates are stored out of line like the
+// content of WriteBlob.
+const maxInlineBlob = 16 << 10
+
+// BlobHandle is the value of a Blob column whose content is stored out of
+// line. Blobs are named by the SHA-256 of their content, so records holding
+// the same content share one blob.
+type BlobHandle struct {
+	Hash string `json:"blob"`
+	Size int64  `json:"size"`
+}
+
+// blobHandle restores a handle decoded from JSON storage
+func blobHandle(value map[string]interface{}) (BlobHandle, bool) {
+	hash, ok := value["blob"].(string)
+	if !ok {
+		return BlobHandle{}, false
+	}
+	var size int64
+	switch n := value["size"].(type) {
+	case json.Number:
+		size, _ = n.Int64()
+	case float64:
+		size = int64(n)
+	}
+	return BlobHandle{Hash: hash, Size: size}, true
+}
+
+// blobHashes returns the hashes of the out-of-line blobs rows refer to, once
+// per reference. Nil rows are skipped.
+func blobHashes(table *Table, rows ...map[string]interface{}) []string {
+	var hashes []string
+	for _, col := range table.Columns {
+		if col.Type != Blob {
+			continue
+		}
+		for _, row := range rows {
+			if handle, ok := row[col.Name].(BlobHandle); ok {
+				hashes = append(hashes, handle.Hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// blobRefs counts the records that refer to each blob and deletes blobs
+// once nothing refers to them. Counts live in memory and are rebuilt from
+// the records when the database opens.
+type blobRefs struct {
+	store  storage.BlobStore // nil when the engine cannot store blobs
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// newBlobRefs returns empty counts for the blobs of engine
+func newBlobRefs(engine storage.Engine) *blobRefs {
+	store, _ := engine.(storage.BlobStore)
+	return &blobRefs{store: store, counts: make(map[string]int)}
+}
+
+// count adds references found while loading records
+func (r *blobRefs) count(hashes []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, hash := range hashes {
+		r.counts[hash]++
+	}
+}
+
+// commit makes a staged blob visible and takes one reference to it. The
+// caller releases the reference once records refer to the blob.
+func (r *blobRefs) commit(staged *storage.StagedBlob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := staged.Commit(); err != nil {
+		return err
+	}
+	r.counts[staged.Hash]++
+	return nil
+}
+
+// hold takes a reference to every blob in hashes before a write that refers
+// to them. It fails without taking any when a blob does not exist.
+func (r *blobRefs) hold(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, hash := range hashes {
+		if r.counts[hash] == 0 {
+			return fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+		}
+	}
+	for _, hash := range hashes {
+		r.counts[hash]++
+	}
+	return nil
+}
+
+// release drops a reference to every blob in hashes and deletes the blobs
+// left without any. A blob that fails to delete is removed by sweep when the
+// database next opens.
+func (r *blobRefs) release(hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, hash := range hashes {
+		if r.counts[hash]--; r.counts[hash] > 0 {
+			continue
+		}
+		delete(r.counts, hash)
+		if r.store != nil {
+			_ = r.store.DeleteBlob(hash)
+		}
+	}
+}
+
+// sweep deletes every stored blob that no record refers to, such as blobs
+// whose last reference went away in a crash
+func (r *blobRefs) sweep() error {
+	if r.store == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hashes, err := r.store.ListBlobs()
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if r.counts[hash] == 0 {
+			if err := r.store.DeleteBlob(hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBlobs runs write, which replaces the rows before of table by the
+// rows after, holding the blobs that after refers to before it runs and
+// releasing those of before once it succeeds. Inserted and deleted rows are
+// nil on one side.
+func (db *database) writeBlobs(table *Table, before, after []map[string]interface{}, write func() error) error {
+	held := blobHashes(table, after...)
+	if err := db.blobs.hold(held); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		db.blobs.release(held)
+		return err
+	}
+	db.blobs.release(blobHashes(table, before...))
+	return nil
+}
+
+// storeLargeBlobs returns data with every Blob value longer than
+// maxInlineBlob stored out of line and replaced by its handle, along with
+// the hashes of the blobs it stored. The caller holds one reference to each
+// and releases it once the write is done. Values stay inline when the
+// engine cannot store blobs.
+func (db *database) storeLargeBlobs(table *Table, data map[string]interface{}) (map[string]interface{}, []string, error) {
+	if db.blobs.store == nil {
+		return data, nil, nil
+	}
+	var stored []string
+	result := data
+	for _, col := range table.Columns {
+		value, ok := data[col.Name].([]byte)
+		if col.Type != Blob || !ok || len(value) <= maxInlineBlob {
+			continue
+		}
+		handle, err := db.storeBlob(value)
+		if err != nil {
+			db.blobs.release(stored)
+			return nil, nil, err
+		}
+		stored = append(stored, handle.Hash)
+		if len(stored) == 1 {
+			// Copy before the first change, data belongs to the caller
+			result = make(map[string]interface{}, len(data))
+			for k, v := range data {
+				result[k] = v
+			}
+		}
+		result[col.Name] = handle
+	}
+	return result, stored, nil
+}
+
+// storeBlob stores content out of line and takes one reference to it
+func (db *database) storeBlob(content []byte) (BlobHandle, error) {
+	staged, err := db.blobs.store.StageBlob(bytes.NewReader(content))
+	if err != nil {
+		return BlobHandle{}, err
+	}
+	defer staged.Discard()
+	if err := db.blobs.commit(staged); err != nil {
+		return BlobHandle{}, err
+	}
+	return BlobHandle{Hash: staged.Hash, Size: staged.Size}, nil
+}
+
+// checkBlobColumn returns an error unless table has a Blob column called name
+func checkBlobColumn(table *Table, name string) error {
+	for _, col := range table.Columns {
+		if col.Name != name {
+			continue
+		}
+		if col.Type != Blob {
+			return fmt.Errorf("%w: column %s is not a blob", ErrInvalidDataType, name)
+		}
+		return nil
+	}
+	return fmt.Errorf("column %s not found in table %s", name, table.Name)
+}
+
+// WriteBlob implements Database.WriteBlob
+func (db *database) WriteBlob(ctx context.Context, tableName string, pk interface{}, column string, r io.Reader) (BlobHandle, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return BlobHandle{}, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return BlobHandle{}, ErrTableNotFound
+	}
+	if err := checkBlobColumn(table, column); err != nil {
+		return BlobHandle{}, err
+	}
+	if db.blobs.store == nil {
+		return BlobHandle{}, fmt.Errorf("%w: storage engine does not store blobs", ErrInvalidOperation)
+	}
+
+	// The content is copied before any record is locked
+	staged, err := db.blobs.store.StageBlob(r)
+	if err != nil {
+		return BlobHandle{}, err
+	}
+	defer staged.Discard()
+	handle := BlobHandle{Hash: staged.Hash, Size: staged.Size}
+	changes := map[string]interface{}{column: handle}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockRecord(ctx, locker, table, pk, changes); err != nil {
+		return BlobHandle{}, err
+	}
+	record, err := db.storage.Read(table.Name, pk)
+	if err != nil {
+		return BlobHandle{}, fmt.Errorf("failed to read record: %w", err)
+	}
+	if record == nil {
+		return BlobHandle{}, fmt.Errorf("record not found")
+	}
+
+	if err := db.blobs.commit(staged); err != nil {
+		return BlobHandle{}, err
+	}
+	defer db.blobs.release([]string{handle.Hash})
+	if _, err := db.updateLocked(ctx, locker, table, record.ID, decodeRecord(table, record), changes); err != nil {
+		return BlobHandle{}, err
+	}
+	return handle, nil
+}
+
+// OpenBlob implements Database.OpenBlob
+func (db *database) OpenBlob(ctx context.Context, tableName string, pk interface{}, column string) (io.ReadSeekCloser, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if err := checkBlobColumn(table, column); err != nil {
+		return nil, err
+	}
+
+	// Writers of the record wait, so its blob cannot be deleted before it
+	// is opened
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, table.Name, LockIntentShared); err != nil {
+		return nil, err
+	}
+	if err := locker.LockKey(ctx, table.Name, pk, LockShared); err != nil {
+		return nil, err
+	}
+	record, err := db.storage.Read(table.Name, pk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	if record == nil {
+		return nil, fmt.Errorf("record not found")
+	}
+
+	switch value := decodeRecord(table, record)[column].(type) {
+	case BlobHandle:
+		if db.blobs.store == nil {
+			return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, value.Hash)
+		}
+		return db.blobs.store.OpenBlob(value.Hash)
+	case []byte:
+		return inlineBlob{bytes.NewReader(value)}, nil
+	default:
+		return nil, fmt.Errorf("%w: column %s of record %v is null", ErrBlobNotFound, column, pk)
+	}
+}
+
+// inlineBlob reads a Blob value stored inside its record
+type inlineBlob struct {
+	*bytes.Reader
+}
+
+func (inlineBlob) Close() error {
+	return nil
+}
+
+// droppedBlobs returns the blobs referred to by the Blob columns that ops
+// drop from table, following renames made by earlier ops
+func (db *database) droppedBlobs(ctx context.Context, table *Table, ops []AlterOp) ([]string, error) {
+	names := make(map[string]string) // current name -> name in table
+	for _, col := range table.Columns {
+		if col.Type == Blob {
+			names[col.Name] = col.Name
+		}
+	}
+	var dropped []Column
+	for _, op := range ops {
+		original, ok := names[op.Column.Name]
+		if !ok {
+			continue
+		}
+		switch op.Kind {
+		case AlterRenameColumn:
+			delete(names, op.Column.Name)
+			names[op.NewName] = original
+		case AlterDropColumn:
+			delete(names, op.Column.Name)
+			dropped = append(dropped, Column{Name: original, Type: Blob})
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	return db.tableBlobs(ctx, table, dropped)
+}
+
+// tableBlobs returns the blobs that the records of table refer to through
+// the Blob columns among columns
+func (db *database) tableBlobs(ctx context.Context, table *Table, columns []Column) ([]string, error) {
+	selected := &Table{Name: table.Name, Columns: columns}
+	var hashes []string
+	err := db.storage.Scan(table.Name, func(record *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hashes = append(hashes, blobHashes(selected, decodeRecord(table, record))...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan table %s: %w", table.Name, err)
+	}
+	return hashes, nil
+}
+
+// hasBlobColumn reports whether a table has a Blob column
+func (t *Table) hasBlobColumn() bool {
+	for _, col := range t.Columns {
+		if col.Type == Blob {
+			return true
+		}
+	}
+	return false
+}
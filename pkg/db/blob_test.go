@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// storedBlobs lists the blobs kept by the storage of db
+func storedBlobs(t *testing.T, db Database) []string {
+	hashes, err := db.(*database).blobs.store.ListBlobs()
+	assert.NoError(t, err)
+	return hashes
+}
+
+// readBlob reads the whole blob of a record
+func readBlob(t *testing.T, db Database, id interface{}) string {
+	r, err := db.OpenBlob(context.Background(), "files", id, "data")
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestBlobs(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "name", Type: String},
+		{Name: "data", Type: Blob},
+	}
+
+	ctx := context.Background()
+	content := strings.Repeat("0123456789", 1000)
+
+	t.Run("Write And Open", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		for id := 1; id <= 2; id++ {
+			assert.NoError(t, db.Insert("files", map[string]interface{}{"id": id, "name": "f"}))
+		}
+		handle, err := db.WriteBlob(ctx, "files", 1, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), handle.Size)
+
+		// Records hold only the handle
+		rows, err := db.Query("files", []string{"data"}, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"data": handle}}, rows)
+
+		r, err := db.OpenBlob(ctx, "files", 1, "data")
+		if assert.NoError(t, err) {
+			_, err = r.Seek(-5, io.SeekEnd)
+			assert.NoError(t, err)
+			tail, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "56789", string(tail))
+			assert.NoError(t, r.Close())
+		}
+		assert.Equal(t, content, readBlob(t, db, 1))
+
+		_, err = db.OpenBlob(ctx, "files", 2, "data")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+
+		// Inline values read the same way
+		assert.NoError(t, db.Update("files", map[string]interface{}{"data": []byte("small")}, map[string]interface{}{"id": 2}))
+		assert.Equal(t, "small", readBlob(t, db, 2))
+		_, err = db.OpenBlob(ctx, "files", 1, "name")
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+		_, err = db.WriteBlob(ctx, "files", 9, "data", strings.NewReader(content))
+		assert.Error(t, err)
+		_, err = db.WriteBlob(ctx, "missing", 1, "data", strings.NewReader(content))
+		assert.ErrorIs(t, err, ErrTableNotFound)
+		assert.Len(t, storedBlobs(t, db), 1)
+	})
+
+	t.Run("Reference Counts", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		for id := 1; id <= 4; id++ {
+			assert.NoError(t, db.Insert("files", map[string]interface{}{"id": id, "name": "f"}))
+		}
+		handle, err := db.WriteBlob(ctx, "files", 1, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		_, err = db.WriteBlob(ctx, "files", 2, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Update("files", map[string]interface{}{"data": handle}, map[string]interface{}{"id": 3}))
+		assert.Equal(t, []string{handle.Hash}, storedBlobs(t, db))
+
+		// Handles must name existing blobs
+		err = db.Insert("files", map[string]interface{}{"id": 5, "data": BlobHandle{Hash: strings.Repeat("0", 64)}})
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+
+		// Rewriting a record keeps its blob
+		assert.NoError(t, db.Update("files", map[string]interface{}{"name": "g"}, map[string]interface{}{"id": 1}))
+		assert.NoError(t, db.Delete("files", map[string]interface{}{"id": 1}))
+		_, err = db.UpdateWhere(ctx, "files", map[string]interface{}{"data": []byte("inline")}, []query.Condition{{Column: "id", Operator: query.Eq, Value: 2}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{handle.Hash}, storedBlobs(t, db))
+		assert.Equal(t, content, readBlob(t, db, 3))
+
+		// The last reference takes the blob with it
+		_, err = db.DeleteWhere(ctx, "files", []query.Condition{{Column: "id", Operator: query.Eq, Value: 3}})
+		assert.NoError(t, err)
+		assert.Empty(t, storedBlobs(t, db))
+
+		// Replacing a blob releases the old one
+		_, err = db.WriteBlob(ctx, "files", 4, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		next, err := db.WriteBlob(ctx, "files", 4, "data", strings.NewReader("replaced"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{next.Hash}, storedBlobs(t, db))
+
+		batch := NewBatch().
+			Insert("files", map[string]interface{}{"id": 6, "data": next}).
+			Delete("files", map[string]interface{}{"id": 4})
+		_, err = db.ExecBatch(batch, BatchAtomic)
+		assert.NoError(t, err)
+		assert.Equal(t, "replaced", readBlob(t, db, 6))
+		_, err = db.ExecBatch(NewBatch().Delete("files", map[string]interface{}{"id": 6}), BatchAtomic)
+		assert.NoError(t, err)
+		assert.Empty(t, storedBlobs(t, db))
+	})
+
+	t.Run("Large Values", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		for id := 1; id <= 2; id++ {
+			assert.NoError(t, db.Insert("files", map[string]interface{}{"id": id, "name": "f"}))
+		}
+		large := []byte(strings.Repeat(content, 2))
+		sum := sha256.Sum256(large)
+		handle := BlobHandle{Hash: hex.EncodeToString(sum[:]), Size: int64(len(large))}
+
+		// Values above maxInlineBlob are stored out of line
+		data := map[string]interface{}{"id": 3, "data": large}
+		assert.NoError(t, db.Insert("files", data))
+		assert.Equal(t, large, data["data"])
+		rows, err := db.Query("files", []string{"data"}, map[string]interface{}{"id": 3}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"data": handle}}, rows)
+		assert.Equal(t, string(large), readBlob(t, db, 3))
+
+		assert.NoError(t, db.Update("files", map[string]interface{}{"data": large}, map[string]interface{}{"id": 1}))
+		_, err = db.UpdateWhere(ctx, "files", map[string]interface{}{"data": large}, []query.Condition{{Column: "id", Operator: query.Eq, Value: 2}})
+		assert.NoError(t, err)
+		_, err = db.ExecBatch(NewBatch().Insert("files", map[string]interface{}{"id": 4, "data": large}), BatchAtomic)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{handle.Hash}, storedBlobs(t, db))
+		assert.Equal(t, string(large), readBlob(t, db, 4))
+
+		// A failed write releases the blob it stored
+		_, err = db.ExecBatch(NewBatch().
+			Insert("files", map[string]interface{}{"id": 5, "data": []byte(strings.Repeat("x", maxInlineBlob+1))}).
+			Insert("files", map[string]interface{}{"id": 1}), BatchAtomic)
+		assert.Error(t, err)
+		assert.Equal(t, []string{handle.Hash}, storedBlobs(t, db))
+
+		// Small values stay inline
+		assert.NoError(t, db.Update("files", map[string]interface{}{"data": []byte("small")}, map[string]interface{}{"id": 1}))
+		rows, err = db.Query("files", []string{"data"}, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"data": []byte("small")}}, rows)
+
+		_, err = db.DeleteWhere(ctx, "files", []query.Condition{{Column: "id", Operator: query.Gt, Value: 1}})
+		assert.NoError(t, err)
+		assert.Empty(t, storedBlobs(t, db))
+	})
+
+	t.Run("Schema Changes", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		for id := 1; id <= 2; id++ {
+			assert.NoError(t, db.Insert("files", map[string]interface{}{"id": id, "name": "f"}))
+		}
+		_, err = db.WriteBlob(ctx, "files", 1, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("files", RenameColumn("data", "body")))
+		assert.Len(t, storedBlobs(t, db), 1)
+		assert.NoError(t, db.AlterTable("files", DropColumn("body")))
+		assert.Empty(t, storedBlobs(t, db))
+
+		assert.NoError(t, db.AlterTable("files", AddColumn(Column{Name: "data", Type: Blob})))
+		handle, err := db.WriteBlob(ctx, "files", 2, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		err = db.AlterTable("files", AddColumn(Column{Name: "copy", Type: Blob, Default: handle}))
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		assert.NoError(t, db.DropTable("files"))
+		assert.Empty(t, storedBlobs(t, db))
+	})
+
+	t.Run("Drop Table Deletes Records", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		for id := 1; id <= rewriteBatch+5; id++ {
+			assert.NoError(t, db.Insert("files", map[string]interface{}{"id": id, "name": "f"}))
+		}
+		defer db.Close()
+		_, err = db.WriteBlob(ctx, "files", 1, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.NoError(t, db.DropTable("files"))
+		assert.Empty(t, storedBlobs(t, db))
+
+		// A table created under the same name starts empty
+		assert.NoError(t, db.CreateTable("files", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "data", Type: Blob},
+		}))
+		rows, err := db.Query("files", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Empty(t, rows)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", columns))
+		assert.NoError(t, db.Insert("files", map[string]interface{}{"id": 1, "name": "f"}))
+		handle, err := db.WriteBlob(ctx, "files", 1, "data", strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		// A blob whose record never got written is removed on open
+		fs, err := storage.NewFileStorage(filepath.Join(config.DataDir, "test_db"), 0)
+		assert.NoError(t, err)
+		orphan, err := fs.StageBlob(strings.NewReader("orphan"))
+		assert.NoError(t, err)
+		assert.NoError(t, orphan.Commit())
+		assert.NoError(t, fs.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		assert.Equal(t, []string{handle.Hash}, storedBlobs(t, db))
+		rows, err := db.Query("files", []string{"data"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"data": handle}}, rows)
+		assert.Equal(t, content, readBlob(t, db, 1))
+
+		assert.NoError(t, db.Delete("files", map[string]interface{}{"id": 1}))
+		assert.Empty(t, storedBlobs(t, db))
+	})
+}
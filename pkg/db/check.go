@@ -0,0 +1,418 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+// ErrCheckViolation is matched by errors returned when a write breaks a check
+// constraint
+var ErrCheckViolation = errors.New("check constraint violation")
+
+// Check is a constraint that every record must satisfy. A check on a column
+// may combine a range, a pattern, an enum, conditions and a validator, all of
+// which must hold. A check on a table may only use conditions and a
+// validator. As in SQL, a rule on a missing or nil value passes; use NotNull
+// to require the value.
+type Check struct {
+	Name string // unique within the table; generated when empty
+	// Min and Max bound the column value inclusively, for Int, Float, String
+	// and DateTime columns
+	Min, Max interface{}
+	Pattern  string        // regular expression a String value must match
+	Enum     []interface{} // values the column may take
+	// Conditions must all hold for the record. Use query.Col as the value to
+	// compare two columns. Conditions name whole columns, not paths into
+	// JSON columns.
+	Conditions []query.Condition
+	Validator  string // name of a func registered with RegisterValidator
+}
+
+// ValidatorFunc validates a record for a check. value is the value of the
+// checked column, or nil for a table check. A non-nil error rejects the
+// write and is wrapped by the CheckError returned.
+type ValidatorFunc func(value interface{}, row map[string]interface{}) error
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = make(map[string]ValidatorFunc)
+
+	// patterns caches compiled check patterns by source
+	patterns sync.Map
+)
+
+// RegisterValidator makes fn available to checks under name, replacing any
+// func registered before. Register validators before opening a database
+// whose checks use them.
+func RegisterValidator(name string, fn ValidatorFunc) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators[name] = fn
+}
+
+// validator returns the func registered under name
+func validator(name string) (ValidatorFunc, bool) {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+	fn, ok := validators[name]
+	return fn, ok
+}
+
+// CheckError reports a write that breaks a check constraint. It matches
+// ErrCheckViolation and unwraps to the error of a validator.
+type CheckError struct {
+	Table  string
+	Column string // empty for a table check
+	Check  string
+	Value  interface{}
+	Err    error
+}
+
+func (e *CheckError) Error() string {
+	msg := fmt.Sprintf("%s %s on table %s", ErrCheckViolation, e.Check, e.Table)
+	if e.Column != "" {
+		msg += fmt.Sprintf(" for column %s: value %v", e.Column, e.Value)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is reports whether target is ErrCheckViolation
+func (e *CheckError) Is(target error) bool {
+	return target == ErrCheckViolation
+}
+
+// Unwrap returns the error of the validator that rejected the write
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// checkJSON is the stored form of a Check. Column references are kept apart
+// from literal values so they survive the round trip.
+type checkJSON struct {
+	Name       string
+	Min        interface{}     `json:",omitempty"`
+	Max        interface{}     `json:",omitempty"`
+	Pattern    string          `json:",omitempty"`
+	Enum       []interface{}   `json:",omitempty"`
+	Conditions []conditionJSON `json:",omitempty"`
+	Validator  string          `json:",omitempty"`
+}
+
+// conditionJSON is the stored form of a check condition
+type conditionJSON struct {
+	Column   string
+	Operator query.Operator
+	Value    interface{} `json:",omitempty"`
+	Ref      string      `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (c Check) MarshalJSON() ([]byte, error) {
+	stored := checkJSON{
+		Name:      c.Name,
+		Min:       c.Min,
+		Max:       c.Max,
+		Pattern:   c.Pattern,
+		Enum:      c.Enum,
+		Validator: c.Validator,
+	}
+	for _, cond := range c.Conditions {
+		sc := conditionJSON{Column: cond.Column, Operator: cond.Operator, Value: cond.Value}
+		if ref, ok := cond.Value.(query.ColumnRef); ok {
+			sc.Value, sc.Ref = nil, string(ref)
+		}
+		stored.Conditions = append(stored.Conditions, sc)
+	}
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Values come back as decoded
+// by encoding/json; restoreChecks converts them to the column types.
+func (c *Check) UnmarshalJSON(data []byte) error {
+	var stored checkJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*c = Check{
+		Name:      stored.Name,
+		Min:       stored.Min,
+		Max:       stored.Max,
+		Pattern:   stored.Pattern,
+		Enum:      stored.Enum,
+		Validator: stored.Validator,
+	}
+	for _, sc := range stored.Conditions {
+		cond := query.Condition{Column: sc.Column, Operator: sc.Operator, Value: sc.Value}
+		if sc.Ref != "" {
+			cond.Value = query.Col(sc.Ref)
+		}
+		c.Conditions = append(c.Conditions, cond)
+	}
+	return nil
+}
+
+// restoreChecks converts the values of checks loaded from JSON back to the
+// Go types of the columns they apply to
+func restoreChecks(table *Table) {
+	types := make(map[string]DataType, len(table.Columns))
+	for _, col := range table.Columns {
+		types[col.Name] = col.Type
+	}
+	restore := func(check *Check, column string) {
+		if column != "" {
+			check.Min = decodeValue(check.Min, types[column])
+			check.Max = decodeValue(check.Max, types[column])
+			for i, v := range check.Enum {
+				check.Enum[i] = decodeValue(v, types[column])
+			}
+		}
+		for i, cond := range check.Conditions {
+			if values, ok := cond.Value.([]interface{}); ok {
+				for j, v := range values {
+					values[j] = decodeValue(v, types[cond.Column])
+				}
+			} else if _, ok := cond.Value.(query.ColumnRef); !ok {
+				check.Conditions[i].Value = decodeValue(cond.Value, types[cond.Column])
+			}
+		}
+	}
+	for i := range table.Columns {
+		for j := range table.Columns[i].Checks {
+			restore(&table.Columns[i].Checks[j], table.Columns[i].Name)
+		}
+	}
+	for i := range table.Checks {
+		restore(&table.Checks[i], "")
+	}
+}
+
+// validateChecks validates the checks of table and names those without a
+// name. Check slices are copied before they are changed.
+func validateChecks(table *Table) error {
+	names := make(map[string]bool)
+	name := func(check *Check, base string) error {
+		if check.Name == "" {
+			check.Name = base
+			for n := 2; names[check.Name]; n++ {
+				check.Name = base + strconv.Itoa(n)
+			}
+		}
+		if names[check.Name] {
+			return fmt.Errorf("%w: check %s already exists", ErrInvalidOperation, check.Name)
+		}
+		names[check.Name] = true
+		return nil
+	}
+
+	for i := range table.Columns {
+		col := &table.Columns[i]
+		if len(col.Checks) == 0 {
+			continue
+		}
+		col.Checks = append([]Check(nil), col.Checks...)
+		for j := range col.Checks {
+			if err := name(&col.Checks[j], table.Name+"_"+col.Name+"_check"); err != nil {
+				return err
+			}
+			if err := validateCheck(table, col, &col.Checks[j]); err != nil {
+				return err
+			}
+		}
+	}
+	table.Checks = append([]Check(nil), table.Checks...)
+	for i := range table.Checks {
+		if err := name(&table.Checks[i], table.Name+"_check"); err != nil {
+			return err
+		}
+		if err := validateCheck(table, nil, &table.Checks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCheck checks that the rules of check suit col, or the table when
+// col is nil, and decodes its condition values to the types of their columns
+func validateCheck(table *Table, col *Column, check *Check) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: check %s: %s", ErrInvalidOperation, check.Name, fmt.Sprintf(format, args...))
+	}
+
+	if check.Min == nil && check.Max == nil && check.Pattern == "" && check.Enum == nil &&
+		len(check.Conditions) == 0 && check.Validator == "" {
+		return invalid("no rule given")
+	}
+	if col == nil {
+		if check.Min != nil || check.Max != nil || check.Pattern != "" || check.Enum != nil {
+			return invalid("a table check may only use conditions and a validator")
+		}
+	} else {
+		if check.Min != nil || check.Max != nil {
+			switch col.Type {
+			case Int, Float, String, DateTime, Decimal:
+			default:
+				return invalid("column %s has no order", col.Name)
+			}
+		}
+		for _, bound := range []interface{}{check.Min, check.Max} {
+			if bound == nil {
+				continue
+			}
+			if err := validateDataType(col.Type, bound); err != nil {
+				return fmt.Errorf("check %s: invalid bound %v for column %s: %w", check.Name, bound, col.Name, err)
+			}
+		}
+		if check.Min != nil && check.Max != nil && compareValues(check.Min, check.Max) > 0 {
+			return invalid("min %v is greater than max %v", check.Min, check.Max)
+		}
+		if check.Pattern != "" {
+			if col.Type != String {
+				return invalid("pattern needs a string column")
+			}
+			if _, err := compilePattern(check.Pattern); err != nil {
+				return invalid("%v", err)
+			}
+		}
+		for _, v := range check.Enum {
+			if err := validateDataType(col.Type, v); err != nil {
+				return fmt.Errorf("check %s: invalid enum value %v for column %s: %w", check.Name, v, col.Name, err)
+			}
+		}
+	}
+	// Checks follow renamed and dropped columns by name, so they cannot
+	// look into documents
+	for _, cond := range check.Conditions {
+		if _, ok := documentPath(table, cond.Column); ok {
+			return invalid("condition on path %s", cond.Column)
+		}
+		if ref, ok := cond.Value.(query.ColumnRef); ok {
+			if _, ok := documentPath(table, string(ref)); ok {
+				return invalid("condition on path %s", ref)
+			}
+		}
+	}
+	conditions, err := validateConditions(table, check.Conditions)
+	if err != nil {
+		return fmt.Errorf("check %s: %w", check.Name, err)
+	}
+	if len(conditions) > 0 {
+		check.Conditions = conditions
+	}
+	if check.Validator != "" {
+		if _, ok := validator(check.Validator); !ok {
+			return invalid("validator %s is not registered", check.Validator)
+		}
+	}
+	return nil
+}
+
+// compilePattern returns the compiled form of a check pattern
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+// checkRow returns a CheckError when row breaks a check of table
+func checkRow(table *Table, row map[string]interface{}) error {
+	for _, col := range table.Columns {
+		for _, check := range col.Checks {
+			if err := evaluateCheck(table, col.Name, check, row); err != nil {
+				return err
+			}
+		}
+	}
+	for _, check := range table.Checks {
+		if err := evaluateCheck(table, "", check, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluateCheck applies check to row, on the value of column unless it is
+// empty
+func evaluateCheck(table *Table, column string, check Check, row map[string]interface{}) error {
+	var value interface{}
+	if column != "" {
+		value = row[column]
+	}
+	violation := func(err error) error {
+		return &CheckError{Table: table.Name, Column: column, Check: check.Name, Value: value, Err: err}
+	}
+
+	conditions := check.Conditions
+	if column != "" {
+		conditions = append(checkConditions(column, check), conditions...)
+	}
+	for _, cond := range conditions {
+		// A rule on a missing value is unknown, which passes
+		if !present(row, cond.Column) {
+			continue
+		}
+		if ref, ok := cond.Value.(query.ColumnRef); ok && !present(row, string(ref)) {
+			continue
+		}
+		if !query.Match([]query.Condition{cond}, row) {
+			return violation(nil)
+		}
+	}
+
+	if s, ok := value.(string); ok && check.Pattern != "" {
+		re, err := compilePattern(check.Pattern)
+		if err != nil {
+			return violation(err)
+		}
+		if !re.MatchString(s) {
+			return violation(nil)
+		}
+	}
+
+	if check.Validator != "" && (column == "" || value != nil) {
+		fn, ok := validator(check.Validator)
+		if !ok {
+			return fmt.Errorf("%w: validator %s of check %s is not registered", ErrInvalidOperation, check.Validator, check.Name)
+		}
+		if err := fn(value, row); err != nil {
+			return violation(err)
+		}
+	}
+	return nil
+}
+
+// checkConditions returns the range and enum of a column check as
+// conditions on column
+func checkConditions(column string, check Check) []query.Condition {
+	var conditions []query.Condition
+	if check.Min != nil {
+		conditions = append(conditions, query.Condition{Column: column, Operator: query.Gte, Value: check.Min})
+	}
+	if check.Max != nil {
+		conditions = append(conditions, query.Condition{Column: column, Operator: query.Lte, Value: check.Max})
+	}
+	if check.Enum != nil {
+		conditions = append(conditions, query.Condition{Column: column, Operator: query.In, Value: check.Enum})
+	}
+	return conditions
+}
+
+// present reports whether row holds a non-nil value for column
+func present(row map[string]interface{}, column string) bool {
+	value, exists := row[column]
+	return exists && value != nil
+}
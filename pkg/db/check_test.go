@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+func TestChecks(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "code", Type: String, Checks: []Check{{Pattern: `^[A-Z]{3}$`}}},
+		{Name: "seats", Type: Int, Checks: []Check{{Name: "seats_range", Min: 1, Max: 100}}},
+		{Name: "status", Type: String, Checks: []Check{{Enum: []interface{}{"draft", "open"}}}},
+		{Name: "starts", Type: DateTime, Checks: []Check{{Min: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}}},
+		{Name: "ends", Type: DateTime, Checks: []Check{{
+			Name:       "ends_after_start",
+			Conditions: []query.Condition{{Column: "ends", Operator: query.Gte, Value: query.Col("starts")}},
+		}}},
+	}
+
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	event := func(id int) map[string]interface{} {
+		return map[string]interface{}{
+			"id": id, "code": "ABC", "seats": 10, "status": "draft",
+			"starts": start, "ends": start.Add(time.Hour),
+		}
+	}
+	with := func(row map[string]interface{}, column string, value interface{}) map[string]interface{} {
+		return copyRow(row, map[string]interface{}{column: value})
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("events", columns))
+		assert.NoError(t, db.Insert("events", event(1)))
+
+		for column, value := range map[string]interface{}{
+			"code":   "abcd",
+			"seats":  0,
+			"status": "closed",
+			"starts": time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC),
+			"ends":   start.Add(-time.Hour),
+		} {
+			err := db.Insert("events", with(event(2), column, value))
+			assert.ErrorIs(t, err, ErrCheckViolation, column)
+			var checkErr *CheckError
+			if assert.True(t, errors.As(err, &checkErr), column) {
+				assert.Equal(t, "events", checkErr.Table)
+				assert.Equal(t, column, checkErr.Column)
+				assert.Equal(t, value, checkErr.Value)
+			}
+		}
+
+		// Missing values pass, as NULL does in SQL
+		assert.NoError(t, db.Insert("events", map[string]interface{}{"id": 2}))
+		assert.NoError(t, db.Insert("events", map[string]interface{}{"id": 3, "ends": start}))
+
+		table, err := db.GetTable("events")
+		assert.NoError(t, err)
+		assert.Equal(t, "events_code_check", table.Columns[1].Checks[0].Name)
+		assert.Equal(t, "seats_range", table.Columns[2].Checks[0].Name)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("events", columns))
+		for id := 1; id <= 3; id++ {
+			assert.NoError(t, db.Insert("events", event(id)))
+		}
+
+		err = db.Update("events", map[string]interface{}{"seats": 101}, map[string]interface{}{"id": 1})
+		var checkErr *CheckError
+		if assert.True(t, errors.As(err, &checkErr)) {
+			assert.Equal(t, "seats_range", checkErr.Check)
+		}
+		// The merged record is checked, not only the changed columns
+		err = db.Update("events", map[string]interface{}{"starts": start.Add(2 * time.Hour)}, map[string]interface{}{"id": 1})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+
+		_, err = db.UpdateWhere(ctx, "events", map[string]interface{}{"status": "gone"}, nil)
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		_, err = db.Upsert("events", with(event(1), "code", "x"), nil, []string{"code"})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+
+		batch := NewBatch().
+			Update("events", map[string]interface{}{"status": "open"}, map[string]interface{}{"id": 1}).
+			Update("events", map[string]interface{}{"seats": -1}, map[string]interface{}{"id": 2})
+		_, err = db.ExecBatch(batch, BatchAtomic)
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		_, err = db.InsertMany("events", []map[string]interface{}{with(event(4), "code", "no")}, BatchAtomic)
+		assert.ErrorIs(t, err, ErrCheckViolation)
+
+		rows, err := db.Query("events", []string{"seats", "status"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 3)
+		for _, row := range rows {
+			assert.Equal(t, map[string]interface{}{"seats": 10, "status": "draft"}, row)
+		}
+
+		n, err := db.UpdateWhere(ctx, "events", map[string]interface{}{"status": "open"}, []query.Condition{
+			{Column: "ends", Operator: query.Gt, Value: query.Col("starts")},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	})
+
+	t.Run("Validators", func(t *testing.T) {
+		errOdd := errors.New("must be even")
+		RegisterValidator("test_even", func(value interface{}, row map[string]interface{}) error {
+			if value.(int)%2 != 0 {
+				return errOdd
+			}
+			return nil
+		})
+		RegisterValidator("test_named", func(value interface{}, row map[string]interface{}) error {
+			if name, _ := row["name"].(string); strings.TrimSpace(name) == "" {
+				return errors.New("name is blank")
+			}
+			return nil
+		})
+
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		err = db.CreateTable("items", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true, Checks: []Check{{Validator: "test_even"}}},
+			{Name: "name", Type: String},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("items", AddCheck("", Check{Name: "named", Validator: "test_named"})))
+
+		assert.NoError(t, db.Insert("items", map[string]interface{}{"id": 2, "name": "a"}))
+		err = db.Insert("items", map[string]interface{}{"id": 3, "name": "b"})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		assert.ErrorIs(t, err, errOdd)
+
+		err = db.Insert("items", map[string]interface{}{"id": 4, "name": " "})
+		var checkErr *CheckError
+		if assert.True(t, errors.As(err, &checkErr)) {
+			assert.Equal(t, "named", checkErr.Check)
+			assert.Empty(t, checkErr.Column)
+			assert.EqualError(t, checkErr.Err, "name is blank")
+		}
+	})
+
+	t.Run("Invalid Checks", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+
+		for _, col := range []Column{
+			{Name: "n", Type: Int, Checks: []Check{{}}},
+			{Name: "n", Type: Int, Checks: []Check{{Pattern: "x"}}},
+			{Name: "n", Type: String, Checks: []Check{{Pattern: "("}}},
+			{Name: "n", Type: Int, Checks: []Check{{Min: "a"}}},
+			{Name: "n", Type: Int, Checks: []Check{{Min: 5, Max: 1}}},
+			{Name: "n", Type: Boolean, Checks: []Check{{Min: true}}},
+			{Name: "n", Type: Int, Checks: []Check{{Enum: []interface{}{1, "2"}}}},
+			{Name: "n", Type: Int, Checks: []Check{{Validator: "missing"}}},
+			{Name: "n", Type: Int, Checks: []Check{{Conditions: []query.Condition{{Column: "n", Operator: query.Gt, Value: query.Col("missing")}}}}},
+			{Name: "n", Type: Int, Checks: []Check{{Name: "c", Min: 1}, {Name: "c", Max: 2}}},
+			{Name: "n", Type: Int, Checks: []Check{{Conditions: []query.Condition{{Column: "n", Operator: query.Gte, Value: "5"}}}}},
+			{Name: "n", Type: String, Checks: []Check{{Conditions: []query.Condition{{Column: "n", Operator: query.NotIn, Value: []interface{}{"a", 1}}}}}},
+			{Name: "n", Type: Enum, Values: []string{"a"}, Checks: []Check{{Conditions: []query.Condition{{Column: "n", Operator: query.Neq, Value: "b"}}}}},
+		} {
+			err := db.CreateTable("bad", []Column{{Name: "id", Type: Int, PrimaryKey: true}, col})
+			assert.Error(t, err, col.Checks)
+		}
+		assert.NoError(t, db.CreateTable("good", []Column{{Name: "id", Type: Int, PrimaryKey: true}}))
+
+		// Condition values are decoded to the column type like stored values
+		assert.NoError(t, db.AlterTable("good", AddColumn(Column{Name: "at", Type: DateTime, Checks: []Check{{
+			Conditions: []query.Condition{{Column: "at", Operator: query.Gte, Value: "2020-01-01T00:00:00Z"}},
+		}}})))
+		err = db.Insert("good", map[string]interface{}{"id": 1, "at": time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		assert.NoError(t, db.Insert("good", map[string]interface{}{"id": 1, "at": time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}))
+
+		assert.ErrorIs(t, db.AlterTable("good", AddCheck("", Check{Min: 1})), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("good", AddCheck("missing", Check{Min: 1})), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("good", DropCheck("missing")), ErrInvalidOperation)
+	})
+
+	t.Run("Path Conditions", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "kind", Type: String},
+			{Name: "meta", Type: JSON},
+		}))
+
+		// Paths would never be enforced, so they are refused
+		err = db.AlterTable("docs", AddCheck("", Check{Conditions: []query.Condition{{Column: "meta.kind", Operator: query.Eq, Value: "a"}}}))
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		err = db.AlterTable("docs", AddCheck("", Check{Conditions: []query.Condition{{Column: "kind", Operator: query.Eq, Value: query.Col("meta.kind")}}}))
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		assert.NoError(t, db.Insert("docs", map[string]interface{}{"id": 1, "meta": map[string]interface{}{"kind": "b"}}))
+
+		// Whole JSON columns can be checked
+		assert.NoError(t, db.AlterTable("docs", AddCheck("", Check{Conditions: []query.Condition{{Column: "meta", Operator: query.HasKey, Value: "kind"}}})))
+		err = db.Insert("docs", map[string]interface{}{"id": 2, "meta": map[string]interface{}{"size": 1}})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+	})
+
+	t.Run("Alter", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("events", columns))
+		assert.NoError(t, db.Insert("events", event(1)))
+		assert.NoError(t, db.Insert("events", with(event(2), "seats", 50)))
+
+		// Stored records must satisfy a new check
+		err = db.AlterTable("events", AddCheck("seats", Check{Name: "small", Max: 20}))
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		assert.NoError(t, db.Insert("events", with(event(3), "seats", 30)))
+		assert.NoError(t, db.AlterTable("events", AddCheck("seats", Check{Name: "large", Min: 5})))
+		assert.ErrorIs(t, db.Insert("events", with(event(4), "seats", 4)), ErrCheckViolation)
+		assert.NoError(t, db.AlterTable("events", DropCheck("large")))
+		assert.NoError(t, db.Insert("events", with(event(4), "seats", 4)))
+
+		// Checks follow renamed columns and keep dropped ones in place
+		assert.ErrorIs(t, db.AlterTable("events", DropColumn("starts")), ErrInvalidOperation)
+		assert.NoError(t, db.AlterTable("events", RenameColumn("starts", "begins")))
+		err = db.Insert("events", map[string]interface{}{"id": 5, "begins": start, "ends": start.Add(-time.Minute)})
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		assert.NoError(t, db.AlterTable("events", DropCheck("ends_after_start"), DropColumn("begins")))
+
+		// Adding a column runs its checks against its default
+		err = db.AlterTable("events", AddColumn(Column{Name: "rating", Type: Int, Default: 0, Checks: []Check{{Min: 1}}}))
+		assert.ErrorIs(t, err, ErrCheckViolation)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("events", columns))
+		assert.NoError(t, db.AlterTable("events", AddCheck("", Check{
+			Name:       "open_has_seats",
+			Conditions: []query.Condition{{Column: "seats", Operator: query.NotIn, Value: []interface{}{13}}},
+		})))
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		table, err := db.GetTable("events")
+		assert.NoError(t, err)
+		assert.Equal(t, query.Col("starts"), table.Columns[5].Checks[0].Conditions[0].Value)
+		assert.Equal(t, 1, table.Columns[2].Checks[0].Min)
+
+		assert.NoError(t, db.Insert("events", event(1)))
+		for column, value := range map[string]interface{}{
+			"code":   "abcd",
+			"seats":  13,
+			"status": "closed",
+			"starts": time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC),
+			"ends":   start.Add(-time.Hour),
+		} {
+			assert.ErrorIs(t, db.Insert("events", with(event(2), column, value)), ErrCheckViolation, column)
+		}
+	})
+}
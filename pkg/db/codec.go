@@ -0,0 +1,138 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Records are stored as JSON, which keeps numbers as text, times as
+// RFC 3339 strings with their zone offset, byte slices as base64, decimals
+// as strings and blob handles as objects. The codec below restores the Go
+// type of every column from the table schema on each path that reads
+// records. Values that already have their Go type, as kept by in-memory
+// storage, are returned unchanged, except that numbers in JSON documents
+// are always normalized by jsonValue.
+
+// decodeRow restores the Go types of the columns in data, replacing them in
+// place, and returns data. Numbers outside the schema become float64, as
+// encoding/json decodes them.
+func decodeRow(columns []Column, data map[string]interface{}) map[string]interface{} {
+	byName := make(map[string]*Column, len(columns))
+	for i := range columns {
+		byName[columns[i].Name] = &columns[i]
+	}
+	for name, value := range data {
+		if col, ok := byName[name]; ok {
+			data[name] = decodeColumn(value, *col)
+		} else {
+			data[name] = plainValue(value)
+		}
+	}
+	return data
+}
+
+// decodeColumn restores a value of col read from storage, decoding the
+// elements of arrays by the element type
+func decodeColumn(value interface{}, col Column) interface{} {
+	if items, ok := value.([]interface{}); ok && col.Type == Array {
+		decoded := make([]interface{}, len(items))
+		for i, item := range items {
+			decoded[i] = decodeValue(item, col.Elem)
+		}
+		return decoded
+	}
+	return decodeValue(value, col.Type)
+}
+
+// decodeValue restores a value read from storage to the Go type of
+// dataType. Values that cannot be restored are returned as they are, so
+// that validation still reports them.
+func decodeValue(value interface{}, dataType DataType) interface{} {
+	switch dataType {
+	case Int:
+		switch v := value.(type) {
+		case json.Number:
+			if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return intValue(n)
+			}
+			if f, err := v.Float64(); err == nil {
+				if n, err := floatToInt(f); err == nil {
+					return n
+				}
+			}
+		case float64:
+			if n, err := floatToInt(v); err == nil {
+				return n
+			}
+		}
+	case Float:
+		if n, ok := value.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				return f
+			}
+		}
+	case DateTime:
+		if s, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+	case Blob:
+		switch v := value.(type) {
+		case string:
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return b
+			}
+		case map[string]interface{}:
+			if handle, ok := blobHandle(v); ok {
+				return handle
+			}
+		}
+	case JSON:
+		return jsonValue(value)
+	case Decimal:
+		switch v := value.(type) {
+		case string:
+			if d, err := ParseDecimal(v); err == nil {
+				return d
+			}
+		case json.Number:
+			if d, err := ParseDecimal(v.String()); err == nil {
+				return d
+			}
+		}
+	}
+	return plainValue(value)
+}
+
+// intValue returns n as an int when it fits one
+func intValue(n int64) interface{} {
+	if int64(int(n)) == n {
+		return int(n)
+	}
+	return n
+}
+
+// plainValue returns value with every json.Number in it, however deeply
+// nested, converted to float64
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v.String()
+		}
+		return f
+	case []interface{}:
+		for i, element := range v {
+			v[i] = plainValue(element)
+		}
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = plainValue(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	big := 1<<53 + 1
+	zone := time.FixedZone("IST", 5*3600+1800)
+	at := time.Date(2024, 2, 29, 23, 59, 59, 123456789, zone)
+	blob := []byte{0, 1, 2, 0xfe, 0xff}
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		err = db.CreateTable("values", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "count", Type: Int, Unique: true},
+			{Name: "ratio", Type: Float},
+			{Name: "at", Type: DateTime},
+			{Name: "data", Type: Blob},
+		})
+		assert.NoError(t, err)
+		row := map[string]interface{}{"id": 1, "count": big, "ratio": 0.1, "at": at, "data": blob}
+		assert.NoError(t, db.Insert("values", row))
+		assert.NoError(t, db.Insert("values", map[string]interface{}{"id": 2, "count": big + 2, "ratio": 3.0}))
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		rows, err := db.Query("values", nil, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, big, rows[0]["count"])
+			assert.Equal(t, 0.1, rows[0]["ratio"])
+			assert.Equal(t, blob, rows[0]["data"])
+			got, ok := rows[0]["at"].(time.Time)
+			if assert.True(t, ok) {
+				assert.True(t, at.Equal(got))
+				_, offset := got.Zone()
+				assert.Equal(t, 5*3600+1800, offset)
+			}
+		}
+
+		// Float columns keep their type even for integral values
+		rows, err = db.Query("values", []string{"ratio"}, map[string]interface{}{"id": 2}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"ratio": 3.0}}, rows)
+
+		// The unique index rebuilt on open tells neighbouring large integers apart
+		rows, err = db.Query("values", []string{"id"}, map[string]interface{}{"count": big}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 1}}, rows)
+
+		page, err := db.QueryPage(context.Background(), "values", PageOptions{Columns: []string{"count"}, OrderBy: "count", Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"count": big}}, page.Rows)
+		page, err = db.QueryPage(context.Background(), "values", PageOptions{Columns: []string{"count"}, OrderBy: "count", Limit: 1, PageToken: page.NextPageToken})
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"count": big + 2}}, page.Rows)
+	})
+
+	t.Run("Blob Validation", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("files", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "data", Type: Blob},
+		}))
+		assert.NoError(t, db.Insert("files", map[string]interface{}{"id": 1, "data": blob}))
+		assert.Error(t, db.Insert("files", map[string]interface{}{"id": 2, "data": "AAEC"}))
+	})
+
+	t.Run("Decode Value", func(t *testing.T) {
+		for _, tc := range []struct {
+			value    interface{}
+			dataType DataType
+			want     interface{}
+		}{
+			{json.Number("9007199254740993"), Int, 9007199254740993},
+			{json.Number("1e3"), Int, 1000},
+			{json.Number("1.5"), Int, 1.5},
+			{float64(7), Int, 7},
+			{1.5, Int, 1.5},
+			{1e300, Int, 1e300},
+			{json.Number("2"), Float, 2.0},
+			{"AAEC", Blob, []byte{0, 1, 2}},
+			{"not base64!", Blob, "not base64!"},
+			{"2024-01-02T03:04:05Z", DateTime, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+			{"yesterday", DateTime, "yesterday"},
+			{"AAEC", String, "AAEC"},
+			{[]interface{}{json.Number("1")}, String, []interface{}{1.0}},
+		} {
+			assert.Equal(t, tc.want, decodeValue(tc.value, tc.dataType), tc.value)
+		}
+	})
+}
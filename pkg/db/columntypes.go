@@ -0,0 +1,85 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateColumnType checks the parameters of Array, Enum and Decimal
+// columns
+func validateColumnType(col Column) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: column %s: %s", ErrInvalidDataType, col.Name, fmt.Sprintf(format, args...))
+	}
+
+	dataType := col.Type
+	if dataType == Array {
+		switch col.Elem {
+		case Int, Float, String, Boolean, DateTime, Enum, Decimal:
+		default:
+			return invalid("arrays cannot hold values of type %v", col.Elem)
+		}
+		if col.PrimaryKey {
+			return invalid("an array cannot be a primary key")
+		}
+		dataType = col.Elem
+	}
+
+	switch dataType {
+	case Decimal:
+		if col.PrimaryKey {
+			// Storage keys have no decimal form that decodes back exactly
+			return invalid("a decimal cannot be a primary key")
+		}
+	}
+
+	switch dataType {
+	case Enum:
+		if len(col.Values) == 0 {
+			return invalid("an enum needs values")
+		}
+		seen := make(map[string]bool, len(col.Values))
+		for _, v := range col.Values {
+			if seen[v] {
+				return invalid("enum value %q is repeated", v)
+			}
+			seen[v] = true
+		}
+	case Decimal:
+		if col.Precision < 1 || col.Precision > maxDecimalPrecision {
+			return invalid("precision must be between 1 and %d", maxDecimalPrecision)
+		}
+		if col.Scale < 0 || col.Scale > col.Precision {
+			return invalid("scale must be between 0 and the precision")
+		}
+	}
+	return nil
+}
+
+// validateValue validates a value against the type of col, including the
+// elements of arrays, the values of enums and the digits of decimals
+func validateValue(col Column, value interface{}) error {
+	if err := validateDataType(col.Type, value); err != nil {
+		return err
+	}
+
+	switch col.Type {
+	case Array:
+		elem := col
+		elem.Type = col.Elem
+		for i, item := range value.([]interface{}) {
+			if err := validateValue(elem, item); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+	case Enum:
+		if !containsString(col.Values, value.(string)) {
+			return fmt.Errorf("%w: %q is not one of %s", ErrInvalidDataType, value, strings.Join(col.Values, ", "))
+		}
+	case Decimal:
+		if d := value.(DecimalValue); !d.fits(col.Precision, col.Scale) {
+			return fmt.Errorf("%w: %s does not fit decimal(%d, %d)", ErrInvalidDataType, d, col.Precision, col.Scale)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+// productIDs returns the ids of the products matching conditions
+func productIDs(t *testing.T, db Database, conditions ...query.Condition) []interface{} {
+	rows, err := db.Query("products", nil, nil, 0, 0)
+	assert.NoError(t, err)
+	var ids []interface{}
+	for _, row := range rows {
+		if query.Match(conditions, row) {
+			ids = append(ids, row["id"])
+		}
+	}
+	return ids
+}
+
+func TestColumnTypes(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "tags", Type: Array, Elem: String},
+		{Name: "sizes", Type: Array, Elem: Enum, Values: []string{"s", "m", "l"}},
+		{Name: "status", Type: Enum, Values: []string{"draft", "live"}, Default: "draft"},
+		{Name: "price", Type: Decimal, Precision: 6, Scale: 2},
+	}
+	seed := []map[string]interface{}{
+		{"id": 1, "tags": []interface{}{"new", "sale"}, "sizes": []interface{}{"s", "m"}, "price": NewDecimal(1999, 2)},
+		{"id": 2, "tags": []interface{}{"sale"}, "status": "live", "price": NewDecimal(5, 0)},
+		{"id": 3, "tags": []interface{}{}, "status": "live", "price": NewDecimal(1, 1)},
+	}
+
+	t.Run("Definitions", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		for _, col := range []Column{
+			{Name: "a", Type: Array, Elem: Blob},
+			{Name: "a", Type: Array, Elem: Array},
+			{Name: "e", Type: Enum},
+			{Name: "e", Type: Enum, Values: []string{"x", "x"}},
+			{Name: "d", Type: Decimal},
+			{Name: "d", Type: Decimal, Precision: 19},
+			{Name: "d", Type: Decimal, Precision: 2, Scale: 3},
+			{Name: "a", Type: Array, Elem: Decimal},
+			{Name: "e", Type: Enum, Values: []string{"x"}, Default: "y"},
+		} {
+			err := db.CreateTable("t", []Column{{Name: "id", Type: Int, PrimaryKey: true}, col})
+			assert.ErrorIs(t, err, ErrInvalidDataType, "%+v", col)
+		}
+		err = db.CreateTable("t", []Column{{Name: "id", Type: Array, Elem: Int, PrimaryKey: true}})
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+
+		// Decimals cannot key records, alone or in a composite key
+		err = db.CreateTable("t", []Column{{Name: "id", Type: Decimal, Precision: 4, Scale: 2, PrimaryKey: true}})
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+		err = db.CreateTable("t", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "rate", Type: Decimal, Precision: 4, Scale: 2, PrimaryKey: true},
+		})
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+		_, err = db.GetTable("t")
+		assert.ErrorIs(t, err, ErrTableNotFound)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("products", columns))
+		_, err = db.InsertMany("products", seed, BatchAtomic)
+		assert.NoError(t, err)
+		for _, row := range []map[string]interface{}{
+			{"id": 9, "tags": []string{"a"}},
+			{"id": 9, "tags": []interface{}{"a", 1}},
+			{"id": 9, "sizes": []interface{}{"xl"}},
+			{"id": 9, "status": "gone"},
+			{"id": 9, "price": 1.5},
+			{"id": 9, "price": NewDecimal(1, 3)},
+			{"id": 9, "price": NewDecimal(10000, 0)},
+		} {
+			assert.Error(t, db.Insert("products", row), "%v", row)
+		}
+		assert.NoError(t, db.Insert("products", map[string]interface{}{"id": 9, "price": NewDecimal(999999, 2)}))
+
+		_, err = db.UpdateWhere(context.Background(), "products", map[string]interface{}{"status": "gone"}, nil)
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+		err = db.AlterTable("products", ChangeType("status", Decimal))
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+		err = db.AlterTable("products", AddColumn(Column{Name: "unit", Type: Enum}))
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+	})
+
+	t.Run("Conditions", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("products", columns))
+		_, err = db.InsertMany("products", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		assert.ElementsMatch(t, []interface{}{1, 2}, productIDs(t, db, query.Condition{Column: "tags", Operator: query.Contains, Value: "sale"}))
+		assert.ElementsMatch(t, []interface{}{1}, productIDs(t, db, query.Condition{Column: "tags", Operator: query.Contains, Value: []interface{}{"sale", "new"}}))
+		assert.ElementsMatch(t, []interface{}{1}, productIDs(t, db, query.Condition{Column: "sizes", Operator: query.Overlaps, Value: []interface{}{"m", "l"}}))
+		assert.Empty(t, productIDs(t, db, query.Condition{Column: "tags", Operator: query.Overlaps, Value: []interface{}{"old"}}))
+
+		assert.ElementsMatch(t, []interface{}{1, 2}, productIDs(t, db, query.Condition{Column: "price", Operator: query.Gte, Value: 5}))
+		assert.ElementsMatch(t, []interface{}{3}, productIDs(t, db, query.Condition{Column: "price", Operator: query.Lt, Value: NewDecimal(5, 0)}))
+		assert.ElementsMatch(t, []interface{}{3}, productIDs(t, db, query.Condition{Column: "price", Operator: query.Eq, Value: 0.1}))
+		assert.ElementsMatch(t, []interface{}{2}, productIDs(t, db, query.Condition{Column: "price", Operator: query.In, Value: []interface{}{NewDecimal(500, 2)}}))
+
+		// Where maps compare numbers with decimals by value
+		rows, err := db.Query("products", []string{"id"}, map[string]interface{}{"price": 19.99}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 1}}, rows)
+	})
+
+	t.Run("Indexes", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("products", columns))
+		_, err = db.InsertMany("products", seed, BatchAtomic)
+		assert.NoError(t, err)
+		err = db.CreateIndex("products", CreateIndexOptions{Name: "idx_price", Columns: []string{"price"}})
+		assert.NoError(t, err)
+		err = db.CreateIndex("products", CreateIndexOptions{Name: "idx_tags", Columns: []string{"tags"}})
+		assert.NoError(t, err)
+
+		indexManager := db.(*database).indexes["products"]
+		index, ok := indexManager.FindColumnIndex("price")
+		assert.True(t, ok)
+		ids, _ := index.Find(NewDecimal(50, 1))
+		assert.Equal(t, []interface{}{2}, ids)
+		ids, _ = index.Find(5)
+		assert.Equal(t, []interface{}{2}, ids)
+		rows, err := db.Query("products", []string{"id"}, map[string]interface{}{"price": 0.1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 3}}, rows)
+		assert.Equal(t, []interface{}{3, 2}, index.Between(nil, &IndexBound{Key: 5, Inclusive: true}))
+		ids, indexed := conditionIDs(db.(*database).tables["products"], indexManager, []query.Condition{{Column: "price", Operator: query.Gt, Value: NewDecimal(5, 0)}})
+		assert.True(t, indexed)
+		assert.Equal(t, []interface{}{1}, ids)
+
+		index, ok = indexManager.FindColumnIndex("tags")
+		assert.True(t, ok)
+		ids, _ = index.Find([]interface{}{"sale"})
+		assert.Equal(t, []interface{}{2}, ids)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("products", columns))
+		_, err = db.InsertMany("products", seed, BatchAtomic)
+		assert.NoError(t, err)
+		err = db.AlterTable("products", AddColumn(Column{Name: "fee", Type: Decimal, Precision: 4, Scale: 2, Default: NewDecimal(25, 2)}))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		rows, err := db.Query("products", nil, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{
+			"id":     1,
+			"tags":   []interface{}{"new", "sale"},
+			"sizes":  []interface{}{"s", "m"},
+			"status": "draft",
+			"price":  NewDecimal(1999, 2),
+			"fee":    NewDecimal(25, 2),
+		}}, rows)
+
+		table, err := db.GetTable("products")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"draft", "live"}, table.Columns[3].Values)
+		assert.Equal(t, 6, table.Columns[4].Precision)
+		assert.Equal(t, NewDecimal(25, 2), table.Columns[5].Default)
+		assert.Error(t, db.Insert("products", map[string]interface{}{"id": 4, "status": "gone"}))
+	})
+}
@@ -1,14 +1,19 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/query"
 	"github.com/tungpsit/ez-file-db/pkg/storage"
 )
 
@@ -19,8 +24,33 @@ var (
 	ErrTableNotFound    = errors.New("table not found")
 	ErrInvalidDataType  = errors.New("invalid data type")
 	ErrInvalidOperation = errors.New("invalid operation")
+	ErrLockTimeout      = errors.New("lock wait timeout")
+	ErrDeadlock         = errors.New("deadlock detected")
+	ErrInvalidPageToken = errors.New("invalid page token")
+	ErrDuplicateKey     = errors.New("duplicate key")
+
+	// ErrMemoryLimit is matched by errors returned when an operation would
+	// exceed Config.MemoryLimit
+	ErrMemoryLimit = memory.ErrLimit
 )
 
+// DuplicateKeyError reports a write that would give two records the same
+// primary key or unique column value. It matches ErrDuplicateKey.
+type DuplicateKeyError struct {
+	Table  string
+	Column string
+	Value  interface{}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("unique constraint violation for column %s of table %s: %s %v", e.Column, e.Table, ErrDuplicateKey, e.Value)
+}
+
+// Is reports whether target is ErrDuplicateKey
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
 const (
 	schemaTableName = "_schema"
 )
@@ -32,11 +62,16 @@ type Database interface {
 	Close() error
 
 	// Table Operations
+	// CreateTable creates a table keyed by its PrimaryKey columns. Several
+	// of them form a composite key, ordered as the columns are.
 	CreateTable(name string, columns []Column) error
 	DropTable(name string) error
 	GetTable(name string) (*Table, error)
 	ListTables() ([]string, error)
 	HasTable(name string) bool
+	// AlterTable applies ops to a table in order. The schema and indexes
+	// change at once; existing records are rewritten in the background.
+	AlterTable(name string, ops ...AlterOp) error
 
 	// Index Operations
 	CreateIndex(table string, options CreateIndexOptions) error
@@ -45,9 +80,73 @@ type Database interface {
 
 	// Data Operations
 	Insert(table string, data map[string]interface{}) error
+	// Update and Delete write the one record whose whole primary key where
+	// gives; use UpdateWhere and DeleteWhere for other rows
 	Update(table string, data map[string]interface{}, where map[string]interface{}) error
 	Delete(table string, where map[string]interface{}) error
 	Query(table string, columns []string, where map[string]interface{}, limit, offset int) ([]map[string]interface{}, error)
+	QueryIter(ctx context.Context, table string, columns []string, where map[string]interface{}, limit, offset int) (*Rows, error)
+	QueryPage(ctx context.Context, table string, options PageOptions) (*Page, error)
+	// Upsert inserts data, or when a record with the same conflictColumns
+	// values exists, updates its updateColumns from data. With no
+	// updateColumns the existing record is left untouched (DO NOTHING).
+	Upsert(table string, data map[string]interface{}, conflictColumns, updateColumns []string) (UpsertAction, error)
+
+	// Returning variants. They write like InsertContext, UpdateContext and
+	// DeleteContext and return the affected rows as stored, or as they were
+	// before deletion, limited to columns (all columns when empty), with
+	// the versions of their records.
+	InsertReturning(ctx context.Context, table string, data map[string]interface{}, columns []string) (ReturnedRow, error)
+	UpdateReturning(ctx context.Context, table string, data map[string]interface{}, where map[string]interface{}, columns []string) ([]ReturnedRow, error)
+	DeleteReturning(ctx context.Context, table string, where map[string]interface{}, columns []string) ([]ReturnedRow, error)
+
+	// Batch Operations. They validate every operation up front, write with a
+	// single storage batch and return the number of operations applied.
+	// In BatchAtomic mode any failure leaves the database unchanged; in
+	// BatchBestEffort mode failures are reported in a *BatchError.
+	InsertMany(table string, rows []map[string]interface{}, mode BatchMode) (int, error)
+	ExecBatch(batch *Batch, mode BatchMode) (int, error)
+
+	// Bulk Operations. They lock, re-check and write every matching row
+	// together and return the number of rows affected.
+	UpdateWhere(ctx context.Context, table string, data map[string]interface{}, conditions []query.Condition) (int, error)
+	DeleteWhere(ctx context.Context, table string, conditions []query.Condition) (int, error)
+
+	// Context-aware variants. They return ctx.Err() promptly when the
+	// context is cancelled or its deadline passes while waiting for locks,
+	// scanning records or building indexes.
+	CreateTableContext(ctx context.Context, name string, columns []Column) error
+	DropTableContext(ctx context.Context, name string) error
+	AlterTableContext(ctx context.Context, name string, ops ...AlterOp) error
+	CreateIndexContext(ctx context.Context, table string, options CreateIndexOptions) error
+	DropIndexContext(ctx context.Context, table, indexName string) error
+	InsertContext(ctx context.Context, table string, data map[string]interface{}) error
+	UpdateContext(ctx context.Context, table string, data map[string]interface{}, where map[string]interface{}) error
+	DeleteContext(ctx context.Context, table string, where map[string]interface{}) error
+	UpsertContext(ctx context.Context, table string, data map[string]interface{}, conflictColumns, updateColumns []string) (UpsertAction, error)
+	InsertManyContext(ctx context.Context, table string, rows []map[string]interface{}, mode BatchMode) (int, error)
+	ExecBatchContext(ctx context.Context, batch *Batch, mode BatchMode) (int, error)
+	QueryContext(ctx context.Context, table string, columns []string, where map[string]interface{}, limit, offset int) ([]map[string]interface{}, error)
+
+	// Blobs. WriteBlob streams r into a blob stored outside the record and
+	// sets column of the record keyed pk to its handle; pk is a tuple for a
+	// composite key. Blob values over 16 KiB written by other writes are
+	// stored out of line too. OpenBlob reads a Blob value whether it is
+	// stored inline or out of line. A blob is deleted once no record refers
+	// to it.
+	WriteBlob(ctx context.Context, table string, pk interface{}, column string, r io.Reader) (BlobHandle, error)
+	OpenBlob(ctx context.Context, table string, pk interface{}, column string) (io.ReadSeekCloser, error)
+
+	// Sequences. NextVal hands out values from blocks reserved in storage,
+	// so concurrent callers rarely wait on a write; values are unique but
+	// may have gaps.
+	CreateSequence(ctx context.Context, name string, options SequenceOptions) error
+	NextVal(ctx context.Context, name string) (int64, error)
+	DropSequence(ctx context.Context, name string) error
+
+	// Monitoring
+	CacheStats() CacheStats
+	MemoryStats() MemoryStats
 }
 
 // database implements the Database interface
@@ -55,39 +154,75 @@ type database struct {
 	name    string
 	config  Config
 	tables  map[string]*Table
-	storage *storage.FileStorage
+	storage storage.Engine
+	cache   *storage.CachedEngine
+	budget  *memory.Budget
 	indexes map[string]*IndexManager
-	mu      sync.RWMutex
+	// refs caches the foreign keys referencing each table
+	refs map[string][]reference
+	// mu guards the table catalog. Data operations hold it shared and
+	// coordinate through locks; only DDL that adds or removes tables holds
+	// it exclusively.
+	mu    *rwLock
+	locks *LockManager
+	// blobs counts the references to out-of-line blobs
+	blobs *blobRefs
+	// sequences caches the values reserved by each sequence
+	seqMu     sync.Mutex
+	sequences map[string]*sequence
+	// jobs tracks background rewrites, which stop when jobsCtx is cancelled
+	jobs     sync.WaitGroup
+	jobsCtx  context.Context
+	stopJobs context.CancelFunc
 }
 
 // New creates a new database instance or opens an existing one
 func New(name string, config Config) (Database, error) {
 	db := &database{
-		name:    name,
-		config:  config,
-		tables:  make(map[string]*Table),
-		indexes: make(map[string]*IndexManager),
-	}
+		name:      name,
+		config:    config,
+		tables:    make(map[string]*Table),
+		budget:    memory.NewBudget(config.MemoryLimit),
+		indexes:   make(map[string]*IndexManager),
+		mu:        newRWLock(),
+		locks:     NewLockManager(config.LockTimeout),
+		sequences: make(map[string]*sequence),
+	}
+	db.jobsCtx, db.stopJobs = context.WithCancel(context.Background())
+
+	if config.Storage != nil {
+		db.storage = config.Storage
+	} else {
+		// Create data directory if it doesn't exist
+		dbPath := filepath.Join(config.DataDir, name)
+		if err := os.MkdirAll(dbPath, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
 
-	// Create data directory if it doesn't exist
-	dbPath := filepath.Join(config.DataDir, name)
-	if err := os.MkdirAll(dbPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+		// Initialize storage
+		fileStorage, err := storage.NewFileStorage(dbPath, config.MaxFileSize,
+			storage.WithSyncMode(config.SyncMode, config.SyncInterval),
+			storage.WithSharding(storage.Sharding{Depth: config.ShardDepth, Width: config.ShardWidth}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize storage: %w", err)
+		}
+		db.storage = fileStorage
 	}
 
-	// Initialize storage
-	storage, err := storage.NewFileStorage(dbPath, config.MaxFileSize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	db.blobs = newBlobRefs(db.storage)
+
+	// Cache records read by primary key
+	if config.CacheSize > 0 {
+		db.cache = storage.NewCachedEngine(db.storage, config.CacheSize, config.CacheBytes, db.budget)
+		db.storage = db.cache
 	}
-	db.storage = storage
 
 	// Check if database exists
-	schemaPath := filepath.Join(dbPath, schemaTableName)
-	exists := true
-	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
-		exists = false
+	schemaRecord, err := db.storage.Read(schemaTableName, schemaTableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
 	}
+	exists := schemaRecord != nil
 
 	if !exists {
 		// Initialize new database
@@ -95,32 +230,151 @@ func New(name string, config Config) (Database, error) {
 			return nil, fmt.Errorf("failed to initialize database: %w", err)
 		}
 	} else {
-		// TODO: Load existing database
+		if err := db.loadDatabase(); err != nil {
+			return nil, fmt.Errorf("failed to load database: %w", err)
+		}
+	}
+	if err := db.blobs.sweep(); err != nil {
+		return nil, fmt.Errorf("failed to remove unreferenced blobs: %w", err)
+	}
+
+	// Resume rewrites interrupted by the last Close
+	var pending []string
+	for name, table := range db.tables {
+		if len(table.pending) > 0 {
+			pending = append(pending, name)
+		}
+	}
+	for _, name := range pending {
+		db.startRewrite(name)
 	}
 
 	return db, nil
 }
 
-// initializeDatabase initializes a new database with schema table
-func (db *database) initializeDatabase() error {
-	// Create schema table directory
-	schemaPath := filepath.Join(db.config.DataDir, db.name, schemaTableName)
-	if err := os.MkdirAll(schemaPath, 0755); err != nil {
-		return fmt.Errorf("failed to create schema directory: %w", err)
+// loadDatabase restores table definitions and indexes from the schema table
+func (db *database) loadDatabase() error {
+	schemaTable := db.newSchemaTable(time.Now())
+	db.tables[schemaTableName] = schemaTable
+
+	var schemas []tableSchema
+	err := db.storage.Scan(schemaTableName, func(record *storage.Record) error {
+		raw, _ := record.Data["schema"].(string)
+		var schema tableSchema
+		if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+			return fmt.Errorf("failed to unmarshal schema %v: %w", record.ID, err)
+		}
+		if schema.Name == schemaTableName {
+			schemaTable.CreatedAt = schema.CreatedAt
+			schemaTable.UpdatedAt = schema.UpdatedAt
+			return nil
+		}
+		schemas = append(schemas, schema)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Create schema table
-	now := time.Now()
-	schemaTable := &Table{
+	for _, schema := range schemas {
+		table := &Table{
+			Name:        schema.Name,
+			Columns:     schema.Columns,
+			PrimaryKey:  schema.PrimaryKey,
+			PrimaryKeys: schema.PrimaryKeys,
+			Indexes:     schema.Indexes,
+			CreatedAt:   schema.CreatedAt,
+			UpdatedAt:   schema.UpdatedAt,
+			MaxFileSize: schema.MaxFileSize,
+			Checks:      schema.Checks,
+			ForeignKeys: schema.ForeignKeys,
+			schema:      schema.Schema,
+			pending:     schema.Alterations,
+		}
+		if len(table.PrimaryKeys) == 0 {
+			table.PrimaryKeys = []string{table.PrimaryKey}
+		}
+		restoreChecks(table)
+
+		indexManager, err := newTableIndexManager(table, db.budget)
+		if err != nil {
+			return fmt.Errorf("failed to create indexes for table %s: %w", table.Name, err)
+		}
+		for _, idx := range table.Indexes {
+			if err := indexManager.CreateIndex(idx.Name, idx.Columns); err != nil {
+				return fmt.Errorf("failed to create index %s: %w", idx.Name, err)
+			}
+		}
+
+		err = db.storage.Scan(table.Name, func(record *storage.Record) error {
+			data := decodeRecord(table, record)
+			db.blobs.count(blobHashes(table, data))
+			return indexManager.IndexRecord(data)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to build indexes for table %s: %w", table.Name, err)
+		}
+
+		db.tables[table.Name] = table
+		db.indexes[table.Name] = indexManager
+	}
+
+	if err := validateReferences(db.tables); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	db.cacheReferences()
+	return nil
+}
+
+// newSchemaTable returns the definition of the schema table itself
+func (db *database) newSchemaTable(now time.Time) *Table {
+	return &Table{
 		Name: schemaTableName,
 		Columns: []Column{
 			{Name: "name", Type: String, PrimaryKey: true},
 			{Name: "schema", Type: String},
 		},
+		PrimaryKey:  "name",
+		PrimaryKeys: []string{"name"},
 		MaxFileSize: db.config.MaxFileSize,
 		CreatedAt:   now,
 		UpdatedAt:   now,
 	}
+}
+
+// newTableIndexManager creates the primary key, unique column and foreign
+// key indexes of a table
+func newTableIndexManager(table *Table, budget *memory.Budget) (*IndexManager, error) {
+	indexManager := NewIndexManager(table.keyColumns(), budget)
+	// Create index for primary key
+	if err := indexManager.CreateIndex(primaryIndexName(table), table.keyColumns()); err != nil {
+		return nil, fmt.Errorf("failed to create primary key index: %w", err)
+	}
+
+	// Create indexes for unique columns
+	for _, col := range table.Columns {
+		if table.hasUniqueIndex(col) {
+			if err := indexManager.CreateIndex(uniqueIndexName(table, col.Name), []string{col.Name}); err != nil {
+				return nil, fmt.Errorf("failed to create unique index for column %s: %w", col.Name, err)
+			}
+		}
+	}
+
+	// Create indexes finding the records that reference a key
+	for _, fk := range table.ForeignKeys {
+		if err := indexManager.CreateIndex(fkIndexName(fk), fk.Columns); err != nil {
+			return nil, fmt.Errorf("failed to create index for foreign key %s: %w", fk.Name, err)
+		}
+	}
+
+	return indexManager, nil
+}
+
+// initializeDatabase initializes a new database with schema table
+func (db *database) initializeDatabase() error {
+	// Create schema table
+	now := time.Now()
+	schemaTable := db.newSchemaTable(now)
 	db.tables[schemaTableName] = schemaTable
 
 	// Create schema record for the schema table itself
@@ -154,9 +408,17 @@ func (db *database) initializeDatabase() error {
 
 // Drop implements Database.Drop
 func (db *database) Drop() error {
+	db.stopJobs()
+	db.jobs.Wait()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// Databases on a caller-provided engine are dropped record by record
+	if db.config.Storage != nil {
+		return db.dropRecords()
+	}
+
 	dbPath := filepath.Join(db.config.DataDir, db.name)
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		return ErrDatabaseNotFound
@@ -169,20 +431,82 @@ func (db *database) Drop() error {
 	return nil
 }
 
+// dropRecords deletes every record of every table, schema table last
+func (db *database) dropRecords() error {
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		if name != schemaTableName {
+			names = append(names, name)
+		}
+	}
+	names = append(names, sequenceTableName, schemaTableName)
+
+	for _, name := range names {
+		var ops []storage.Op
+		err := db.storage.Scan(name, func(record *storage.Record) error {
+			ops = append(ops, storage.Op{Type: storage.OpDelete, Table: name, ID: record.ID})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan table %s: %w", name, err)
+		}
+		if err := db.storage.Batch(ops); err != nil {
+			return fmt.Errorf("failed to delete records of table %s: %w", name, err)
+		}
+	}
+
+	db.blobs.counts = make(map[string]int)
+	if err := db.blobs.sweep(); err != nil {
+		return fmt.Errorf("failed to delete blobs: %w", err)
+	}
+
+	db.tables = make(map[string]*Table)
+	db.indexes = make(map[string]*IndexManager)
+	db.sequences = make(map[string]*sequence)
+	return nil
+}
+
 // Close implements Database.Close
 func (db *database) Close() error {
+	// Rewrites resume when the database is opened again
+	db.stopJobs()
+	db.jobs.Wait()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	// Implement cleanup logic here
+	if err := db.releaseSequences(); err != nil {
+		return err
+	}
+
+	// Caller-provided engines are owned by the caller
+	if db.config.Storage != nil {
+		return nil
+	}
+
+	// Flush pending writes and stop background work
+	if err := db.storage.Close(); err != nil {
+		return fmt.Errorf("failed to close storage: %w", err)
+	}
 	return nil
 }
 
 // CreateTable implements Database.CreateTable
 func (db *database) CreateTable(name string, columns []Column) error {
-	db.mu.Lock()
+	return db.CreateTableContext(context.Background(), name, columns)
+}
+
+// CreateTableContext implements Database.CreateTableContext
+func (db *database) CreateTableContext(ctx context.Context, name string, columns []Column) error {
+	if err := db.mu.LockContext(ctx); err != nil {
+		return err
+	}
 	defer db.mu.Unlock()
 
+	// Storage tables the database keeps its own state in
+	if name == schemaTableName || name == sequenceTableName {
+		return fmt.Errorf("%w: table name %s is reserved", ErrInvalidOperation, name)
+	}
 	if _, exists := db.tables[name]; exists {
 		return ErrTableExists
 	}
@@ -190,38 +514,50 @@ func (db *database) CreateTable(name string, columns []Column) error {
 	now := time.Now()
 	table := &Table{
 		Name:        name,
-		Columns:     columns,
+		Columns:     append([]Column(nil), columns...),
 		MaxFileSize: db.config.MaxFileSize,
 		CreatedAt:   now,
 		UpdatedAt:   now,
 	}
 
 	// Validate columns and set primary key
+	autoIncrement := 0
+	for _, col := range columns {
+		if err := validateColumnType(col); err != nil {
+			return err
+		}
+		if err := validateDefault(col); err != nil {
+			return err
+		}
+		if col.AutoIncrement {
+			autoIncrement++
+		}
+	}
+	if autoIncrement > 1 {
+		return fmt.Errorf("%w: a table can have only one auto-increment column", ErrInvalidOperation)
+	}
 	for _, col := range columns {
 		if col.PrimaryKey {
-			table.PrimaryKey = col.Name
-			break
+			table.PrimaryKeys = append(table.PrimaryKeys, col.Name)
 		}
 	}
 
-	if table.PrimaryKey == "" {
+	if len(table.PrimaryKeys) == 0 {
 		return fmt.Errorf("table must have a primary key")
 	}
+	table.PrimaryKey = table.PrimaryKeys[0]
+	if err := validateChecks(table); err != nil {
+		return err
+	}
 
-	// Create index manager for the table
-	indexManager := NewIndexManager()
-	// Create index for primary key
-	if err := indexManager.CreateIndex("pk_"+table.PrimaryKey, []string{table.PrimaryKey}); err != nil {
-		return fmt.Errorf("failed to create primary key index: %w", err)
+	if err := db.ensureSequences(ctx, name, columns); err != nil {
+		return err
 	}
 
-	// Create indexes for unique columns
-	for _, col := range columns {
-		if col.Unique && col.Name != table.PrimaryKey {
-			if err := indexManager.CreateIndex("idx_"+col.Name, []string{col.Name}); err != nil {
-				return fmt.Errorf("failed to create unique index for column %s: %w", col.Name, err)
-			}
-		}
+	// Create index manager for the table
+	indexManager, err := newTableIndexManager(table, db.budget)
+	if err != nil {
+		return err
 	}
 
 	db.indexes[name] = indexManager
@@ -229,8 +565,9 @@ func (db *database) CreateTable(name string, columns []Column) error {
 	// Persist table schema
 	schema := tableSchema{
 		Name:        name,
-		Columns:     columns,
+		Columns:     table.Columns,
 		PrimaryKey:  table.PrimaryKey,
+		PrimaryKeys: table.PrimaryKeys,
 		CreatedAt:   table.CreatedAt,
 		UpdatedAt:   table.UpdatedAt,
 		MaxFileSize: table.MaxFileSize,
@@ -255,6 +592,7 @@ func (db *database) CreateTable(name string, columns []Column) error {
 	}
 
 	db.tables[name] = table
+	db.cacheReferences()
 	return nil
 }
 
@@ -294,43 +632,74 @@ func (db *database) HasTable(name string) bool {
 
 // Insert implements Database.Insert
 func (db *database) Insert(tableName string, data map[string]interface{}) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.InsertContext(context.Background(), tableName, data)
+}
+
+// InsertContext implements Database.InsertContext
+func (db *database) InsertContext(ctx context.Context, tableName string, data map[string]interface{}) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
 
 	table, exists := db.tables[tableName]
 	if !exists {
 		return ErrTableNotFound
 	}
+	_, err := db.insertRow(ctx, table, data)
+	return err
+}
+
+// insertRow validates, locks and inserts data and returns the stored
+// record. Callers hold db.mu shared.
+func (db *database) insertRow(ctx context.Context, table *Table, data map[string]interface{}) (*storage.Record, error) {
+	data, err := db.withDefaults(ctx, table, data)
+	if err != nil {
+		return nil, err
+	}
 
 	// Validate data against schema
 	if err := validateData(table, data); err != nil {
-		return err
+		return nil, err
+	}
+	if err := checkRow(table, data); err != nil {
+		return nil, err
 	}
+	data, stored, err := db.storeLargeBlobs(table, data)
+	if err != nil {
+		return nil, err
+	}
+	defer db.blobs.release(stored)
 
 	// Get primary key value
-	id, ok := data[table.PrimaryKey]
+	id, ok := table.recordID(data)
 	if !ok {
-		return fmt.Errorf("primary key %s is required", table.PrimaryKey)
+		return nil, fmt.Errorf("primary key %s is required", table.keyName())
 	}
 
-	// Check unique constraints
-	indexManager := db.indexes[tableName]
-	for _, col := range table.Columns {
-		if col.Unique {
-			if value, exists := data[col.Name]; exists {
-				var indexName string
-				if col.PrimaryKey {
-					indexName = "pk_" + col.Name
-				} else {
-					indexName = "idx_" + col.Name
-				}
-				if index, err := indexManager.GetIndex(indexName); err == nil {
-					if results, err := index.Find(value); err == nil && len(results) > 0 {
-						return fmt.Errorf("unique constraint violation for column %s", col.Name)
-					}
-				}
-			}
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockRecord(ctx, locker, table, id, data); err != nil {
+		return nil, err
+	}
+
+	return db.insertLocked(ctx, locker, table, id, data)
+}
+
+// insertLocked writes a new record, indexes it and returns it. Callers hold
+// the locks taken by lockRecord.
+func (db *database) insertLocked(ctx context.Context, locker *Locker, table *Table, id interface{}, data map[string]interface{}) (*storage.Record, error) {
+	// Check primary key and unique constraints
+	indexManager := db.indexes[table.Name]
+	if err := checkUnique(table, indexManager, data, nil); err != nil {
+		return nil, err
+	}
+	if db.hasForeignKeys(table) {
+		version, err := db.writeReferenced(ctx, locker, table, []interface{}{id}, []map[string]interface{}{data})
+		if err != nil {
+			return nil, err
 		}
+		return &storage.Record{ID: id, Data: data, Version: version}, nil
 	}
 
 	// Create record
@@ -338,133 +707,255 @@ func (db *database) Insert(tableName string, data map[string]interface{}) error
 		ID:      id,
 		Data:    data,
 		Version: time.Now().UnixNano(),
+		Schema:  table.schema,
 	}
 
 	// Write to storage
-	if err := db.storage.Write(tableName, record); err != nil {
-		return fmt.Errorf("failed to write record: %w", err)
+	err := db.writeBlobs(table, nil, []map[string]interface{}{data}, func() error {
+		return db.storage.Write(table.Name, record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write record: %w", err)
 	}
 
 	// Update indexes
 	if err := indexManager.IndexRecord(data); err != nil {
 		// Rollback storage write on index error
-		_ = db.storage.Delete(tableName, id)
-		return fmt.Errorf("failed to update indexes: %w", err)
+		_ = db.storage.Delete(table.Name, id)
+		db.blobs.release(blobHashes(table, data))
+		return nil, fmt.Errorf("failed to update indexes: %w", err)
 	}
 
-	return nil
+	return record, nil
 }
 
 // Update implements Database.Update
 func (db *database) Update(tableName string, data map[string]interface{}, where map[string]interface{}) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.UpdateContext(context.Background(), tableName, data, where)
+}
+
+// UpdateContext implements Database.UpdateContext
+func (db *database) UpdateContext(ctx context.Context, tableName string, data map[string]interface{}, where map[string]interface{}) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
 
 	table, exists := db.tables[tableName]
 	if !exists {
 		return ErrTableNotFound
 	}
+	_, err := db.updateRows(ctx, table, data, where)
+	return err
+}
+
+// updateRows merges data into the records matching where and returns the
+// updated records. Callers hold db.mu shared.
+func (db *database) updateRows(ctx context.Context, table *Table, data map[string]interface{}, where map[string]interface{}) ([]*storage.Record, error) {
+	id, err := table.whereID(where)
+	if err != nil {
+		return nil, err
+	}
 
 	// Validate update data against schema
 	if err := validateData(table, data); err != nil {
-		return err
+		return nil, err
 	}
+	data, stored, err := db.storeLargeBlobs(table, data)
+	if err != nil {
+		return nil, err
+	}
+	defer db.blobs.release(stored)
 
-	// Get primary key value from where clause
-	id, ok := where[table.PrimaryKey]
-	if !ok {
-		return fmt.Errorf("primary key %s is required in where clause", table.PrimaryKey)
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockRecord(ctx, locker, table, id, data); err != nil {
+		return nil, err
 	}
 
 	// Read existing record
-	record, err := db.storage.Read(tableName, id)
+	record, err := db.storage.Read(table.Name, id)
 	if err != nil {
-		return fmt.Errorf("failed to read record: %w", err)
+		return nil, fmt.Errorf("failed to read record: %w", err)
 	}
 	if record == nil {
-		return fmt.Errorf("record not found")
+		return nil, fmt.Errorf("record not found")
 	}
 
-	// Check unique constraints for updated values
-	indexManager := db.indexes[tableName]
-	for _, col := range table.Columns {
-		if col.Unique {
-			if value, exists := data[col.Name]; exists && value != record.Data[col.Name] {
-				if index, err := indexManager.GetIndex(col.Name); err == nil {
-					if results, err := index.Find(value); err == nil && len(results) > 0 {
-						return fmt.Errorf("unique constraint violation for column %s", col.Name)
-					}
-				}
-			}
+	updated, err := db.updateLocked(ctx, locker, table, record.ID, decodeRecord(table, record), data)
+	if err != nil {
+		return nil, err
+	}
+	return []*storage.Record{updated}, nil
+}
+
+// updateLocked merges changes into the record old, rewrites it together
+// with its index entries and returns the merged record. Callers hold the
+// locks taken by lockRecord.
+func (db *database) updateLocked(ctx context.Context, locker *Locker, table *Table, id interface{}, old, changes map[string]interface{}) (*storage.Record, error) {
+	for _, col := range table.keyColumns() {
+		if value, ok := changes[col]; ok && compareValues(value, old[col]) != 0 {
+			return nil, fmt.Errorf("%w: primary key %s cannot be changed", ErrInvalidOperation, col)
 		}
 	}
 
-	// Remove old index entries
-	if err := indexManager.RemoveRecord(record.Data); err != nil {
-		return fmt.Errorf("failed to remove old index entries: %w", err)
+	// Check unique constraints for updated values
+	indexManager := db.indexes[table.Name]
+	if err := checkUnique(table, indexManager, changes, id); err != nil {
+		return nil, err
 	}
 
-	// Update record data
-	for k, v := range data {
-		record.Data[k] = v
+	updated := make(map[string]interface{}, len(old)+len(changes))
+	for k, v := range old {
+		updated[k] = v
+	}
+	for k, v := range changes {
+		updated[k] = v
+	}
+	if err := checkRow(table, updated); err != nil {
+		return nil, err
+	}
+	if db.hasForeignKeys(table) {
+		version, err := db.writeReferenced(ctx, locker, table, []interface{}{id}, []map[string]interface{}{updated})
+		if err != nil {
+			return nil, err
+		}
+		return &storage.Record{ID: id, Data: updated, Version: version}, nil
 	}
-	record.Version = time.Now().UnixNano()
 
 	// Write updated record
-	if err := db.storage.Write(tableName, record); err != nil {
-		return fmt.Errorf("failed to write record: %w", err)
+	record := &storage.Record{ID: id, Data: updated, Version: time.Now().UnixNano(), Schema: table.schema}
+	err := db.writeBlobs(table, []map[string]interface{}{old}, []map[string]interface{}{updated}, func() error {
+		return db.storage.Write(table.Name, record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write record: %w", err)
 	}
 
-	// Update indexes with new values
-	if err := indexManager.IndexRecord(record.Data); err != nil {
-		return fmt.Errorf("failed to update indexes: %w", err)
+	// Replace old index entries with the new values
+	if err := indexManager.RemoveRecord(old); err != nil {
+		return nil, fmt.Errorf("failed to remove old index entries: %w", err)
 	}
+	if err := indexManager.IndexRecord(updated); err != nil {
+		return nil, fmt.Errorf("failed to update indexes: %w", err)
+	}
+
+	return record, nil
+}
 
+// checkUnique returns a DuplicateKeyError when a primary key or unique
+// column value in data is already held by a record other than self. Pass a
+// nil self for new records.
+func checkUnique(table *Table, indexManager *IndexManager, data map[string]interface{}, self interface{}) error {
+	held := func(indexName string, value interface{}) bool {
+		index, err := indexManager.GetIndex(indexName)
+		if err != nil {
+			return false
+		}
+		holders, _ := index.Find(value)
+		for _, pk := range holders {
+			if self == nil || compareValues(pk, self) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	if id, ok := table.recordID(data); ok && held(primaryIndexName(table), id) {
+		return &DuplicateKeyError{Table: table.Name, Column: table.keyName(), Value: id}
+	}
+	for _, col := range table.Columns {
+		if !table.hasUniqueIndex(col) {
+			continue
+		}
+		value, exists := data[col.Name]
+		if exists && held(uniqueIndexName(table, col.Name), value) {
+			return &DuplicateKeyError{Table: table.Name, Column: col.Name, Value: value}
+		}
+	}
 	return nil
 }
 
 // Delete implements Database.Delete
 func (db *database) Delete(tableName string, where map[string]interface{}) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.DeleteContext(context.Background(), tableName, where)
+}
+
+// DeleteContext implements Database.DeleteContext
+func (db *database) DeleteContext(ctx context.Context, tableName string, where map[string]interface{}) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
 
 	table, exists := db.tables[tableName]
 	if !exists {
 		return ErrTableNotFound
 	}
+	_, err := db.deleteRows(ctx, table, where)
+	return err
+}
 
-	// Get primary key value from where clause
-	id, ok := where[table.PrimaryKey]
-	if !ok {
-		return fmt.Errorf("primary key %s is required in where clause", table.PrimaryKey)
+// deleteRows removes the records matching where and returns them as they
+// were stored. Callers hold db.mu shared.
+func (db *database) deleteRows(ctx context.Context, table *Table, where map[string]interface{}) ([]*storage.Record, error) {
+	id, err := table.whereID(where)
+	if err != nil {
+		return nil, err
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockRecord(ctx, locker, table, id, nil); err != nil {
+		return nil, err
 	}
 
 	// Read existing record to update indexes
-	record, err := db.storage.Read(tableName, id)
+	record, err := db.storage.Read(table.Name, id)
 	if err != nil {
-		return fmt.Errorf("failed to read record: %w", err)
+		return nil, fmt.Errorf("failed to read record: %w", err)
 	}
 	if record == nil {
-		return nil // Record doesn't exist, nothing to delete
+		return nil, nil // Record doesn't exist, nothing to delete
+	}
+	record.Data = decodeRecord(table, record)
+	if db.hasForeignKeys(table) {
+		if _, err := db.writeReferenced(ctx, locker, table, []interface{}{id}, []map[string]interface{}{nil}); err != nil {
+			return nil, err
+		}
+		return []*storage.Record{record}, nil
 	}
 
 	// Remove index entries
-	indexManager := db.indexes[tableName]
+	indexManager := db.indexes[table.Name]
 	if err := indexManager.RemoveRecord(record.Data); err != nil {
-		return fmt.Errorf("failed to remove index entries: %w", err)
+		return nil, fmt.Errorf("failed to remove index entries: %w", err)
 	}
 
 	// Delete from storage
-	if err := db.storage.Delete(tableName, id); err != nil {
-		return fmt.Errorf("failed to delete record: %w", err)
+	err = db.writeBlobs(table, []map[string]interface{}{record.Data}, nil, func() error {
+		return db.storage.Delete(table.Name, id)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete record: %w", err)
 	}
 
-	return nil
+	return []*storage.Record{record}, nil
 }
 
 // Query implements Database.Query
 func (db *database) Query(tableName string, columns []string, where map[string]interface{}, limit, offset int) ([]map[string]interface{}, error) {
-	db.mu.RLock()
+	return db.QueryContext(context.Background(), tableName, columns, where, limit, offset)
+}
+
+// QueryContext implements Database.QueryContext
+func (db *database) QueryContext(ctx context.Context, tableName string, columns []string, where map[string]interface{}, limit, offset int) ([]map[string]interface{}, error) {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer db.mu.RUnlock()
 
 	table, exists := db.tables[tableName]
@@ -477,72 +968,154 @@ func (db *database) Query(tableName string, columns []string, where map[string]i
 		return nil, err
 	}
 
+	// Writers to single records may proceed, index builds may not
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, tableName, LockIntentShared); err != nil {
+		return nil, err
+	}
+
 	indexManager := db.indexes[tableName]
-	var results []map[string]interface{}
 
-	// Try to use index for primary key lookup
-	if id, ok := where[table.PrimaryKey]; ok {
-		if index, err := indexManager.GetIndex(table.PrimaryKey); err == nil {
-			if records, err := index.Find(id); err == nil && len(records) > 0 {
-				for _, record := range records {
-					if data, ok := record.(map[string]interface{}); ok {
-						result := projectColumns(data, columns)
-						results = append(results, result)
-					}
-				}
-				return applyLimitOffset(results, limit, offset), nil
-			}
+	// Results are held against the memory budget until they are returned
+	var results []map[string]interface{}
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+	addResult := func(data map[string]interface{}) error {
+		result := projectColumns(data, columns)
+		if err := reservation.Grow(memory.SizeOf(result)); err != nil {
+			return fmt.Errorf("query on table %s: %w", tableName, err)
 		}
+		results = append(results, result)
+		return nil
 	}
 
-	// Try to use other indexes
-	for column := range where {
-		if indexManager.HasIndex(column) {
-			if index, err := indexManager.GetIndex(column); err == nil {
-				if records, err := index.Find(where[column]); err == nil {
-					for _, record := range records {
-						if data, ok := record.(map[string]interface{}); ok {
-							if matchesWhere(data, where) {
-								result := projectColumns(data, columns)
-								results = append(results, result)
-							}
-						}
-					}
-					return applyLimitOffset(results, limit, offset), nil
-				}
+	err := db.scanRows(ctx, table, indexManager, where, limit, offset, addResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan records: %w", err)
+	}
+
+	return results, nil
+}
+
+// lockRecord takes the locks needed to write one record: an intention lock on
+// the table, then exclusive locks on its primary key and on the values of
+// unique columns in data. Locks are always taken in this order so that
+// writers of single records cannot deadlock each other.
+func lockRecord(ctx context.Context, locker *Locker, table *Table, id interface{}, data map[string]interface{}) error {
+	if err := locker.LockTable(ctx, table.Name, LockIntentExclusive); err != nil {
+		return err
+	}
+	if err := locker.LockKey(ctx, table.Name, id, LockExclusive); err != nil {
+		return err
+	}
+	for _, col := range table.Columns {
+		if !table.hasUniqueIndex(col) {
+			continue
+		}
+		if value, exists := data[col.Name]; exists {
+			if err := locker.LockValue(ctx, table.Name, col.Name, value, LockExclusive); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
 
-	// Fall back to full table scan
-	var currentOffset int
-	var count int
+// withQueryTimeout applies Config.QueryTimeout to contexts without a deadline
+func (db *database) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.config.QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.config.QueryTimeout)
+}
 
-	err := db.storage.Scan(tableName, func(record *storage.Record) error {
-		data := transformDataType(db.tables[tableName].Columns, record.Data)
+// errStopScan ends a scan early without reporting an error
+var errStopScan = errors.New("stop scan")
+
+// scanRows calls fn with every row of table that matches where, skipping
+// the first offset matches and stopping after limit rows (0 = no limit).
+// Rows come from the primary key or an index when where allows it and from
+// a full table scan otherwise. fn may return errStopScan to end early.
+func (db *database) scanRows(ctx context.Context, table *Table, indexManager *IndexManager, where map[string]interface{}, limit, offset int, fn func(map[string]interface{}) error) error {
+	skipped, emitted := 0, 0
+	visit := func(data map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !matchesWhere(data, where) {
+			return nil
+		}
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+		emitted++
+		if limit > 0 && emitted >= limit {
+			return errStopScan
+		}
+		return nil
+	}
 
-		if matchesWhere(data, where) {
-			if currentOffset < offset {
-				currentOffset++
-				return nil
+	var err error
+	if ids, indexed := lookupIDs(table, indexManager, where); indexed {
+		for _, id := range ids {
+			record, readErr := db.storage.Read(table.Name, id)
+			if readErr != nil {
+				return fmt.Errorf("failed to read record: %w", readErr)
 			}
-
-			if limit > 0 && count >= limit {
-				return nil
+			if record == nil {
+				continue
+			}
+			if err = visit(decodeRecord(table, record)); err != nil {
+				break
 			}
-
-			result := projectColumns(data, columns)
-			results = append(results, result)
-			count++
 		}
+	} else {
+		err = db.storage.Scan(table.Name, func(record *storage.Record) error {
+			return visit(decodeRecord(table, record))
+		})
+	}
+
+	if errors.Is(err, errStopScan) {
 		return nil
-	})
+	}
+	return err
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to scan records: %w", err)
+// lookupIDs returns the primary keys of the records that can match where
+// according to the primary key, a prefix of a composite primary key or a
+// single-column index. The second result is false when no key or index
+// applies and the table must be scanned.
+func lookupIDs(table *Table, indexManager *IndexManager, where map[string]interface{}) ([]interface{}, bool) {
+	if ids, ok := keyIDs(table, indexManager, where); ok {
+		return ids, true
 	}
 
-	return results, nil
+	// Prefer columns in a stable order so the same query uses the same index
+	columns := make([]string, 0, len(where))
+	for column := range where {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	for _, column := range columns {
+		value := where[column]
+		if path, ok := documentPath(table, column); ok {
+			column, value = path.String(), jsonValue(value)
+		}
+		if index, ok := indexManager.FindColumnIndex(column); ok {
+			ids, _ := index.Find(value)
+			return ids, true
+		}
+	}
+	return nil, false
 }
 
 // projectColumns creates a new map with only the requested columns
@@ -564,48 +1137,23 @@ func projectColumns(data map[string]interface{}, columns []string) map[string]in
 	return result
 }
 
-// transformDataType transforms the data type of the value
-func transformDataType(columns []Column, data map[string]interface{}) map[string]interface{} {
-	for _, col := range columns {
-		if value, exists := data[col.Name]; exists {
-			data[col.Name] = transformValue(value, col.Type)
-		}
-	}
-	return data
-}
-
-func transformValue(value interface{}, dataType DataType) interface{} {
-	switch dataType {
-	case Int:
-		return int(value.(float64))
-	}
-	return value
-}
-
-// matchesWhere checks if a record matches the where conditions
+// matchesWhere checks if a record matches the where conditions. Keys may
+// be paths into JSON documents.
 func matchesWhere(data map[string]interface{}, where map[string]interface{}) bool {
 	for k, v := range where {
-		if value, exists := data[k]; !exists || value != v {
+		value, exists := data[k]
+		if !exists {
+			if value, exists = lookupValue(data, k); exists {
+				v = jsonValue(v)
+			}
+		}
+		if !exists || !valuesEqual(value, v) {
 			return false
 		}
 	}
 	return true
 }
 
-// applyLimitOffset applies limit and offset to results
-func applyLimitOffset(results []map[string]interface{}, limit, offset int) []map[string]interface{} {
-	if offset >= len(results) {
-		return []map[string]interface{}{}
-	}
-
-	end := len(results)
-	if limit > 0 && offset+limit < end {
-		end = offset + limit
-	}
-
-	return results[offset:end]
-}
-
 // validateData validates data against table schema
 func validateData(table *Table, data map[string]interface{}) error {
 	for _, col := range table.Columns {
@@ -617,7 +1165,7 @@ func validateData(table *Table, data map[string]interface{}) error {
 			continue
 		}
 
-		if err := validateDataType(col.Type, value); err != nil {
+		if err := validateValue(col, value); err != nil {
 			return fmt.Errorf("invalid data type for column %s: %w", col.Name, err)
 		}
 	}
@@ -669,6 +1217,31 @@ func validateDataType(dt DataType, value interface{}) error {
 		case time.Time:
 			return nil
 		}
+	case Blob:
+		switch value.(type) {
+		case []byte, BlobHandle:
+			return nil
+		}
+	case Array:
+		if _, ok := value.([]interface{}); ok {
+			return nil
+		}
+	case Enum:
+		if _, ok := value.(string); ok {
+			return nil
+		}
+	case Decimal:
+		if _, ok := value.(DecimalValue); ok {
+			return nil
+		}
+	case JSON:
+		if value == nil {
+			break
+		}
+		if err := validateJSON(value); err != nil {
+			return fmt.Errorf("invalid type for %v: %w", dt, err)
+		}
+		return nil
 	default:
 		return ErrInvalidDataType
 	}
@@ -677,42 +1250,120 @@ func validateDataType(dt DataType, value interface{}) error {
 
 // DropTable implements Database.DropTable
 func (db *database) DropTable(name string) error {
-	db.mu.Lock()
+	return db.DropTableContext(context.Background(), name)
+}
+
+// DropTableContext implements Database.DropTableContext
+func (db *database) DropTableContext(ctx context.Context, name string) error {
+	if err := db.mu.LockContext(ctx); err != nil {
+		return err
+	}
 	defer db.mu.Unlock()
 
 	if _, exists := db.tables[name]; !exists {
 		return ErrTableNotFound
 	}
+	for _, ref := range db.references(name) {
+		if ref.table.Name != name {
+			return fmt.Errorf("%w: table %s is referenced by foreign key %s of table %s", ErrInvalidOperation, name, ref.fk.Name, ref.table.Name)
+		}
+	}
+
+	// The records go first, so that a failure leaves the table in place
+	if err := db.deleteRecords(ctx, db.tables[name]); err != nil {
+		return err
+	}
 
 	// Delete schema record
 	if err := db.storage.Delete(schemaTableName, name); err != nil {
 		return fmt.Errorf("failed to delete schema: %w", err)
 	}
 
+	// The sequence of an auto-increment column goes with its table
+	err := db.dropSequence(ctx, autoIncrementSequence(name))
+	if err != nil && !errors.Is(err, ErrSequenceNotFound) {
+		return err
+	}
+
+	if indexManager, ok := db.indexes[name]; ok {
+		indexManager.DropAll()
+		delete(db.indexes, name)
+	}
 	delete(db.tables, name)
+	db.cacheReferences()
 	return nil
 }
 
+// deleteRecords deletes every record of table, rewriteBatch records per
+// storage batch, releasing their blobs once they are gone. Callers hold
+// db.mu exclusively.
+func (db *database) deleteRecords(ctx context.Context, table *Table) error {
+	var ops []storage.Op
+	var blobs []string
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		if err := db.storage.Batch(ops); err != nil {
+			return fmt.Errorf("failed to delete records of table %s: %w", table.Name, err)
+		}
+		db.blobs.release(blobs)
+		ops, blobs = ops[:0], nil
+		return nil
+	}
+	err := db.storage.Scan(table.Name, func(record *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ops = append(ops, storage.Op{Type: storage.OpDelete, Table: table.Name, ID: record.ID})
+		blobs = append(blobs, blobHashes(table, decodeRecord(table, record))...)
+		if len(ops) < rewriteBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan table %s: %w", table.Name, err)
+	}
+	return flush()
+}
+
 // CreateIndex implements Database.CreateIndex
 func (db *database) CreateIndex(table string, options CreateIndexOptions) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.CreateIndexContext(context.Background(), table, options)
+}
+
+// CreateIndexContext implements Database.CreateIndexContext
+func (db *database) CreateIndexContext(ctx context.Context, table string, options CreateIndexOptions) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
 
 	t, exists := db.tables[table]
 	if !exists {
 		return ErrTableNotFound
 	}
 
-	// Validate columns
-	columnMap := make(map[string]bool)
-	for _, col := range t.Columns {
-		columnMap[col.Name] = true
+	// Writes to the table wait for the build, other tables are unaffected
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, table, LockExclusive); err != nil {
+		return err
 	}
-	for _, col := range options.Columns {
-		if !columnMap[col] {
-			return fmt.Errorf("column %s not found in table %s", col, table)
+
+	// Validate columns, keeping paths into documents in canonical form
+	if err := validatePaths(t, options.Columns); err != nil {
+		return err
+	}
+	columns := make([]string, len(options.Columns))
+	for i, col := range options.Columns {
+		columns[i] = col
+		if path, ok := documentPath(t, col); ok {
+			columns[i] = path.String()
 		}
 	}
+	options.Columns = columns
 
 	// Check if index already exists
 	for _, idx := range t.Indexes {
@@ -721,10 +1372,18 @@ func (db *database) CreateIndex(table string, options CreateIndexOptions) error
 		}
 	}
 
-	// Create index in memory
+	// Build index data before publishing the index in the schema
 	indexManager := db.indexes[table]
-	if err := indexManager.CreateIndex(options.Name, options.Columns); err != nil {
-		return fmt.Errorf("failed to create index: %w", err)
+	err := indexManager.BuildIndex(options.Name, options.Columns, func(add func(map[string]interface{}) error) error {
+		return db.storage.Scan(table, func(record *storage.Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return add(decodeRecord(t, record))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build index: %w", err)
 	}
 
 	// Add index info to table
@@ -733,34 +1392,37 @@ func (db *database) CreateIndex(table string, options CreateIndexOptions) error
 	// Update table schema
 	if err := db.updateTableSchema(t); err != nil {
 		// Rollback index creation
+		t.Indexes = t.Indexes[:len(t.Indexes)-1]
 		indexManager.DropIndex(options.Name)
 		return fmt.Errorf("failed to update table schema: %w", err)
 	}
 
-	// Build index data
-	err := db.storage.Scan(table, func(record *storage.Record) error {
-		data := transformDataType(db.tables[table].Columns, record.Data)
-		return indexManager.IndexRecord(data)
-	})
-	if err != nil {
-		// Rollback index creation
-		indexManager.DropIndex(options.Name)
-		return fmt.Errorf("failed to build index: %w", err)
-	}
-
 	return nil
 }
 
 // DropIndex implements Database.DropIndex
 func (db *database) DropIndex(table, indexName string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.DropIndexContext(context.Background(), table, indexName)
+}
+
+// DropIndexContext implements Database.DropIndexContext
+func (db *database) DropIndexContext(ctx context.Context, table, indexName string) error {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
 
 	t, exists := db.tables[table]
 	if !exists {
 		return ErrTableNotFound
 	}
 
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, table, LockExclusive); err != nil {
+		return err
+	}
+
 	// Find and remove index info
 	found := false
 	for i, idx := range t.Indexes {
@@ -798,6 +1460,12 @@ func (db *database) ListIndexes(table string) ([]IndexInfo, error) {
 		return nil, ErrTableNotFound
 	}
 
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(context.Background(), table, LockShared); err != nil {
+		return nil, err
+	}
+
 	indexes := make([]IndexInfo, len(t.Indexes))
 	copy(indexes, t.Indexes)
 	return indexes, nil
@@ -818,9 +1486,15 @@ func (db *database) updateTableSchema(table *Table) error {
 		Name:        table.Name,
 		Columns:     table.Columns,
 		PrimaryKey:  table.PrimaryKey,
+		PrimaryKeys: table.PrimaryKeys,
+		Indexes:     table.Indexes,
 		CreatedAt:   table.CreatedAt,
 		UpdatedAt:   time.Now(),
 		MaxFileSize: table.MaxFileSize,
+		Checks:      table.Checks,
+		ForeignKeys: table.ForeignKeys,
+		Alterations: table.pending,
+		Schema:      table.schema,
 	}
 
 	schemaData, err := json.Marshal(schema)
@@ -844,14 +1518,33 @@ func (db *database) updateTableSchema(table *Table) error {
 	return nil
 }
 
+// MemoryStats implements Database.MemoryStats
+func (db *database) MemoryStats() MemoryStats {
+	return db.budget.Stats()
+}
+
+// CacheStats implements Database.CacheStats
+func (db *database) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.Stats()
+}
+
 // Additional method implementations will be added for other Database interface methods
 
 // tableSchema represents the persisted table schema
 type tableSchema struct {
-	Name        string    `json:"name"`
-	Columns     []Column  `json:"columns"`
-	PrimaryKey  string    `json:"primary_key"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	MaxFileSize int64     `json:"max_file_size"`
+	Name        string       `json:"name"`
+	Columns     []Column     `json:"columns"`
+	PrimaryKey  string       `json:"primary_key"`
+	PrimaryKeys []string     `json:"primary_keys,omitempty"`
+	Indexes     []IndexInfo  `json:"indexes"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	MaxFileSize int64        `json:"max_file_size"`
+	Checks      []Check      `json:"checks,omitempty"`
+	ForeignKeys []ForeignKey `json:"foreign_keys,omitempty"`
+	Alterations []alteration `json:"alterations,omitempty"`
+	Schema      int64        `json:"schema,omitempty"`
 }
@@ -1,23 +1,45 @@
 package db
 
 import (
-	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
 )
 
-func TestDatabase(t *testing.T) {
-	// Setup test database
-	config := Config{
-		DataDir:          "./testdata",
+// newTestConfig returns a configuration backed by a fresh in-memory engine
+func newTestConfig() Config {
+	return Config{
 		MaxFileSize:      1024 * 1024, // 1MB
 		CacheSize:        100,
 		CompressionLevel: 0,
+		Storage:          storage.NewMemoryStorage(),
 	}
+}
 
-	// Clean up test directory after tests
-	defer os.RemoveAll(config.DataDir)
+// newTestDB returns a database with a users table of n rows, aged 0 to 9
+func newTestDB(t *testing.T, n int) Database {
+	db, err := New("test_db", newTestConfig())
+	assert.NoError(t, err)
+
+	err = db.CreateTable("users", []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "name", Type: String},
+		{Name: "age", Type: Int},
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		err := db.Insert("users", map[string]interface{}{"id": i, "name": "user", "age": i % 10})
+		assert.NoError(t, err)
+	}
+	return db
+}
+
+func TestDatabase(t *testing.T) {
+	// Setup test database
+	config := newTestConfig()
 
 	t.Run("Database Creation", func(t *testing.T) {
 		db, err := New("test_db", config)
@@ -93,6 +115,12 @@ func TestDatabase(t *testing.T) {
 		assert.Equal(t, 1, len(results))
 		assert.Equal(t, 31, results[0]["age"])
 
+		// The query above cached the record, so the update reads it from memory
+		before := db.CacheStats()
+		err = db.Update("users", updateData, map[string]interface{}{"id": 1})
+		assert.NoError(t, err)
+		assert.Equal(t, before.Hits+1, db.CacheStats().Hits)
+
 		// Delete data
 		err = db.Delete("users", map[string]interface{}{"id": 1})
 		assert.NoError(t, err)
@@ -104,3 +132,58 @@ func TestDatabase(t *testing.T) {
 		assert.Equal(t, 0, len(results))
 	})
 }
+
+func TestMemoryLimit(t *testing.T) {
+	config := newTestConfig()
+	config.CacheSize = 0
+	config.MemoryLimit = 20 * 1024
+
+	db, err := New("test_db", config)
+	assert.NoError(t, err)
+
+	err = db.CreateTable("docs", []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "body", Type: String},
+	})
+	assert.NoError(t, err)
+
+	body := strings.Repeat("x", 200)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Insert("docs", map[string]interface{}{"id": i, "body": body}))
+	}
+	baseline := db.MemoryStats().Used
+	assert.Greater(t, baseline, int64(0))
+
+	t.Run("Query", func(t *testing.T) {
+		_, err := db.Query("docs", nil, nil, 0, 0)
+		assert.ErrorIs(t, err, ErrMemoryLimit)
+		assert.Equal(t, baseline, db.MemoryStats().Used)
+
+		// A bounded query fits
+		results, err := db.Query("docs", nil, nil, 10, 0)
+		assert.NoError(t, err)
+		assert.Len(t, results, 10)
+	})
+
+	t.Run("Index Build", func(t *testing.T) {
+		err := db.CreateIndex("docs", CreateIndexOptions{Name: "idx_body", Columns: []string{"body"}})
+		assert.ErrorIs(t, err, ErrMemoryLimit)
+		assert.Equal(t, baseline, db.MemoryStats().Used)
+
+		indexes, err := db.ListIndexes("docs")
+		assert.NoError(t, err)
+		assert.Empty(t, indexes)
+	})
+
+	t.Run("Generated Defaults", func(t *testing.T) {
+		// The defaults generated for every record are reserved while the
+		// records are rewritten
+		err := db.AlterTable("docs", AddColumn(Column{Name: "token", Type: String, Default: DefaultUUIDv4}))
+		assert.ErrorIs(t, err, ErrMemoryLimit)
+		assert.Equal(t, baseline, db.MemoryStats().Used)
+
+		table, err := db.GetTable("docs")
+		assert.NoError(t, err)
+		assert.Len(t, table.Columns, 2)
+	})
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxDecimalPrecision is the most digits a decimal holds, as many as fit
+// in an int64
+const maxDecimalPrecision = 18
+
+// DecimalValue is an exact decimal number, the value of Decimal columns. It
+// is an integer coefficient scaled by a power of ten, kept without trailing
+// zeros so that equal numbers are equal values. The zero value is 0.
+type DecimalValue struct {
+	coef  int64
+	scale int
+}
+
+// NewDecimal returns coef × 10^-scale. Scale must not be negative.
+func NewDecimal(coef int64, scale int) DecimalValue {
+	for scale > 0 && coef%10 == 0 {
+		coef /= 10
+		scale--
+	}
+	if coef == 0 {
+		scale = 0
+	}
+	return DecimalValue{coef: coef, scale: scale}
+}
+
+// ParseDecimal parses a decimal written as digits with an optional sign
+// and decimal point, such as -12.50
+func ParseDecimal(s string) (DecimalValue, error) {
+	invalid := func(reason string) (DecimalValue, error) {
+		return DecimalValue{}, fmt.Errorf("%w: decimal %q %s", ErrInvalidDataType, s, reason)
+	}
+
+	text, negative := s, false
+	if text != "" && (text[0] == '-' || text[0] == '+') {
+		text, negative = text[1:], text[0] == '-'
+	}
+	whole, frac, _ := strings.Cut(text, ".")
+	if whole == "" && frac == "" {
+		return invalid("has no digits")
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return invalid("is malformed")
+		}
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	digits := strings.TrimLeft(whole+frac, "0")
+	if len(digits) > maxDecimalPrecision {
+		return invalid(fmt.Sprintf("has more than %d digits", maxDecimalPrecision))
+	}
+	var coef int64
+	if digits != "" {
+		coef, _ = strconv.ParseInt(digits, 10, 64)
+	}
+	if negative {
+		coef = -coef
+	}
+	return NewDecimal(coef, len(frac)), nil
+}
+
+// String formats the decimal with the digits after the point it needs
+func (d DecimalValue) String() string {
+	return d.format(d.scale)
+}
+
+// StringFixed formats the decimal with scale digits after the point,
+// rounding half away from zero
+func (d DecimalValue) StringFixed(scale int) string {
+	return d.Round(scale).format(scale)
+}
+
+// format formats the decimal with scale digits after the point, which
+// must be at least d.scale
+func (d DecimalValue) format(scale int) string {
+	// The conversion keeps the magnitude of math.MinInt64
+	magnitude := uint64(d.coef)
+	if d.coef < 0 {
+		magnitude = uint64(-d.coef)
+	}
+	digits := strconv.FormatUint(magnitude, 10) + strings.Repeat("0", scale-d.scale)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+
+	var b strings.Builder
+	if d.coef < 0 {
+		b.WriteByte('-')
+	}
+	b.WriteString(digits[:len(digits)-scale])
+	if scale > 0 {
+		b.WriteByte('.')
+		b.WriteString(digits[len(digits)-scale:])
+	}
+	return b.String()
+}
+
+// Round returns the decimal rounded half away from zero to scale digits
+// after the point
+func (d DecimalValue) Round(scale int) DecimalValue {
+	if scale < 0 {
+		scale = 0
+	}
+	if d.scale <= scale {
+		return d
+	}
+	drop := pow10(d.scale - scale)
+	coef, rest := new(big.Int).QuoRem(big.NewInt(d.coef), drop, new(big.Int))
+	if rest.Abs(rest).Lsh(rest, 1).Cmp(drop) >= 0 {
+		coef.Add(coef, big.NewInt(int64(d.Sign())))
+	}
+	return NewDecimal(coef.Int64(), scale)
+}
+
+// Sign returns -1, 0 or +1 for negative, zero and positive decimals
+func (d DecimalValue) Sign() int {
+	switch {
+	case d.coef < 0:
+		return -1
+	case d.coef > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp compares two decimals, returning -1, 0 or +1
+func (d DecimalValue) Cmp(other DecimalValue) int {
+	a := new(big.Int).Mul(big.NewInt(d.coef), pow10(other.scale))
+	b := new(big.Int).Mul(big.NewInt(other.coef), pow10(d.scale))
+	return a.Cmp(b)
+}
+
+// Compare implements query.Comparable. Decimals compare with decimals and
+// with numbers of any Go type.
+func (d DecimalValue) Compare(other interface{}) (int, bool) {
+	o, ok := decimalOf(other)
+	if !ok {
+		return 0, false
+	}
+	return d.Cmp(o), true
+}
+
+// Float64 returns the nearest float64 to the decimal
+func (d DecimalValue) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// fits reports whether the decimal has at most scale digits after the
+// point and precision digits in all
+func (d DecimalValue) fits(precision, scale int) bool {
+	magnitude := strings.TrimPrefix(strconv.FormatInt(d.coef, 10), "-")
+	whole := len(magnitude) - d.scale
+	if d.coef == 0 {
+		whole = 0
+	}
+	return d.scale <= scale && whole <= precision-scale
+}
+
+// MarshalJSON implements json.Marshaler. Decimals are stored as strings so
+// that no JSON reader rounds them.
+func (d DecimalValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, reading strings and numbers.
+// Like the standard types, it leaves the decimal unchanged for null.
+func (d *DecimalValue) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return fmt.Errorf("%w: decimal %s: %v", ErrInvalidDataType, data, err)
+		}
+	}
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// decimalOf converts decimals and numbers of any Go type to a decimal
+func decimalOf(v interface{}) (DecimalValue, bool) {
+	switch n := v.(type) {
+	case DecimalValue:
+		return n, true
+	case float32:
+		d, err := ParseDecimal(strconv.FormatFloat(float64(n), 'f', -1, 32))
+		return d, err == nil
+	case float64:
+		d, err := ParseDecimal(strconv.FormatFloat(n, 'f', -1, 64))
+		return d, err == nil
+	}
+	if i, ok := toInt64(v); ok {
+		return NewDecimal(i, 0), true
+	}
+	return DecimalValue{}, false
+}
+
+// pow10 returns 10^n
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
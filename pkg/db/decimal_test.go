@@ -0,0 +1,80 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecimal(t *testing.T) {
+	t.Run("Parse And Format", func(t *testing.T) {
+		for input, want := range map[string]string{
+			"12.50":   "12.5",
+			"-0.05":   "-0.05",
+			"+7":      "7",
+			".5":      "0.5",
+			"100":     "100",
+			"0.000":   "0",
+			"-0":      "0",
+			"0012.30": "12.3",
+		} {
+			d, err := ParseDecimal(input)
+			if assert.NoError(t, err, input) {
+				assert.Equal(t, want, d.String(), input)
+			}
+		}
+		for _, input := range []string{"", "-", ".", "1.2.3", "1e5", "abc", "1234567890123456789"} {
+			_, err := ParseDecimal(input)
+			assert.ErrorIs(t, err, ErrInvalidDataType, input)
+		}
+
+		// Equal numbers are equal values whatever their trailing zeros
+		assert.Equal(t, NewDecimal(1250, 2), NewDecimal(125, 1))
+		assert.Equal(t, "12.50", NewDecimal(125, 1).StringFixed(2))
+		assert.Equal(t, "-1.01", NewDecimal(-10051, 4).StringFixed(2))
+		assert.Equal(t, "-1.00", NewDecimal(-10049, 4).StringFixed(2))
+		assert.Equal(t, "3", NewDecimal(25, 1).Round(0).String())
+	})
+
+	t.Run("Compare", func(t *testing.T) {
+		a, b := NewDecimal(1, 1), NewDecimal(2, 1)
+		assert.Equal(t, -1, a.Cmp(b))
+		assert.Equal(t, 0, a.Cmp(NewDecimal(10, 2)))
+		assert.Equal(t, 1, NewDecimal(-1, 18).Cmp(NewDecimal(-1, 0)))
+
+		// Sums of floats are not exact, decimals are
+		tenth := 0.1
+		c, ok := NewDecimal(3, 1).Compare(tenth + 0.2)
+		assert.True(t, ok)
+		assert.Equal(t, -1, c)
+		c, ok = NewDecimal(3, 0).Compare(3)
+		assert.True(t, ok)
+		assert.Equal(t, 0, c)
+		_, ok = a.Compare("0.1")
+		assert.False(t, ok)
+
+		assert.Equal(t, -1, compareValues(a, 1))
+		assert.Equal(t, 1, compareValues(2, b))
+		assert.Equal(t, -1, compareValues(b, "0"))
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		data, err := json.Marshal(map[string]interface{}{"price": NewDecimal(1999, 2)})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"price": "19.99"}`, string(data))
+
+		var d DecimalValue
+		assert.NoError(t, json.Unmarshal([]byte(`"19.99"`), &d))
+		assert.Equal(t, NewDecimal(1999, 2), d)
+		assert.NoError(t, json.Unmarshal([]byte(`0.1`), &d))
+		assert.Equal(t, NewDecimal(1, 1), d)
+		assert.NoError(t, json.Unmarshal([]byte(`null`), &d))
+		assert.Equal(t, NewDecimal(1, 1), d)
+		for _, input := range []string{`"1.5`, `1.5"`, `"1.5""`, `"\u0031"x`, `true`} {
+			assert.Error(t, d.UnmarshalJSON([]byte(input)), input)
+		}
+		assert.NoError(t, json.Unmarshal([]byte(`"\u0031.5"`), &d))
+		assert.Equal(t, NewDecimal(15, 1), d)
+	})
+}
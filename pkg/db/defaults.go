@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultFunc is a Column.Default computed each time a record is inserted
+type DefaultFunc string
+
+const (
+	DefaultNow    DefaultFunc = "now()"     // the insert time, for DateTime columns
+	DefaultUUIDv4 DefaultFunc = "uuid_v4()" // a random UUID, for String columns
+	DefaultUUIDv7 DefaultFunc = "uuid_v7()" // a time-ordered UUID, for String columns
+)
+
+// sequencePrefix starts the DefaultFunc of sequence defaults
+const sequencePrefix = "nextval:"
+
+// DefaultSequence returns a default that takes the next value of the named
+// sequence, for Int columns
+func DefaultSequence(name string) DefaultFunc {
+	return DefaultFunc(sequencePrefix + name)
+}
+
+// sequence returns the sequence a default draws from, if any
+func (f DefaultFunc) sequence() (string, bool) {
+	return strings.CutPrefix(string(f), sequencePrefix)
+}
+
+// volatile reports whether every evaluation yields a different value, so
+// that existing records cannot share one
+func (f DefaultFunc) volatile() bool {
+	return f != DefaultNow
+}
+
+// columnJSON is the stored form of a Column. Generated defaults are kept
+// apart from literal ones so they survive the round trip.
+type columnJSON struct {
+	Name          string
+	Type          DataType
+	PrimaryKey    bool
+	NotNull       bool
+	Unique        bool
+	Default       interface{}
+	DefaultFunc   DefaultFunc `json:",omitempty"`
+	AutoIncrement bool        `json:",omitempty"`
+	Checks        []Check     `json:",omitempty"`
+	Elem          DataType    `json:",omitempty"`
+	Values        []string    `json:",omitempty"`
+	Precision     int         `json:",omitempty"`
+	Scale         int         `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (c Column) MarshalJSON() ([]byte, error) {
+	stored := columnJSON{
+		Name:          c.Name,
+		Type:          c.Type,
+		PrimaryKey:    c.PrimaryKey,
+		NotNull:       c.NotNull,
+		Unique:        c.Unique,
+		Default:       c.Default,
+		AutoIncrement: c.AutoIncrement,
+		Checks:        c.Checks,
+		Elem:          c.Elem,
+		Values:        c.Values,
+		Precision:     c.Precision,
+		Scale:         c.Scale,
+	}
+	if f, ok := c.Default.(DefaultFunc); ok {
+		stored.Default = nil
+		stored.DefaultFunc = f
+	}
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Literal defaults are restored
+// to the Go type of the column.
+func (c *Column) UnmarshalJSON(data []byte) error {
+	var stored columnJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*c = Column{
+		Name:          stored.Name,
+		Type:          stored.Type,
+		PrimaryKey:    stored.PrimaryKey,
+		NotNull:       stored.NotNull,
+		Unique:        stored.Unique,
+		AutoIncrement: stored.AutoIncrement,
+		Checks:        stored.Checks,
+		Elem:          stored.Elem,
+		Values:        stored.Values,
+		Precision:     stored.Precision,
+		Scale:         stored.Scale,
+	}
+	c.Default = decodeColumn(stored.Default, *c)
+	if stored.DefaultFunc != "" {
+		c.Default = stored.DefaultFunc
+	}
+	return nil
+}
+
+// validateDefault checks that the default of col suits its type
+func validateDefault(col Column) error {
+	if col.AutoIncrement {
+		if col.Type != Int {
+			return fmt.Errorf("%w: auto-increment column %s must be an int", ErrInvalidDataType, col.Name)
+		}
+		if col.Default != nil {
+			return fmt.Errorf("%w: auto-increment column %s cannot have a default", ErrInvalidOperation, col.Name)
+		}
+		return nil
+	}
+
+	f, ok := col.Default.(DefaultFunc)
+	if !ok {
+		if col.Default == nil {
+			return nil
+		}
+		if err := validateValue(col, col.Default); err != nil {
+			return fmt.Errorf("invalid default for column %s: %w", col.Name, err)
+		}
+		// Records filled in by AlterTable would not count as references
+		if _, ok := col.Default.(BlobHandle); ok {
+			return fmt.Errorf("%w: default for column %s must be stored inline", ErrInvalidOperation, col.Name)
+		}
+		return nil
+	}
+
+	want := String
+	switch {
+	case f == DefaultNow:
+		want = DateTime
+	case f == DefaultUUIDv4 || f == DefaultUUIDv7:
+	default:
+		name, ok := f.sequence()
+		if !ok || name == "" {
+			return fmt.Errorf("%w: unknown default %s for column %s", ErrInvalidOperation, f, col.Name)
+		}
+		want = Int
+	}
+	if col.Type != want {
+		return fmt.Errorf("%w: default %s does not suit the type of column %s", ErrInvalidDataType, f, col.Name)
+	}
+	return nil
+}
+
+// withDefaults returns a copy of data with the defaults of its missing
+// columns filled in. Columns given explicitly, even as nil, are kept.
+func (db *database) withDefaults(ctx context.Context, table *Table, data map[string]interface{}) (map[string]interface{}, error) {
+	var filled map[string]interface{}
+	for _, col := range table.Columns {
+		if col.AutoIncrement {
+			col.Default = DefaultSequence(autoIncrementSequence(table.Name))
+		}
+		if col.Default == nil {
+			continue
+		}
+		if _, exists := data[col.Name]; exists {
+			continue
+		}
+		value, err := db.defaultValue(ctx, col)
+		if err != nil {
+			return nil, err
+		}
+		if filled == nil {
+			filled = copyRow(data, nil)
+		}
+		filled[col.Name] = value
+	}
+	if filled == nil {
+		return data, nil
+	}
+	return filled, nil
+}
+
+// defaultValue evaluates the default of col
+func (db *database) defaultValue(ctx context.Context, col Column) (interface{}, error) {
+	f, ok := col.Default.(DefaultFunc)
+	if !ok {
+		return col.Default, nil
+	}
+	switch f {
+	case DefaultNow:
+		return time.Now(), nil
+	case DefaultUUIDv4:
+		return newUUIDv4()
+	case DefaultUUIDv7:
+		return newUUIDv7()
+	}
+	name, _ := f.sequence()
+	value, err := db.NextVal(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("default for column %s: %w", col.Name, err)
+	}
+	return int(value), nil
+}
+
+// newUUIDv4 returns a random UUID as defined by RFC 9562
+func newUUIDv4() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", fmt.Errorf("failed to generate uuid: %w", err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u), nil
+}
+
+// newUUIDv7 returns a UUID that starts with the current Unix time in
+// milliseconds, so that later UUIDs sort after earlier ones
+func newUUIDv7() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		return "", fmt.Errorf("failed to generate uuid: %w", err)
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ms[2:])
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u), nil
+}
+
+// formatUUID returns the canonical hyphenated form of u
+func formatUUID(u [16]byte) string {
+	s := hex.EncodeToString(u[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
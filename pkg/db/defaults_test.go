@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([47])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestDefaults(t *testing.T) {
+	ctx := context.Background()
+	columns := []Column{
+		{Name: "id", Type: String, PrimaryKey: true, Default: DefaultUUIDv7},
+		{Name: "token", Type: String, Default: DefaultUUIDv4},
+		{Name: "number", Type: Int, Default: DefaultSequence("orders")},
+		{Name: "status", Type: String, NotNull: true, Default: "new"},
+		{Name: "quantity", Type: Int, Default: 1},
+		{Name: "created_at", Type: DateTime, Default: DefaultNow},
+		{Name: "note", Type: String},
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("orders", columns))
+
+		before := time.Now()
+		returned, err := db.InsertReturning(ctx, "orders", map[string]interface{}{"note": "first"}, nil)
+		assert.NoError(t, err)
+		row := returned.Row
+		assert.Equal(t, []string{"7"}, uuidPattern.FindStringSubmatch(row["id"].(string))[1:])
+		assert.Equal(t, []string{"4"}, uuidPattern.FindStringSubmatch(row["token"].(string))[1:])
+		assert.Equal(t, 1, row["number"])
+		assert.Equal(t, "new", row["status"])
+		assert.Equal(t, 1, row["quantity"])
+		assert.False(t, row["created_at"].(time.Time).Before(before))
+
+		// Given values win over defaults
+		returned, err = db.InsertReturning(ctx, "orders", map[string]interface{}{"id": "custom", "quantity": 5, "status": ""}, nil)
+		assert.NoError(t, err)
+		row = returned.Row
+		assert.Equal(t, "custom", row["id"])
+		assert.Equal(t, 5, row["quantity"])
+		assert.Equal(t, 2, row["number"])
+		assert.Equal(t, "", row["status"])
+
+		_, err = db.InsertMany("orders", []map[string]interface{}{{}, {}}, BatchAtomic)
+		assert.NoError(t, err)
+		action, err := db.Upsert("orders", map[string]interface{}{"id": "custom", "status": "paid"}, nil, []string{"status"})
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertUpdated, action)
+
+		rows, err := db.Query("orders", []string{"number"}, map[string]interface{}{"status": "new"}, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{{"number": 1}, {"number": 3}, {"number": 4}}, rows)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("orders", columns))
+		assert.NoError(t, db.Insert("orders", map[string]interface{}{}))
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		table, err := db.GetTable("orders")
+		assert.NoError(t, err)
+		assert.Equal(t, columns, table.Columns)
+
+		row, err := db.InsertReturning(ctx, "orders", map[string]interface{}{}, []string{"number", "quantity"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"number": 2, "quantity": 1}, row.Row)
+	})
+
+	t.Run("Validated In Create Table", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		for _, col := range []Column{
+			{Name: "n", Type: Int, Default: "one"},
+			{Name: "n", Type: Int, Default: DefaultUUIDv4},
+			{Name: "n", Type: String, Default: DefaultNow},
+			{Name: "n", Type: String, Default: DefaultSequence("s")},
+			{Name: "n", Type: Int, Default: DefaultFunc("random()")},
+		} {
+			err := db.CreateTable("t", []Column{{Name: "id", Type: Int, PrimaryKey: true}, col})
+			assert.Error(t, err, col.Default)
+			assert.False(t, db.HasTable("t"))
+		}
+	})
+
+	t.Run("Alter Add Column", func(t *testing.T) {
+		// More records than one rewrite batch holds
+		n := rewriteBatch + 5
+		db := newTestDB(t, n)
+
+		err := db.AlterTable("users",
+			AddColumn(Column{Name: "ref", Type: String, Unique: true, Default: DefaultUUIDv4}),
+			AddColumn(Column{Name: "seq", Type: Int, Default: DefaultSequence("users_seq")}),
+			AddColumn(Column{Name: "added_at", Type: DateTime, Default: DefaultNow}),
+		)
+		assert.NoError(t, err)
+
+		rows, err := db.Query("users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		refs := make(map[interface{}]bool)
+		seqs := make(map[interface{}]bool)
+		for _, row := range rows {
+			refs[row["ref"]] = true
+			seqs[row["seq"]] = true
+			assert.Equal(t, rows[0]["added_at"], row["added_at"])
+		}
+		assert.Len(t, refs, n)
+		assert.Len(t, seqs, n)
+
+		// Generated values are stored, so reads return the same ones
+		again, err := db.Query("users", []string{"ref"}, map[string]interface{}{"id": 2}, 0, 0)
+		assert.NoError(t, err)
+		for _, row := range rows {
+			if row["id"] == 2 {
+				assert.Equal(t, row["ref"], again[0]["ref"])
+			}
+		}
+
+		err = db.AlterTable("users", AddColumn(Column{Name: "bad", Type: Int, Default: DefaultNow}))
+		assert.ErrorIs(t, err, ErrInvalidDataType)
+	})
+}
@@ -0,0 +1,474 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrForeignKeyViolation is matched by errors returned when a write would
+// leave a foreign key pointing at a missing record
+var ErrForeignKeyViolation = errors.New("foreign key violation")
+
+// RefAction is what happens to referencing records when the record they
+// reference is deleted or its referenced columns change
+type RefAction string
+
+const (
+	Restrict RefAction = "RESTRICT" // reject the write; also the zero value
+	Cascade  RefAction = "CASCADE"  // delete or update the referencing records
+	SetNull  RefAction = "SET NULL" // remove the foreign key values
+)
+
+// ForeignKey links Columns of a table to RefColumns of RefTable, which must
+// be its primary key or a unique column. Records whose foreign key values
+// are missing reference nothing. Each foreign key is backed by an index on
+// Columns.
+type ForeignKey struct {
+	Name       string    `json:"name"` // unique within the table; generated when empty
+	Columns    []string  `json:"columns"`
+	RefTable   string    `json:"ref_table"`
+	RefColumns []string  `json:"ref_columns"` // the primary key of RefTable when empty
+	OnDelete   RefAction `json:"on_delete,omitempty"`
+	OnUpdate   RefAction `json:"on_update,omitempty"`
+}
+
+// ForeignKeyError reports a write that breaks a foreign key. It matches
+// ErrForeignKeyViolation.
+type ForeignKeyError struct {
+	Table      string // table holding the foreign key
+	ForeignKey string
+	RefTable   string
+	Value      interface{} // referenced key
+	// Referenced is set when the write deletes or changes a record that is
+	// still referenced, and clear when the referenced record is missing
+	Referenced bool
+}
+
+func (e *ForeignKeyError) Error() string {
+	if e.Referenced {
+		return fmt.Sprintf("%s %s of table %s: record %v of table %s is still referenced", ErrForeignKeyViolation, e.ForeignKey, e.Table, e.Value, e.RefTable)
+	}
+	return fmt.Sprintf("%s %s of table %s: no record %v in table %s", ErrForeignKeyViolation, e.ForeignKey, e.Table, e.Value, e.RefTable)
+}
+
+// Is reports whether target is ErrForeignKeyViolation
+func (e *ForeignKeyError) Is(target error) bool {
+	return target == ErrForeignKeyViolation
+}
+
+// fkIndexName returns the name of the index backing a foreign key
+func fkIndexName(fk ForeignKey) string {
+	return "fk_" + fk.Name
+}
+
+// reference is a foreign key together with the table holding it
+type reference struct {
+	table *Table
+	fk    ForeignKey
+}
+
+// references returns the foreign keys that reference table, in a stable
+// order. Callers hold db.mu.
+func (db *database) references(table string) []reference {
+	return db.refs[table]
+}
+
+// cacheReferences rebuilds the foreign keys referencing each table. It runs
+// whenever the catalog changes, with db.mu held exclusively.
+func (db *database) cacheReferences() {
+	refs := make(map[string][]reference)
+	for _, t := range db.tables {
+		for _, fk := range t.ForeignKeys {
+			refs[fk.RefTable] = append(refs[fk.RefTable], reference{table: t, fk: fk})
+		}
+	}
+	for _, list := range refs {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].table.Name != list[j].table.Name {
+				return list[i].table.Name < list[j].table.Name
+			}
+			return list[i].fk.Name < list[j].fk.Name
+		})
+	}
+	db.refs = refs
+}
+
+// hasForeignKeys reports whether table holds or is referenced by a foreign
+// key, so that writes to it go through writeReferenced
+func (db *database) hasForeignKeys(table *Table) bool {
+	return len(table.ForeignKeys) > 0 || len(db.references(table.Name)) > 0
+}
+
+// resolveForeignKeys fills the RefColumns left empty in the foreign keys of
+// table with the primary key of the referenced table
+func resolveForeignKeys(tables map[string]*Table, table *Table) {
+	resolved := make([]ForeignKey, len(table.ForeignKeys))
+	for i, fk := range table.ForeignKeys {
+		if ref, ok := tables[fk.RefTable]; ok && len(fk.RefColumns) == 0 {
+			fk.RefColumns = append([]string(nil), ref.keyColumns()...)
+		}
+		resolved[i] = fk
+	}
+	table.ForeignKeys = resolved
+}
+
+// validateReferences checks every foreign key of tables against the tables
+// it links
+func validateReferences(tables map[string]*Table) error {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := tables[name]
+		seen := make(map[string]bool)
+		for _, fk := range table.ForeignKeys {
+			if seen[fk.Name] {
+				return fmt.Errorf("%w: foreign key %s already exists in table %s", ErrInvalidOperation, fk.Name, table.Name)
+			}
+			seen[fk.Name] = true
+			if err := validateForeignKey(tables, table, fk); err != nil {
+				return fmt.Errorf("foreign key %s of table %s: %w", fk.Name, table.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateForeignKey checks that fk of table links columns of matching
+// types to the primary key or a unique column of an existing table
+func validateForeignKey(tables map[string]*Table, table *Table, fk ForeignKey) error {
+	if fk.Name == "" || len(fk.Columns) == 0 {
+		return fmt.Errorf("%w: name and columns are required", ErrInvalidOperation)
+	}
+	ref, ok := tables[fk.RefTable]
+	if !ok || fk.RefTable == schemaTableName {
+		return fmt.Errorf("%w: referenced table %s not found", ErrInvalidOperation, fk.RefTable)
+	}
+	if len(fk.RefColumns) != len(fk.Columns) {
+		return fmt.Errorf("%w: %d columns reference %d columns", ErrInvalidOperation, len(fk.Columns), len(fk.RefColumns))
+	}
+	if _, _, err := conflictKey(ref, fk.RefColumns); err != nil {
+		return fmt.Errorf("%w: referenced columns must be the primary key or a unique column of table %s", ErrInvalidOperation, ref.Name)
+	}
+
+	column := func(t *Table, name string) (Column, bool) {
+		for _, col := range t.Columns {
+			if col.Name == name {
+				return col, true
+			}
+		}
+		return Column{}, false
+	}
+	// Primary keys never change, so ON UPDATE only acts on unique columns
+	updates := !sameColumns(fk.RefColumns, ref.keyColumns())
+	for i, name := range fk.Columns {
+		if containsString(fk.Columns[:i], name) {
+			return fmt.Errorf("%w: column %s is listed twice", ErrInvalidOperation, name)
+		}
+		col, ok := column(table, name)
+		if !ok {
+			return fmt.Errorf("%w: column %s not found in table %s", ErrInvalidOperation, name, table.Name)
+		}
+		refCol, ok := column(ref, fk.RefColumns[i])
+		if !ok {
+			return fmt.Errorf("%w: column %s not found in table %s", ErrInvalidOperation, fk.RefColumns[i], ref.Name)
+		}
+		if col.Type != refCol.Type {
+			return fmt.Errorf("%w: column %s does not match the type of %s.%s", ErrInvalidDataType, name, ref.Name, refCol.Name)
+		}
+		setNull := fk.OnDelete == SetNull || (updates && fk.OnUpdate == SetNull)
+		if setNull && (col.NotNull || table.isKeyColumn(name)) {
+			return fmt.Errorf("%w: SET NULL needs column %s to be nullable", ErrInvalidOperation, name)
+		}
+		if updates && fk.OnUpdate == Cascade && table.isKeyColumn(name) {
+			return fmt.Errorf("%w: ON UPDATE CASCADE cannot change primary key %s", ErrInvalidOperation, name)
+		}
+	}
+	for _, action := range []RefAction{fk.OnDelete, fk.OnUpdate} {
+		switch action {
+		case "", Restrict, Cascade, SetNull:
+		default:
+			return fmt.Errorf("%w: unknown action %s", ErrInvalidOperation, action)
+		}
+	}
+	return nil
+}
+
+// refKey returns the index holding the referenced key of fk and the value
+// to look up for the record row, or false when a foreign key value of row
+// is missing
+func refKey(ref *Table, fk ForeignKey, row map[string]interface{}) (string, interface{}, bool) {
+	indexName, keyColumns, err := conflictKey(ref, fk.RefColumns)
+	if err != nil {
+		return "", nil, false
+	}
+	values := make(map[string]interface{}, len(keyColumns))
+	for i, col := range fk.Columns {
+		value, exists := row[col]
+		if !exists || value == nil {
+			return "", nil, false
+		}
+		values[fk.RefColumns[i]] = value
+	}
+	value, _ := keyValue(keyColumns, values)
+	return indexName, value, true
+}
+
+// fkValues returns the values of columns in row as an index key of the
+// foreign key index, or false when one is missing
+func fkValues(columns []string, row map[string]interface{}) (interface{}, bool) {
+	for _, col := range columns {
+		if row[col] == nil {
+			return nil, false
+		}
+	}
+	return keyValue(columns, row)
+}
+
+// writeReferenced writes rows to the records of table with the given
+// primary keys, a nil row deleting the record, together with the
+// referential actions they trigger, with one storage batch, and returns the
+// version written. Callers hold db.mu shared and the locks taken by
+// lockRecord.
+func (db *database) writeReferenced(ctx context.Context, locker *Locker, table *Table, ids []interface{}, rows []map[string]interface{}) (int64, error) {
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+	state := db.newBatchState(reservation)
+	for i, id := range ids {
+		row, err := state.load(table, id)
+		if err != nil {
+			return 0, err
+		}
+		if err := state.set(row, rows[i]); err != nil {
+			return 0, err
+		}
+	}
+	if err := state.enforceReferences(ctx, locker); err != nil {
+		return 0, err
+	}
+	if err := state.commit(); err != nil {
+		return 0, err
+	}
+	return state.version, nil
+}
+
+// enforceReferences applies the actions of the foreign keys referencing the
+// rows changed so far, then checks that every written row references
+// existing records. Records are locked as they are loaded.
+func (s *batchState) enforceReferences(ctx context.Context, locker *Locker) error {
+	var queue []*batchRow
+	for _, row := range s.order {
+		if row.dirty {
+			queue = append(queue, row)
+		}
+	}
+	for i := 0; i < len(queue); i++ {
+		for _, ref := range s.db.references(queue[i].table.Name) {
+			changed, err := s.applyAction(ctx, locker, queue[i], ref)
+			if err != nil {
+				return err
+			}
+			queue = append(queue, changed...)
+		}
+	}
+
+	for _, row := range s.order {
+		if !row.dirty || row.data == nil {
+			continue
+		}
+		for _, fk := range row.table.ForeignKeys {
+			if err := s.checkParent(ctx, locker, row, fk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyAction applies the action of ref to the records referencing the old
+// values of row when row is deleted or its referenced columns change. It
+// returns the records it changed.
+func (s *batchState) applyAction(ctx context.Context, locker *Locker, row *batchRow, ref reference) ([]*batchRow, error) {
+	if row.old == nil {
+		return nil, nil
+	}
+	old, ok := fkValues(ref.fk.RefColumns, row.old)
+	if !ok {
+		return nil, nil
+	}
+	action := ref.fk.OnDelete
+	var current interface{}
+	if row.data != nil {
+		if current, ok = fkValues(ref.fk.RefColumns, row.data); ok && valuesEqual(old, current) {
+			return nil, nil
+		}
+		action = ref.fk.OnUpdate
+	}
+
+	children, err := s.children(ctx, locker, ref, old)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		var data map[string]interface{}
+		switch action {
+		case Cascade:
+			if row.data != nil {
+				data = copyRow(child.data, nil)
+				for i, col := range ref.fk.Columns {
+					data[col] = row.data[ref.fk.RefColumns[i]]
+				}
+			}
+		case SetNull:
+			data = copyRow(child.data, nil)
+			for _, col := range ref.fk.Columns {
+				delete(data, col)
+			}
+		default:
+			return nil, &ForeignKeyError{Table: ref.table.Name, ForeignKey: ref.fk.Name, RefTable: row.table.Name, Value: old, Referenced: true}
+		}
+		if data != nil {
+			if err := checkRow(child.table, data); err != nil {
+				return nil, err
+			}
+			if err := s.checkUnique(child, data); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.set(child, data); err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// children locks and loads the records of ref.table whose foreign key
+// values are value, as the batch so far leaves them
+func (s *batchState) children(ctx context.Context, locker *Locker, ref reference, value interface{}) ([]*batchRow, error) {
+	table := s.db.tables[ref.table.Name]
+	matches := func(row *batchRow) bool {
+		current, ok := fkValues(ref.fk.Columns, row.data)
+		return ok && valuesEqual(current, value)
+	}
+
+	index, err := s.db.indexes[table.Name].GetIndex(fkIndexName(ref.fk))
+	if err != nil {
+		return nil, err
+	}
+	holders, _ := index.Find(value)
+	if len(holders) > 0 {
+		if err := locker.LockTable(ctx, table.Name, LockIntentExclusive); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return compareValues(holders[i], holders[j]) < 0 })
+	for _, id := range holders {
+		if err := locker.LockKey(ctx, table.Name, id, LockExclusive); err != nil {
+			return nil, err
+		}
+		if _, err := s.load(table, id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Rows written by the batch are judged by their new values
+	var children []*batchRow
+	for _, row := range s.order {
+		if row.table.Name == table.Name && row.data != nil && matches(row) {
+			children = append(children, row)
+		}
+	}
+	return children, nil
+}
+
+// checkParent returns a ForeignKeyError when the foreign key values of row
+// changed to a key that no record holds. The referenced record is locked
+// shared so that it cannot go away before the batch is written.
+func (s *batchState) checkParent(ctx context.Context, locker *Locker, row *batchRow, fk ForeignKey) error {
+	if row.old != nil {
+		old, oldOK := fkValues(fk.Columns, row.old)
+		current, ok := fkValues(fk.Columns, row.data)
+		if oldOK == ok && (!ok || valuesEqual(old, current)) {
+			return nil
+		}
+	}
+	ref := s.db.tables[fk.RefTable]
+	indexName, value, ok := refKey(ref, fk, row.data)
+	if !ok {
+		return nil
+	}
+
+	// Rows written by the batch are judged by their new values
+	for _, other := range s.order {
+		if other.table.Name != ref.Name || other.data == nil {
+			continue
+		}
+		if _, key, ok := refKey(ref, ForeignKey{Columns: fk.RefColumns, RefColumns: fk.RefColumns}, other.data); ok && valuesEqual(key, value) {
+			return nil
+		}
+	}
+
+	missing := &ForeignKeyError{Table: row.table.Name, ForeignKey: fk.Name, RefTable: ref.Name, Value: value}
+	index, err := s.db.indexes[ref.Name].GetIndex(indexName)
+	if err != nil {
+		return err
+	}
+	holders, _ := index.Find(value)
+	for _, id := range holders {
+		if _, loaded := s.rows[lockResource{table: ref.Name, key: lockKeyString(id)}]; loaded {
+			continue
+		}
+		if err := locker.LockTable(ctx, ref.Name, LockIntentShared); err != nil {
+			return err
+		}
+		if err := locker.LockKey(ctx, ref.Name, id, LockShared); err != nil {
+			return err
+		}
+		// The record may have changed before it was locked
+		current, _ := index.Find(value)
+		for _, held := range current {
+			if valuesEqual(held, id) {
+				return nil
+			}
+		}
+	}
+	return missing
+}
+
+// checkExistingReferences returns a ForeignKeyError when a record of table
+// references a missing record. References within table are looked up in
+// indexManager, and skipped when it is nil; the others only when it is nil.
+// Callers hold db.mu exclusively.
+func (db *database) checkExistingReferences(table *Table, indexManager *IndexManager, row map[string]interface{}) error {
+	for _, fk := range table.ForeignKeys {
+		ref, refIndexes := db.tables[fk.RefTable], db.indexes[fk.RefTable]
+		if (fk.RefTable == table.Name) != (indexManager != nil) {
+			continue
+		}
+		if indexManager != nil {
+			ref, refIndexes = table, indexManager
+		}
+		indexName, value, ok := refKey(ref, fk, row)
+		if !ok {
+			continue
+		}
+		index, err := refIndexes.GetIndex(indexName)
+		if err != nil {
+			return err
+		}
+		if holders, _ := index.Find(value); len(holders) == 0 {
+			return &ForeignKeyError{Table: table.Name, ForeignKey: fk.Name, RefTable: ref.Name, Value: value}
+		}
+	}
+	return nil
+}
+
+// foreignKeyName returns the name given to a foreign key without one
+func foreignKeyName(table string, fk ForeignKey) string {
+	return table + "_" + strings.Join(fk.Columns, "_") + "_fkey"
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+func TestForeignKeys(t *testing.T) {
+	ctx := context.Background()
+	// Customers 1 and 2; orders 10 and 11 of customer 1 and order 12 of
+	// customer 2, referencing customers with the given actions
+	newShop := func(t *testing.T, config Config, onDelete, onUpdate RefAction) Database {
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		err = db.CreateTable("customers", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "email", Type: String, Unique: true},
+		})
+		assert.NoError(t, err)
+		err = db.CreateTable("orders", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "customer_id", Type: Int},
+			{Name: "customer_email", Type: String},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("orders",
+			AddForeignKey(ForeignKey{Columns: []string{"customer_id"}, RefTable: "customers", OnDelete: onDelete}),
+			AddForeignKey(ForeignKey{
+				Name: "by_email", Columns: []string{"customer_email"}, RefTable: "customers", RefColumns: []string{"email"},
+				OnDelete: onDelete, OnUpdate: onUpdate,
+			}),
+		))
+
+		for id, email := range map[int]string{1: "a@x", 2: "b@x"} {
+			assert.NoError(t, db.Insert("customers", map[string]interface{}{"id": id, "email": email}))
+		}
+		for id, customer := range map[int]int{10: 1, 11: 1, 12: 2} {
+			email := map[int]string{1: "a@x", 2: "b@x"}[customer]
+			err := db.Insert("orders", map[string]interface{}{"id": id, "customer_id": customer, "customer_email": email})
+			assert.NoError(t, err)
+		}
+		return db
+	}
+
+	customer := func(id int) map[string]interface{} {
+		return map[string]interface{}{"id": id}
+	}
+
+	t.Run("Restrict", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), "", Restrict)
+		table, err := db.GetTable("orders")
+		assert.NoError(t, err)
+		assert.Equal(t, "orders_customer_id_fkey", table.ForeignKeys[0].Name)
+		assert.Equal(t, []string{"id"}, table.ForeignKeys[0].RefColumns)
+		assert.True(t, db.(*database).indexes["orders"].HasIndex("fk_orders_customer_id_fkey"))
+
+		err = db.Insert("orders", map[string]interface{}{"id": 13, "customer_id": 3})
+		var fkErr *ForeignKeyError
+		if assert.True(t, errors.As(err, &fkErr)) {
+			assert.Equal(t, "orders", fkErr.Table)
+			assert.Equal(t, "customers", fkErr.RefTable)
+			assert.Equal(t, 3, fkErr.Value)
+			assert.False(t, fkErr.Referenced)
+		}
+		// Missing values reference nothing
+		assert.NoError(t, db.Insert("orders", map[string]interface{}{"id": 13}))
+		err = db.Update("orders", map[string]interface{}{"customer_id": 3}, map[string]interface{}{"id": 13})
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+		assert.NoError(t, db.Update("orders", map[string]interface{}{"customer_id": 2}, map[string]interface{}{"id": 13}))
+
+		err = db.Delete("customers", customer(1))
+		if assert.True(t, errors.As(err, &fkErr)) {
+			assert.True(t, fkErr.Referenced)
+		}
+		_, err = db.DeleteWhere(ctx, "customers", nil)
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+		err = db.Update("customers", map[string]interface{}{"email": "c@x"}, customer(1))
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+
+		// Nothing was written by the failed deletes
+		rows, err := db.Query("customers", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+
+		_, err = db.DeleteWhere(ctx, "orders", []query.Condition{{Column: "customer_id", Operator: query.Eq, Value: 2}})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Delete("customers", customer(2)))
+	})
+
+	t.Run("Cascade", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), Cascade, Cascade)
+		err := db.CreateTable("items", []Column{
+			{Name: "order_id", Type: Int, PrimaryKey: true},
+			{Name: "line", Type: Int, PrimaryKey: true},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("items", AddForeignKey(ForeignKey{
+			Columns: []string{"order_id"}, RefTable: "orders", OnDelete: Cascade, OnUpdate: Cascade,
+		})))
+		for _, order := range []int{10, 11, 12} {
+			assert.NoError(t, db.Insert("items", map[string]interface{}{"order_id": order, "line": 1}))
+		}
+
+		// Deletes cascade through every level
+		assert.NoError(t, db.Delete("customers", customer(1)))
+		rows, err := db.Query("orders", []string{"id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 12}}, rows)
+		rows, err = db.Query("items", []string{"order_id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"order_id": 12}}, rows)
+
+		// Updates of a referenced unique column follow to the references
+		assert.NoError(t, db.Update("customers", map[string]interface{}{"email": "new@x"}, customer(2)))
+		rows, err = db.Query("orders", []string{"customer_email"}, map[string]interface{}{"id": 12}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"customer_email": "new@x"}}, rows)
+		rows, err = db.Query("orders", []string{"id"}, map[string]interface{}{"customer_email": "new@x"}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 1)
+
+		// Cascaded values must satisfy the checks of the referencing table
+		assert.NoError(t, db.AlterTable("orders", AddCheck("customer_email", Check{Pattern: "^[a-z@]+$"})))
+		err = db.Update("customers", map[string]interface{}{"email": "NEW@x"}, customer(2))
+		assert.ErrorIs(t, err, ErrCheckViolation)
+		rows, err = db.Query("customers", []string{"email"}, customer(2), 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"email": "new@x"}}, rows)
+
+		n, err := db.DeleteWhere(ctx, "customers", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		for _, table := range []string{"orders", "items"} {
+			rows, err := db.Query(table, nil, nil, 0, 0)
+			assert.NoError(t, err)
+			assert.Empty(t, rows, table)
+		}
+	})
+
+	t.Run("Set Null", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), SetNull, SetNull)
+
+		assert.NoError(t, db.Update("customers", map[string]interface{}{"email": "c@x"}, customer(2)))
+		assert.NoError(t, db.Delete("customers", customer(1)))
+		rows, err := db.Query("orders", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{
+			{"id": 10}, {"id": 11}, {"id": 12, "customer_id": 2},
+		}, rows)
+
+		// A record may reference its own table
+		err = db.CreateTable("staff", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "manager_id", Type: Int},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("staff", AddForeignKey(ForeignKey{Columns: []string{"manager_id"}, RefTable: "staff", OnDelete: SetNull})))
+		assert.NoError(t, db.Insert("staff", map[string]interface{}{"id": 1, "manager_id": 1}))
+		assert.NoError(t, db.Insert("staff", map[string]interface{}{"id": 2, "manager_id": 1}))
+		assert.ErrorIs(t, db.Insert("staff", map[string]interface{}{"id": 3, "manager_id": 4}), ErrForeignKeyViolation)
+		assert.NoError(t, db.Delete("staff", customer(1)))
+		rows, err = db.Query("staff", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 2}}, rows)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), "", "")
+
+		// References are checked against the batch as a whole
+		batch := NewBatch().
+			Insert("orders", map[string]interface{}{"id": 20, "customer_id": 3}).
+			Insert("customers", map[string]interface{}{"id": 3}).
+			Delete("orders", map[string]interface{}{"id": 12}).
+			Delete("customers", customer(2))
+		n, err := db.ExecBatch(batch, BatchAtomic)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, n)
+
+		_, err = db.InsertMany("orders", []map[string]interface{}{{"id": 21, "customer_id": 2}}, BatchAtomic)
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+		_, err = db.ExecBatch(NewBatch().Delete("customers", customer(3)), BatchBestEffort)
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+
+		rows, err := db.Query("customers", []string{"id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{{"id": 1}, {"id": 3}}, rows)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), "", "")
+
+		_, err := db.Upsert("orders", map[string]interface{}{"id": 13, "customer_id": 9}, nil, []string{"customer_id"})
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+		_, err = db.Upsert("orders", map[string]interface{}{"id": 10, "customer_id": 9}, nil, []string{"customer_id"})
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+		action, err := db.Upsert("orders", map[string]interface{}{"id": 10, "customer_id": 2}, nil, []string{"customer_id"})
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertUpdated, action)
+	})
+
+	t.Run("Schema Changes", func(t *testing.T) {
+		db := newShop(t, newTestConfig(), "", "")
+
+		assert.NoError(t, db.CreateTable("notes", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "customer_id", Type: Int, NotNull: true},
+			{Name: "label", Type: String},
+		}))
+		for _, fk := range []ForeignKey{
+			{Columns: []string{"customer_id"}, RefTable: "missing"},
+			{Columns: []string{"label"}, RefTable: "customers"},
+			{Columns: []string{"missing"}, RefTable: "customers"},
+			{Columns: []string{"customer_id", "label"}, RefTable: "customers"},
+			{Columns: []string{"label"}, RefTable: "orders", RefColumns: []string{"customer_email"}},
+			{Columns: []string{"customer_id"}, RefTable: "customers", OnDelete: SetNull},
+			{Columns: []string{"customer_id"}, RefTable: "customers", OnDelete: "IGNORE"},
+			{Columns: []string{"customer_id"}, RefTable: schemaTableName},
+		} {
+			assert.Error(t, db.AlterTable("notes", AddForeignKey(fk)), fk)
+		}
+
+		// Stored records must reference existing ones
+		assert.NoError(t, db.Insert("notes", map[string]interface{}{"id": 1, "customer_id": 5}))
+		err := db.AlterTable("notes", AddForeignKey(ForeignKey{Columns: []string{"customer_id"}, RefTable: "customers"}))
+		assert.ErrorIs(t, err, ErrForeignKeyViolation)
+
+		// Referenced tables and columns stay as the references need them
+		assert.ErrorIs(t, db.DropTable("customers"), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("customers", RenameColumn("email", "mail")), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("customers", DropColumn("email")), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("orders", DropColumn("customer_id")), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("orders", DropForeignKey("missing")), ErrInvalidOperation)
+
+		assert.NoError(t, db.AlterTable("orders", RenameColumn("customer_id", "buyer_id")))
+		table, err := db.GetTable("orders")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"buyer_id"}, table.ForeignKeys[0].Columns)
+		assert.ErrorIs(t, db.Insert("orders", map[string]interface{}{"id": 13, "buyer_id": 7}), ErrForeignKeyViolation)
+
+		assert.NoError(t, db.AlterTable("orders", DropForeignKey("orders_customer_id_fkey"), DropForeignKey("by_email")))
+		assert.False(t, db.(*database).indexes["orders"].HasIndex("fk_by_email"))
+		assert.NoError(t, db.Insert("orders", map[string]interface{}{"id": 13, "buyer_id": 7}))
+		assert.NoError(t, db.DropTable("customers"))
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db := newShop(t, config, Cascade, Restrict)
+		assert.NoError(t, db.Close())
+
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		table, err := db.GetTable("orders")
+		assert.NoError(t, err)
+		assert.Len(t, table.ForeignKeys, 2)
+
+		assert.ErrorIs(t, db.Insert("orders", map[string]interface{}{"id": 13, "customer_id": 3}), ErrForeignKeyViolation)
+		assert.NoError(t, db.Delete("customers", customer(2)))
+		rows, err := db.Query("orders", []string{"id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{{"id": 10}, {"id": 11}}, rows)
+	})
+}
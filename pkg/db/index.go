@@ -1,13 +1,23 @@
 package db
 
 import (
+	"cmp"
 	"fmt"
+	"math"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
 )
 
-// IndexEntry represents a single index entry
+// indexEntryOverhead approximates the per-entry cost of the entry slice
+const indexEntryOverhead = 32
+
+// IndexEntry represents a single index entry. Value holds the primary key
+// of the indexed record rather than the record itself.
 type IndexEntry struct {
 	Key   interface{}
 	Value interface{}
@@ -16,36 +26,98 @@ type IndexEntry struct {
 // MemoryIndex is a simple in-memory index implementation
 type MemoryIndex struct {
 	entries []IndexEntry
+	bytes   int64
+	budget  *memory.Budget
 	mu      sync.RWMutex
 }
 
-// NewMemoryIndex creates a new memory index
-func NewMemoryIndex() *MemoryIndex {
+// NewMemoryIndex creates a new memory index whose entries are reserved
+// from budget, which may be nil
+func NewMemoryIndex(budget *memory.Budget) *MemoryIndex {
 	return &MemoryIndex{
 		entries: make([]IndexEntry, 0),
+		budget:  budget,
 	}
 }
 
 // Add adds a new entry to the index
 func (idx *MemoryIndex) Add(key, value interface{}) error {
+	size := indexEntrySize(key, value)
+	if err := idx.budget.Reserve(size); err != nil {
+		return err
+	}
+
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	idx.entries = append(idx.entries, IndexEntry{Key: key, Value: value})
-	sort.Slice(idx.entries, func(i, j int) bool {
-		return compareValues(idx.entries[i].Key, idx.entries[j].Key) < 0
+	// Insert in place rather than re-sorting the whole index
+	entry := IndexEntry{Key: key, Value: value}
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return compareEntries(idx.entries[i], entry) > 0
 	})
+	idx.bytes += size
+	idx.entries = append(idx.entries, IndexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = entry
 	return nil
 }
 
-// Remove removes an entry from the index
-func (idx *MemoryIndex) Remove(key interface{}) error {
+// AddMany bulk-loads entries, sorting them once and merging them into the
+// index in a single pass
+func (idx *MemoryIndex) AddMany(entries []IndexEntry) error {
+	var size int64
+	for _, entry := range entries {
+		size += indexEntrySize(entry.Key, entry.Value)
+	}
+	if err := idx.budget.Reserve(size); err != nil {
+		return err
+	}
+
+	added := make([]IndexEntry, len(entries))
+	copy(added, entries)
+	sort.Slice(added, func(i, j int) bool {
+		return compareEntries(added[i], added[j]) < 0
+	})
+
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	for i, entry := range idx.entries {
-		if entry.Key == key {
+	merged := make([]IndexEntry, 0, len(idx.entries)+len(added))
+	i, j := 0, 0
+	for i < len(idx.entries) && j < len(added) {
+		if compareEntries(added[j], idx.entries[i]) < 0 {
+			merged = append(merged, added[j])
+			j++
+		} else {
+			merged = append(merged, idx.entries[i])
+			i++
+		}
+	}
+	merged = append(merged, idx.entries[i:]...)
+	merged = append(merged, added[j:]...)
+
+	idx.bytes += size
+	idx.entries = merged
+	return nil
+}
+
+// Remove removes the entry with the given key and value from the index
+func (idx *MemoryIndex) Remove(key, value interface{}) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	// Entries are sorted, so only those ordered like the removed one are
+	// compared for equality
+	entry := IndexEntry{Key: key, Value: value}
+	start := sort.Search(len(idx.entries), func(i int) bool {
+		return compareEntries(idx.entries[i], entry) >= 0
+	})
+	for i := start; i < len(idx.entries) && compareEntries(idx.entries[i], entry) == 0; i++ {
+		if valuesEqual(idx.entries[i].Key, key) && valuesEqual(idx.entries[i].Value, value) {
 			idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+			size := indexEntrySize(key, value)
+			idx.bytes -= size
+			idx.budget.Release(size)
 			return nil
 		}
 	}
@@ -57,9 +129,15 @@ func (idx *MemoryIndex) Find(key interface{}) ([]interface{}, error) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
+	start := sort.Search(len(idx.entries), func(i int) bool {
+		return compareValues(idx.entries[i].Key, key) >= 0
+	})
 	var results []interface{}
-	for _, entry := range idx.entries {
-		if entry.Key == key {
+	for _, entry := range idx.entries[start:] {
+		if compareValues(entry.Key, key) != 0 {
+			break
+		}
+		if valuesEqual(entry.Key, key) {
 			results = append(results, entry.Value)
 		}
 	}
@@ -80,32 +158,151 @@ func (idx *MemoryIndex) Range(start, end interface{}) ([]interface{}, error) {
 	return results, nil
 }
 
+// Prefix returns the values of entries whose composite keys start with
+// prefix, in key order
+func (idx *MemoryIndex) Prefix(prefix []interface{}) []interface{} {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// A prefix sorts before every longer key that extends it
+	start := sort.Search(len(idx.entries), func(i int) bool {
+		return compareValues(idx.entries[i].Key, prefix) >= 0
+	})
+
+	var results []interface{}
+	for _, entry := range idx.entries[start:] {
+		key, ok := entry.Key.([]interface{})
+		if !ok || len(key) < len(prefix) || compareValues(key[:len(prefix)], prefix) != 0 {
+			break
+		}
+		results = append(results, entry.Value)
+	}
+	return results
+}
+
+// IndexBound is one end of a range of index keys
+type IndexBound struct {
+	Key       interface{}
+	Inclusive bool
+}
+
+// Between returns the values of entries whose keys lie between lower and
+// upper. A nil bound leaves that end of the range open.
+func (idx *MemoryIndex) Between(lower, upper *IndexBound) []interface{} {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	start := 0
+	if lower != nil {
+		start = sort.Search(len(idx.entries), func(i int) bool {
+			c := compareValues(idx.entries[i].Key, lower.Key)
+			return c > 0 || (c == 0 && lower.Inclusive)
+		})
+	}
+
+	var results []interface{}
+	for _, entry := range idx.entries[start:] {
+		if upper != nil {
+			c := compareValues(entry.Key, upper.Key)
+			if c > 0 || (c == 0 && !upper.Inclusive) {
+				break
+			}
+		}
+		results = append(results, entry.Value)
+	}
+	return results
+}
+
+// Seek returns up to n entries in key order that come after from, or from
+// the start of the index when from is nil. Entries with equal keys are
+// ordered by primary key, so a seek resumes exactly where the last one ended.
+func (idx *MemoryIndex) Seek(from *IndexEntry, n int, descending bool) []IndexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var start, end int
+	if descending {
+		end = len(idx.entries)
+		if from != nil {
+			end = sort.Search(len(idx.entries), func(i int) bool {
+				return compareEntries(idx.entries[i], *from) >= 0
+			})
+		}
+		start = max(end-n, 0)
+	} else {
+		if from != nil {
+			start = sort.Search(len(idx.entries), func(i int) bool {
+				return compareEntries(idx.entries[i], *from) > 0
+			})
+		}
+		end = min(start+n, len(idx.entries))
+	}
+
+	entries := make([]IndexEntry, end-start)
+	copy(entries, idx.entries[start:end])
+	if descending {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries
+}
+
+// compareEntries orders index entries by key, then by primary key
+func compareEntries(a, b IndexEntry) int {
+	if c := compareValues(a.Key, b.Key); c != 0 {
+		return c
+	}
+	return compareValues(a.Value, b.Value)
+}
+
 // Clear removes all entries from the index
 func (idx *MemoryIndex) Clear() error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
 	idx.entries = make([]IndexEntry, 0)
+	idx.budget.Release(idx.bytes)
+	idx.bytes = 0
 	return nil
 }
 
+// Size returns the estimated memory held by the index in bytes
+func (idx *MemoryIndex) Size() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.bytes
+}
+
+// indexEntrySize estimates the memory held by one index entry
+func indexEntrySize(key, value interface{}) int64 {
+	return indexEntryOverhead + memory.SizeOf(key) + memory.SizeOf(value)
+}
+
+// managedIndex is an index together with the columns it covers
+type managedIndex struct {
+	index   *MemoryIndex
+	columns []string
+}
+
 // IndexManager manages indexes for a table
 type IndexManager struct {
-	indexes map[string]*struct {
-		index   *MemoryIndex
-		columns []string
-	}
-	mu sync.RWMutex
+	indexes    map[string]*managedIndex
+	primaryKey []string
+	budget     *memory.Budget
+	mu         sync.RWMutex
 }
 
-// NewIndexManager creates a new index manager
-func NewIndexManager() *IndexManager {
+// NewIndexManager creates a new index manager for a table with the given
+// primary key columns. Index memory is reserved from budget, which may be
+// nil.
+func NewIndexManager(primaryKey []string, budget *memory.Budget) *IndexManager {
 	return &IndexManager{
-		indexes: make(map[string]*struct {
-			index   *MemoryIndex
-			columns []string
-		}),
-		mu: sync.RWMutex{},
+		indexes:    make(map[string]*managedIndex),
+		primaryKey: primaryKey,
+		budget:     budget,
+		mu:         sync.RWMutex{},
 	}
 }
 
@@ -118,11 +315,8 @@ func (im *IndexManager) CreateIndex(name string, columns []string) error {
 		return fmt.Errorf("index %s already exists", name)
 	}
 
-	im.indexes[name] = &struct {
-		index   *MemoryIndex
-		columns []string
-	}{
-		index:   NewMemoryIndex(),
+	im.indexes[name] = &managedIndex{
+		index:   NewMemoryIndex(im.budget),
 		columns: columns,
 	}
 	return nil
@@ -141,14 +335,27 @@ func (im *IndexManager) DropIndex(name string) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
-	if _, exists := im.indexes[name]; !exists {
+	idx, exists := im.indexes[name]
+	if !exists {
 		return fmt.Errorf("index %s not found", name)
 	}
 
+	idx.index.Clear()
 	delete(im.indexes, name)
 	return nil
 }
 
+// DropAll drops every index and releases their memory
+func (im *IndexManager) DropAll() {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	for name, idx := range im.indexes {
+		idx.index.Clear()
+		delete(im.indexes, name)
+	}
+}
+
 // GetIndex returns the index for the specified column
 func (im *IndexManager) GetIndex(name string) (*MemoryIndex, error) {
 	im.mu.RLock()
@@ -171,28 +378,100 @@ func (im *IndexManager) HasIndex(name string) bool {
 	return exists
 }
 
+// FindColumnIndex returns an index covering exactly the given column
+func (im *IndexManager) FindColumnIndex(column string) (*MemoryIndex, bool) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	names := make([]string, 0, len(im.indexes))
+	for name, idx := range im.indexes {
+		if len(idx.columns) == 1 && idx.columns[0] == column {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+
+	// Pick deterministically when several indexes cover the column
+	sort.Strings(names)
+	return im.indexes[names[0]].index, true
+}
+
 // IndexRecord indexes a record
 func (im *IndexManager) IndexRecord(record map[string]interface{}) error {
 	im.mu.RLock()
 	defer im.mu.RUnlock()
 
+	pk := im.pk(record)
+	var added []*managedIndex
 	for name, idx := range im.indexes {
-		// For multi-column indexes, create a composite key
-		var key interface{}
-		if len(idx.columns) == 1 {
-			key = record[idx.columns[0]]
-		} else {
-			keys := make([]interface{}, len(idx.columns))
-			for i, col := range idx.columns {
-				keys[i] = record[col]
+		key := idx.key(record)
+		if err := idx.index.Add(key, pk); err != nil {
+			// Undo the entries added so far so the indexes stay consistent
+			for _, done := range added {
+				done.index.Remove(done.key(record), pk)
 			}
-			key = keys
+			return fmt.Errorf("failed to index record for index %s: %w", name, err)
 		}
+		added = append(added, idx)
+	}
+	return nil
+}
 
-		if err := idx.index.Add(key, record); err != nil {
+// IndexRecords bulk-loads many records into every index
+func (im *IndexManager) IndexRecords(records []map[string]interface{}) error {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	var added []*managedIndex
+	for name, idx := range im.indexes {
+		entries := make([]IndexEntry, len(records))
+		for i, record := range records {
+			entries[i] = IndexEntry{Key: idx.key(record), Value: im.pk(record)}
+		}
+		if err := idx.index.AddMany(entries); err != nil {
+			// Undo the indexes loaded so far so they stay consistent
+			for _, done := range added {
+				for _, record := range records {
+					done.index.Remove(done.key(record), im.pk(record))
+				}
+			}
+			return fmt.Errorf("failed to index records for index %s: %w", name, err)
+		}
+		added = append(added, idx)
+	}
+	return nil
+}
+
+// BuildIndex creates an index from the records that scan passes to add.
+// The index becomes visible only once it is complete, so lookups never use
+// a partially built index.
+func (im *IndexManager) BuildIndex(name string, columns []string, scan func(add func(map[string]interface{}) error) error) error {
+	if im.HasIndex(name) {
+		return fmt.Errorf("index %s already exists", name)
+	}
+
+	idx := &managedIndex{index: NewMemoryIndex(im.budget), columns: columns}
+	err := scan(func(record map[string]interface{}) error {
+		if err := idx.index.Add(idx.key(record), im.pk(record)); err != nil {
 			return fmt.Errorf("failed to index record for index %s: %w", name, err)
 		}
+		return nil
+	})
+	if err != nil {
+		idx.index.Clear()
+		return err
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if _, exists := im.indexes[name]; exists {
+		idx.index.Clear()
+		return fmt.Errorf("index %s already exists", name)
 	}
+	im.indexes[name] = idx
 	return nil
 }
 
@@ -201,60 +480,186 @@ func (im *IndexManager) RemoveRecord(record map[string]interface{}) error {
 	im.mu.RLock()
 	defer im.mu.RUnlock()
 
+	pk := im.pk(record)
 	for name, idx := range im.indexes {
-		// For multi-column indexes, create a composite key
-		var key interface{}
-		if len(idx.columns) == 1 {
-			key = record[idx.columns[0]]
-		} else {
-			keys := make([]interface{}, len(idx.columns))
-			for i, col := range idx.columns {
-				keys[i] = record[col]
-			}
-			key = keys
-		}
-
-		if err := idx.index.Remove(key); err != nil {
+		if err := idx.index.Remove(idx.key(record), pk); err != nil {
 			return fmt.Errorf("failed to remove record from index %s: %w", name, err)
 		}
 	}
 	return nil
 }
 
-// compareValues compares two values
-func compareValues(a, b interface{}) int {
-	switch v1 := a.(type) {
-	case int:
-		v2, ok := b.(int)
-		if !ok {
-			return 0
-		}
-		if v1 < v2 {
-			return -1
+// pk returns the primary key of a record, a tuple for composite keys
+func (im *IndexManager) pk(record map[string]interface{}) interface{} {
+	pk, _ := keyValue(im.primaryKey, record)
+	return pk
+}
+
+// key returns the index key of a record. Multi-column indexes use a
+// composite key, and columns may be paths into JSON documents.
+func (mi *managedIndex) key(record map[string]interface{}) interface{} {
+	if len(mi.columns) == 1 {
+		key, _ := lookupValue(record, mi.columns[0])
+		return key
+	}
+	keys := make([]interface{}, len(mi.columns))
+	for i, col := range mi.columns {
+		keys[i], _ = lookupValue(record, col)
+	}
+	return keys
+}
+
+// valuesEqual compares index keys and values, including composite keys.
+// Numbers of any Go type, decimals included, are equal when their values are.
+func valuesEqual(a, b interface{}) bool {
+	if valueRank(a) == rankNumber && valueRank(b) == rankNumber {
+		return compareNumbers(a, b) == 0
+	}
+	if as, ok := a.([]interface{}); ok {
+		bs, ok := b.([]interface{})
+		if !ok || len(as) != len(bs) {
+			return false
 		}
-		if v1 > v2 {
-			return 1
+		for i := range as {
+			if !valuesEqual(as[i], bs[i]) {
+				return false
+			}
 		}
-		return 0
-	case float64:
-		v2, ok := b.(float64)
-		if !ok {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Kinds of values in the order compareValues sorts them
+const (
+	rankNil = iota
+	rankBool
+	rankNumber
+	rankString
+	rankTime
+	rankComposite
+	rankOther
+)
+
+// valueRank returns the kind of a value for ordering
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return rankNil
+	case bool:
+		return rankBool
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, DecimalValue:
+		return rankNumber
+	case string:
+		return rankString
+	case time.Time:
+		return rankTime
+	case []interface{}:
+		return rankComposite
+	}
+	return rankOther
+}
+
+// compareValues orders two values: nil first, then booleans, numbers of any
+// Go type including decimals, strings and times. Composite keys compare element by element.
+// Values of other types compare equal.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return cmp.Compare(ra, rb)
+	}
+
+	switch ra {
+	case rankBool:
+		v1, v2 := a.(bool), b.(bool)
+		if v1 == v2 {
 			return 0
 		}
-		if v1 < v2 {
+		if v2 {
 			return -1
 		}
-		if v1 > v2 {
-			return 1
+		return 1
+	case rankNumber:
+		return compareNumbers(a, b)
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	case rankTime:
+		return a.(time.Time).Compare(b.(time.Time))
+	case rankComposite:
+		v1, v2 := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(v1) && i < len(v2); i++ {
+			if c := compareValues(v1[i], v2[i]); c != 0 {
+				return c
+			}
 		}
-		return 0
-	case string:
-		v2, ok := b.(string)
-		if !ok {
-			return 0
+		return cmp.Compare(len(v1), len(v2))
+	}
+	return 0
+}
+
+// compareNumbers compares numbers of any Go type, exactly when both are
+// integers that fit in an int64 or either is a decimal
+func compareNumbers(a, b interface{}) int {
+	if x, ok := a.(DecimalValue); ok {
+		if c, ok := x.Compare(b); ok {
+			return c
+		}
+	}
+	if y, ok := b.(DecimalValue); ok {
+		if c, ok := y.Compare(a); ok {
+			return -c
 		}
-		return strings.Compare(v1, v2)
-	default:
-		return 0
 	}
+	i1, ok1 := toInt64(a)
+	i2, ok2 := toInt64(b)
+	if ok1 && ok2 {
+		return cmp.Compare(i1, i2)
+	}
+	return cmp.Compare(toFloat64(a), toFloat64(b))
+}
+
+// toInt64 converts an integer to int64, reporting false for floats and for
+// unsigned values that do not fit
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// toFloat64 converts a number of any Go type to float64
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	case uint:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case DecimalValue:
+		return n.Float64()
+	}
+	i, _ := toInt64(v)
+	return float64(i)
 }
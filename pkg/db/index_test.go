@@ -0,0 +1,53 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryIndex(t *testing.T) {
+	t.Run("Find", func(t *testing.T) {
+		idx := NewMemoryIndex(nil)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, idx.Add(i%10, i))
+		}
+		assert.NoError(t, idx.Add(int64(1<<60), "big"))
+		assert.NoError(t, idx.Add(int64(1<<60+1), "next"))
+		assert.NoError(t, idx.Add(map[string]interface{}{"a": 1}, "a"))
+		assert.NoError(t, idx.Add(map[string]interface{}{"b": 1}, "b"))
+
+		ids, err := idx.Find(3)
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{3, 13, 23, 33, 43, 53, 63, 73, 83, 93}, ids)
+
+		// Numbers match across Go types, exactly for large integers
+		ids, _ = idx.Find(3.0)
+		assert.Len(t, ids, 10)
+		ids, _ = idx.Find(uint64(1<<60 + 1))
+		assert.Equal(t, []interface{}{"next"}, ids)
+		ids, _ = idx.Find(11)
+		assert.Empty(t, ids)
+
+		// Keys without an order are told apart by equality
+		ids, _ = idx.Find(map[string]interface{}{"b": 1})
+		assert.Equal(t, []interface{}{"b"}, ids)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		idx := NewMemoryIndex(nil)
+		assert.NoError(t, idx.AddMany([]IndexEntry{{Key: "x", Value: 1}, {Key: "x", Value: 2}, {Key: "y", Value: 1}}))
+
+		assert.NoError(t, idx.Remove("x", 2))
+		assert.NoError(t, idx.Remove("x", 3))
+		assert.NoError(t, idx.Remove("z", 1))
+		ids, _ := idx.Find("x")
+		assert.Equal(t, []interface{}{1}, ids)
+		ids, _ = idx.Find("y")
+		assert.Equal(t, []interface{}{1}, ids)
+
+		assert.NoError(t, idx.Remove("x", 1.0))
+		ids, _ = idx.Find("x")
+		assert.Empty(t, ids)
+	})
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+// JSON columns hold documents built from maps with string keys, slices,
+// strings, numbers, booleans and nil. Conditions and indexes reach into
+// them with path expressions such as meta.tags[0]; see query.ParsePath.
+
+// validateJSON checks that value is a JSON document
+func validateJSON(value interface{}) error {
+	switch v := value.(type) {
+	case nil, bool, string, json.Number,
+		int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return nil
+	case map[string]interface{}:
+		for key, item := range v {
+			if err := validateJSON(item); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return nil
+	case []interface{}:
+		for i, item := range v {
+			if err := validateJSON(item); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%T is not a JSON value", value)
+}
+
+// jsonValue returns a copy of value with every number in it as an int when
+// it is integral and fits one, and as a float64 otherwise. Documents read
+// back from storage and values compared with them then agree on the Go
+// types of equal numbers.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return intValue(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return v.String()
+		}
+		return jsonFloat(f)
+	case int:
+		return v
+	case int8, int16, int32, int64:
+		n, _ := toInt64(v)
+		return intValue(n)
+	case uint, uint8, uint16, uint32, uint64:
+		if n, ok := toInt64(v); ok {
+			return intValue(n)
+		}
+		return toFloat64(v)
+	case float32:
+		return jsonFloat(float64(v))
+	case float64:
+		return jsonFloat(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[key] = jsonValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = jsonValue(item)
+		}
+		return out
+	}
+	return value
+}
+
+// jsonFloat returns f as an int when it is integral and fits one
+func jsonFloat(f float64) interface{} {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return intValue(int64(f))
+	}
+	return f
+}
+
+// documentPath parses expr as a path into a JSON column of table. It
+// reports false when expr names a column, or is not a valid path.
+func documentPath(table *Table, expr string) (query.Path, bool) {
+	for _, col := range table.Columns {
+		if col.Name == expr {
+			return query.Path{}, false
+		}
+	}
+	path, err := query.ParsePath(expr)
+	if err != nil || path.IsColumn() {
+		return query.Path{}, false
+	}
+	return path, true
+}
+
+// validatePaths checks that every expression in exprs names a column of
+// table or a path into one of its JSON columns
+func validatePaths(table *Table, exprs []string) error {
+	for _, expr := range exprs {
+		if err := validatePath(table, expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePath checks one expression of validatePaths
+func validatePath(table *Table, expr string) error {
+	if validateColumns(table, []string{expr}) == nil {
+		return nil
+	}
+	path, err := query.ParsePath(expr)
+	if err != nil {
+		return err
+	}
+	for _, col := range table.Columns {
+		if col.Name == path.Column && !path.IsColumn() {
+			if col.Type != JSON {
+				return fmt.Errorf("%w: column %s is not a JSON document", ErrInvalidOperation, col.Name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("column %s not found in table %s", path.Column, table.Name)
+}
+
+// renamePath points an expression that starts at column name to newName
+func renamePath(expr, name, newName string) string {
+	if expr == name {
+		return newName
+	}
+	path, err := query.ParsePath(expr)
+	if err != nil || path.Column != name {
+		return expr
+	}
+	path.Column = newName
+	return path.String()
+}
+
+// usesColumn reports whether one of exprs names column, or is a path into
+// it
+func usesColumn(table *Table, exprs []string, column string) bool {
+	for _, expr := range exprs {
+		if expr == column {
+			return true
+		}
+		if path, ok := documentPath(table, expr); ok && path.Column == column {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupValue returns the value of a column or a document path in row.
+// Values reached through a path are normalized by jsonValue.
+func lookupValue(row map[string]interface{}, expr string) (interface{}, bool) {
+	if value, ok := row[expr]; ok {
+		return value, true
+	}
+	value, ok := query.Lookup(row, expr)
+	if !ok {
+		return nil, false
+	}
+	return jsonValue(value), true
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+// docIDs returns the ids of the docs matching where
+func docIDs(t *testing.T, db Database, where map[string]interface{}) []interface{} {
+	rows, err := db.Query("docs", []string{"id"}, where, 0, 0)
+	assert.NoError(t, err)
+	ids := make([]interface{}, len(rows))
+	for i, row := range rows {
+		ids[i] = row["id"]
+	}
+	return ids
+}
+
+func TestJSON(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "name", Type: String},
+		{Name: "meta", Type: JSON},
+	}
+	seed := []map[string]interface{}{
+		{"id": 1, "name": "d", "meta": map[string]interface{}{"kind": "post", "tags": []interface{}{"go", "db"}, "stats": map[string]interface{}{"views": 10}}},
+		{"id": 2, "name": "d", "meta": map[string]interface{}{"kind": "page", "tags": []interface{}{"db"}, "stats": map[string]interface{}{"views": 2.5}}},
+		{"id": 3, "name": "d", "meta": map[string]interface{}{"kind": 7, "draft": true}},
+	}
+
+	ctx := context.Background()
+
+	t.Run("Documents", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", columns))
+		_, err = db.InsertMany("docs", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		err = db.Insert("docs", map[string]interface{}{"id": 9, "meta": []string{"a"}})
+		assert.Error(t, err)
+		err = db.Insert("docs", map[string]interface{}{"id": 9, "meta": map[string]interface{}{"at": struct{}{}}})
+		assert.Error(t, err)
+		assert.NoError(t, db.Insert("docs", map[string]interface{}{"id": 9, "meta": "scalar"}))
+
+		assert.ElementsMatch(t, []interface{}{1}, docIDs(t, db, map[string]interface{}{"meta.tags[0]": "go"}))
+		assert.ElementsMatch(t, []interface{}{1}, docIDs(t, db, map[string]interface{}{"meta.stats.views": 10.0}))
+		assert.ElementsMatch(t, []interface{}{2}, docIDs(t, db, map[string]interface{}{"meta": map[string]interface{}{"kind": "page", "tags": []interface{}{"db"}, "stats": map[string]interface{}{"views": 2.5}}}))
+		assert.Empty(t, docIDs(t, db, map[string]interface{}{"meta.tags[5]": "go"}))
+	})
+
+	t.Run("Path Conditions", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", columns))
+		_, err = db.InsertMany("docs", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		n, err := db.UpdateWhere(ctx, "docs", map[string]interface{}{"name": "tagged"}, []query.Condition{
+			{Column: "meta.tags", Operator: query.Contains, Value: "db"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.ElementsMatch(t, []interface{}{1, 2}, docIDs(t, db, map[string]interface{}{"name": "tagged"}))
+
+		n, err = db.UpdateWhere(ctx, "docs", map[string]interface{}{"name": "popular"}, []query.Condition{
+			{Column: "meta", Operator: query.Contains, Value: map[string]interface{}{"stats": map[string]interface{}{"views": 10}}},
+			{Column: `meta["stats"].views`, Operator: query.Gte, Value: 5},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		_, err = db.UpdateWhere(ctx, "docs", map[string]interface{}{"name": "x"}, []query.Condition{
+			{Column: "name.first", Operator: query.Eq, Value: "x"},
+		})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		_, err = db.UpdateWhere(ctx, "docs", map[string]interface{}{"name": "x"}, []query.Condition{
+			{Column: "meta.tags[", Operator: query.Eq, Value: "x"},
+		})
+		assert.ErrorIs(t, err, query.ErrInvalidPath)
+
+		n, err = db.DeleteWhere(ctx, "docs", []query.Condition{{Column: "meta", Operator: query.HasKey, Value: "draft"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.ElementsMatch(t, []interface{}{1, 2}, docIDs(t, db, nil))
+	})
+
+	t.Run("Path Indexes", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", columns))
+		_, err = db.InsertMany("docs", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		err = db.CreateIndex("docs", CreateIndexOptions{Name: "idx_kind", Columns: []string{`meta["kind"]`}})
+		assert.NoError(t, err)
+		err = db.CreateIndex("docs", CreateIndexOptions{Name: "idx_views", Columns: []string{"meta.stats.views"}})
+		assert.NoError(t, err)
+		err = db.CreateIndex("docs", CreateIndexOptions{Name: "idx_bad", Columns: []string{"name.first"}})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		table, err := db.GetTable("docs")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"meta.kind"}, table.Indexes[0].Columns)
+
+		// Lookups normalize numbers the way the index keys are
+		indexManager := db.(*database).indexes["docs"]
+		index, ok := indexManager.FindColumnIndex("meta.kind")
+		assert.True(t, ok)
+		ids, _ := index.Find(7)
+		assert.Equal(t, []interface{}{3}, ids)
+		assert.ElementsMatch(t, []interface{}{3}, docIDs(t, db, map[string]interface{}{"meta.kind": 7.0}))
+
+		n, err := db.UpdateWhere(ctx, "docs", map[string]interface{}{"name": "viewed"}, []query.Condition{
+			{Column: "meta.stats.views", Operator: query.Gt, Value: 2},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		// Index keys follow updates of the document
+		err = db.Update("docs", map[string]interface{}{"meta": map[string]interface{}{"kind": "note"}}, map[string]interface{}{"id": 1})
+		assert.NoError(t, err)
+		ids, _ = index.Find("note")
+		assert.Equal(t, []interface{}{1}, ids)
+		ids, _ = index.Find("post")
+		assert.Empty(t, ids)
+	})
+
+	t.Run("Schema Changes", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", columns))
+		_, err = db.InsertMany("docs", seed, BatchAtomic)
+		assert.NoError(t, err)
+		err = db.CreateIndex("docs", CreateIndexOptions{Name: "idx_kind", Columns: []string{"meta.kind"}})
+		assert.NoError(t, err)
+
+		err = db.AlterTable("docs", ChangeType("meta", String))
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		assert.NoError(t, db.AlterTable("docs", RenameColumn("meta", "doc")))
+		assert.ElementsMatch(t, []interface{}{2}, docIDs(t, db, map[string]interface{}{"doc.kind": "page"}))
+		_, ok := db.(*database).indexes["docs"].FindColumnIndex("doc.kind")
+		assert.True(t, ok)
+
+		assert.NoError(t, db.AlterTable("docs", DropColumn("doc")))
+		table, err := db.GetTable("docs")
+		assert.NoError(t, err)
+		assert.Empty(t, table.Indexes)
+
+		// Scalars convert to documents, and documents to their JSON text
+		assert.NoError(t, db.AlterTable("docs", ChangeType("name", JSON)))
+		assert.NoError(t, db.Update("docs", map[string]interface{}{"name": map[string]interface{}{"a": 1}}, map[string]interface{}{"id": 1}))
+		assert.NoError(t, db.AlterTable("docs", ChangeType("name", String)))
+		rows, err := db.Query("docs", []string{"name"}, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"name": `{"a":1}`}}, rows)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("docs", columns))
+		_, err = db.InsertMany("docs", seed, BatchAtomic)
+		assert.NoError(t, err)
+		err = db.CreateIndex("docs", CreateIndexOptions{Name: "idx_tag", Columns: []string{"meta.tags[0]"}})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		rows, err := db.Query("docs", []string{"meta"}, map[string]interface{}{"id": 2}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"meta": map[string]interface{}{
+			"kind": "page", "tags": []interface{}{"db"}, "stats": map[string]interface{}{"views": 2.5},
+		}}}, rows)
+		rows, err = db.Query("docs", []string{"meta"}, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, rows[0]["meta"].(map[string]interface{})["stats"].(map[string]interface{})["views"])
+
+		index, ok := db.(*database).indexes["docs"].FindColumnIndex("meta.tags[0]")
+		assert.True(t, ok)
+		ids, _ := index.Find("db")
+		assert.Equal(t, []interface{}{2}, ids)
+	})
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyColumns returns the primary key columns of the table in key order
+func (t *Table) keyColumns() []string {
+	if len(t.PrimaryKeys) > 0 {
+		return t.PrimaryKeys
+	}
+	return []string{t.PrimaryKey}
+}
+
+// compositeKey reports whether the primary key spans several columns
+func (t *Table) compositeKey() bool {
+	return len(t.PrimaryKeys) > 1
+}
+
+// isKeyColumn reports whether column is part of the primary key
+func (t *Table) isKeyColumn(column string) bool {
+	return containsString(t.keyColumns(), column)
+}
+
+// column returns the column called name
+func (t *Table) column(name string) (Column, bool) {
+	for _, col := range t.Columns {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+// keyName names the primary key in messages
+func (t *Table) keyName() string {
+	return strings.Join(t.keyColumns(), ", ")
+}
+
+// recordID returns the storage key of row: the value of its primary key
+// column, or the tuple of its key values when the key is composite. It
+// reports false when a key column is missing.
+func (t *Table) recordID(row map[string]interface{}) (interface{}, bool) {
+	return keyValue(t.keyColumns(), row)
+}
+
+// whereID returns the storage key of the single record a where map of
+// Update or Delete names by its whole primary key. Other rows are updated
+// and deleted through UpdateWhere and DeleteWhere.
+func (t *Table) whereID(where map[string]interface{}) (interface{}, error) {
+	if len(where) == 0 {
+		return nil, fmt.Errorf("%w: where clause is required", ErrInvalidOperation)
+	}
+	id, ok := t.recordID(where)
+	if !ok {
+		return nil, fmt.Errorf("%w: primary key %s is required in where clause", ErrInvalidOperation, t.keyName())
+	}
+	return id, nil
+}
+
+// keyPrefix returns the values of the leading primary key columns present
+// in where. It is empty unless the key is composite.
+func (t *Table) keyPrefix(where map[string]interface{}) []interface{} {
+	if !t.compositeKey() {
+		return nil
+	}
+	var prefix []interface{}
+	for _, col := range t.PrimaryKeys {
+		value, ok := where[col]
+		if !ok {
+			break
+		}
+		prefix = append(prefix, value)
+	}
+	return prefix
+}
+
+// hasUniqueIndex reports whether col has a unique index of its own, apart
+// from the primary key index
+func (t *Table) hasUniqueIndex(col Column) bool {
+	return col.Unique && (col.Name != t.PrimaryKey || t.compositeKey())
+}
+
+// keyValue returns the value of columns in row, as a tuple when there are
+// several. It reports false when a column is missing.
+func keyValue(columns []string, row map[string]interface{}) (interface{}, bool) {
+	if len(columns) == 1 {
+		value, ok := row[columns[0]]
+		return value, ok
+	}
+	tuple := make([]interface{}, len(columns))
+	for i, col := range columns {
+		value, ok := row[col]
+		if !ok {
+			return nil, false
+		}
+		tuple[i] = value
+	}
+	return tuple, true
+}
+
+// primaryIndexName returns the name of the index backing the primary key
+func primaryIndexName(table *Table) string {
+	return "pk_" + strings.Join(table.keyColumns(), "_")
+}
+
+// uniqueIndexName returns the name of the index backing the primary key or
+// a unique column
+func uniqueIndexName(table *Table, column string) string {
+	if column == table.PrimaryKey && !table.compositeKey() {
+		return primaryIndexName(table)
+	}
+	return "idx_" + column
+}
+
+// keyIDs returns the primary keys of the records matching the primary key
+// values in where: the record itself when the whole key is given, or the
+// records sharing a prefix of a composite key. The second result is false
+// when where does not constrain the key.
+func keyIDs(table *Table, indexManager *IndexManager, where map[string]interface{}) ([]interface{}, bool) {
+	if id, ok := table.recordID(where); ok {
+		return []interface{}{id}, true
+	}
+	prefix := table.keyPrefix(where)
+	if len(prefix) == 0 {
+		return nil, false
+	}
+	index, err := indexManager.GetIndex(primaryIndexName(table))
+	if err != nil {
+		return nil, false
+	}
+	return index.Prefix(prefix), true
+}
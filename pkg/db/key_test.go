@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+func TestCompositeKeys(t *testing.T) {
+	columns := []Column{
+		{Name: "user_id", Type: Int, PrimaryKey: true},
+		{Name: "group_id", Type: Int, PrimaryKey: true},
+		{Name: "role", Type: String},
+	}
+	seed := []map[string]interface{}{
+		{"user_id": 1, "group_id": 10, "role": "member"},
+		{"user_id": 1, "group_id": 20, "role": "member"},
+		{"user_id": 2, "group_id": 10, "role": "member"},
+		{"user_id": 2, "group_id": 20, "role": "member"},
+	}
+
+	ctx := context.Background()
+	key := func(user, group int) map[string]interface{} {
+		return map[string]interface{}{"user_id": user, "group_id": group}
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+		table, err := db.GetTable("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user_id", "group_id"}, table.PrimaryKeys)
+		assert.Equal(t, "user_id", table.PrimaryKey)
+
+		err = db.Insert("memberships", map[string]interface{}{"user_id": 1, "group_id": 10})
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+		err = db.Insert("memberships", map[string]interface{}{"user_id": 1})
+		assert.ErrorContains(t, err, "primary key user_id, group_id is required")
+		assert.NoError(t, db.Insert("memberships", key(1, 30)))
+	})
+
+	t.Run("Update And Delete By Full Key", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		rows, err := db.UpdateReturning(ctx, "memberships", map[string]interface{}{"role": "owner"}, key(1, 20), []string{"role"})
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, map[string]interface{}{"role": "owner"}, rows[0].Row)
+		}
+		err = db.Update("memberships", map[string]interface{}{"group_id": 30}, key(1, 20))
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		assert.NoError(t, db.Delete("memberships", key(2, 10)))
+		result, err := db.Query("memberships", []string{"user_id", "group_id", "role"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{
+			{"user_id": 1, "group_id": 10, "role": "member"},
+			{"user_id": 1, "group_id": 20, "role": "owner"},
+			{"user_id": 2, "group_id": 20, "role": "member"},
+		}, result)
+
+		batch := NewBatch().
+			Update("memberships", map[string]interface{}{"role": "admin"}, key(2, 20)).
+			Delete("memberships", key(1, 10))
+		n, err := db.ExecBatch(batch, BatchAtomic)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		result, err = db.Query("memberships", []string{"role"}, key(2, 20), 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"role": "admin"}}, result)
+	})
+
+	t.Run("Prefix Lookups", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+		d := db.(*database)
+
+		ids, indexed := lookupIDs(d.tables["memberships"], d.indexes["memberships"], map[string]interface{}{"user_id": 2})
+		assert.True(t, indexed)
+		assert.Equal(t, []interface{}{[]interface{}{2, 10}, []interface{}{2, 20}}, ids)
+		_, indexed = lookupIDs(d.tables["memberships"], d.indexes["memberships"], map[string]interface{}{"group_id": 10})
+		assert.False(t, indexed)
+
+		result, err := db.Query("memberships", []string{"group_id"}, map[string]interface{}{"user_id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"group_id": 10}, {"group_id": 20}}, result)
+
+		// A prefix of the key names several records, which only bulk
+		// updates may change
+		_, err = db.UpdateReturning(ctx, "memberships", map[string]interface{}{"role": "guest"}, map[string]interface{}{"user_id": 1}, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		n, err := db.UpdateWhere(ctx, "memberships", map[string]interface{}{"role": "guest"}, []query.Condition{{Column: "user_id", Operator: query.Eq, Value: 1}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		result, err = db.Query("memberships", nil, map[string]interface{}{"role": "guest"}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, result, 2)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		data := map[string]interface{}{"user_id": 2, "group_id": 20, "role": "owner"}
+		action, err := db.Upsert("memberships", data, []string{"group_id", "user_id"}, []string{"role"})
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertUpdated, action)
+		_, err = db.Upsert("memberships", data, []string{"group_id"}, []string{"role"})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		_, err = db.Upsert("memberships", data, nil, []string{"group_id"})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		result, err := db.Query("memberships", []string{"role"}, key(2, 20), 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"role": "owner"}}, result)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		var seen []map[string]interface{}
+		options := PageOptions{Columns: []string{"user_id", "group_id"}, Limit: 3}
+		for {
+			page, err := db.QueryPage(ctx, "memberships", options)
+			assert.NoError(t, err)
+			seen = append(seen, page.Rows...)
+			if page.NextPageToken == "" {
+				break
+			}
+			options.PageToken = page.NextPageToken
+		}
+		assert.Equal(t, []map[string]interface{}{
+			{"user_id": 1, "group_id": 10}, {"user_id": 1, "group_id": 20},
+			{"user_id": 2, "group_id": 10}, {"user_id": 2, "group_id": 20},
+		}, seen)
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		config.Storage = nil
+		config.DataDir = t.TempDir()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+		table, err := db.GetTable("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user_id", "group_id"}, table.PrimaryKeys)
+
+		err = db.Insert("memberships", key(2, 20))
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+		result, err := db.Query("memberships", []string{"group_id"}, map[string]interface{}{"user_id": 2}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"group_id": 10}, {"group_id": 20}}, result)
+	})
+
+	t.Run("Alter", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("memberships", columns))
+		_, err = db.InsertMany("memberships", seed, BatchAtomic)
+		assert.NoError(t, err)
+
+		assert.ErrorIs(t, db.AlterTable("memberships", DropColumn("group_id")), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("memberships", ChangeType("group_id", String)), ErrInvalidOperation)
+		assert.NoError(t, db.AlterTable("memberships", RenameColumn("group_id", "team_id")))
+
+		table, err := db.GetTable("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user_id", "team_id"}, table.PrimaryKeys)
+		result, err := db.Query("memberships", []string{"team_id"}, map[string]interface{}{"user_id": 1, "team_id": 20}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"team_id": 20}}, result)
+	})
+}
@@ -0,0 +1,394 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// rwLock is a reader/writer lock whose acquisition can be abandoned when a
+// context is cancelled or its deadline passes. Waiting writers block new
+// readers so that a steady stream of readers cannot starve them.
+type rwLock struct {
+	mu             sync.Mutex
+	readers        int
+	writer         bool
+	waitingWriters int
+	// changed is closed and replaced whenever the lock state changes
+	changed chan struct{}
+}
+
+// newRWLock creates an unlocked rwLock
+func newRWLock() *rwLock {
+	return &rwLock{changed: make(chan struct{})}
+}
+
+// LockContext acquires the lock exclusively or returns ctx.Err()
+func (l *rwLock) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.waitingWriters++
+	for l.writer || l.readers > 0 {
+		if err := l.wait(ctx); err != nil {
+			l.waitingWriters--
+			l.notify()
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.waitingWriters--
+	l.writer = true
+	l.mu.Unlock()
+	return nil
+}
+
+// RLockContext acquires the lock shared or returns ctx.Err()
+func (l *rwLock) RLockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	for l.writer || l.waitingWriters > 0 {
+		if err := l.wait(ctx); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.readers++
+	l.mu.Unlock()
+	return nil
+}
+
+// Lock acquires the lock exclusively, waiting as long as it takes
+func (l *rwLock) Lock() {
+	_ = l.LockContext(context.Background())
+}
+
+// RLock acquires the lock shared, waiting as long as it takes
+func (l *rwLock) RLock() {
+	_ = l.RLockContext(context.Background())
+}
+
+// Unlock releases an exclusive hold
+func (l *rwLock) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.notify()
+	l.mu.Unlock()
+}
+
+// RUnlock releases a shared hold
+func (l *rwLock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	l.notify()
+	l.mu.Unlock()
+}
+
+// wait releases l.mu until the state changes or ctx ends, then reacquires
+// it. Callers hold l.mu.
+func (l *rwLock) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	changed := l.changed
+	l.mu.Unlock()
+	select {
+	case <-changed:
+		l.mu.Lock()
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		return ctx.Err()
+	}
+}
+
+// notify wakes every waiter. Callers hold l.mu.
+func (l *rwLock) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// LockMode is the strength of a lock taken through a LockManager. Intention
+// modes are taken on a table by operations that go on to lock single keys.
+type LockMode int
+
+const (
+	LockIntentShared    LockMode = iota // reading some keys of a table
+	LockIntentExclusive                 // writing some keys of a table
+	LockShared                          // reading a whole table or one key
+	LockExclusive                       // writing a whole table or one key
+)
+
+// lockCompatible reports whether two owners may hold the given modes at once
+var lockCompatible = [4][4]bool{
+	LockIntentShared:    {true, true, true, false},
+	LockIntentExclusive: {true, true, false, false},
+	LockShared:          {true, false, true, false},
+	LockExclusive:       {false, false, false, false},
+}
+
+// String returns the conventional abbreviation of the mode
+func (m LockMode) String() string {
+	switch m {
+	case LockIntentShared:
+		return "IS"
+	case LockIntentExclusive:
+		return "IX"
+	case LockShared:
+		return "S"
+	case LockExclusive:
+		return "X"
+	}
+	return fmt.Sprintf("LockMode(%d)", int(m))
+}
+
+// covers reports whether holding m also grants other
+func (m LockMode) covers(other LockMode) bool {
+	switch m {
+	case LockExclusive:
+		return true
+	case LockShared:
+		return other == LockShared || other == LockIntentShared
+	case LockIntentExclusive:
+		return other == LockIntentExclusive || other == LockIntentShared
+	}
+	return other == LockIntentShared
+}
+
+// joinModes returns the weakest mode that grants both a and b
+func joinModes(a, b LockMode) LockMode {
+	if a.covers(b) {
+		return a
+	}
+	if b.covers(a) {
+		return b
+	}
+	return LockExclusive
+}
+
+// lockResource names a lockable table, or a key within it
+type lockResource struct {
+	table string
+	key   string // empty for the whole table
+}
+
+func (r lockResource) String() string {
+	if r.key == "" {
+		return "table " + r.table
+	}
+	return fmt.Sprintf("key %s of table %s", r.key, r.table)
+}
+
+// lockState tracks the owners holding or waiting for one resource
+type lockState struct {
+	holders map[uint64]LockMode
+	waiters int
+	// changed is closed and replaced whenever a holder releases the resource
+	changed chan struct{}
+}
+
+// lockWait records the resource an owner is blocked on
+type lockWait struct {
+	resource lockResource
+	mode     LockMode
+}
+
+// LockManager grants shared and exclusive locks on tables and on single keys
+// within them. A request that would complete a cycle of waiting owners fails
+// with ErrDeadlock, and one that waits longer than the timeout fails with
+// ErrLockTimeout.
+type LockManager struct {
+	timeout   time.Duration
+	mu        sync.Mutex
+	nextOwner uint64
+	states    map[lockResource]*lockState
+	waits     map[uint64]lockWait
+}
+
+// NewLockManager creates a lock manager. A timeout of 0 lets requests wait
+// until their context ends.
+func NewLockManager(timeout time.Duration) *LockManager {
+	return &LockManager{
+		timeout: timeout,
+		states:  make(map[lockResource]*lockState),
+		waits:   make(map[uint64]lockWait),
+	}
+}
+
+// Locker holds the locks of one operation until Release. It is not safe for
+// concurrent use.
+type Locker struct {
+	lm    *LockManager
+	owner uint64
+	held  map[lockResource]bool
+}
+
+// NewLocker returns a Locker for a new owner
+func (lm *LockManager) NewLocker() *Locker {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.nextOwner++
+	return &Locker{lm: lm, owner: lm.nextOwner, held: make(map[lockResource]bool)}
+}
+
+// LockTable locks a whole table
+func (l *Locker) LockTable(ctx context.Context, table string, mode LockMode) error {
+	return l.lock(ctx, lockResource{table: table}, mode)
+}
+
+// LockKey locks the record with the given primary key. Callers first take
+// an intention lock on the table.
+func (l *Locker) LockKey(ctx context.Context, table string, key interface{}, mode LockMode) error {
+	return l.lock(ctx, lockResource{table: table, key: lockKeyString(key)}, mode)
+}
+
+// LockValue locks one value of a column, as when enforcing uniqueness.
+// Callers first take an intention lock on the table.
+func (l *Locker) LockValue(ctx context.Context, table, column string, value interface{}, mode LockMode) error {
+	return l.lock(ctx, lockResource{table: table, key: column + "=" + lockKeyString(value)}, mode)
+}
+
+// Release drops every lock held by the Locker
+func (l *Locker) Release() {
+	lm := l.lm
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for resource := range l.held {
+		state := lm.states[resource]
+		delete(state.holders, l.owner)
+		close(state.changed)
+		state.changed = make(chan struct{})
+		lm.cleanup(resource, state)
+	}
+	l.held = make(map[lockResource]bool)
+}
+
+// lock acquires resource in mode, upgrading a weaker hold of the same owner
+func (l *Locker) lock(ctx context.Context, resource lockResource, mode LockMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lm := l.lm
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	state, ok := lm.states[resource]
+	if !ok {
+		state = &lockState{holders: make(map[uint64]LockMode), changed: make(chan struct{})}
+		lm.states[resource] = state
+	}
+	if held, ok := state.holders[l.owner]; ok {
+		if held.covers(mode) {
+			return nil
+		}
+		mode = joinModes(held, mode)
+	}
+
+	var timeout <-chan time.Time
+	if lm.timeout > 0 {
+		timer := time.NewTimer(lm.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for !lm.grantable(state, l.owner, mode) {
+		lm.waits[l.owner] = lockWait{resource: resource, mode: mode}
+		if lm.deadlocked(l.owner) {
+			delete(lm.waits, l.owner)
+			lm.cleanup(resource, state)
+			return fmt.Errorf("%w: waiting for %s on %s", ErrDeadlock, mode, resource)
+		}
+
+		state.waiters++
+		changed := state.changed
+		lm.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timeout:
+			err = fmt.Errorf("%w: waited %s for %s on %s", ErrLockTimeout, lm.timeout, mode, resource)
+		}
+
+		lm.mu.Lock()
+		state.waiters--
+		delete(lm.waits, l.owner)
+		if err != nil {
+			lm.cleanup(resource, state)
+			return err
+		}
+	}
+
+	state.holders[l.owner] = mode
+	l.held[resource] = true
+	return nil
+}
+
+// grantable reports whether owner may take mode on a resource. Callers hold lm.mu.
+func (lm *LockManager) grantable(state *lockState, owner uint64, mode LockMode) bool {
+	for holder, held := range state.holders {
+		if holder != owner && !lockCompatible[mode][held] {
+			return false
+		}
+	}
+	return true
+}
+
+// deadlocked reports whether owner waits, directly or through other waiting
+// owners, on a lock that owner itself holds. Callers hold lm.mu.
+func (lm *LockManager) deadlocked(owner uint64) bool {
+	visited := make(map[uint64]bool)
+	stack := []uint64{owner}
+	for len(stack) > 0 {
+		waiter := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		wait, ok := lm.waits[waiter]
+		if !ok {
+			continue
+		}
+		for holder, held := range lm.states[wait.resource].holders {
+			if holder == waiter || lockCompatible[wait.mode][held] {
+				continue
+			}
+			if holder == owner {
+				return true
+			}
+			if !visited[holder] {
+				visited[holder] = true
+				stack = append(stack, holder)
+			}
+		}
+	}
+	return false
+}
+
+// cleanup forgets a resource nobody holds or waits for. Callers hold lm.mu.
+func (lm *LockManager) cleanup(resource lockResource, state *lockState) {
+	if len(state.holders) == 0 && state.waiters == 0 {
+		delete(lm.states, resource)
+	}
+}
+
+// lockKeyString returns the canonical form of a key value, so that equal
+// keys of different Go types share a lock
+func lockKeyString(key interface{}) string {
+	if encoded, err := storage.EncodeKey(key); err == nil {
+		return encoded
+	}
+	return fmt.Sprintf("%T:%v", key, key)
+}
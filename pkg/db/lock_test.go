@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRWLock(t *testing.T) {
+	t.Run("Shared Holders", func(t *testing.T) {
+		l := newRWLock()
+		assert.NoError(t, l.RLockContext(context.Background()))
+		assert.NoError(t, l.RLockContext(context.Background()))
+		l.RUnlock()
+		l.RUnlock()
+		assert.NoError(t, l.LockContext(context.Background()))
+		l.Unlock()
+	})
+
+	t.Run("Wait Abandoned On Deadline", func(t *testing.T) {
+		l := newRWLock()
+		l.RLock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, l.LockContext(ctx), context.DeadlineExceeded)
+
+		// The abandoned writer no longer blocks readers
+		assert.NoError(t, l.RLockContext(context.Background()))
+		l.RUnlock()
+		l.RUnlock()
+	})
+
+	t.Run("Writer Wakes Reader", func(t *testing.T) {
+		l := newRWLock()
+		l.Lock()
+
+		acquired := make(chan error, 1)
+		go func() { acquired <- l.RLockContext(context.Background()) }()
+
+		time.Sleep(10 * time.Millisecond)
+		l.Unlock()
+		assert.NoError(t, <-acquired)
+		l.RUnlock()
+	})
+}
+
+func TestContextCancellation(t *testing.T) {
+	db := newTestDB(t, 20)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("Cancelled Context", func(t *testing.T) {
+		_, err := db.QueryContext(cancelled, "users", nil, nil, 0, 0)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		err = db.InsertContext(cancelled, "users", map[string]interface{}{"id": 100, "name": "x", "age": 1})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		err = db.CreateIndexContext(cancelled, "users", CreateIndexOptions{Name: "idx_age", Columns: []string{"age"}})
+		assert.ErrorIs(t, err, context.Canceled)
+		indexes, err := db.ListIndexes("users")
+		assert.NoError(t, err)
+		assert.Empty(t, indexes)
+
+		_, err = db.QueryIter(cancelled, "users", nil, nil, 0, 0)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Lock Wait Cancelled", func(t *testing.T) {
+		// Hold the write lock so the query has to wait for it
+		impl := db.(*database)
+		impl.mu.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := db.QueryContext(ctx, "users", nil, nil, 0, 0)
+		impl.mu.Unlock()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Query Timeout", func(t *testing.T) {
+		config := newTestConfig()
+		config.QueryTimeout = 20 * time.Millisecond
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		err = db.CreateTable("users", []Column{{Name: "id", Type: Int, PrimaryKey: true}})
+		assert.NoError(t, err)
+
+		impl := db.(*database)
+		impl.mu.Lock()
+		_, err = db.Query("users", nil, nil, 0, 0)
+		impl.mu.Unlock()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// An explicit deadline takes precedence over the configured timeout
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err = db.QueryContext(ctx, "users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+	})
+}
+
+func TestLockManager(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Compatibility", func(t *testing.T) {
+		lm := NewLockManager(20 * time.Millisecond)
+		a, b := lm.NewLocker(), lm.NewLocker()
+		defer a.Release()
+		defer b.Release()
+
+		// Writers of different keys share the table
+		assert.NoError(t, a.LockTable(ctx, "users", LockIntentExclusive))
+		assert.NoError(t, b.LockTable(ctx, "users", LockIntentExclusive))
+		assert.NoError(t, a.LockKey(ctx, "users", 1, LockExclusive))
+		assert.NoError(t, b.LockKey(ctx, "users", 2, LockExclusive))
+
+		// Equal keys of different types share a lock
+		assert.ErrorIs(t, b.LockKey(ctx, "users", int64(1), LockShared), ErrLockTimeout)
+
+		// A whole-table lock waits for the key writers
+		c := lm.NewLocker()
+		assert.ErrorIs(t, c.LockTable(ctx, "users", LockShared), ErrLockTimeout)
+		assert.NoError(t, c.LockTable(ctx, "orders", LockExclusive))
+		c.Release()
+
+		a.Release()
+		b.Release()
+		assert.NoError(t, c.LockTable(ctx, "users", LockShared))
+		c.Release()
+	})
+
+	t.Run("Upgrade", func(t *testing.T) {
+		lm := NewLockManager(20 * time.Millisecond)
+		a, b := lm.NewLocker(), lm.NewLocker()
+		defer a.Release()
+		defer b.Release()
+
+		assert.NoError(t, a.LockKey(ctx, "users", 1, LockShared))
+		assert.NoError(t, a.LockKey(ctx, "users", 1, LockExclusive))
+		assert.ErrorIs(t, b.LockKey(ctx, "users", 1, LockShared), ErrLockTimeout)
+
+		// Shared plus intention exclusive is exclusive
+		assert.Equal(t, LockExclusive, joinModes(LockShared, LockIntentExclusive))
+	})
+
+	t.Run("Waiter Granted On Release", func(t *testing.T) {
+		lm := NewLockManager(0)
+		a, b := lm.NewLocker(), lm.NewLocker()
+
+		assert.NoError(t, a.LockKey(ctx, "users", 1, LockExclusive))
+		acquired := make(chan error, 1)
+		go func() { acquired <- b.LockKey(ctx, "users", 1, LockExclusive) }()
+
+		time.Sleep(10 * time.Millisecond)
+		a.Release()
+		assert.NoError(t, <-acquired)
+		b.Release()
+		assert.Empty(t, lm.states)
+	})
+
+	t.Run("Deadlock", func(t *testing.T) {
+		lm := NewLockManager(0)
+		a, b := lm.NewLocker(), lm.NewLocker()
+
+		assert.NoError(t, a.LockKey(ctx, "users", 1, LockExclusive))
+		assert.NoError(t, b.LockKey(ctx, "users", 2, LockExclusive))
+
+		acquired := make(chan error, 1)
+		go func() { acquired <- a.LockKey(ctx, "users", 2, LockExclusive) }()
+		time.Sleep(10 * time.Millisecond)
+
+		// b closes the cycle and is refused; a proceeds once b gives up
+		assert.ErrorIs(t, b.LockKey(ctx, "users", 1, LockExclusive), ErrDeadlock)
+		b.Release()
+		assert.NoError(t, <-acquired)
+		a.Release()
+	})
+
+	t.Run("Context Cancelled", func(t *testing.T) {
+		lm := NewLockManager(0)
+		a, b := lm.NewLocker(), lm.NewLocker()
+		defer a.Release()
+
+		assert.NoError(t, a.LockTable(ctx, "users", LockExclusive))
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, b.LockTable(waitCtx, "users", LockIntentShared), context.DeadlineExceeded)
+	})
+}
+
+func TestRowLocking(t *testing.T) {
+	config := newTestConfig()
+	config.LockTimeout = 20 * time.Millisecond
+	db, err := New("test_db", config)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for _, name := range []string{"users", "orders"} {
+		err := db.CreateTable(name, []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "email", Type: String, Unique: true},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 1, "email": "a@example.com"}))
+
+	// Hold user 1 as an in-flight writer would
+	impl := db.(*database)
+	locker := impl.locks.NewLocker()
+	table, _ := db.GetTable("users")
+	assert.NoError(t, lockRecord(context.Background(), locker, table, 1, map[string]interface{}{"email": "b@example.com"}))
+
+	// Other keys and other tables are not blocked
+	assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 2, "email": "c@example.com"}))
+	assert.NoError(t, db.Insert("orders", map[string]interface{}{"id": 1, "email": "b@example.com"}))
+	_, err = db.Query("users", nil, nil, 0, 0)
+	assert.NoError(t, err)
+
+	// The same key, or a unique value being written, is
+	err = db.Update("users", map[string]interface{}{"email": "d@example.com"}, map[string]interface{}{"id": 1})
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	err = db.Insert("users", map[string]interface{}{"id": 3, "email": "b@example.com"})
+	assert.ErrorIs(t, err, ErrLockTimeout)
+
+	// As is building an index on the table
+	err = db.CreateIndex("users", CreateIndexOptions{Name: "idx_id", Columns: []string{"id"}})
+	assert.ErrorIs(t, err, ErrLockTimeout)
+
+	locker.Release()
+	assert.NoError(t, db.Delete("users", map[string]interface{}{"id": 1}))
+	assert.NoError(t, db.CreateIndex("users", CreateIndexOptions{Name: "idx_id", Columns: []string{"id"}}))
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// pageSeekBatch is the number of index entries read per index seek
+const pageSeekBatch = 64
+
+// pageToken is the decoded form of a continuation token. Keys are tagged
+// with their type so that their Go types survive the round trip.
+type pageToken struct {
+	Table      string     `json:"t"`
+	OrderBy    string     `json:"o"`
+	Descending bool       `json:"d,omitempty"`
+	Key        *pageValue `json:"k,omitempty"` // nil when the row had no sort value
+	PK         pageValue  `json:"p"`
+}
+
+// pageValue is a sort value or primary key in a page token: a type tag and
+// the JSON form of the value, or the elements of a composite key
+type pageValue struct {
+	Type     string          `json:"t"`
+	Value    json.RawMessage `json:"v,omitempty"`
+	Elements []pageValue     `json:"e,omitempty"`
+}
+
+// Type tags of page token values
+const (
+	pageInt     = "i"
+	pageUint    = "u"
+	pageFloat   = "f"
+	pageString  = "s"
+	pageBool    = "b"
+	pageTime    = "t"
+	pageDecimal = "d"
+	pageTuple   = "l"
+)
+
+// pageRow is a row together with its position in the page order
+type pageRow struct {
+	pos  IndexEntry
+	data map[string]interface{}
+}
+
+// QueryPage implements Database.QueryPage. Rows are ordered by the sort
+// column and then the primary key, and each page resumes strictly after the
+// last row of the previous one, so rows inserted or deleted between pages
+// never cause rows to be skipped or repeated.
+func (db *database) QueryPage(ctx context.Context, tableName string, options PageOptions) (*Page, error) {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if err := validateColumns(table, options.Columns); err != nil {
+		return nil, err
+	}
+	if options.Limit <= 0 {
+		return nil, fmt.Errorf("%w: page limit must be positive", ErrInvalidOperation)
+	}
+
+	orderBy := options.OrderBy
+	if orderBy == "" {
+		orderBy = table.PrimaryKey
+	}
+	if err := validateColumns(table, []string{orderBy}); err != nil {
+		return nil, err
+	}
+
+	var after *IndexEntry
+	if options.PageToken != "" {
+		pos, err := decodePageToken(options.PageToken, tableName, orderBy, options.Descending)
+		if err != nil {
+			return nil, err
+		}
+		after = &pos
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockTable(ctx, tableName, LockIntentShared); err != nil {
+		return nil, err
+	}
+
+	// One row beyond the page tells whether another page follows
+	indexManager := db.indexes[tableName]
+	var rows []pageRow
+	var err error
+	if index, ok := indexManager.FindColumnIndex(orderBy); ok {
+		rows, err = db.seekPage(ctx, table, index, orderBy, options, after)
+	} else {
+		rows, err = db.scanPage(ctx, table, orderBy, options, after)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan records: %w", err)
+	}
+
+	page := &Page{}
+	if len(rows) > options.Limit {
+		rows = rows[:options.Limit]
+		token, err := encodePageToken(tableName, orderBy, options.Descending, rows[len(rows)-1].pos)
+		if err != nil {
+			return nil, err
+		}
+		page.NextPageToken = token
+	}
+
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+	page.Rows = make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		page.Rows[i] = projectColumns(row.data, options.Columns)
+		if err := reservation.Grow(memory.SizeOf(page.Rows[i])); err != nil {
+			return nil, fmt.Errorf("query on table %s: %w", tableName, err)
+		}
+	}
+	return page, nil
+}
+
+// seekPage reads up to Limit+1 matching rows in index order after the given
+// position
+func (db *database) seekPage(ctx context.Context, table *Table, index *MemoryIndex, orderBy string, options PageOptions, after *IndexEntry) ([]pageRow, error) {
+	var rows []pageRow
+	for len(rows) <= options.Limit {
+		entries := index.Seek(after, pageSeekBatch, options.Descending)
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			record, err := db.storage.Read(table.Name, entry.Value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read record: %w", err)
+			}
+			if record == nil {
+				continue
+			}
+			data := decodeRecord(table, record)
+			// A record updated since the seek is visited at its new position
+			if compareValues(data[orderBy], entry.Key) != 0 || !matchesWhere(data, options.Where) {
+				continue
+			}
+			rows = append(rows, pageRow{pos: entry, data: data})
+			if len(rows) > options.Limit {
+				break
+			}
+		}
+		after = &entries[len(entries)-1]
+	}
+	return rows, nil
+}
+
+// scanPage finds the first Limit+1 matching rows after the given position
+// with a full table scan, keeping only those candidates in memory
+func (db *database) scanPage(ctx context.Context, table *Table, orderBy string, options PageOptions, after *IndexEntry) ([]pageRow, error) {
+	before := func(a, b IndexEntry) bool {
+		if options.Descending {
+			return compareEntries(a, b) > 0
+		}
+		return compareEntries(a, b) < 0
+	}
+
+	var rows []pageRow
+	err := db.storage.Scan(table.Name, func(record *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data := decodeRecord(table, record)
+		if !matchesWhere(data, options.Where) {
+			return nil
+		}
+		id, _ := table.recordID(data)
+		pos := IndexEntry{Key: data[orderBy], Value: id}
+		if after != nil && !before(*after, pos) {
+			return nil
+		}
+
+		i := sort.Search(len(rows), func(i int) bool { return before(pos, rows[i].pos) })
+		if i > options.Limit {
+			return nil
+		}
+		rows = append(rows, pageRow{})
+		copy(rows[i+1:], rows[i:])
+		rows[i] = pageRow{pos: pos, data: data}
+		if len(rows) > options.Limit+1 {
+			rows = rows[:options.Limit+1]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// encodePageToken returns the opaque token that resumes a query after pos
+func encodePageToken(tableName, orderBy string, descending bool, pos IndexEntry) (string, error) {
+	token := pageToken{Table: tableName, OrderBy: orderBy, Descending: descending}
+	if pos.Key != nil {
+		key, err := encodePageValue(pos.Key)
+		if err != nil {
+			return "", fmt.Errorf("column %s cannot be used for pagination: %w", orderBy, err)
+		}
+		token.Key = &key
+	}
+	pk, err := encodePageValue(pos.Value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	token.PK = pk
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken returns the position a token resumes after. The token must
+// come from a query on the same table, sort column and direction.
+func decodePageToken(encoded, tableName, orderBy string, descending bool) (IndexEntry, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return IndexEntry{}, ErrInvalidPageToken
+	}
+	var token pageToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return IndexEntry{}, ErrInvalidPageToken
+	}
+	if token.Table != tableName || token.OrderBy != orderBy || token.Descending != descending {
+		return IndexEntry{}, fmt.Errorf("%w: token belongs to a different query", ErrInvalidPageToken)
+	}
+
+	var pos IndexEntry
+	if token.Key != nil {
+		if pos.Key, err = decodePageValue(*token.Key); err != nil {
+			return IndexEntry{}, ErrInvalidPageToken
+		}
+	}
+	if pos.Value, err = decodePageValue(token.PK); err != nil {
+		return IndexEntry{}, ErrInvalidPageToken
+	}
+	return pos, nil
+}
+
+// encodePageValue tags a sort value or primary key with its type
+func encodePageValue(v interface{}) (pageValue, error) {
+	var tag string
+	switch n := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32:
+		tag = pageInt
+	case uint64:
+		tag = pageUint
+		if n <= math.MaxInt64 {
+			tag = pageInt
+		}
+	case float32, float64:
+		// JSON has no NaN or infinities, so those are encoded as strings
+		if f := toFloat64(n); math.IsNaN(f) || math.IsInf(f, 0) {
+			data, _ := json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+			return pageValue{Type: pageFloat, Value: data}, nil
+		}
+		tag = pageFloat
+	case string:
+		tag = pageString
+	case bool:
+		tag = pageBool
+	case time.Time:
+		tag = pageTime
+	case DecimalValue:
+		tag = pageDecimal
+	case []interface{}:
+		elements := make([]pageValue, len(n))
+		for i, element := range n {
+			e, err := encodePageValue(element)
+			if err != nil {
+				return pageValue{}, err
+			}
+			elements[i] = e
+		}
+		return pageValue{Type: pageTuple, Elements: elements}, nil
+	default:
+		return pageValue{}, fmt.Errorf("%w: unsupported value type %T", ErrInvalidOperation, v)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return pageValue{}, err
+	}
+	return pageValue{Type: tag, Value: data}, nil
+}
+
+// decodePageValue restores a value tagged by encodePageValue
+func decodePageValue(v pageValue) (interface{}, error) {
+	switch v.Type {
+	case pageInt:
+		var n int64
+		err := json.Unmarshal(v.Value, &n)
+		return intValue(n), err
+	case pageUint:
+		var n uint64
+		err := json.Unmarshal(v.Value, &n)
+		return n, err
+	case pageFloat:
+		var s string
+		if json.Unmarshal(v.Value, &s) == nil {
+			return strconv.ParseFloat(s, 64)
+		}
+		var f float64
+		err := json.Unmarshal(v.Value, &f)
+		return f, err
+	case pageString:
+		var s string
+		err := json.Unmarshal(v.Value, &s)
+		return s, err
+	case pageBool:
+		var b bool
+		err := json.Unmarshal(v.Value, &b)
+		return b, err
+	case pageTime:
+		var t time.Time
+		err := json.Unmarshal(v.Value, &t)
+		return t, err
+	case pageDecimal:
+		var d DecimalValue
+		err := json.Unmarshal(v.Value, &d)
+		return d, err
+	case pageTuple:
+		if len(v.Elements) == 0 {
+			return nil, ErrInvalidPageToken
+		}
+		tuple := make([]interface{}, len(v.Elements))
+		for i, element := range v.Elements {
+			value, err := decodePageValue(element)
+			if err != nil {
+				return nil, err
+			}
+			tuple[i] = value
+		}
+		return tuple, nil
+	}
+	return nil, ErrInvalidPageToken
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collectPages reads every page of a query and returns the ids in order
+func collectPages(t *testing.T, db Database, options PageOptions) []interface{} {
+	var ids []interface{}
+	for {
+		page, err := db.QueryPage(context.Background(), "users", options)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Rows), options.Limit)
+		for _, row := range page.Rows {
+			ids = append(ids, row["id"])
+		}
+		if page.NextPageToken == "" {
+			return ids
+		}
+		options.PageToken = page.NextPageToken
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	db := newTestDB(t, 25)
+	err := db.CreateIndex("users", CreateIndexOptions{Name: "idx_age", Columns: []string{"age"}})
+	assert.NoError(t, err)
+
+	t.Run("Primary Key Order", func(t *testing.T) {
+		ids := collectPages(t, db, PageOptions{Columns: []string{"id"}, Limit: 10})
+		assert.Len(t, ids, 25)
+		for i, id := range ids {
+			assert.Equal(t, i, id)
+		}
+	})
+
+	t.Run("Indexed Column Descending", func(t *testing.T) {
+		ids := collectPages(t, db, PageOptions{OrderBy: "age", Descending: true, Limit: 4})
+		assert.Len(t, ids, 25)
+		// Ages descend and ties are broken by descending id
+		assert.Equal(t, []interface{}{19, 9, 18, 8, 17}, ids[:5])
+	})
+
+	t.Run("Unindexed Column With Where", func(t *testing.T) {
+		ids := collectPages(t, db, PageOptions{
+			Columns: []string{"id"},
+			Where:   map[string]interface{}{"age": 3},
+			OrderBy: "name",
+			Limit:   1,
+		})
+		assert.Equal(t, []interface{}{3, 13, 23}, ids)
+	})
+
+	t.Run("Stable Under Concurrent Writes", func(t *testing.T) {
+		options := PageOptions{Limit: 10}
+		page, err := db.QueryPage(context.Background(), "users", options)
+		assert.NoError(t, err)
+		assert.Equal(t, 9, page.Rows[9]["id"])
+
+		// Rows inserted or deleted before the cursor do not shift the next page
+		assert.NoError(t, db.Delete("users", map[string]interface{}{"id": 0}))
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": -1, "name": "user", "age": 0}))
+
+		options.PageToken = page.NextPageToken
+		page, err = db.QueryPage(context.Background(), "users", options)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, page.Rows[0]["id"])
+	})
+
+	t.Run("Invalid Tokens", func(t *testing.T) {
+		page, err := db.QueryPage(context.Background(), "users", PageOptions{Limit: 5})
+		assert.NoError(t, err)
+
+		_, err = db.QueryPage(context.Background(), "users", PageOptions{Limit: 5, PageToken: "not a token"})
+		assert.ErrorIs(t, err, ErrInvalidPageToken)
+
+		// Tokens only resume the query they came from
+		_, err = db.QueryPage(context.Background(), "users", PageOptions{OrderBy: "age", Limit: 5, PageToken: page.NextPageToken})
+		assert.ErrorIs(t, err, ErrInvalidPageToken)
+
+		_, err = db.QueryPage(context.Background(), "users", PageOptions{})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+	})
+
+	t.Run("Sort Value Types", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		err = db.CreateTable("users", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "name", Type: String},
+			{Name: "joined", Type: DateTime},
+			{Name: "balance", Type: Decimal, Precision: 8, Scale: 2},
+		})
+		assert.NoError(t, err)
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 7; i++ {
+			assert.NoError(t, db.Insert("users", map[string]interface{}{
+				"id":      i,
+				"name":    strings.Repeat("x", 200) + string(rune('g'-i)),
+				"joined":  start.Add(time.Duration(i) * time.Hour),
+				"balance": NewDecimal(int64(700-i*100), 2),
+			}))
+		}
+
+		// Times, long strings and decimals all resume where the page ended
+		assert.Equal(t, []interface{}{0, 1, 2, 3, 4, 5, 6}, collectPages(t, db, PageOptions{OrderBy: "joined", Limit: 2}))
+		assert.Equal(t, []interface{}{6, 5, 4, 3, 2, 1, 0}, collectPages(t, db, PageOptions{OrderBy: "name", Limit: 2}))
+		assert.Equal(t, []interface{}{6, 5, 4, 3, 2, 1, 0}, collectPages(t, db, PageOptions{OrderBy: "balance", Limit: 3}))
+		err = db.CreateIndex("users", CreateIndexOptions{Name: "idx_balance", Columns: []string{"balance"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{0, 1, 2, 3, 4, 5, 6}, collectPages(t, db, PageOptions{OrderBy: "balance", Descending: true, Limit: 3}))
+	})
+
+	t.Run("Non-Finite Floats", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		err = db.CreateTable("users", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "score", Type: Float},
+		})
+		assert.NoError(t, err)
+		scores := []float64{math.Inf(1), 1.5, math.NaN(), math.Inf(-1), math.NaN()}
+		for i, score := range scores {
+			assert.NoError(t, db.Insert("users", map[string]interface{}{"id": i, "score": score}))
+		}
+
+		// NaN sorts first, then the infinities bound the finite values
+		want := []interface{}{2, 4, 3, 1, 0}
+		assert.Equal(t, want, collectPages(t, db, PageOptions{OrderBy: "score", Limit: 1}))
+		err = db.CreateIndex("users", CreateIndexOptions{Name: "idx_score", Columns: []string{"score"}})
+		assert.NoError(t, err)
+		assert.Equal(t, want, collectPages(t, db, PageOptions{OrderBy: "score", Limit: 1}))
+	})
+}
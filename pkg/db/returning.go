@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// ReturnedRow is a row written or deleted by a Returning variant together
+// with the version of its record: the version the write stored, or for a
+// deleted row the last version it had. Every write stores a higher version.
+type ReturnedRow struct {
+	Row     map[string]interface{}
+	Version int64
+}
+
+// InsertReturning implements Database.InsertReturning
+func (db *database) InsertReturning(ctx context.Context, tableName string, data map[string]interface{}, columns []string) (ReturnedRow, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return ReturnedRow{}, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return ReturnedRow{}, ErrTableNotFound
+	}
+	if err := validateColumns(table, columns); err != nil {
+		return ReturnedRow{}, err
+	}
+
+	record, err := db.insertRow(ctx, table, data)
+	if err != nil {
+		return ReturnedRow{}, err
+	}
+	return returnedRow(record, columns), nil
+}
+
+// UpdateReturning implements Database.UpdateReturning
+func (db *database) UpdateReturning(ctx context.Context, tableName string, data map[string]interface{}, where map[string]interface{}, columns []string) ([]ReturnedRow, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if err := validateColumns(table, columns); err != nil {
+		return nil, err
+	}
+
+	records, err := db.updateRows(ctx, table, data, where)
+	if err != nil {
+		return nil, err
+	}
+	return returnedRows(records, columns), nil
+}
+
+// DeleteReturning implements Database.DeleteReturning
+func (db *database) DeleteReturning(ctx context.Context, tableName string, where map[string]interface{}, columns []string) ([]ReturnedRow, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if err := validateColumns(table, columns); err != nil {
+		return nil, err
+	}
+
+	records, err := db.deleteRows(ctx, table, where)
+	if err != nil {
+		return nil, err
+	}
+	return returnedRows(records, columns), nil
+}
+
+// returnedRow copies the data of record keeping only the requested
+// columns, so callers never share maps with storage or the cache
+func returnedRow(record *storage.Record, columns []string) ReturnedRow {
+	return ReturnedRow{Row: projectColumns(record.Data, columns), Version: record.Version}
+}
+
+// returnedRows applies returnedRow to each record
+func returnedRows(records []*storage.Record, columns []string) []ReturnedRow {
+	result := make([]ReturnedRow, len(records))
+	for i, record := range records {
+		result[i] = returnedRow(record, columns)
+	}
+	return result
+}
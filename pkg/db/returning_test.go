@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storedVersion returns the version of a record as storage holds it
+func storedVersion(t *testing.T, db Database, table string, id interface{}) int64 {
+	record, err := db.(*database).storage.Read(table, id)
+	if !assert.NoError(t, err) || !assert.NotNil(t, record) {
+		return 0
+	}
+	return record.Version
+}
+
+// returnedData returns the rows of returned without their versions
+func returnedData(returned []ReturnedRow) []map[string]interface{} {
+	rows := make([]map[string]interface{}, len(returned))
+	for i, r := range returned {
+		rows[i] = r.Row
+	}
+	return rows
+}
+
+func TestReturning(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, 10)
+	var version int64
+
+	t.Run("Insert", func(t *testing.T) {
+		row, err := db.InsertReturning(ctx, "users", map[string]interface{}{"id": 10, "name": "new", "age": 30}, []string{"id", "name"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"id": 10, "name": "new"}, row.Row)
+		assert.Equal(t, storedVersion(t, db, "users", 10), row.Version)
+		version = row.Version
+
+		_, err = db.InsertReturning(ctx, "users", map[string]interface{}{"id": 10, "name": "again"}, nil)
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+	})
+
+	t.Run("Update Merges Row", func(t *testing.T) {
+		rows, err := db.UpdateReturning(ctx, "users", map[string]interface{}{"age": 31}, map[string]interface{}{"id": 10}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 10, "name": "new", "age": 31}}, returnedData(rows))
+		if assert.Len(t, rows, 1) {
+			assert.Greater(t, rows[0].Version, version)
+			assert.Equal(t, storedVersion(t, db, "users", 10), rows[0].Version)
+			version = rows[0].Version
+		}
+
+		rows, err = db.UpdateReturning(ctx, "users", map[string]interface{}{"name": "three"}, map[string]interface{}{"id": 3}, []string{"id", "name"})
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 3, "name": "three"}}, returnedData(rows))
+
+		// Like Update, the primary key is required
+		_, err = db.UpdateReturning(ctx, "users", map[string]interface{}{"name": "three"}, map[string]interface{}{"age": 3}, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		_, err = db.UpdateReturning(ctx, "users", map[string]interface{}{"age": 1}, map[string]interface{}{"id": 1}, []string{"missing"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Delete Returns Old Rows", func(t *testing.T) {
+		rows, err := db.DeleteReturning(ctx, "users", map[string]interface{}{"id": 10}, []string{"age"})
+		assert.NoError(t, err)
+		assert.Equal(t, []ReturnedRow{{Row: map[string]interface{}{"age": 31}, Version: version}}, rows)
+
+		rows, err = db.DeleteReturning(ctx, "users", map[string]interface{}{"id": 10}, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, rows)
+
+		_, err = db.DeleteReturning(ctx, "users", map[string]interface{}{"name": "user"}, []string{"id"})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		_, err = db.DeleteReturning(ctx, "users", nil, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+	})
+
+	t.Run("Versions With Foreign Keys", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		err = db.CreateTable("customers", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "email", Type: String, Unique: true},
+		})
+		assert.NoError(t, err)
+		err = db.CreateTable("orders", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "customer_id", Type: Int},
+			{Name: "customer_email", Type: String},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AlterTable("orders", AddForeignKey(ForeignKey{
+			Columns: []string{"customer_email"}, RefTable: "customers", RefColumns: []string{"email"}, OnUpdate: Cascade,
+		})))
+		assert.NoError(t, db.Insert("customers", map[string]interface{}{"id": 2, "email": "b@x"}))
+		assert.NoError(t, db.Insert("orders", map[string]interface{}{"id": 12, "customer_id": 2, "customer_email": "b@x"}))
+
+		row, err := db.InsertReturning(ctx, "orders", map[string]interface{}{"id": 13, "customer_id": 2}, []string{"id"})
+		assert.NoError(t, err)
+		assert.Equal(t, storedVersion(t, db, "orders", 13), row.Version)
+
+		rows, err := db.UpdateReturning(ctx, "customers", map[string]interface{}{"email": "c@x"}, map[string]interface{}{"id": 2}, nil)
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, storedVersion(t, db, "customers", 2), rows[0].Version)
+			// Cascaded changes are written with the same version
+			assert.Equal(t, rows[0].Version, storedVersion(t, db, "orders", 12))
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// rowsBufferSize is the number of rows read ahead of the consumer
+const rowsBufferSize = 16
+
+// Rows is a cursor over the result of QueryIter. Rows are read from
+// storage on a background goroutine as the consumer advances, so only a
+// handful are held in memory at a time.
+//
+//	rows, err := db.QueryIter(ctx, "users", []string{"id", "name"}, nil, 0, 0)
+//	if err != nil {
+//		return err
+//	}
+//	defer rows.Close()
+//	for rows.Next() {
+//		var id int
+//		var name string
+//		if err := rows.Scan(&id, &name); err != nil {
+//			return err
+//		}
+//	}
+//	return rows.Err()
+type Rows struct {
+	columns []string
+	rows    chan map[string]interface{}
+	stop    chan struct{}
+	done    chan struct{}
+	cancel  context.CancelFunc
+	current map[string]interface{}
+
+	// scanErr is written by the producer before rows is closed
+	scanErr error
+	err     error
+	closed  bool
+
+	closeOnce sync.Once
+}
+
+// newRows starts a producer that feeds rows from scan into a new cursor.
+// scan must call emit for every row and stop when emit returns an error.
+// cancel releases ctx once the cursor is closed.
+func newRows(ctx context.Context, cancel context.CancelFunc, columns []string, scan func(emit func(map[string]interface{}) error) error) *Rows {
+	r := &Rows{
+		columns: columns,
+		rows:    make(chan map[string]interface{}, rowsBufferSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	go func() {
+		defer close(r.done)
+		defer close(r.rows)
+
+		err := scan(func(row map[string]interface{}) error {
+			select {
+			case r.rows <- row:
+				return nil
+			case <-r.stop:
+				return errStopScan
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != errStopScan {
+			r.scanErr = err
+		}
+	}()
+
+	return r
+}
+
+// Columns returns the names of the columns in the order used by Scan
+func (r *Rows) Columns() []string {
+	columns := make([]string, len(r.columns))
+	copy(columns, r.columns)
+	return columns
+}
+
+// Next advances to the next row. It returns false when the rows are
+// exhausted, an error occurred or the cursor was closed.
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+
+	row, ok := <-r.rows
+	if !ok {
+		r.err = r.scanErr
+		r.Close()
+		return false
+	}
+	r.current = row
+	return true
+}
+
+// Row returns the current row as a map of column name to value
+func (r *Rows) Row() map[string]interface{} {
+	return r.current
+}
+
+// Scan copies the columns of the current row into the values pointed at
+// by dest, in the order returned by Columns
+func (r *Rows) Scan(dest ...interface{}) error {
+	if r.current == nil {
+		return fmt.Errorf("%w: Scan called without a current row", ErrInvalidOperation)
+	}
+	if len(dest) != len(r.columns) {
+		return fmt.Errorf("%w: expected %d destinations, got %d", ErrInvalidOperation, len(r.columns), len(dest))
+	}
+
+	for i, column := range r.columns {
+		if err := assignValue(dest[i], r.current[column]); err != nil {
+			return fmt.Errorf("column %s: %w", column, err)
+		}
+	}
+	return nil
+}
+
+// Err returns the error, if any, that ended the iteration
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close stops the iteration and releases its resources. It is safe to call
+// Close more than once and after Next has returned false.
+func (r *Rows) Close() error {
+	r.closeOnce.Do(func() {
+		r.closed = true
+		r.current = nil
+		close(r.stop)
+		<-r.done
+		r.cancel()
+	})
+	return nil
+}
+
+// assignValue stores value in the variable pointed at by dest, converting
+// between compatible types
+func assignValue(dest, value interface{}) error {
+	if p, ok := dest.(*interface{}); ok {
+		*p = value
+		return nil
+	}
+
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("%w: destination must be a non-nil pointer", ErrInvalidOperation)
+	}
+	elem := target.Elem()
+
+	if value == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch {
+	case v.Type().AssignableTo(elem.Type()):
+		elem.Set(v)
+	case isNumericKind(v.Kind()) && isNumericKind(elem.Kind()):
+		elem.Set(v.Convert(elem.Type()))
+	default:
+		return fmt.Errorf("%w: cannot assign %T to %s", ErrInvalidDataType, value, elem.Type())
+	}
+	return nil
+}
+
+// isNumericKind reports whether k is an integer or floating point kind
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// QueryIter implements Database.QueryIter
+func (db *database) QueryIter(ctx context.Context, tableName string, columns []string, where map[string]interface{}, limit, offset int) (*Rows, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	table, exists := db.tables[tableName]
+	indexManager := db.indexes[tableName]
+	db.mu.RUnlock()
+
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if err := validateColumns(table, columns); err != nil {
+		return nil, err
+	}
+
+	// Scan fills destinations in the requested order, or in table order
+	order := columns
+	if len(order) == 0 {
+		order = make([]string, len(table.Columns))
+		for i, col := range table.Columns {
+			order[i] = col.Name
+		}
+	}
+
+	// The producer does not hold db.mu, so the consumer may write while iterating
+	ctx, cancel := db.withQueryTimeout(ctx)
+	return newRows(ctx, cancel, order, func(emit func(map[string]interface{}) error) error {
+		return db.scanRows(ctx, table, indexManager, where, limit, offset, func(data map[string]interface{}) error {
+			return emit(projectColumns(data, columns))
+		})
+	}), nil
+}
@@ -0,0 +1,30 @@
+//go:build go1.23
+
+package db
+
+import "iter"
+
+// All returns an iterator over the remaining rows for use with range.
+// Breaking out of the loop closes the rows; an error ending the iteration
+// is yielded as the final element.
+//
+//	for row, err := range rows.All() {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(row["name"])
+//	}
+func (r *Rows) All() iter.Seq2[map[string]interface{}, error] {
+	return func(yield func(map[string]interface{}, error) bool) {
+		defer r.Close()
+
+		for r.Next() {
+			if !yield(r.Row(), nil) {
+				return
+			}
+		}
+		if err := r.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build go1.23
+
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowsAll(t *testing.T) {
+	db := newTestDB(t, 20)
+
+	rows, err := db.QueryIter(context.Background(), "users", nil, nil, 0, 0)
+	assert.NoError(t, err)
+
+	count := 0
+	for row, err := range rows.All() {
+		assert.NoError(t, err)
+		assert.NotNil(t, row["id"])
+		count++
+		if count == 5 {
+			break
+		}
+	}
+	assert.Equal(t, 5, count)
+
+	// Breaking out of the loop closed the rows
+	assert.False(t, rows.Next())
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryIter(t *testing.T) {
+	db := newTestDB(t, 50)
+
+	t.Run("Iterate And Scan", func(t *testing.T) {
+		rows, err := db.QueryIter(context.Background(), "users", []string{"id", "age"}, nil, 0, 0)
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		assert.Equal(t, []string{"id", "age"}, rows.Columns())
+		count := 0
+		for rows.Next() {
+			var id int64
+			var age interface{}
+			assert.NoError(t, rows.Scan(&id, &age))
+			assert.Equal(t, int(id)%10, age)
+			count++
+		}
+		assert.NoError(t, rows.Err())
+		assert.Equal(t, 50, count)
+	})
+
+	t.Run("Limit Offset And Where", func(t *testing.T) {
+		rows, err := db.QueryIter(context.Background(), "users", nil, map[string]interface{}{"age": 3}, 2, 1)
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		count := 0
+		for rows.Next() {
+			assert.Equal(t, 3, rows.Row()["age"])
+			count++
+		}
+		assert.NoError(t, rows.Err())
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("Early Close", func(t *testing.T) {
+		rows, err := db.QueryIter(context.Background(), "users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+
+		assert.True(t, rows.Next())
+		assert.NoError(t, rows.Close())
+		assert.False(t, rows.Next())
+		assert.NoError(t, rows.Err())
+	})
+
+	t.Run("Write While Iterating", func(t *testing.T) {
+		rows, err := db.QueryIter(context.Background(), "users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		for rows.Next() {
+			id := rows.Row()["id"]
+			assert.NoError(t, db.Update("users", map[string]interface{}{"name": "seen"}, map[string]interface{}{"id": id}))
+		}
+		assert.NoError(t, rows.Err())
+	})
+
+	t.Run("Cancelled Context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		rows, err := db.QueryIter(ctx, "users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		assert.True(t, rows.Next())
+		cancel()
+		for rows.Next() {
+		}
+		assert.ErrorIs(t, rows.Err(), context.Canceled)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := db.QueryIter(context.Background(), "missing", nil, nil, 0, 0)
+		assert.Equal(t, ErrTableNotFound, err)
+
+		rows, err := db.QueryIter(context.Background(), "users", []string{"name"}, nil, 1, 0)
+		assert.NoError(t, err)
+		defer rows.Close()
+		assert.True(t, rows.Next())
+		var n int
+		assert.ErrorIs(t, rows.Scan(&n), ErrInvalidDataType)
+	})
+}
@@ -0,0 +1,314 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+var (
+	ErrSequenceExists   = errors.New("sequence already exists")
+	ErrSequenceNotFound = errors.New("sequence not found")
+	// ErrSequenceExhausted is returned by NextVal once the next value of a
+	// sequence would not fit in an int64
+	ErrSequenceExhausted = errors.New("sequence exhausted")
+)
+
+// sequenceTableName is the storage table holding the state of every sequence
+const sequenceTableName = "_sequences"
+
+// defaultSequenceCache is the number of values a sequence reserves at once
+// when SequenceOptions.Cache is zero
+const defaultSequenceCache = 32
+
+// autoIncrementPrefix starts the name of the sequence behind the
+// AutoIncrement column of a table
+const autoIncrementPrefix = "auto:"
+
+// SequenceOptions configures a sequence created by CreateSequence
+type SequenceOptions struct {
+	// Start is the first value (0 = 1). Start-Increment must fit in an
+	// int64.
+	Start     int64
+	Increment int64 // Step between values, may be negative (0 = 1)
+	// Cache is the number of values reserved by each write to storage
+	// (0 = 32). Reserved values not handed out before Close or a crash are
+	// skipped, never reused.
+	Cache int
+}
+
+// sequence hands out the values reserved for one sequence
+type sequence struct {
+	mu    sync.Mutex
+	next  int64 // next value to hand out
+	left  int   // values reserved from next on
+	step  int64
+	cache int
+}
+
+// autoIncrementSequence returns the name of the sequence that numbers the
+// AutoIncrement column of table
+func autoIncrementSequence(table string) string {
+	return autoIncrementPrefix + table
+}
+
+// CreateSequence implements Database.CreateSequence
+func (db *database) CreateSequence(ctx context.Context, name string, options SequenceOptions) error {
+	if name == "" || strings.HasPrefix(name, autoIncrementPrefix) {
+		return fmt.Errorf("%w: invalid sequence name %q", ErrInvalidOperation, name)
+	}
+	if options.Cache < 0 {
+		return fmt.Errorf("%w: sequence cache must not be negative", ErrInvalidOperation)
+	}
+	return db.createSequence(ctx, name, options)
+}
+
+// createSequence stores a new sequence. It returns ErrSequenceExists when
+// the name is taken.
+func (db *database) createSequence(ctx context.Context, name string, options SequenceOptions) error {
+	if options.Start == 0 {
+		options.Start = 1
+	}
+	if options.Increment == 0 {
+		options.Increment = 1
+	}
+	if options.Cache == 0 {
+		options.Cache = defaultSequenceCache
+	}
+	last := options.Start - options.Increment
+	if (options.Increment > 0) != (last < options.Start) {
+		return fmt.Errorf("%w: sequence %s cannot start at %d with increment %d", ErrInvalidOperation, name, options.Start, options.Increment)
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockKey(ctx, sequenceTableName, name, LockExclusive); err != nil {
+		return err
+	}
+
+	record, err := db.storage.Read(sequenceTableName, name)
+	if err != nil {
+		return fmt.Errorf("failed to read sequence %s: %w", name, err)
+	}
+	if record != nil {
+		return fmt.Errorf("%w: %s", ErrSequenceExists, name)
+	}
+
+	// The stored value is the last one reserved, so the first reservation
+	// starts at Start
+	err = db.writeSequence(name, last, options.Increment, options.Cache)
+	if err != nil {
+		return fmt.Errorf("failed to create sequence %s: %w", name, err)
+	}
+	return nil
+}
+
+// ensureSequence creates the named sequence with default options unless it
+// exists
+func (db *database) ensureSequence(ctx context.Context, name string) error {
+	err := db.createSequence(ctx, name, SequenceOptions{})
+	if errors.Is(err, ErrSequenceExists) {
+		return nil
+	}
+	return err
+}
+
+// ensureSequences creates the sequences that number columns of table
+func (db *database) ensureSequences(ctx context.Context, table string, columns []Column) error {
+	for _, col := range columns {
+		name, ok := "", false
+		if col.AutoIncrement {
+			name, ok = autoIncrementSequence(table), true
+		} else if f, isFunc := col.Default.(DefaultFunc); isFunc {
+			name, ok = f.sequence()
+		}
+		if !ok {
+			continue
+		}
+		if err := db.ensureSequence(ctx, name); err != nil {
+			return fmt.Errorf("failed to create sequence for column %s: %w", col.Name, err)
+		}
+	}
+	return nil
+}
+
+// NextVal implements Database.NextVal
+func (db *database) NextVal(ctx context.Context, name string) (int64, error) {
+	seq := db.sequence(name)
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	if seq.left == 0 {
+		if err := db.reserveSequence(ctx, name, seq); err != nil {
+			return 0, err
+		}
+	}
+	value := seq.next
+	seq.next += seq.step
+	seq.left--
+	return value, nil
+}
+
+// sequence returns the in-memory state of the named sequence
+func (db *database) sequence(name string) *sequence {
+	db.seqMu.Lock()
+	defer db.seqMu.Unlock()
+
+	seq, ok := db.sequences[name]
+	if !ok {
+		seq = &sequence{}
+		db.sequences[name] = seq
+	}
+	return seq
+}
+
+// reserveSequence persists the end of the next block of values before any
+// of them is handed out, so a crash can only skip values. Callers hold
+// seq.mu.
+func (db *database) reserveSequence(ctx context.Context, name string, seq *sequence) error {
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockKey(ctx, sequenceTableName, name, LockExclusive); err != nil {
+		return err
+	}
+
+	record, err := db.storage.Read(sequenceTableName, name)
+	if err != nil {
+		return fmt.Errorf("failed to read sequence %s: %w", name, err)
+	}
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	last, err := sequenceField(record, "value", 0)
+	if err == nil {
+		seq.step, err = sequenceField(record, "increment", 1)
+	}
+	cache := int64(defaultSequenceCache)
+	if err == nil {
+		cache, err = sequenceField(record, "cache", defaultSequenceCache)
+	}
+	if err != nil {
+		return fmt.Errorf("sequence %s is corrupt: %w", name, err)
+	}
+
+	// The last block stops at the end of the int64 range
+	n := remainingValues(last, seq.step)
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrSequenceExhausted, name)
+	}
+	n = min(n, uint64(cache))
+	end := last + seq.step*int64(n)
+	if err := db.writeSequence(name, end, seq.step, int(cache)); err != nil {
+		return fmt.Errorf("failed to advance sequence %s: %w", name, err)
+	}
+	seq.next = last + seq.step
+	seq.left = int(n)
+	seq.cache = int(cache)
+	return nil
+}
+
+// remainingValues returns how many values after last a sequence moving by
+// step can hand out before leaving the int64 range. Distances are taken in
+// uint64, where they cannot overflow.
+func remainingValues(last, step int64) uint64 {
+	if step > 0 {
+		return (math.MaxInt64 - uint64(last)) / uint64(step)
+	}
+	// last - MinInt64, and -step, which MinInt64 has no int64 for
+	return (uint64(last) + 1<<63) / (uint64(-(step + 1)) + 1)
+}
+
+// releaseSequences gives back the values reserved but not handed out, so a
+// clean shutdown leaves no gaps
+func (db *database) releaseSequences() error {
+	db.seqMu.Lock()
+	sequences := make(map[string]*sequence, len(db.sequences))
+	for name, seq := range db.sequences {
+		sequences[name] = seq
+	}
+	db.seqMu.Unlock()
+
+	for name, seq := range sequences {
+		seq.mu.Lock()
+		if seq.left > 0 {
+			if err := db.writeSequence(name, seq.next-seq.step, seq.step, seq.cache); err != nil {
+				seq.mu.Unlock()
+				return fmt.Errorf("failed to release sequence %s: %w", name, err)
+			}
+			seq.left = 0
+		}
+		seq.mu.Unlock()
+	}
+	return nil
+}
+
+// writeSequence stores the state of a sequence. Numbers are stored as
+// decimal strings so that large values survive JSON encoding exactly.
+func (db *database) writeSequence(name string, value, increment int64, cache int) error {
+	return db.storage.Write(sequenceTableName, &storage.Record{
+		ID: name,
+		Data: map[string]interface{}{
+			"name":      name,
+			"value":     strconv.FormatInt(value, 10),
+			"increment": strconv.FormatInt(increment, 10),
+			"cache":     strconv.Itoa(cache),
+		},
+		Version: time.Now().UnixNano(),
+	})
+}
+
+// sequenceField parses a number stored by writeSequence, or returns def
+// when the field is missing
+func sequenceField(record *storage.Record, field string, def int64) (int64, error) {
+	text, ok := record.Data[field].(string)
+	if !ok {
+		return def, nil
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+// DropSequence implements Database.DropSequence
+func (db *database) DropSequence(ctx context.Context, name string) error {
+	if strings.HasPrefix(name, autoIncrementPrefix) {
+		return fmt.Errorf("%w: sequence %s belongs to a table", ErrInvalidOperation, name)
+	}
+	return db.dropSequence(ctx, name)
+}
+
+// dropSequence deletes a sequence and the values it has reserved
+func (db *database) dropSequence(ctx context.Context, name string) error {
+	seq := db.sequence(name)
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := locker.LockKey(ctx, sequenceTableName, name, LockExclusive); err != nil {
+		return err
+	}
+
+	record, err := db.storage.Read(sequenceTableName, name)
+	if err != nil {
+		return fmt.Errorf("failed to read sequence %s: %w", name, err)
+	}
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	if err := db.storage.Delete(sequenceTableName, name); err != nil {
+		return fmt.Errorf("failed to drop sequence %s: %w", name, err)
+	}
+
+	// Values reserved before the drop must not outlive it
+	seq.left = 0
+	db.seqMu.Lock()
+	delete(db.sequences, name)
+	db.seqMu.Unlock()
+	return nil
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequences(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Create And Drop", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.CreateSequence(ctx, "invoices", SequenceOptions{Start: 10, Increment: -5}))
+		assert.ErrorIs(t, db.CreateSequence(ctx, "invoices", SequenceOptions{}), ErrSequenceExists)
+		assert.ErrorIs(t, db.CreateSequence(ctx, "", SequenceOptions{}), ErrInvalidOperation)
+
+		for _, want := range []int64{10, 5, 0, -5} {
+			value, err := db.NextVal(ctx, "invoices")
+			assert.NoError(t, err)
+			assert.Equal(t, want, value)
+		}
+
+		_, err = db.NextVal(ctx, "missing")
+		assert.ErrorIs(t, err, ErrSequenceNotFound)
+
+		assert.NoError(t, db.DropSequence(ctx, "invoices"))
+		_, err = db.NextVal(ctx, "invoices")
+		assert.ErrorIs(t, err, ErrSequenceNotFound)
+		assert.ErrorIs(t, db.DropSequence(ctx, "invoices"), ErrSequenceNotFound)
+	})
+
+	t.Run("Exhausted At Int64 Limits", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateSequence(ctx, "up", SequenceOptions{Start: math.MaxInt64 - 4, Increment: 2}))
+		assert.NoError(t, db.CreateSequence(ctx, "down", SequenceOptions{Start: math.MinInt64 + 1, Increment: -1, Cache: 1}))
+
+		for _, want := range []int64{math.MaxInt64 - 4, math.MaxInt64 - 2, math.MaxInt64} {
+			value, err := db.NextVal(ctx, "up")
+			assert.NoError(t, err)
+			assert.Equal(t, want, value)
+		}
+		for _, want := range []int64{math.MinInt64 + 1, math.MinInt64} {
+			value, err := db.NextVal(ctx, "down")
+			assert.NoError(t, err)
+			assert.Equal(t, want, value)
+		}
+		for _, name := range []string{"up", "down"} {
+			_, err := db.NextVal(ctx, name)
+			assert.ErrorIs(t, err, ErrSequenceExhausted, name)
+		}
+
+		// The value before the first must fit too
+		err = db.CreateSequence(ctx, "bad", SequenceOptions{Start: math.MinInt64, Increment: 1})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		err = db.CreateSequence(ctx, "bad", SequenceOptions{Start: 1, Increment: math.MinInt64})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+	})
+
+	t.Run("Reserved Table Names", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateSequence(ctx, "orders", SequenceOptions{}))
+
+		// The tables holding sequences and schemas are not user tables
+		for _, name := range []string{"_sequences", "_schema"} {
+			err := db.CreateTable(name, []Column{{Name: "name", Type: String, PrimaryKey: true}})
+			assert.ErrorIs(t, err, ErrInvalidOperation, name)
+		}
+		_, err = db.Query("_sequences", nil, nil, 0, 0)
+		assert.ErrorIs(t, err, ErrTableNotFound)
+		assert.NoError(t, db.CreateTable("_schema_migrations", []Column{{Name: "version", Type: Int, PrimaryKey: true}}))
+	})
+
+	t.Run("Survive Reopen", func(t *testing.T) {
+		config := newTestConfig()
+		db, err := New("test_db", config)
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateSequence(ctx, "ids", SequenceOptions{Cache: 4}))
+		for _, want := range []int64{1, 2} {
+			value, err := db.NextVal(ctx, "ids")
+			assert.NoError(t, err)
+			assert.Equal(t, want, value)
+		}
+
+		// Without Close the rest of the reserved block is skipped
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		value, err := db.NextVal(ctx, "ids")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), value)
+
+		// Close gives back what it has not handed out
+		assert.NoError(t, db.Close())
+		db, err = New("test_db", config)
+		assert.NoError(t, err)
+		value, err = db.NextVal(ctx, "ids")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), value)
+	})
+
+	t.Run("Concurrent NextVal", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateSequence(ctx, "ids", SequenceOptions{Cache: 8}))
+
+		var mu sync.Mutex
+		seen := make(map[int64]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					value, err := db.NextVal(ctx, "ids")
+					assert.NoError(t, err)
+					mu.Lock()
+					seen[value] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, seen, 800)
+	})
+
+	t.Run("Auto Increment", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		columns := []Column{
+			{Name: "id", Type: Int, PrimaryKey: true, AutoIncrement: true},
+			{Name: "name", Type: String},
+		}
+		assert.NoError(t, db.CreateTable("users", columns))
+
+		row, err := db.InsertReturning(ctx, "users", map[string]interface{}{"name": "a"}, []string{"id"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"id": 1}, row.Row)
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 100, "name": "b"}))
+		_, err = db.InsertMany("users", []map[string]interface{}{{"name": "c"}, {"name": "d"}}, BatchAtomic)
+		assert.NoError(t, err)
+
+		rows, err := db.Query("users", []string{"id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []map[string]interface{}{{"id": 1}, {"id": 2}, {"id": 3}, {"id": 100}}, rows)
+
+		// The table owns its sequence, which restarts when it is recreated
+		assert.ErrorIs(t, db.DropSequence(ctx, autoIncrementSequence("users")), ErrInvalidOperation)
+		assert.NoError(t, db.DropTable("users"))
+		assert.NoError(t, db.CreateTable("users", columns))
+		row, err = db.InsertReturning(ctx, "users", map[string]interface{}{"name": "a"}, []string{"id"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"id": 1}, row.Row)
+
+		for _, cols := range [][]Column{
+			{{Name: "id", Type: String, PrimaryKey: true, AutoIncrement: true}},
+			{{Name: "id", Type: Int, PrimaryKey: true, AutoIncrement: true, Default: 1}},
+			{{Name: "id", Type: Int, PrimaryKey: true, AutoIncrement: true}, {Name: "n", Type: Int, AutoIncrement: true}},
+		} {
+			assert.Error(t, db.CreateTable("bad", cols))
+		}
+		assert.ErrorIs(t, db.AlterTable("users", AddColumn(Column{Name: "n", Type: Int, AutoIncrement: true})), ErrInvalidOperation)
+		assert.ErrorIs(t, db.AlterTable("users", ChangeType("id", String)), ErrInvalidOperation)
+	})
+
+	t.Run("Concurrent Inserts", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		assert.NoError(t, db.CreateTable("events", []Column{{Name: "id", Type: Int, PrimaryKey: true, AutoIncrement: true}}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					assert.NoError(t, db.Insert("events", map[string]interface{}{}))
+				}
+			}()
+		}
+		wg.Wait()
+
+		rows, err := db.Query("events", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 400)
+	})
+}
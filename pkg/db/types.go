@@ -2,6 +2,9 @@ package db
 
 import (
 	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
 )
 
 // DataType represents the supported data types in the database
@@ -14,6 +17,18 @@ const (
 	Boolean
 	DateTime
 	Blob
+	// JSON holds nested documents of maps, slices and scalars
+	JSON
+	// Array holds []interface{} values whose elements are of Column.Elem.
+	// An index on an array column keys whole arrays, so it serves equality
+	// on the array; Contains and Overlaps conditions scan.
+	Array
+	// Enum holds strings from Column.Values
+	Enum
+	// Decimal holds DecimalValue numbers of Column.Precision digits, of
+	// which Column.Scale follow the decimal point. Decimal columns cannot be
+	// primary keys.
+	Decimal
 )
 
 // Column represents a table column definition
@@ -24,6 +39,20 @@ type Column struct {
 	NotNull    bool
 	Unique     bool
 	Default    interface{}
+	// AutoIncrement numbers new records from a sequence owned by the table
+	// when they leave the column out. Only one Int column per table may set
+	// it.
+	AutoIncrement bool
+	// Checks constrain the values of the column
+	Checks []Check
+	// Elem is the type of the elements of an Array column. Values,
+	// Precision and Scale then apply to the elements.
+	Elem DataType
+	// Values lists the strings an Enum column accepts
+	Values []string
+	// Precision and Scale bound the digits of a Decimal column
+	Precision int
+	Scale     int
 }
 
 // IndexInfo represents index configuration
@@ -36,13 +65,22 @@ type IndexInfo struct {
 
 // Table represents a database table structure
 type Table struct {
-	Name        string      `json:"name"`
-	Columns     []Column    `json:"columns"`
-	PrimaryKey  string      `json:"primary_key"`
-	Indexes     []IndexInfo `json:"indexes"`
-	CreatedAt   time.Time   `json:"created_at"`
-	UpdatedAt   time.Time   `json:"updated_at"`
-	MaxFileSize int64       `json:"max_file_size"`
+	Name        string       `json:"name"`
+	Columns     []Column     `json:"columns"`
+	PrimaryKey  string       `json:"primary_key"`  // first primary key column
+	PrimaryKeys []string     `json:"primary_keys"` // all primary key columns in key order
+	Indexes     []IndexInfo  `json:"indexes"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	MaxFileSize int64        `json:"max_file_size"`
+	Checks      []Check      `json:"checks,omitempty"` // checks over whole records
+	ForeignKeys []ForeignKey `json:"foreign_keys,omitempty"`
+
+	// schema counts the alterations of the table. Records are stamped with
+	// the schema they are written under.
+	schema int64
+	// pending lists the alterations whose records are still being rewritten
+	pending []alteration
 }
 
 // Index represents a table index
@@ -60,15 +98,42 @@ const (
 	Hash
 )
 
+// SyncMode controls how aggressively writes are flushed to disk
+type SyncMode = storage.SyncMode
+
+const (
+	SyncAlways  = storage.SyncAlways  // fsync every write before it returns
+	SyncBatched = storage.SyncBatched // fsync pending writes every SyncInterval
+	SyncNone    = storage.SyncNone    // leave flushing to the operating system
+)
+
+// CacheStats reports record cache hits, misses and size
+type CacheStats = storage.CacheStats
+
+// MemoryStats reports memory reserved by queries, indexes and the cache
+type MemoryStats = memory.Stats
+
 // Config represents the database configuration
 type Config struct {
 	DataDir          string
-	MaxFileSize      int64  // Maximum size of each data file in bytes
-	CacheSize        int    // Maximum number of records to cache
-	CompressionLevel int    // Compression level (0-9, 0 = disabled)
-	EnableEncryption bool   // Enable encryption at rest
-	EncryptionKey    string // Encryption key (if encryption is enabled)
-	MaxConnections   int    // Maximum number of concurrent connections
+	MaxFileSize      int64         // Maximum size of each data file in bytes
+	CacheSize        int           // Maximum number of records to cache (0 = disabled)
+	CacheBytes       int64         // Maximum estimated size of cached records (0 = unlimited)
+	CompressionLevel int           // Compression level (0-9, 0 = disabled)
+	EnableEncryption bool          // Enable encryption at rest
+	EncryptionKey    string        // Encryption key (if encryption is enabled)
+	MaxConnections   int           // Maximum number of concurrent connections
+	SyncMode         SyncMode      // Durability of writes (always, batched or none)
+	SyncInterval     time.Duration // Flush interval when SyncMode is SyncBatched
+	ShardDepth       int           // Levels of hashed subdirectories for new tables (0 = flat)
+	ShardWidth       int           // Number of subdirectories per shard level
+	MemoryLimit      int64         // Memory for queries, indexes and the cache in bytes (0 = unlimited)
+	QueryTimeout     time.Duration // Deadline for queries whose context has none (0 = no timeout)
+	LockTimeout      time.Duration // Longest wait for a table or row lock (0 = until the context ends)
+
+	// Storage overrides the storage backend. When nil, records are kept in
+	// files under DataDir. A provided engine is not closed by Database.Close.
+	Storage storage.Engine
 }
 
 // DefaultConfig returns the default database configuration
@@ -80,13 +145,45 @@ func DefaultConfig() Config {
 		CompressionLevel: 0,
 		EnableEncryption: false,
 		MaxConnections:   100,
+		SyncMode:         SyncAlways,
+		SyncInterval:     storage.DefaultSyncInterval,
+		ShardDepth:       1,
+		ShardWidth:       256,
 	}
 }
 
 // CreateIndexOptions represents options for creating an index
 type CreateIndexOptions struct {
-	Name    string
-	Type    IndexType
+	Name string
+	Type IndexType
+	// Columns may also be paths into JSON columns, such as meta.kind
 	Columns []string
 	Unique  bool
 }
+
+// PageOptions selects one page of a keyset-paginated query
+type PageOptions struct {
+	Columns    []string               // Columns to return (empty = all)
+	Where      map[string]interface{} // Equality conditions rows must match
+	OrderBy    string                 // Column to order by (empty = primary key)
+	Descending bool                   // Order from the largest value down
+	Limit      int                    // Maximum number of rows per page
+	PageToken  string                 // NextPageToken of the previous page (empty = first page)
+}
+
+// Page is one page of query results
+type Page struct {
+	Rows []map[string]interface{}
+	// NextPageToken resumes the query after the last row of this page. It is
+	// empty on the last page.
+	NextPageToken string
+}
+
+// UpsertAction reports what an Upsert did
+type UpsertAction int
+
+const (
+	UpsertInserted UpsertAction = iota // no record conflicted, data was inserted
+	UpsertUpdated                      // the conflicting record was updated
+	UpsertNothing                      // a record conflicted and was left as is
+)
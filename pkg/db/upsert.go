@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Upsert implements Database.Upsert
+func (db *database) Upsert(tableName string, data map[string]interface{}, conflictColumns, updateColumns []string) (UpsertAction, error) {
+	return db.UpsertContext(context.Background(), tableName, data, conflictColumns, updateColumns)
+}
+
+// UpsertContext implements Database.UpsertContext
+func (db *database) UpsertContext(ctx context.Context, tableName string, data map[string]interface{}, conflictColumns, updateColumns []string) (UpsertAction, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return 0, ErrTableNotFound
+	}
+
+	indexName, conflict, err := conflictKey(table, conflictColumns)
+	if err != nil {
+		return 0, err
+	}
+	if err := validateColumns(table, updateColumns); err != nil {
+		return 0, err
+	}
+	for _, col := range updateColumns {
+		if table.isKeyColumn(col) {
+			return 0, fmt.Errorf("%w: primary key %s cannot be updated", ErrInvalidOperation, col)
+		}
+	}
+
+	// Fill defaults and validate data as for an insert
+	data, err = db.withDefaults(ctx, table, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := validateData(table, data); err != nil {
+		return 0, err
+	}
+	if err := checkRow(table, data); err != nil {
+		return 0, err
+	}
+	data, stored, err := db.storeLargeBlobs(table, data)
+	if err != nil {
+		return 0, err
+	}
+	defer db.blobs.release(stored)
+	id, ok := table.recordID(data)
+	if !ok {
+		return 0, fmt.Errorf("primary key %s is required", table.keyName())
+	}
+	value, ok := keyValue(conflict, data)
+	if !ok {
+		return 0, fmt.Errorf("conflict column %s is required", strings.Join(conflict, ", "))
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	if err := lockRecord(ctx, locker, table, id, data); err != nil {
+		return 0, err
+	}
+
+	// The conflicting record may change while its key is being locked, so
+	// look it up again until the record found is the one locked
+	index, err := db.indexes[tableName].GetIndex(indexName)
+	if err != nil {
+		return 0, err
+	}
+	var target interface{}
+	for {
+		holders, _ := index.Find(value)
+		if len(holders) == 0 {
+			if _, err := db.insertLocked(ctx, locker, table, id, data); err != nil {
+				return 0, err
+			}
+			return UpsertInserted, nil
+		}
+		if target != nil && compareValues(holders[0], target) == 0 {
+			break
+		}
+		target = holders[0]
+		if err := locker.LockKey(ctx, tableName, target, LockExclusive); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(updateColumns) == 0 {
+		return UpsertNothing, nil
+	}
+
+	record, err := db.storage.Read(tableName, target)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read record: %w", err)
+	}
+	if record == nil {
+		return 0, fmt.Errorf("record not found")
+	}
+
+	changes := make(map[string]interface{}, len(updateColumns))
+	for _, col := range updateColumns {
+		if v, ok := data[col]; ok {
+			changes[col] = v
+		}
+	}
+	if _, err := db.updateLocked(ctx, locker, table, record.ID, decodeRecord(table, record), changes); err != nil {
+		return 0, err
+	}
+	return UpsertUpdated, nil
+}
+
+// conflictKey returns the index and columns of the primary key or unique
+// column that an upsert detects conflicts on. No columns means the primary
+// key, whose columns may be given in any order.
+func conflictKey(table *Table, columns []string) (string, []string, error) {
+	keys := table.keyColumns()
+	if len(columns) == 0 || sameColumns(columns, keys) {
+		return primaryIndexName(table), keys, nil
+	}
+	if len(columns) == 1 {
+		for _, col := range table.Columns {
+			if col.Name == columns[0] && table.hasUniqueIndex(col) {
+				return uniqueIndexName(table, col.Name), columns, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("%w: no primary key or unique constraint on columns %v", ErrInvalidOperation, columns)
+}
+
+// sameColumns reports whether a and b hold the same distinct columns
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, col := range a {
+		if !containsString(b, col) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsert(t *testing.T) {
+	db, err := New("test_db", newTestConfig())
+	assert.NoError(t, err)
+	err = db.CreateTable("users", []Column{
+		{Name: "id", Type: Int, PrimaryKey: true},
+		{Name: "email", Type: String, Unique: true},
+		{Name: "name", Type: String},
+		{Name: "visits", Type: Int},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 1, "email": "a@example.com", "name": "Ann", "visits": 1}))
+
+	t.Run("Duplicate Keys", func(t *testing.T) {
+		err := db.Insert("users", map[string]interface{}{"id": 1, "email": "b@example.com"})
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+		var dupErr *DuplicateKeyError
+		if assert.True(t, errors.As(err, &dupErr)) {
+			assert.Equal(t, "id", dupErr.Column)
+			assert.Equal(t, 1, dupErr.Value)
+		}
+
+		err = db.Insert("users", map[string]interface{}{"id": 2, "email": "a@example.com"})
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+
+		// The original row is untouched
+		rows, err := db.Query("users", nil, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "a@example.com", rows[0]["email"])
+
+		// Updates may not take another record's unique value either
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 2, "email": "b@example.com"}))
+		err = db.Update("users", map[string]interface{}{"email": "a@example.com"}, map[string]interface{}{"id": 2})
+		assert.ErrorIs(t, err, ErrDuplicateKey)
+		assert.NoError(t, db.Update("users", map[string]interface{}{"email": "b@example.com"}, map[string]interface{}{"id": 2}))
+		assert.NoError(t, db.Delete("users", map[string]interface{}{"id": 2}))
+	})
+
+	t.Run("Do Nothing", func(t *testing.T) {
+		action, err := db.Upsert("users", map[string]interface{}{"id": 1, "email": "a@example.com", "name": "Other"}, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertNothing, action)
+
+		rows, err := db.Query("users", nil, map[string]interface{}{"id": 1}, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "Ann", rows[0]["name"])
+	})
+
+	t.Run("Do Update On Unique Column", func(t *testing.T) {
+		data := map[string]interface{}{"id": 5, "email": "a@example.com", "name": "Annie", "visits": 2}
+		action, err := db.Upsert("users", data, []string{"email"}, []string{"name", "visits"})
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertUpdated, action)
+
+		// The existing record keeps its primary key
+		rows, err := db.Query("users", nil, map[string]interface{}{"email": "a@example.com"}, 0, 0)
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, 1, rows[0]["id"])
+			assert.Equal(t, "Annie", rows[0]["name"])
+			assert.Equal(t, 2, rows[0]["visits"])
+		}
+	})
+
+	t.Run("Insert", func(t *testing.T) {
+		data := map[string]interface{}{"id": 3, "email": "c@example.com", "name": "Cy"}
+		action, err := db.Upsert("users", data, []string{"id"}, []string{"name"})
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertInserted, action)
+
+		rows, err := db.Query("users", nil, map[string]interface{}{"id": 3}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 1)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		data := map[string]interface{}{"id": 1, "email": "a@example.com"}
+		_, err := db.Upsert("users", data, []string{"name"}, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		_, err = db.Upsert("users", data, nil, []string{"id"})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+	})
+}
@@ -0,0 +1,491 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+	"github.com/tungpsit/ez-file-db/pkg/query"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+// UpdateWhere implements Database.UpdateWhere
+func (db *database) UpdateWhere(ctx context.Context, tableName string, data map[string]interface{}, conditions []query.Condition) (int, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return 0, ErrTableNotFound
+	}
+	rows, err := db.updateWhere(ctx, table, data, conditions)
+	return len(rows), err
+}
+
+// DeleteWhere implements Database.DeleteWhere
+func (db *database) DeleteWhere(ctx context.Context, tableName string, conditions []query.Condition) (int, error) {
+	if err := db.mu.RLockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mu.RUnlock()
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return 0, ErrTableNotFound
+	}
+	rows, err := db.deleteWhere(ctx, table, conditions)
+	return len(rows), err
+}
+
+// updateWhere merges data into every record matching conditions, writes
+// them with a single storage batch and returns the updated rows. Callers
+// hold db.mu shared.
+func (db *database) updateWhere(ctx context.Context, table *Table, data map[string]interface{}, conditions []query.Condition) ([]map[string]interface{}, error) {
+	for _, col := range table.keyColumns() {
+		if _, ok := data[col]; ok {
+			return nil, fmt.Errorf("%w: primary key %s cannot be changed by a bulk update", ErrInvalidOperation, col)
+		}
+	}
+	conditions, err := validateConditions(table, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateColumnValues(table, data); err != nil {
+		return nil, err
+	}
+	data, stored, err := db.storeLargeBlobs(table, data)
+	if err != nil {
+		return nil, err
+	}
+	defer db.blobs.release(stored)
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	indexManager := db.indexes[table.Name]
+	ids, err := db.lockMatching(ctx, locker, table, indexManager, conditions)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range table.Columns {
+		if value, exists := data[col.Name]; exists && col.Unique {
+			if err := locker.LockValue(ctx, table.Name, col.Name, value, LockExclusive); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Records stay reserved against the memory budget until they are written
+	reservation := db.budget.NewReservation()
+	defer reservation.Release()
+	var oldRows, newRows []map[string]interface{}
+	var ops []storage.Op
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		record, err := db.storage.Read(table.Name, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+		// Another writer may have changed the record before it was locked
+		if record == nil {
+			continue
+		}
+		old := decodeRecord(table, record)
+		if !query.Match(conditions, old) {
+			continue
+		}
+
+		updated := make(map[string]interface{}, len(old)+len(data))
+		for k, v := range old {
+			updated[k] = v
+		}
+		for k, v := range data {
+			updated[k] = v
+		}
+		if err := checkRow(table, updated); err != nil {
+			return nil, err
+		}
+		if err := reservation.Grow(memory.SizeOf(updated)); err != nil {
+			return nil, fmt.Errorf("update on table %s: %w", table.Name, err)
+		}
+
+		oldRows = append(oldRows, old)
+		newRows = append(newRows, updated)
+		ops = append(ops, storage.Op{
+			Type:   storage.OpWrite,
+			Table:  table.Name,
+			Record: &storage.Record{ID: record.ID, Data: updated, Version: time.Now().UnixNano(), Schema: table.schema},
+		})
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	if err := checkUniqueUpdate(table, indexManager, data, oldRows); err != nil {
+		return nil, err
+	}
+	if db.hasForeignKeys(table) {
+		ids := make([]interface{}, len(ops))
+		for i, op := range ops {
+			ids[i] = op.Record.ID
+		}
+		if _, err := db.writeReferenced(ctx, locker, table, ids, newRows); err != nil {
+			return nil, err
+		}
+		return newRows, nil
+	}
+	err = db.writeBlobs(table, oldRows, newRows, func() error {
+		return db.storage.Batch(ops)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write records: %w", err)
+	}
+
+	for i := range oldRows {
+		if err := indexManager.RemoveRecord(oldRows[i]); err != nil {
+			return nil, fmt.Errorf("failed to remove old index entries: %w", err)
+		}
+		if err := indexManager.IndexRecord(newRows[i]); err != nil {
+			return nil, fmt.Errorf("failed to update indexes: %w", err)
+		}
+	}
+	return newRows, nil
+}
+
+// deleteWhere removes every record matching conditions with a single storage
+// batch and returns the deleted rows. Callers hold db.mu shared.
+func (db *database) deleteWhere(ctx context.Context, table *Table, conditions []query.Condition) ([]map[string]interface{}, error) {
+	conditions, err := validateConditions(table, conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	locker := db.locks.NewLocker()
+	defer locker.Release()
+	indexManager := db.indexes[table.Name]
+	ids, err := db.lockMatching(ctx, locker, table, indexManager, conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []map[string]interface{}
+	var ops []storage.Op
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		record, err := db.storage.Read(table.Name, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+		if record == nil {
+			continue
+		}
+		data := decodeRecord(table, record)
+		if !query.Match(conditions, data) {
+			continue
+		}
+		deleted = append(deleted, data)
+		ops = append(ops, storage.Op{Type: storage.OpDelete, Table: table.Name, ID: record.ID})
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	if db.hasForeignKeys(table) {
+		ids := make([]interface{}, len(ops))
+		for i, op := range ops {
+			ids[i] = op.ID
+		}
+		if _, err := db.writeReferenced(ctx, locker, table, ids, make([]map[string]interface{}, len(ids))); err != nil {
+			return nil, err
+		}
+		return deleted, nil
+	}
+	err = db.writeBlobs(table, deleted, nil, func() error {
+		return db.storage.Batch(ops)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete records: %w", err)
+	}
+	for _, data := range deleted {
+		if err := indexManager.RemoveRecord(data); err != nil {
+			return nil, fmt.Errorf("failed to remove index entries: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+// lockMatching finds the primary keys of the records that may match
+// conditions and locks them exclusively in key order, so that concurrent
+// bulk writers cannot deadlock each other. The records must be read again
+// and re-checked once locked.
+func (db *database) lockMatching(ctx context.Context, locker *Locker, table *Table, indexManager *IndexManager, conditions []query.Condition) ([]interface{}, error) {
+	if err := locker.LockTable(ctx, table.Name, LockIntentExclusive); err != nil {
+		return nil, err
+	}
+
+	ids, indexed := conditionIDs(table, indexManager, conditions)
+	if !indexed {
+		err := db.storage.Scan(table.Name, func(record *storage.Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if query.Match(conditions, decodeRecord(table, record)) {
+				ids = append(ids, record.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan records: %w", err)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return compareValues(ids[i], ids[j]) < 0 })
+	unique := ids[:0]
+	for _, id := range ids {
+		if len(unique) > 0 && compareValues(unique[len(unique)-1], id) == 0 {
+			continue
+		}
+		if err := locker.LockKey(ctx, table.Name, id, LockExclusive); err != nil {
+			return nil, err
+		}
+		unique = append(unique, id)
+	}
+	return unique, nil
+}
+
+// conditionIDs returns the primary keys of the records that may satisfy
+// conditions according to the primary key, a prefix of a composite primary
+// key or a single-column index. The second result is false when no
+// condition can use an index and the table must be scanned. Candidates
+// still have to be checked against conditions.
+func conditionIDs(table *Table, indexManager *IndexManager, conditions []query.Condition) ([]interface{}, bool) {
+	// Comparisons between two columns cannot use an index
+	lookups := make([]query.Condition, 0, len(conditions))
+	for _, cond := range conditions {
+		if _, ok := cond.Value.(query.ColumnRef); !ok {
+			lookups = append(lookups, cond)
+		}
+	}
+	conditions = lookups
+
+	// Equality on the primary key needs no index at all
+	if table.compositeKey() {
+		key := make(map[string]interface{})
+		for _, cond := range conditions {
+			if cond.Operator == query.Eq && table.isKeyColumn(cond.Column) {
+				key[cond.Column] = cond.Value
+			}
+		}
+		if ids, ok := keyIDs(table, indexManager, key); ok {
+			return ids, true
+		}
+	}
+	for _, cond := range conditions {
+		if cond.Column != table.PrimaryKey || table.compositeKey() {
+			continue
+		}
+		switch cond.Operator {
+		case query.Eq:
+			return []interface{}{cond.Value}, true
+		case query.In:
+			if values, ok := cond.Value.([]interface{}); ok {
+				return append([]interface{}(nil), values...), true
+			}
+		}
+	}
+
+	// Then prefer point lookups over range scans
+	var ranged *query.Condition
+	var rangedIndex *MemoryIndex
+	for i, cond := range conditions {
+		// Paths into documents use the index on their canonical form
+		if path, ok := documentPath(table, cond.Column); ok {
+			cond.Column, cond.Value = path.String(), jsonValue(cond.Value)
+			conditions[i] = cond
+		}
+		index, ok := indexManager.FindColumnIndex(cond.Column)
+		if !ok {
+			continue
+		}
+		switch cond.Operator {
+		case query.Eq:
+			ids, _ := index.Find(cond.Value)
+			return ids, true
+		case query.In:
+			if values, ok := cond.Value.([]interface{}); ok {
+				var ids []interface{}
+				for _, value := range values {
+					found, _ := index.Find(value)
+					ids = append(ids, found...)
+				}
+				return ids, true
+			}
+		case query.Gt, query.Gte, query.Lt, query.Lte:
+			if ranged == nil {
+				ranged, rangedIndex = &conditions[i], index
+			}
+		}
+	}
+	if ranged == nil {
+		return nil, false
+	}
+
+	bound := &IndexBound{Key: ranged.Value, Inclusive: ranged.Operator == query.Gte || ranged.Operator == query.Lte}
+	if ranged.Operator == query.Gt || ranged.Operator == query.Gte {
+		return rangedIndex.Between(bound, nil), true
+	}
+	return rangedIndex.Between(nil, bound), true
+}
+
+// checkUniqueUpdate reports a violation when data sets a unique column that
+// another record already holds, or that several updated records would share
+func checkUniqueUpdate(table *Table, indexManager *IndexManager, data map[string]interface{}, updated []map[string]interface{}) error {
+	if len(updated) > 1 {
+		for _, col := range table.Columns {
+			if value, exists := data[col.Name]; exists && col.Unique {
+				return &DuplicateKeyError{Table: table.Name, Column: col.Name, Value: value}
+			}
+		}
+	}
+	id, _ := table.recordID(updated[0])
+	return checkUnique(table, indexManager, data, id)
+}
+
+// validateColumnValues checks the type of each column value present in data
+func validateColumnValues(table *Table, data map[string]interface{}) error {
+	for _, col := range table.Columns {
+		if value, exists := data[col.Name]; exists {
+			if err := validateValue(col, value); err != nil {
+				return fmt.Errorf("invalid data type for column %s: %w", col.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateConditions checks that every condition, and every column it is
+// compared with, refers to a table column or a path into a JSON column, and
+// that condition values suit the type of their column. It returns the
+// conditions with their values decoded to that type, so that scans and
+// index lookups compare them the same way.
+func validateConditions(table *Table, conditions []query.Condition) ([]query.Condition, error) {
+	columns := make([]string, 0, len(conditions))
+	for _, cond := range conditions {
+		columns = append(columns, cond.Column)
+		if ref, ok := cond.Value.(query.ColumnRef); ok {
+			columns = append(columns, string(ref))
+		}
+	}
+	if err := validatePaths(table, columns); err != nil {
+		return nil, err
+	}
+
+	typed := make([]query.Condition, len(conditions))
+	for i, cond := range conditions {
+		value, err := conditionValue(table, cond)
+		if err != nil {
+			return nil, fmt.Errorf("condition on %s: %w", cond.Column, err)
+		}
+		cond.Value = value
+		typed[i] = cond
+	}
+	return typed, nil
+}
+
+// conditionValue decodes the value of cond to the type of its column and
+// checks that the operator applies to that type
+func conditionValue(table *Table, cond query.Condition) (interface{}, error) {
+	if _, ok := cond.Value.(query.ColumnRef); ok {
+		return cond.Value, nil
+	}
+	col, ok := table.column(cond.Column)
+	if !ok || col.Type == JSON {
+		// Documents hold values of any type
+		if cond.Operator == query.HasKey {
+			if _, ok := cond.Value.(string); !ok {
+				return nil, fmt.Errorf("%w: %s needs a string key", ErrInvalidDataType, cond.Operator)
+			}
+		}
+		return cond.Value, nil
+	}
+
+	elem := col
+	elem.Type = col.Elem
+	switch cond.Operator {
+	case query.In, query.NotIn:
+		return conditionValues(col, cond)
+	case query.Like:
+		if col.Type != String && col.Type != Enum {
+			return nil, fmt.Errorf("%w: %s needs a string column", ErrInvalidDataType, cond.Operator)
+		}
+		if _, ok := cond.Value.(string); !ok {
+			return nil, fmt.Errorf("%w: %s needs a string pattern", ErrInvalidDataType, cond.Operator)
+		}
+		return cond.Value, nil
+	case query.Contains:
+		if col.Type != Array {
+			return nil, fmt.Errorf("%w: %s needs an array column", ErrInvalidDataType, cond.Operator)
+		}
+		if _, ok := cond.Value.([]interface{}); ok {
+			return conditionValues(elem, cond)
+		}
+		return typedValue(elem, cond.Value)
+	case query.Overlaps:
+		if col.Type != Array {
+			return nil, fmt.Errorf("%w: %s needs an array column", ErrInvalidDataType, cond.Operator)
+		}
+		return conditionValues(elem, cond)
+	case query.HasKey:
+		return nil, fmt.Errorf("%w: %s needs a JSON column", ErrInvalidDataType, cond.Operator)
+	}
+	return typedValue(col, cond.Value)
+}
+
+// conditionValues decodes each element of the list value of cond to the
+// type of col
+func conditionValues(col Column, cond query.Condition) (interface{}, error) {
+	values, ok := cond.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s needs a list of values", ErrInvalidDataType, cond.Operator)
+	}
+	typed := make([]interface{}, len(values))
+	for i, value := range values {
+		v, err := typedValue(col, value)
+		if err != nil {
+			return nil, err
+		}
+		typed[i] = v
+	}
+	return typed, nil
+}
+
+// typedValue decodes value to the type of col and validates it like a
+// stored value. Numbers compare with each other whatever their type and
+// digits, and nil matches missing values.
+func typedValue(col Column, value interface{}) (interface{}, error) {
+	value = decodeValue(value, col.Type)
+	if value == nil {
+		return nil, nil
+	}
+	switch col.Type {
+	case Int, Float, Decimal:
+		if valueRank(value) == rankNumber {
+			return value, nil
+		}
+	}
+	if err := validateValue(col, value); err != nil {
+		if !errors.Is(err, ErrInvalidDataType) {
+			err = fmt.Errorf("%w: %v", ErrInvalidDataType, err)
+		}
+		return nil, err
+	}
+	return value, nil
+}
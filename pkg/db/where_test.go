@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/query"
+)
+
+func TestWhere(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Update Where", func(t *testing.T) {
+		db := newTestDB(t, 30)
+
+		n, err := db.UpdateWhere(ctx, "users", map[string]interface{}{"name": "teen"}, []query.Condition{
+			{Column: "age", Operator: query.Gte, Value: 3},
+			{Column: "age", Operator: query.Lt, Value: 5},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 6, n)
+
+		rows, err := db.Query("users", []string{"id"}, map[string]interface{}{"name": "teen"}, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 6)
+
+		// Primary keys cannot be rewritten in bulk
+		_, err = db.UpdateWhere(ctx, "users", map[string]interface{}{"id": 1}, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+
+		_, err = db.UpdateWhere(ctx, "users", map[string]interface{}{"name": "x"}, []query.Condition{{Column: "missing", Operator: query.Eq, Value: 1}})
+		assert.Error(t, err)
+	})
+
+	t.Run("Delete Where Uses Index", func(t *testing.T) {
+		db := newTestDB(t, 30)
+		err := db.CreateIndex("users", CreateIndexOptions{Name: "idx_age", Columns: []string{"age"}})
+		assert.NoError(t, err)
+
+		n, err := db.DeleteWhere(ctx, "users", []query.Condition{{Column: "age", Operator: query.Gt, Value: 7}})
+		assert.NoError(t, err)
+		assert.Equal(t, 6, n)
+
+		n, err = db.DeleteWhere(ctx, "users", []query.Condition{{Column: "id", Operator: query.In, Value: []interface{}{0, 1, 1, 99}}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		rows, err := db.Query("users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 22)
+
+		// The index no longer refers to deleted rows
+		rows, err = db.Query("users", nil, map[string]interface{}{"age": 9}, 0, 0)
+		assert.NoError(t, err)
+		assert.Empty(t, rows)
+	})
+
+	t.Run("Update And Delete Without Primary Key", func(t *testing.T) {
+		db := newTestDB(t, 20)
+
+		// Update and Delete write single records; bulk writes go through
+		// UpdateWhere and DeleteWhere
+		err := db.Update("users", map[string]interface{}{"name": "seven"}, map[string]interface{}{"age": 7})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		err = db.Update("users", map[string]interface{}{"name": "seven"}, nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		err = db.Delete("users", map[string]interface{}{"name": "user"})
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		err = db.Delete("users", nil)
+		assert.ErrorIs(t, err, ErrInvalidOperation)
+		rows, err := db.Query("users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 20)
+
+		n, err := db.UpdateWhere(ctx, "users", map[string]interface{}{"name": "seven"}, []query.Condition{{Column: "age", Operator: query.Eq, Value: 7}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		n, err = db.DeleteWhere(ctx, "users", []query.Condition{{Column: "name", Operator: query.Eq, Value: "seven"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		rows, err = db.Query("users", nil, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 18)
+	})
+
+	t.Run("Condition Values", func(t *testing.T) {
+		for _, indexed := range []bool{false, true} {
+			db := newTestDB(t, 30)
+			if indexed {
+				err := db.CreateIndex("users", CreateIndexOptions{Name: "idx_age", Columns: []string{"age"}})
+				assert.NoError(t, err)
+			}
+
+			// Values must suit the column type, scanned or indexed
+			for _, cond := range []query.Condition{
+				{Column: "age", Operator: query.Gte, Value: "5"},
+				{Column: "age", Operator: query.In, Value: []interface{}{1, "2"}},
+				{Column: "age", Operator: query.In, Value: 1},
+				{Column: "age", Operator: query.Like, Value: "1%"},
+				{Column: "name", Operator: query.Eq, Value: 1},
+				{Column: "name", Operator: query.Contains, Value: "u"},
+			} {
+				_, err := db.DeleteWhere(ctx, "users", []query.Condition{cond})
+				assert.ErrorIs(t, err, ErrInvalidDataType, "%+v", cond)
+			}
+
+			// Numbers of any Go type compare by value
+			n, err := db.DeleteWhere(ctx, "users", []query.Condition{{Column: "age", Operator: query.Gte, Value: 7.5}})
+			assert.NoError(t, err)
+			assert.Equal(t, 6, n, "indexed %v", indexed)
+			n, err = db.DeleteWhere(ctx, "users", []query.Condition{{Column: "age", Operator: query.Lt, Value: int64(1)}})
+			assert.NoError(t, err)
+			assert.Equal(t, 3, n, "indexed %v", indexed)
+		}
+	})
+
+	t.Run("Large Integers", func(t *testing.T) {
+		db := newTestDB(t, 0)
+		big := int64(1 << 60)
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 1, "age": big}))
+		assert.NoError(t, db.Insert("users", map[string]interface{}{"id": 2, "age": big + 1}))
+
+		// Neighbours above 2^53 stay distinct
+		n, err := db.DeleteWhere(ctx, "users", []query.Condition{{Column: "age", Operator: query.Eq, Value: big + 1}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		rows, err := db.Query("users", []string{"id"}, nil, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"id": 1}}, rows)
+	})
+
+	t.Run("Unique Columns", func(t *testing.T) {
+		db, err := New("test_db", newTestConfig())
+		assert.NoError(t, err)
+		err = db.CreateTable("accounts", []Column{
+			{Name: "id", Type: Int, PrimaryKey: true},
+			{Name: "email", Type: String, Unique: true},
+			{Name: "plan", Type: String},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Insert("accounts", map[string]interface{}{"id": 1, "email": "a@example.com", "plan": "free"}))
+		assert.NoError(t, db.Insert("accounts", map[string]interface{}{"id": 2, "email": "b@example.com", "plan": "free"}))
+
+		// Several rows cannot take the same unique value
+		_, err = db.UpdateWhere(ctx, "accounts", map[string]interface{}{"email": "c@example.com"}, []query.Condition{{Column: "plan", Operator: query.Eq, Value: "free"}})
+		assert.Error(t, err)
+
+		// Nor can one row take another's
+		_, err = db.UpdateWhere(ctx, "accounts", map[string]interface{}{"email": "b@example.com"}, []query.Condition{{Column: "id", Operator: query.Eq, Value: 1}})
+		assert.Error(t, err)
+
+		n, err := db.UpdateWhere(ctx, "accounts", map[string]interface{}{"email": "c@example.com"}, []query.Condition{{Column: "id", Operator: query.Eq, Value: 1}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	})
+}
@@ -0,0 +1,135 @@
+// Package memory accounts for the memory used by queries, indexes and
+// caches so that the database can refuse work instead of running out of
+// memory.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrLimit is matched by errors returned when a reservation would exceed
+// the memory limit
+var ErrLimit = errors.New("memory limit exceeded")
+
+// LimitError describes a reservation that was refused
+type LimitError struct {
+	Requested int64 // Bytes requested by the failed reservation
+	Used      int64 // Bytes reserved when the request was made
+	Limit     int64 // Configured limit in bytes
+}
+
+// Error implements error
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v: requested %d bytes with %d of %d in use", ErrLimit, e.Requested, e.Used, e.Limit)
+}
+
+// Is reports whether target is ErrLimit
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimit
+}
+
+// Stats reports the state of a Budget
+type Stats struct {
+	Used  int64 // Bytes currently reserved
+	Peak  int64 // Highest number of bytes reserved at once
+	Limit int64 // Configured limit in bytes (0 = unlimited)
+}
+
+// Budget is a shared memory accountant. Consumers reserve an estimate of
+// the memory they are about to hold and release it when they let go. A nil
+// Budget and a Budget with a non-positive limit never refuse a reservation.
+type Budget struct {
+	limit int64
+	used  int64
+	peak  int64
+	mu    sync.Mutex
+}
+
+// NewBudget creates a budget of limit bytes
+func NewBudget(limit int64) *Budget {
+	if limit < 0 {
+		limit = 0
+	}
+	return &Budget{limit: limit}
+}
+
+// Reserve reserves n bytes or returns a *LimitError if that would exceed
+// the limit
+func (b *Budget) Reserve(n int64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit > 0 && b.used+n > b.limit {
+		return &LimitError{Requested: n, Used: b.used, Limit: b.limit}
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	return nil
+}
+
+// Release returns n previously reserved bytes
+func (b *Budget) Release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	if b.used < 0 {
+		b.used = 0
+	}
+}
+
+// Stats returns a snapshot of the budget
+func (b *Budget) Stats() Stats {
+	if b == nil {
+		return Stats{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return Stats{Used: b.used, Peak: b.peak, Limit: b.limit}
+}
+
+// Reservation accumulates reservations for a single operation so they can
+// be released together
+type Reservation struct {
+	budget *Budget
+	size   int64
+}
+
+// NewReservation starts an empty reservation against b
+func (b *Budget) NewReservation() *Reservation {
+	return &Reservation{budget: b}
+}
+
+// Grow reserves n more bytes
+func (r *Reservation) Grow(n int64) error {
+	if err := r.budget.Reserve(n); err != nil {
+		return err
+	}
+	r.size += n
+	return nil
+}
+
+// Size returns the number of bytes held by the reservation
+func (r *Reservation) Size() int64 {
+	return r.size
+}
+
+// Release returns everything held by the reservation
+func (r *Reservation) Release() {
+	r.budget.Release(r.size)
+	r.size = 0
+}
@@ -0,0 +1,37 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(100)
+
+	assert.NoError(t, b.Reserve(60))
+	err := b.Reserve(50)
+	assert.True(t, errors.Is(err, ErrLimit))
+
+	var limitErr *LimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, int64(50), limitErr.Requested)
+	assert.Equal(t, int64(60), limitErr.Used)
+
+	r := b.NewReservation()
+	assert.NoError(t, r.Grow(40))
+	assert.Error(t, r.Grow(1))
+	assert.Equal(t, int64(40), r.Size())
+	r.Release()
+	b.Release(60)
+
+	stats := b.Stats()
+	assert.Equal(t, int64(0), stats.Used)
+	assert.Equal(t, int64(100), stats.Peak)
+
+	// Nil and unlimited budgets never refuse
+	var none *Budget
+	assert.NoError(t, none.Reserve(1<<40))
+	assert.NoError(t, NewBudget(0).Reserve(1<<40))
+}
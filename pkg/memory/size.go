@@ -0,0 +1,33 @@
+package memory
+
+import "time"
+
+// SizeOf estimates the in-memory size of a decoded value in bytes. The
+// estimate includes interface, header and map overhead so that it tracks
+// real usage closely enough for budgeting.
+func SizeOf(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 16
+	case string:
+		return 32 + int64(len(v))
+	case []byte:
+		return 40 + int64(len(v))
+	case time.Time:
+		return 40
+	case map[string]interface{}:
+		size := int64(64)
+		for k, item := range v {
+			size += 16 + int64(len(k)) + SizeOf(item)
+		}
+		return size
+	case []interface{}:
+		size := int64(40)
+		for _, item := range v {
+			size += SizeOf(item)
+		}
+		return size
+	default:
+		return 24
+	}
+}
@@ -0,0 +1,379 @@
+// Package migrate applies numbered schema migrations to an ez-file-db
+// database and records which versions have been applied.
+//
+// Migrations are registered as Go functions or as SQL text (see ParseSQL for
+// the supported statements). Applied versions are tracked in the
+// _schema_migrations table, and a lock row in that table keeps two
+// migrators from running against the same database at once. Schema changes
+// are not transactional: a migration that fails part way is not recorded,
+// and any changes it made before failing remain.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tungpsit/ez-file-db/pkg/db"
+)
+
+// TableName is the table recording applied migrations
+const TableName = "_schema_migrations"
+
+// lockVersion is the reserved version of the row held while migrating
+const lockVersion int64 = 0
+
+var (
+	ErrLocked           = errors.New("migrations are locked by another migrator")
+	ErrDuplicateVersion = errors.New("duplicate migration version")
+	ErrInvalidMigration = errors.New("invalid migration")
+	ErrNoDown           = errors.New("migration has no down step")
+)
+
+// Func changes the schema or data of a database
+type Func func(ctx context.Context, database db.Database) error
+
+// Migration is one numbered schema change and its reversal
+type Migration struct {
+	Version int64
+	Name    string
+	Up      Func
+	Down    Func // nil when the migration cannot be reverted
+}
+
+// Status reports whether a migration has been applied
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Missing is set for applied versions that are no longer registered
+	Missing bool
+}
+
+// Migrator applies registered migrations in version order
+type Migrator struct {
+	db         db.Database
+	migrations map[int64]Migration
+}
+
+// New creates a migrator for database
+func New(database db.Database) *Migrator {
+	return &Migrator{
+		db:         database,
+		migrations: make(map[int64]Migration),
+	}
+}
+
+// Register adds a migration. Versions must be positive and unique.
+func (m *Migrator) Register(migration Migration) error {
+	if migration.Version <= lockVersion {
+		return fmt.Errorf("%w: version %d must be positive", ErrInvalidMigration, migration.Version)
+	}
+	if migration.Up == nil {
+		return fmt.Errorf("%w: version %d has no up step", ErrInvalidMigration, migration.Version)
+	}
+	if _, exists := m.migrations[migration.Version]; exists {
+		return fmt.Errorf("%w: %d", ErrDuplicateVersion, migration.Version)
+	}
+	m.migrations[migration.Version] = migration
+	return nil
+}
+
+// RegisterFunc adds a migration made of Go functions
+func (m *Migrator) RegisterFunc(version int64, name string, up, down Func) error {
+	return m.Register(Migration{Version: version, Name: name, Up: up, Down: down})
+}
+
+// RegisterSQL adds a migration made of SQL statements. An empty down
+// script registers a migration that cannot be reverted.
+func (m *Migrator) RegisterSQL(version int64, name, up, down string) error {
+	upStmts, err := ParseSQL(up)
+	if err != nil {
+		return fmt.Errorf("migration %d up: %w", version, err)
+	}
+	migration := Migration{Version: version, Name: name, Up: sqlFunc(upStmts)}
+	if strings.TrimSpace(down) != "" {
+		downStmts, err := ParseSQL(down)
+		if err != nil {
+			return fmt.Errorf("migration %d down: %w", version, err)
+		}
+		migration.Down = sqlFunc(downStmts)
+	}
+	return m.Register(migration)
+}
+
+// RegisterFS adds the SQL migrations found in dir of fsys. Files are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql; the down file is
+// optional.
+func (m *Migrator) RegisterFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	type files struct{ name, up, down string }
+	found := make(map[int64]*files)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		base, direction, ok := splitFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		versionText, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(versionText, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: file %s does not start with a version", ErrInvalidMigration, entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read migration: %w", err)
+		}
+		f := found[version]
+		if f == nil {
+			f = &files{name: name}
+			found[version] = f
+		}
+		if f.name != name {
+			return fmt.Errorf("%w: %d", ErrDuplicateVersion, version)
+		}
+		if direction == "up" {
+			f.up = string(data)
+		} else {
+			f.down = string(data)
+		}
+	}
+
+	for version, f := range found {
+		if f.up == "" {
+			return fmt.Errorf("%w: version %d has no up file", ErrInvalidMigration, version)
+		}
+		if err := m.RegisterSQL(version, f.name, f.up, f.down); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitFileName splits a migration file name into its base and direction
+func splitFileName(name string) (base, direction string, ok bool) {
+	if base, ok = strings.CutSuffix(name, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok = strings.CutSuffix(name, ".down.sql"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// Up applies every pending migration in version order and returns the
+// versions applied
+func (m *Migrator) Up(ctx context.Context) ([]int64, error) {
+	return m.UpTo(ctx, 0)
+}
+
+// UpTo applies the pending migrations up to and including target, or all of
+// them when target is zero, and returns the versions applied
+func (m *Migrator) UpTo(ctx context.Context, target int64) ([]int64, error) {
+	var done []int64
+	err := m.locked(ctx, func(applied map[int64]Status) error {
+		for _, migration := range m.sorted() {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if applied[migration.Version].Applied {
+				continue
+			}
+			if err := migration.Up(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			err := m.db.InsertContext(ctx, TableName, map[string]interface{}{
+				"version":    migration.Version,
+				"name":       migration.Name,
+				"applied_at": time.Now().UTC(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+			}
+			done = append(done, migration.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest steps applied migrations, newest first, and
+// returns the versions reverted. Steps must be at least 1.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int64, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("%w: steps must be at least 1, got %d", ErrInvalidMigration, steps)
+	}
+	var done []int64
+	err := m.locked(ctx, func(applied map[int64]Status) error {
+		versions := make([]int64, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for _, version := range versions {
+			if len(done) == steps {
+				break
+			}
+			migration, ok := m.migrations[version]
+			if !ok {
+				return fmt.Errorf("%w: applied version %d is not registered", ErrInvalidMigration, version)
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("%w: %d %s", ErrNoDown, version, migration.Name)
+			}
+			if err := migration.Down(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d %s: %w", version, migration.Name, err)
+			}
+			if err := m.db.DeleteContext(ctx, TableName, map[string]interface{}{"version": version}); err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", version, err)
+			}
+			done = append(done, version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every registered or applied migration in version order
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.sorted() {
+		status := applied[migration.Version]
+		status.Version = migration.Version
+		status.Name = migration.Name
+		statuses = append(statuses, status)
+		delete(applied, migration.Version)
+	}
+	for _, status := range applied {
+		status.Missing = true
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Unlock removes the lock row left behind by a migrator that did not finish
+func (m *Migrator) Unlock(ctx context.Context) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	return m.db.DeleteContext(ctx, TableName, map[string]interface{}{"version": lockVersion})
+}
+
+// locked runs fn while holding the migration lock, passing it the applied
+// migrations
+func (m *Migrator) locked(ctx context.Context, fn func(applied map[int64]Status) error) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	// The lock row is a primary key, so only one migrator can insert it
+	err := m.db.InsertContext(ctx, TableName, map[string]interface{}{
+		"version":    lockVersion,
+		"name":       "lock",
+		"applied_at": time.Now().UTC(),
+	})
+	if errors.Is(err, db.ErrDuplicateKey) {
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer m.db.DeleteContext(context.Background(), TableName, map[string]interface{}{"version": lockVersion})
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(applied)
+}
+
+// ensureTable creates the migrations table on first use
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	if m.db.HasTable(TableName) {
+		return nil
+	}
+	err := m.db.CreateTableContext(ctx, TableName, []db.Column{
+		{Name: "version", Type: db.Int, PrimaryKey: true},
+		{Name: "name", Type: db.String},
+		{Name: "applied_at", Type: db.DateTime},
+	})
+	if err != nil && !errors.Is(err, db.ErrTableExists) {
+		return fmt.Errorf("failed to create %s: %w", TableName, err)
+	}
+	return nil
+}
+
+// applied returns the applied migrations by version
+func (m *Migrator) applied(ctx context.Context) (map[int64]Status, error) {
+	rows, err := m.db.QueryContext(ctx, TableName, nil, nil, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", TableName, err)
+	}
+
+	applied := make(map[int64]Status, len(rows))
+	for _, row := range rows {
+		version, ok := toInt64(row["version"])
+		if !ok || version == lockVersion {
+			continue
+		}
+		status := Status{Version: version, Applied: true}
+		status.Name, _ = row["name"].(string)
+		switch at := row["applied_at"].(type) {
+		case time.Time:
+			status.AppliedAt = at
+		case string:
+			status.AppliedAt, _ = time.Parse(time.RFC3339Nano, at)
+		}
+		applied[version] = status
+	}
+	return applied, nil
+}
+
+// sorted returns the registered migrations in version order
+func (m *Migrator) sorted() []Migration {
+	migrations := make([]Migration, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+// toInt64 converts a stored integer, which may have been decoded as a float
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int32:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/db"
+	"github.com/tungpsit/ez-file-db/pkg/storage"
+)
+
+func newTestDB(t *testing.T) db.Database {
+	database, err := db.New("test_db", db.Config{Storage: storage.NewMemoryStorage()})
+	assert.NoError(t, err)
+	return database
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Up Down And Status", func(t *testing.T) {
+		database := newTestDB(t)
+		m := New(database)
+		assert.NoError(t, m.RegisterSQL(1, "users",
+			"CREATE TABLE users (id INT PRIMARY KEY, name TEXT NOT NULL)",
+			"DROP TABLE users"))
+		assert.NoError(t, m.RegisterFunc(2, "seed",
+			func(ctx context.Context, d db.Database) error {
+				return d.InsertContext(ctx, "users", map[string]interface{}{"id": 1, "name": "admin"})
+			},
+			func(ctx context.Context, d db.Database) error {
+				return d.DeleteContext(ctx, "users", map[string]interface{}{"id": 1})
+			}))
+		assert.NoError(t, m.RegisterSQL(3, "email", "ALTER TABLE users ADD COLUMN email TEXT DEFAULT ''", ""))
+
+		applied, err := m.UpTo(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, applied)
+
+		applied, err = m.Up(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{3}, applied)
+		table, err := database.GetTable("users")
+		assert.NoError(t, err)
+		assert.Len(t, table.Columns, 3)
+
+		// Running again applies nothing
+		applied, err = m.Up(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, applied)
+
+		statuses, err := m.Status(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, statuses, 3)
+		for _, status := range statuses {
+			assert.True(t, status.Applied)
+			assert.False(t, status.AppliedAt.IsZero())
+		}
+
+		// Version 3 has no down step
+		_, err = m.Down(ctx, 1)
+		assert.ErrorIs(t, err, ErrNoDown)
+	})
+
+	t.Run("Down Reverts Newest First", func(t *testing.T) {
+		database := newTestDB(t)
+		m := New(database)
+		assert.NoError(t, m.RegisterSQL(1, "users", "CREATE TABLE users (id INT PRIMARY KEY)", "DROP TABLE users"))
+		assert.NoError(t, m.RegisterSQL(2, "index", "CREATE INDEX idx_id ON users (id)", "DROP INDEX idx_id ON users"))
+		_, err := m.Up(ctx)
+		assert.NoError(t, err)
+
+		// Zero or negative steps revert nothing rather than everything
+		for _, steps := range []int{0, -1} {
+			reverted, err := m.Down(ctx, steps)
+			assert.ErrorIs(t, err, ErrInvalidMigration)
+			assert.Empty(t, reverted)
+		}
+		assert.True(t, database.HasTable("users"))
+
+		reverted, err := m.Down(ctx, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2, 1}, reverted)
+		assert.False(t, database.HasTable("users"))
+
+		statuses, err := m.Status(ctx)
+		assert.NoError(t, err)
+		assert.False(t, statuses[0].Applied)
+	})
+
+	t.Run("Failed Migration Is Not Recorded", func(t *testing.T) {
+		database := newTestDB(t)
+		m := New(database)
+		assert.NoError(t, m.RegisterSQL(1, "users", "CREATE TABLE users (id INT PRIMARY KEY)", ""))
+		assert.NoError(t, m.RegisterFunc(2, "broken", func(context.Context, db.Database) error {
+			return errors.New("boom")
+		}, nil))
+
+		applied, err := m.Up(ctx)
+		assert.Error(t, err)
+		assert.Equal(t, []int64{1}, applied)
+
+		statuses, err := m.Status(ctx)
+		assert.NoError(t, err)
+		assert.True(t, statuses[0].Applied)
+		assert.False(t, statuses[1].Applied)
+
+		// The lock is released after a failure
+		_, err = m.Status(ctx)
+		assert.NoError(t, err)
+		_, err = m.UpTo(ctx, 1)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		database := newTestDB(t)
+		m := New(database)
+		assert.NoError(t, m.RegisterFunc(1, "wait", func(ctx context.Context, d db.Database) error {
+			// A second migrator cannot run while the first holds the lock
+			_, err := New(d).Up(ctx)
+			assert.ErrorIs(t, err, ErrLocked)
+			return nil
+		}, nil))
+		_, err := m.Up(ctx)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Register", func(t *testing.T) {
+		m := New(newTestDB(t))
+		up := func(context.Context, db.Database) error { return nil }
+		assert.NoError(t, m.RegisterFunc(1, "a", up, nil))
+		assert.ErrorIs(t, m.RegisterFunc(1, "b", up, nil), ErrDuplicateVersion)
+		assert.ErrorIs(t, m.RegisterFunc(0, "c", up, nil), ErrInvalidMigration)
+		assert.ErrorIs(t, m.RegisterSQL(2, "d", "CREATE VIEW v", ""), ErrInvalidMigration)
+	})
+
+	t.Run("Register FS", func(t *testing.T) {
+		database := newTestDB(t)
+		m := New(database)
+		fsys := fstest.MapFS{
+			"migrations/0001_users.up.sql":   {Data: []byte("CREATE TABLE users (id INT PRIMARY KEY);")},
+			"migrations/0001_users.down.sql": {Data: []byte("DROP TABLE users;")},
+			"migrations/0002_age.up.sql":     {Data: []byte("ALTER TABLE users ADD age INT")},
+			"migrations/README.md":           {Data: []byte("ignored")},
+		}
+		assert.NoError(t, m.RegisterFS(fsys, "migrations"))
+
+		statuses, err := m.Status(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []Status{{Version: 1, Name: "users"}, {Version: 2, Name: "age"}}, statuses)
+
+		applied, err := m.Up(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, applied)
+	})
+}
@@ -0,0 +1,528 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tungpsit/ez-file-db/pkg/db"
+)
+
+// Statement is one parsed SQL statement
+type Statement interface {
+	Exec(ctx context.Context, database db.Database) error
+}
+
+// ParseSQL parses semicolon-separated DDL statements. The supported forms
+// are:
+//
+//	CREATE TABLE name (column type [PRIMARY KEY] [NOT NULL] [UNIQUE] [DEFAULT literal], ... [, PRIMARY KEY (column, ...)])
+//	DROP TABLE name
+//	CREATE [UNIQUE] INDEX name ON table (column, ...)
+//	DROP INDEX name ON table
+//	ALTER TABLE name action, ...
+//
+// where an ALTER TABLE action is one of ADD [COLUMN] definition,
+// DROP [COLUMN] name, RENAME [COLUMN] name TO new_name or
+// ALTER [COLUMN] name [SET DATA] TYPE type. A composite primary key is
+// ordered as its columns are declared. Types are INT, FLOAT, TEXT,
+// BOOLEAN, DATETIME and BLOB, with their common aliases. Keywords are case
+// insensitive and -- starts a comment.
+func ParseSQL(text string) ([]Statement, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	var stmts []Statement
+	for !p.done() {
+		if p.accept(";") {
+			continue
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.done() && !p.accept(";") {
+			return nil, p.errorf("expected ; but found %q", p.peek().text)
+		}
+	}
+	return stmts, nil
+}
+
+// sqlFunc returns a migration step that executes stmts in order
+func sqlFunc(stmts []Statement) Func {
+	return func(ctx context.Context, database db.Database) error {
+		for i, stmt := range stmts {
+			if err := stmt.Exec(ctx, database); err != nil {
+				return fmt.Errorf("statement %d: %w", i+1, err)
+			}
+		}
+		return nil
+	}
+}
+
+type createTable struct {
+	name    string
+	columns []db.Column
+}
+
+func (s *createTable) Exec(ctx context.Context, database db.Database) error {
+	return database.CreateTableContext(ctx, s.name, s.columns)
+}
+
+type dropTable struct {
+	name string
+}
+
+func (s *dropTable) Exec(ctx context.Context, database db.Database) error {
+	return database.DropTableContext(ctx, s.name)
+}
+
+type createIndex struct {
+	table   string
+	options db.CreateIndexOptions
+}
+
+func (s *createIndex) Exec(ctx context.Context, database db.Database) error {
+	return database.CreateIndexContext(ctx, s.table, s.options)
+}
+
+type dropIndex struct {
+	table, name string
+}
+
+func (s *dropIndex) Exec(ctx context.Context, database db.Database) error {
+	return database.DropIndexContext(ctx, s.table, s.name)
+}
+
+type alterTable struct {
+	name string
+	ops  []db.AlterOp
+}
+
+func (s *alterTable) Exec(ctx context.Context, database db.Database) error {
+	return database.AlterTableContext(ctx, s.name, s.ops...)
+}
+
+// token is a keyword, identifier, literal or punctuation mark
+type token struct {
+	text   string
+	quoted bool // a string literal, with quotes removed
+	pos    int
+}
+
+// tokenize splits SQL text into tokens
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(text[i:], "--"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '(' || c == ')' || c == ',' || c == ';':
+			tokens = append(tokens, token{text: string(c), pos: i})
+			i++
+		case c == '\'':
+			// Quotes inside a literal are doubled
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(text) {
+					return nil, fmt.Errorf("%w: unterminated string at offset %d", ErrInvalidMigration, start)
+				}
+				if text[i] == '\'' {
+					if i+1 < len(text) && text[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(text[i])
+			}
+			tokens = append(tokens, token{text: b.String(), quoted: true, pos: start})
+		case c == '_' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			start := i
+			for i < len(text) && (text[i] == '_' || text[i] == '-' || text[i] == '.' ||
+				unicode.IsLetter(rune(text[i])) || unicode.IsDigit(rune(text[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{text: text[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q at offset %d", ErrInvalidMigration, c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// parser is a recursive descent parser over tokens
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{text: "end of input", pos: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token when it is the keyword or mark want
+func (p *parser) accept(want string) bool {
+	if p.done() || p.tokens[p.pos].quoted || !strings.EqualFold(p.tokens[p.pos].text, want) {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *parser) expect(want string) error {
+	if !p.accept(want) {
+		return p.errorf("expected %s but found %q", want, p.peek().text)
+	}
+	return nil
+}
+
+// ident consumes an identifier
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if p.done() || t.quoted || !isIdent(t.text) {
+		return "", p.errorf("expected a name but found %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// nameList consumes a parenthesized list of names
+func (p *parser) nameList() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			return names, p.expect(")")
+		}
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalidMigration, fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+func (p *parser) statement() (Statement, error) {
+	switch {
+	case p.accept("CREATE"):
+		if p.accept("TABLE") {
+			return p.createTable()
+		}
+		unique := p.accept("UNIQUE")
+		if err := p.expect("INDEX"); err != nil {
+			return nil, err
+		}
+		return p.createIndex(unique)
+	case p.accept("DROP"):
+		if p.accept("TABLE") {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return &dropTable{name: name}, nil
+		}
+		if err := p.expect("INDEX"); err != nil {
+			return nil, err
+		}
+		return p.dropIndex()
+	case p.accept("ALTER"):
+		if err := p.expect("TABLE"); err != nil {
+			return nil, err
+		}
+		return p.alterTable()
+	}
+	return nil, p.errorf("unsupported statement starting with %q", p.peek().text)
+}
+
+func (p *parser) createTable() (Statement, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	stmt := &createTable{name: name}
+	var keys []string
+	for {
+		if p.accept("PRIMARY") {
+			if err := p.expect("KEY"); err != nil {
+				return nil, err
+			}
+			names, err := p.nameList()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, names...)
+		} else {
+			col, err := p.columnDefinition()
+			if err != nil {
+				return nil, err
+			}
+			stmt.columns = append(stmt.columns, col)
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		found := false
+		for i := range stmt.columns {
+			if stmt.columns[i].Name == key {
+				stmt.columns[i].PrimaryKey = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, p.errorf("primary key column %s is not defined", key)
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) createIndex(unique bool) (Statement, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	columns, err := p.nameList()
+	if err != nil {
+		return nil, err
+	}
+	return &createIndex{table: table, options: db.CreateIndexOptions{Name: name, Columns: columns, Unique: unique}}, nil
+}
+
+func (p *parser) dropIndex() (Statement, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	return &dropIndex{table: table, name: name}, nil
+}
+
+func (p *parser) alterTable() (Statement, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &alterTable{name: name}
+	for {
+		op, err := p.alterAction()
+		if err != nil {
+			return nil, err
+		}
+		stmt.ops = append(stmt.ops, op)
+		if !p.accept(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) alterAction() (db.AlterOp, error) {
+	switch {
+	case p.accept("ADD"):
+		p.accept("COLUMN")
+		col, err := p.columnDefinition()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		return db.AddColumn(col), nil
+	case p.accept("DROP"):
+		p.accept("COLUMN")
+		name, err := p.ident()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		return db.DropColumn(name), nil
+	case p.accept("RENAME"):
+		p.accept("COLUMN")
+		name, err := p.ident()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		if err := p.expect("TO"); err != nil {
+			return db.AlterOp{}, err
+		}
+		newName, err := p.ident()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		return db.RenameColumn(name, newName), nil
+	case p.accept("ALTER"):
+		p.accept("COLUMN")
+		name, err := p.ident()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		if p.accept("SET") {
+			if err := p.expect("DATA"); err != nil {
+				return db.AlterOp{}, err
+			}
+		}
+		if err := p.expect("TYPE"); err != nil {
+			return db.AlterOp{}, err
+		}
+		dataType, err := p.dataType()
+		if err != nil {
+			return db.AlterOp{}, err
+		}
+		return db.ChangeType(name, dataType), nil
+	}
+	return db.AlterOp{}, p.errorf("unsupported ALTER TABLE action %q", p.peek().text)
+}
+
+func (p *parser) columnDefinition() (db.Column, error) {
+	name, err := p.ident()
+	if err != nil {
+		return db.Column{}, err
+	}
+	dataType, err := p.dataType()
+	if err != nil {
+		return db.Column{}, err
+	}
+	col := db.Column{Name: name, Type: dataType}
+	for {
+		switch {
+		case p.accept("PRIMARY"):
+			if err := p.expect("KEY"); err != nil {
+				return db.Column{}, err
+			}
+			col.PrimaryKey = true
+		case p.accept("NOT"):
+			if err := p.expect("NULL"); err != nil {
+				return db.Column{}, err
+			}
+			col.NotNull = true
+		case p.accept("UNIQUE"):
+			col.Unique = true
+		case p.accept("DEFAULT"):
+			if col.Default, err = p.literal(dataType); err != nil {
+				return db.Column{}, err
+			}
+		default:
+			return col, nil
+		}
+	}
+}
+
+// dataTypes maps SQL type names to column types
+var dataTypes = map[string]db.DataType{
+	"INT": db.Int, "INTEGER": db.Int, "BIGINT": db.Int, "SMALLINT": db.Int,
+	"FLOAT": db.Float, "REAL": db.Float, "DOUBLE": db.Float,
+	"TEXT": db.String, "STRING": db.String, "VARCHAR": db.String, "CHAR": db.String,
+	"BOOL": db.Boolean, "BOOLEAN": db.Boolean,
+	"DATETIME": db.DateTime, "TIMESTAMP": db.DateTime,
+	"BLOB": db.Blob, "BYTES": db.Blob,
+	"JSON": db.JSON, "JSONB": db.JSON,
+}
+
+func (p *parser) dataType() (db.DataType, error) {
+	t := p.peek()
+	dataType, ok := dataTypes[strings.ToUpper(t.text)]
+	if p.done() || t.quoted || !ok {
+		return 0, p.errorf("unknown type %q", t.text)
+	}
+	p.pos++
+
+	// Lengths such as VARCHAR(255) are accepted and ignored
+	if p.accept("(") {
+		if _, err := strconv.Atoi(p.peek().text); err != nil {
+			return 0, p.errorf("expected a length but found %q", p.peek().text)
+		}
+		p.pos++
+		if err := p.expect(")"); err != nil {
+			return 0, err
+		}
+	}
+	return dataType, nil
+}
+
+// literal consumes a default value for a column of dataType
+func (p *parser) literal(dataType db.DataType) (interface{}, error) {
+	t := p.peek()
+	if p.done() {
+		return nil, p.errorf("expected a value but found %q", t.text)
+	}
+	p.pos++
+
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToUpper(t.text) {
+	case "NULL":
+		return nil, nil
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	if dataType == db.Int {
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return int(n), nil
+		}
+	}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return f, nil
+	}
+	p.pos--
+	return nil, p.errorf("expected a value but found %q", t.text)
+}
+
+// isIdent reports whether s can name a table, column or index
+func isIdent(s string) bool {
+	if s == "" || unicode.IsDigit(rune(s[0])) || s[0] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
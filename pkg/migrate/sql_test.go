@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tungpsit/ez-file-db/pkg/db"
+)
+
+func TestParseSQL(t *testing.T) {
+	t.Run("Statements", func(t *testing.T) {
+		stmts, err := ParseSQL(`
+			-- accounts and their owners
+			CREATE TABLE accounts (
+				id BIGINT PRIMARY KEY,
+				email VARCHAR(255) NOT NULL UNIQUE,
+				note TEXT DEFAULT 'it''s new',
+				balance FLOAT DEFAULT -1.5,
+				active BOOLEAN DEFAULT TRUE
+			);
+			create unique index idx_email on accounts (email);
+			ALTER TABLE accounts ADD COLUMN visits INT DEFAULT 0, RENAME note TO memo,
+				ALTER COLUMN balance SET DATA TYPE TEXT, DROP active;
+			DROP INDEX idx_email ON accounts;
+			DROP TABLE accounts;
+			CREATE TABLE memberships (user_id INT, group_id INT, role TEXT, PRIMARY KEY (user_id, group_id));
+		`)
+		assert.NoError(t, err)
+		assert.Equal(t, []Statement{
+			&createTable{name: "accounts", columns: []db.Column{
+				{Name: "id", Type: db.Int, PrimaryKey: true},
+				{Name: "email", Type: db.String, NotNull: true, Unique: true},
+				{Name: "note", Type: db.String, Default: "it's new"},
+				{Name: "balance", Type: db.Float, Default: -1.5},
+				{Name: "active", Type: db.Boolean, Default: true},
+			}},
+			&createIndex{table: "accounts", options: db.CreateIndexOptions{Name: "idx_email", Columns: []string{"email"}, Unique: true}},
+			&alterTable{name: "accounts", ops: []db.AlterOp{
+				db.AddColumn(db.Column{Name: "visits", Type: db.Int, Default: 0}),
+				db.RenameColumn("note", "memo"),
+				db.ChangeType("balance", db.String),
+				db.DropColumn("active"),
+			}},
+			&dropIndex{table: "accounts", name: "idx_email"},
+			&dropTable{name: "accounts"},
+			&createTable{name: "memberships", columns: []db.Column{
+				{Name: "user_id", Type: db.Int, PrimaryKey: true},
+				{Name: "group_id", Type: db.Int, PrimaryKey: true},
+				{Name: "role", Type: db.String},
+			}},
+		}, stmts)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, text := range []string{
+			"CREATE TABLE t (id UUID PRIMARY KEY)",
+			"CREATE TABLE t (id INT PRIMARY)",
+			"CREATE TABLE t (note TEXT DEFAULT 'open",
+			"DROP TABLE a DROP TABLE b",
+			"ALTER TABLE t TRUNCATE",
+			"INSERT INTO t VALUES (1)",
+			"CREATE TABLE 1t (id INT)",
+			"CREATE TABLE t (id INT, PRIMARY KEY (missing))",
+		} {
+			_, err := ParseSQL(text)
+			assert.ErrorIs(t, err, ErrInvalidMigration, text)
+		}
+	})
+
+	t.Run("Exec", func(t *testing.T) {
+		database := newTestDB(t)
+		stmts, err := ParseSQL("CREATE TABLE t (id INT PRIMARY KEY); ALTER TABLE t ADD name TEXT")
+		assert.NoError(t, err)
+		assert.NoError(t, sqlFunc(stmts)(context.Background(), database))
+
+		table, err := database.GetTable("t")
+		assert.NoError(t, err)
+		assert.Equal(t, "name", table.Columns[1].Name)
+	})
+}
@@ -0,0 +1,150 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPath is returned for malformed path expressions
+var ErrInvalidPath = errors.New("invalid path")
+
+// Path is a parsed path expression. It names a column and then, step by
+// step, a key of a nested map or an index of a nested array, as in
+// meta.tags[0]. Keys that are not plain names are quoted: meta["a.b"].
+type Path struct {
+	Column string
+	Steps  []PathStep
+}
+
+// PathStep is one step of a path: a map key, or an array index
+type PathStep struct {
+	Key   string
+	Index int // array index, or -1 for a map key
+}
+
+// ParsePath parses a path expression
+func ParsePath(expr string) (Path, error) {
+	fail := func(reason string) (Path, error) {
+		return Path{}, fmt.Errorf("%w %q: %s", ErrInvalidPath, expr, reason)
+	}
+
+	name := func(s string) int {
+		return strings.IndexAny(s, ".[]\"")
+	}
+
+	end := name(expr)
+	if end < 0 {
+		end = len(expr)
+	}
+	if end == 0 {
+		return fail("missing column")
+	}
+	path := Path{Column: expr[:end]}
+
+	for rest := expr[end:]; rest != ""; {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := name(rest)
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return fail("missing key after '.'")
+			}
+			path.Steps = append(path.Steps, PathStep{Key: rest[:end], Index: -1})
+			rest = rest[end:]
+		case '[':
+			closing := strings.IndexByte(rest, ']')
+			if strings.HasPrefix(rest, `["`) {
+				// Quoted keys may themselves contain ']'
+				closing = strings.Index(rest, `"]`) + 1
+			}
+			if closing <= 0 {
+				return fail("unterminated '['")
+			}
+			inner := rest[1:closing]
+			rest = rest[closing+1:]
+			if strings.HasPrefix(inner, `"`) {
+				key, err := strconv.Unquote(inner)
+				if err != nil {
+					return fail("malformed quoted key")
+				}
+				path.Steps = append(path.Steps, PathStep{Key: key, Index: -1})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 || strconv.Itoa(index) != inner {
+				return fail("array index must be a non-negative integer")
+			}
+			path.Steps = append(path.Steps, PathStep{Index: index})
+		default:
+			return fail(fmt.Sprintf("unexpected %q", rest[0]))
+		}
+	}
+
+	return path, nil
+}
+
+// IsColumn reports whether the path names a whole column
+func (p Path) IsColumn() bool {
+	return len(p.Steps) == 0
+}
+
+// String returns the canonical expression of the path
+func (p Path) String() string {
+	var b strings.Builder
+	b.WriteString(p.Column)
+	for _, step := range p.Steps {
+		switch {
+		case step.Index >= 0:
+			fmt.Fprintf(&b, "[%d]", step.Index)
+		case step.Key != "" && strings.IndexAny(step.Key, ".[]\"") < 0:
+			b.WriteString("." + step.Key)
+		default:
+			b.WriteString("[" + strconv.Quote(step.Key) + "]")
+		}
+	}
+	return b.String()
+}
+
+// Lookup returns the value the path leads to in record. It reports false
+// when a column, key or index along the way is missing or a step does not
+// match the kind of value it meets.
+func (p Path) Lookup(record map[string]interface{}) (interface{}, bool) {
+	value, ok := record[p.Column]
+	for _, step := range p.Steps {
+		if !ok {
+			return nil, false
+		}
+		if step.Index >= 0 {
+			array, isArray := value.([]interface{})
+			if !isArray || step.Index >= len(array) {
+				return nil, false
+			}
+			value = array[step.Index]
+			continue
+		}
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil, false
+		}
+		value, ok = object[step.Key]
+	}
+	return value, ok
+}
+
+// Lookup returns the value expr names in record: a column, or a path into
+// a nested document. A column whose name is exactly expr wins over a path.
+func Lookup(record map[string]interface{}, expr string) (interface{}, bool) {
+	if value, ok := record[expr]; ok {
+		return value, true
+	}
+	path, err := ParsePath(expr)
+	if err != nil || path.IsColumn() {
+		return nil, false
+	}
+	return path.Lookup(record)
+}
@@ -1,9 +1,12 @@
 package query
 
 import (
+	"cmp"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // Operator represents a comparison operator
@@ -19,15 +22,41 @@ const (
 	Like  Operator = "LIKE"
 	In    Operator = "IN"
 	NotIn Operator = "NOT IN"
+	// Contains matches documents that contain Value: arrays holding it, or
+	// holding every element of an array Value, and maps holding every key
+	// of a map Value with contained values
+	Contains Operator = "CONTAINS"
+	// HasKey matches maps that have the key Value
+	HasKey Operator = "HAS KEY"
+	// Overlaps matches arrays that share at least one element with the
+	// array Value
+	Overlaps Operator = "OVERLAPS"
 )
 
-// Condition represents a WHERE condition
+// Comparable is implemented by values that order themselves against other
+// values, such as exact decimals. Compare reports false when other cannot
+// be compared with the value.
+type Comparable interface {
+	Compare(other interface{}) (int, bool)
+}
+
+// Condition represents a WHERE condition. Column is a column name or a path
+// into a nested document such as meta.tags[0].
 type Condition struct {
 	Column   string
 	Operator Operator
 	Value    interface{}
 }
 
+// ColumnRef is a condition value naming another column, or a path, of the
+// same record, so that conditions can compare two columns
+type ColumnRef string
+
+// Col returns a reference to column for use as a condition value
+func Col(column string) ColumnRef {
+	return ColumnRef(column)
+}
+
 // Query represents a database query
 type Query struct {
 	Table      string
@@ -88,13 +117,26 @@ func (q *Query) SetOffset(offset int) *Query {
 
 // Evaluate evaluates a record against the query conditions
 func (q *Query) Evaluate(record map[string]interface{}) bool {
-	for _, condition := range q.Conditions {
-		value, exists := record[condition.Column]
+	return Match(q.Conditions, record)
+}
+
+// Match reports whether a record satisfies every condition. A ColumnRef
+// value is replaced by the referenced column of the record. Conditions on
+// missing columns and paths never match.
+func Match(conditions []Condition, record map[string]interface{}) bool {
+	for _, condition := range conditions {
+		value, exists := Lookup(record, condition.Column)
 		if !exists {
 			return false
 		}
 
-		if !evaluateCondition(value, condition.Operator, condition.Value) {
+		target := condition.Value
+		if ref, ok := target.(ColumnRef); ok {
+			if target, exists = Lookup(record, string(ref)); !exists {
+				return false
+			}
+		}
+		if !evaluateCondition(value, condition.Operator, target) {
 			return false
 		}
 	}
@@ -105,17 +147,21 @@ func (q *Query) Evaluate(record map[string]interface{}) bool {
 func evaluateCondition(value interface{}, operator Operator, target interface{}) bool {
 	switch operator {
 	case Eq:
-		return reflect.DeepEqual(value, target)
+		return equalValues(value, target)
 	case Neq:
-		return !reflect.DeepEqual(value, target)
+		return !equalValues(value, target)
 	case Gt:
-		return compareValues(value, target) > 0
+		c, ok := compareValues(value, target)
+		return ok && c > 0
 	case Lt:
-		return compareValues(value, target) < 0
+		c, ok := compareValues(value, target)
+		return ok && c < 0
 	case Gte:
-		return compareValues(value, target) >= 0
+		c, ok := compareValues(value, target)
+		return ok && c >= 0
 	case Lte:
-		return compareValues(value, target) <= 0
+		c, ok := compareValues(value, target)
+		return ok && c <= 0
 	case Like:
 		str, ok := value.(string)
 		if !ok {
@@ -132,7 +178,7 @@ func evaluateCondition(value interface{}, operator Operator, target interface{})
 			return false
 		}
 		for _, t := range targetSlice {
-			if reflect.DeepEqual(value, t) {
+			if equalValues(value, t) {
 				return true
 			}
 		}
@@ -143,52 +189,275 @@ func evaluateCondition(value interface{}, operator Operator, target interface{})
 			return false
 		}
 		for _, t := range targetSlice {
-			if reflect.DeepEqual(value, t) {
+			if equalValues(value, t) {
 				return false
 			}
 		}
 		return true
+	case Contains:
+		return containsValue(value, target)
+	case Overlaps:
+		values, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		targets, ok := target.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			for _, t := range targets {
+				if equalValues(v, t) {
+					return true
+				}
+			}
+		}
+		return false
+	case HasKey:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		key, ok := target.(string)
+		if !ok {
+			return false
+		}
+		_, exists := object[key]
+		return exists
 	default:
 		return false
 	}
 }
 
-// compareValues compares two values
-func compareValues(a, b interface{}) int {
-	switch v1 := a.(type) {
-	case int:
-		v2, ok := b.(int)
+// containsValue reports whether doc contains target. Maps contain maps
+// whose keys they hold with contained values. Arrays contain single
+// elements and arrays whose elements all appear in them. Other values
+// contain only values equal to them.
+func containsValue(doc, target interface{}) bool {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		t, ok := target.(map[string]interface{})
 		if !ok {
-			return 0
-		}
-		if v1 < v2 {
-			return -1
+			return false
 		}
-		if v1 > v2 {
-			return 1
+		for key, want := range t {
+			have, exists := d[key]
+			if !exists || !containsValue(have, want) {
+				return false
+			}
 		}
-		return 0
-	case float64:
-		v2, ok := b.(float64)
+		return true
+	case []interface{}:
+		wanted, ok := target.([]interface{})
 		if !ok {
-			return 0
+			wanted = []interface{}{target}
+		}
+		for _, want := range wanted {
+			found := false
+			for _, have := range d {
+				if containsValue(have, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return equalValues(doc, target)
+	}
+}
+
+// equalValues compares two values, treating numbers of different Go types
+// as equal when they have the same value, also within nested maps and
+// arrays
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareOrdered(a, b); ok {
+		return c == 0
+	}
+	if c, ok := compareNumbers(a, b); ok {
+		return c == 0
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
 		}
-		if v1 < v2 {
-			return -1
+		for key, value := range x {
+			other, exists := y[key]
+			if !exists || !equalValues(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
 		}
-		if v1 > v2 {
-			return 1
+		for i := range x {
+			if !equalValues(x[i], y[i]) {
+				return false
+			}
 		}
-		return 0
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues compares two values. Numbers of any Go type and Comparable
+// values compare by value, booleans order false first, and strings and
+// times compare with their own kind. It reports false for values that
+// cannot be compared, so that range conditions on them never match.
+func compareValues(a, b interface{}) (int, bool) {
+	if c, ok := compareOrdered(a, b); ok {
+		return c, true
+	}
+	if _, ok := toFloat(a); ok {
+		return compareNumbers(a, b)
+	}
+
+	switch v1 := a.(type) {
+	case bool:
+		v2, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case v1 == v2:
+			return 0, true
+		case v2:
+			return -1, true
+		}
+		return 1, true
 	case string:
 		v2, ok := b.(string)
 		if !ok {
-			return 0
+			return 0, false
 		}
-		return strings.Compare(v1, v2)
-	default:
-		return 0
+		return strings.Compare(v1, v2), true
+	case time.Time:
+		v2, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return v1.Compare(v2), true
+	}
+	return 0, false
+}
+
+// compareOrdered compares a and b when either is Comparable
+func compareOrdered(a, b interface{}) (int, bool) {
+	if x, ok := a.(Comparable); ok {
+		return x.Compare(b)
+	}
+	if y, ok := b.(Comparable); ok {
+		c, ok := y.Compare(a)
+		return -c, ok
+	}
+	return 0, false
+}
+
+// compareNumbers compares two numbers of any Go type. Integers compare
+// exactly, so that values above 2^53 stay distinct; only when one side is
+// a float are both compared as float64.
+func compareNumbers(a, b interface{}) (int, bool) {
+	if x, ok := toInt64(a); ok {
+		if y, ok := toInt64(b); ok {
+			return cmp.Compare(x, y), true
+		}
+	}
+	if x, ok := toUint64(a); ok {
+		if y, ok := toUint64(b); ok {
+			return cmp.Compare(x, y), true
+		}
+	}
+	x, ok := toFloat(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		return 0, false
+	}
+	return cmp.Compare(x, y), true
+}
+
+// toInt64 converts an integer to int64, reporting false for floats and for
+// unsigned values that do not fit
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// toUint64 converts an integer to uint64, reporting false for floats and
+// for negative values
+func toUint64(v interface{}) (uint64, bool) {
+	if n, ok := toInt64(v); ok {
+		return uint64(n), n >= 0
+	}
+	switch n := v.(type) {
+	case uint:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	}
+	return 0, false
+}
+
+// toFloat converts a number of any Go type to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
 	}
+	return 0, false
 }
 
 // String returns a string representation of the query
@@ -0,0 +1,154 @@
+package query
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	record := map[string]interface{}{
+		"id":    1,
+		"name":  "Alice",
+		"age":   30,
+		"min":   18,
+		"tags":  []interface{}{"a", "b"},
+		"meta":  map[string]interface{}{"kind": "x", "sizes": []interface{}{1, 2}},
+		"added": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name      string
+		condition Condition
+		want      bool
+	}{
+		{"Eq Across Number Types", Condition{"age", Eq, int64(30)}, true},
+		{"Eq Float", Condition{"age", Eq, 30.0}, true},
+		{"Neq", Condition{"name", Neq, "Bob"}, true},
+		{"Gt", Condition{"age", Gt, 29.5}, true},
+		{"Lt", Condition{"age", Lt, uint8(30)}, false},
+		{"Gte", Condition{"age", Gte, 30}, true},
+		{"Lte Time", Condition{"added", Lte, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{"Range On Incomparable Values", Condition{"name", Gt, 1}, false},
+		{"Like Ignores Case", Condition{"name", Like, "lic"}, true},
+		{"In", Condition{"age", In, []interface{}{1, 30}}, true},
+		{"NotIn", Condition{"age", NotIn, []interface{}{1, 30}}, false},
+		{"Contains Element", Condition{"tags", Contains, "b"}, true},
+		{"Contains Every Element", Condition{"tags", Contains, []interface{}{"a", "c"}}, false},
+		{"Contains Map", Condition{"meta", Contains, map[string]interface{}{"sizes": []interface{}{2}}}, true},
+		{"HasKey", Condition{"meta", HasKey, "kind"}, true},
+		{"Overlaps", Condition{"tags", Overlaps, []interface{}{"c", "a"}}, true},
+		{"Path", Condition{"meta.sizes[1]", Eq, 2}, true},
+		{"Missing Path", Condition{"meta.sizes[2]", Eq, nil}, false},
+		{"Missing Column", Condition{"email", Neq, "x"}, false},
+		{"Column Reference", Condition{"age", Gt, Col("min")}, true},
+		{"Missing Column Reference", Condition{"age", Gt, Col("max")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Match([]Condition{tt.condition}, record))
+		})
+	}
+
+	t.Run("Query", func(t *testing.T) {
+		q := NewQuery("users").Select("id").Where("age", Gte, 18).Where("name", Like, "al")
+		assert.True(t, q.Evaluate(record))
+		assert.False(t, q.Where("id", Neq, 1).Evaluate(record))
+	})
+}
+
+func TestCompareValues(t *testing.T) {
+	t.Run("Large Integers Compare Exactly", func(t *testing.T) {
+		n := int64(1 << 60)
+		assert.False(t, equalValues(n, n+1))
+		assert.False(t, equalValues(int(n), uint64(n+1)))
+		assert.True(t, equalValues(int(n), uint64(n)))
+		c, ok := compareValues(n+1, n)
+		assert.True(t, ok)
+		assert.Equal(t, 1, c)
+		assert.False(t, Match([]Condition{{"n", Eq, n + 1}}, map[string]interface{}{"n": n}))
+		assert.False(t, Match([]Condition{{"n", In, []interface{}{n + 1}}}, map[string]interface{}{"n": n}))
+	})
+
+	t.Run("Unsigned Beyond Int64", func(t *testing.T) {
+		big := uint64(math.MaxUint64)
+		c, ok := compareValues(big, int64(math.MaxInt64))
+		assert.True(t, ok)
+		assert.Equal(t, 1, c)
+		c, ok = compareValues(-1, big)
+		assert.True(t, ok)
+		assert.Equal(t, -1, c)
+		c, ok = compareValues(big, big-1)
+		assert.True(t, ok)
+		assert.Equal(t, 1, c)
+	})
+
+	t.Run("Floats", func(t *testing.T) {
+		c, ok := compareValues(1, 1.5)
+		assert.True(t, ok)
+		assert.Equal(t, -1, c)
+		assert.True(t, equalValues(float32(2), 2))
+	})
+
+	t.Run("Other Kinds", func(t *testing.T) {
+		c, ok := compareValues(false, true)
+		assert.True(t, ok)
+		assert.Equal(t, -1, c)
+		c, ok = compareValues("b", "a")
+		assert.True(t, ok)
+		assert.Equal(t, 1, c)
+		_, ok = compareValues("1", 1)
+		assert.False(t, ok)
+		_, ok = compareValues(1, "1")
+		assert.False(t, ok)
+		_, ok = compareValues([]interface{}{1}, []interface{}{1})
+		assert.False(t, ok)
+		assert.True(t, equalValues([]interface{}{1, map[string]interface{}{"a": 2.0}}, []interface{}{1.0, map[string]interface{}{"a": 2}}))
+	})
+}
+
+func TestParsePath(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		path, err := ParsePath(`meta.tags[0]["a.b"]`)
+		assert.NoError(t, err)
+		assert.Equal(t, Path{Column: "meta", Steps: []PathStep{
+			{Key: "tags", Index: -1}, {Index: 0}, {Key: "a.b", Index: -1},
+		}}, path)
+		assert.Equal(t, `meta.tags[0]["a.b"]`, path.String())
+		assert.False(t, path.IsColumn())
+
+		path, err = ParsePath("name")
+		assert.NoError(t, err)
+		assert.True(t, path.IsColumn())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, expr := range []string{"", ".a", "a.", "a[", "a[-1]", "a[01]", "a[x]", `a["b]`, "a]"} {
+			_, err := ParsePath(expr)
+			assert.ErrorIs(t, err, ErrInvalidPath, expr)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		record := map[string]interface{}{
+			"meta":  map[string]interface{}{"tags": []interface{}{"x"}},
+			"a.b":   1,
+			"plain": "v",
+		}
+		value, ok := Lookup(record, "meta.tags[0]")
+		assert.True(t, ok)
+		assert.Equal(t, "x", value)
+
+		// A column named like a path wins
+		value, ok = Lookup(record, "a.b")
+		assert.True(t, ok)
+		assert.Equal(t, 1, value)
+
+		for _, expr := range []string{"meta.tags[1]", "meta.tags.x", "plain[0]", "missing", "meta["} {
+			_, ok := Lookup(record, expr)
+			assert.False(t, ok, expr)
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// blobDirName is the directory under the storage root that holds blobs. Its
+// leading dot keeps it apart from table directories.
+const blobDirName = ".blobs"
+
+var (
+	// ErrBlobNotFound is returned when a blob does not exist
+	ErrBlobNotFound = errors.New("blob not found")
+	// ErrInvalidBlobHash is returned for names that are not SHA-256 hashes
+	ErrInvalidBlobHash = errors.New("invalid blob hash")
+)
+
+// BlobStore is implemented by engines that keep large values out of line.
+// Blobs are immutable and named by the hex SHA-256 of their content, so
+// storing the same content twice yields the same blob. Reference counting
+// is left to the caller.
+type BlobStore interface {
+	// StageBlob copies r into a blob that stays invisible until committed
+	StageBlob(r io.Reader) (*StagedBlob, error)
+	// OpenBlob opens a committed blob. The reader stays valid after the
+	// blob is deleted.
+	OpenBlob(hash string) (io.ReadSeekCloser, error)
+	// DeleteBlob removes a blob; deleting a missing blob is not an error
+	DeleteBlob(hash string) error
+	// ListBlobs returns the hashes of every committed blob
+	ListBlobs() ([]string, error)
+}
+
+// StagedBlob is a blob written by StageBlob that is not yet visible
+type StagedBlob struct {
+	Hash string
+	Size int64
+
+	commit  func() error
+	discard func()
+	done    bool
+}
+
+// Commit makes the blob visible under its hash, replacing any blob with the
+// same content
+func (b *StagedBlob) Commit() error {
+	if b.done {
+		return nil
+	}
+	if err := b.commit(); err != nil {
+		return err
+	}
+	b.done = true
+	return nil
+}
+
+// Discard drops an uncommitted blob. It does nothing after Commit, so it
+// can be deferred.
+func (b *StagedBlob) Discard() {
+	if !b.done {
+		b.discard()
+		b.done = true
+	}
+}
+
+// validateBlobHash rejects names that could escape the blob directory
+func validateBlobHash(hash string) error {
+	if len(hash) != sha256.Size*2 {
+		return fmt.Errorf("%w: %q", ErrInvalidBlobHash, hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidBlobHash, hash)
+	}
+	return nil
+}
+
+// hashReader hashes and counts what is read through it
+type hashReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// sum returns the hex hash of everything read so far
+func (h *hashReader) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+var _ BlobStore = (*FileStorage)(nil)
+
+// blobPath returns the file of a blob, in a subdirectory named by the first
+// byte of its hash
+func (fs *FileStorage) blobPath(hash string) (string, error) {
+	if err := validateBlobHash(hash); err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.basePath, blobDirName, hash[:2], hash), nil
+}
+
+// StageBlob implements BlobStore. The content is streamed to a temp file,
+// which is left for removeTempFiles if the process dies before Commit.
+func (fs *FileStorage) StageBlob(r io.Reader) (*StagedBlob, error) {
+	dir := filepath.Join(fs.basePath, blobDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".blob.*"+tempFileExt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage blob: %w", err)
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) (*StagedBlob, error) {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to stage blob: %w", err)
+	}
+
+	hr := newHashReader(r)
+	if _, err := io.Copy(tmp, hr); err != nil {
+		return fail(err)
+	}
+	if fs.syncMode == SyncAlways {
+		if err := tmp.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return fail(err)
+	}
+
+	hash := hr.sum()
+	return &StagedBlob{
+		Hash: hash,
+		Size: hr.size,
+		commit: func() error {
+			path, err := fs.blobPath(hash)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("failed to create blob directory: %w", err)
+			}
+			if err := os.Rename(tmpPath, path); err != nil {
+				os.Remove(tmpPath)
+				return fmt.Errorf("failed to commit blob: %w", err)
+			}
+			return fs.commitDurability(
+				map[string]struct{}{path: {}},
+				map[string]struct{}{filepath.Dir(path): {}},
+			)
+		},
+		discard: func() {
+			os.Remove(tmpPath)
+		},
+	}, nil
+}
+
+// OpenBlob implements BlobStore
+func (fs *FileStorage) OpenBlob(hash string) (io.ReadSeekCloser, error) {
+	path, err := fs.blobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return f, nil
+}
+
+// DeleteBlob implements BlobStore
+func (fs *FileStorage) DeleteBlob(hash string) error {
+	path, err := fs.blobPath(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	if err := fs.syncParent(path); err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+// ListBlobs implements BlobStore
+func (fs *FileStorage) ListBlobs() ([]string, error) {
+	dir := filepath.Join(fs.basePath, blobDirName)
+	var hashes []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && validateBlobHash(info.Name()) == nil {
+			hashes = append(hashes, info.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+var _ BlobStore = (*MemoryStorage)(nil)
+
+// StageBlob implements BlobStore
+func (ms *MemoryStorage) StageBlob(r io.Reader) (*StagedBlob, error) {
+	hr := newHashReader(r)
+	data, err := io.ReadAll(hr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage blob: %w", err)
+	}
+	hash := hr.sum()
+	return &StagedBlob{
+		Hash: hash,
+		Size: hr.size,
+		commit: func() error {
+			ms.mu.Lock()
+			defer ms.mu.Unlock()
+			if ms.closed {
+				return ErrClosed
+			}
+			ms.blobs[hash] = data
+			return nil
+		},
+		discard: func() {},
+	}, nil
+}
+
+// OpenBlob implements BlobStore
+func (ms *MemoryStorage) OpenBlob(hash string) (io.ReadSeekCloser, error) {
+	if err := validateBlobHash(hash); err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.closed {
+		return nil, ErrClosed
+	}
+	data, ok := ms.blobs[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+	}
+	// Stored blobs are never modified, so readers can share them
+	return blobReader{bytes.NewReader(data)}, nil
+}
+
+// DeleteBlob implements BlobStore
+func (ms *MemoryStorage) DeleteBlob(hash string) error {
+	if err := validateBlobHash(hash); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.closed {
+		return ErrClosed
+	}
+	delete(ms.blobs, hash)
+	return nil
+}
+
+// ListBlobs implements BlobStore
+func (ms *MemoryStorage) ListBlobs() ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.closed {
+		return nil, ErrClosed
+	}
+	hashes := make([]string, 0, len(ms.blobs))
+	for hash := range ms.blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// blobReader adds a no-op Close to an in-memory blob
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) BlobStore{
+		"File": func(t *testing.T) BlobStore {
+			fs, err := NewFileStorage(t.TempDir(), 16)
+			assert.NoError(t, err)
+			return fs
+		},
+		"Memory": func(t *testing.T) BlobStore {
+			return NewMemoryStorage()
+		},
+	}
+
+	content := strings.Repeat("blob content ", 100)
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			// Staged blobs stay invisible until committed, and are not
+			// limited by the maximum record size
+			staged, err := store.StageBlob(strings.NewReader(content))
+			assert.NoError(t, err)
+			assert.Equal(t, hash, staged.Hash)
+			assert.Equal(t, int64(len(content)), staged.Size)
+			hashes, err := store.ListBlobs()
+			assert.NoError(t, err)
+			assert.Empty(t, hashes)
+			assert.NoError(t, staged.Commit())
+			staged.Discard()
+
+			r, err := store.OpenBlob(hash)
+			if assert.NoError(t, err) {
+				_, err = r.Seek(13, io.SeekStart)
+				assert.NoError(t, err)
+				data, err := io.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, content[13:], string(data))
+				assert.NoError(t, r.Close())
+			}
+
+			// The same content names the same blob
+			staged, err = store.StageBlob(strings.NewReader(content))
+			assert.NoError(t, err)
+			assert.NoError(t, staged.Commit())
+			other, err := store.StageBlob(strings.NewReader("other"))
+			assert.NoError(t, err)
+			other.Discard()
+			hashes, err = store.ListBlobs()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{hash}, hashes)
+
+			assert.NoError(t, store.DeleteBlob(hash))
+			assert.NoError(t, store.DeleteBlob(hash))
+			_, err = store.OpenBlob(hash)
+			assert.ErrorIs(t, err, ErrBlobNotFound)
+			_, err = store.OpenBlob("../../items")
+			assert.ErrorIs(t, err, ErrInvalidBlobHash)
+		})
+	}
+}
+
+func TestFileBlobsRemoveStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir, 0)
+	assert.NoError(t, err)
+	_, err = fs.StageBlob(strings.NewReader("never committed"))
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Close())
+
+	// Blobs staged before a crash are removed with other temp files
+	fs, err = NewFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer fs.Close()
+	entries, err := os.ReadDir(filepath.Join(dir, blobDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
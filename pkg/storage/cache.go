@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+)
+
+// CacheStats reports the effectiveness of a record cache
+type CacheStats struct {
+	Hits      uint64 // Reads served from the cache
+	Misses    uint64 // Reads that went to the underlying engine
+	Evictions uint64 // Records evicted to respect the size limits
+	Records   int    // Records currently cached
+	Bytes     int64  // Estimated size of the cached records
+}
+
+// CachedEngine wraps an Engine with an LRU cache of records read by key.
+//
+// Writes, deletes and batches invalidate the affected keys both before and
+// after they reach the underlying engine, and a read only populates the
+// cache if no write happened while it was in flight, so the cache never
+// serves a record older than the last completed write.
+//
+// Cached records are reserved from a memory budget. When the budget is
+// exhausted the cache gives memory back by evicting records, and stops
+// caching rather than failing reads.
+type CachedEngine struct {
+	engine     Engine
+	maxRecords int
+	maxBytes   int64
+	budget     *memory.Budget
+
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	epoch   uint64
+	stats   CacheStats
+	mu      sync.Mutex
+}
+
+// cacheEntry is a cached record with its estimated size
+type cacheEntry struct {
+	key    string
+	record *Record
+	size   int64
+}
+
+var _ Engine = (*CachedEngine)(nil)
+
+// NewCachedEngine caches up to maxRecords records and, if maxBytes is
+// positive, up to maxBytes of estimated record size. The budget may be nil.
+func NewCachedEngine(engine Engine, maxRecords int, maxBytes int64, budget *memory.Budget) *CachedEngine {
+	return &CachedEngine{
+		engine:     engine,
+		maxRecords: maxRecords,
+		maxBytes:   maxBytes,
+		budget:     budget,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Write writes a record through to the underlying engine
+func (c *CachedEngine) Write(tableName string, record *Record) error {
+	key, err := cacheKey(tableName, record.ID)
+	if err != nil {
+		return err
+	}
+
+	c.invalidate(key)
+	defer c.invalidate(key)
+	return c.engine.Write(tableName, record)
+}
+
+// Read returns a cached copy of a record, reading it from the underlying
+// engine on a miss
+func (c *CachedEngine) Read(tableName string, id interface{}) (*Record, error) {
+	key, err := cacheKey(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.stats.Hits++
+		record := cloneRecord(elem.Value.(*cacheEntry).record)
+		c.mu.Unlock()
+		return record, nil
+	}
+	c.stats.Misses++
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	record, err := c.engine.Read(tableName, id)
+	if err != nil || record == nil {
+		return record, err
+	}
+
+	c.add(key, record, epoch)
+	return record, nil
+}
+
+// Delete removes a record from the underlying engine
+func (c *CachedEngine) Delete(tableName string, id interface{}) error {
+	key, err := cacheKey(tableName, id)
+	if err != nil {
+		return err
+	}
+
+	c.invalidate(key)
+	defer c.invalidate(key)
+	return c.engine.Delete(tableName, id)
+}
+
+// Scan reads directly from the underlying engine without populating the cache
+func (c *CachedEngine) Scan(tableName string, fn func(*Record) error) error {
+	return c.engine.Scan(tableName, fn)
+}
+
+// Batch applies a batch to the underlying engine
+func (c *CachedEngine) Batch(ops []Op) error {
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		id := op.ID
+		if op.Type == OpWrite && op.Record != nil {
+			id = op.Record.ID
+		}
+		key, err := cacheKey(op.Table, id)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	c.invalidate(keys...)
+	defer c.invalidate(keys...)
+	return c.engine.Batch(ops)
+}
+
+// Close clears the cache and closes the underlying engine
+func (c *CachedEngine) Close() error {
+	c.mu.Lock()
+	c.budget.Release(c.bytes)
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+	c.epoch++
+	c.mu.Unlock()
+
+	return c.engine.Close()
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *CachedEngine) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Records = c.lru.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// add caches a copy of record unless a write happened since epoch
+func (c *CachedEngine) add(key string, record *Record, epoch uint64) {
+	size := recordSize(record)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch != epoch {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+
+	// Make room in the memory budget, giving up if the cache runs dry
+	for c.budget.Reserve(size) != nil {
+		if c.lru.Len() == 0 {
+			return
+		}
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	entry := &cacheEntry{key: key, record: cloneRecord(record), size: size}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += size
+
+	for c.lru.Len() > c.maxRecords || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidate drops keys from the cache and fences off in-flight reads
+func (c *CachedEngine) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removeElement unlinks a cache entry. Callers hold c.mu.
+func (c *CachedEngine) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	c.budget.Release(entry.size)
+}
+
+// cacheKey identifies a record across tables
+func cacheKey(tableName string, id interface{}) (string, error) {
+	key, err := EncodeKey(id)
+	if err != nil {
+		return "", err
+	}
+	return tableName + "/" + key, nil
+}
+
+// recordSize estimates the in-memory size of a record in bytes
+func recordSize(record *Record) int64 {
+	return 64 + memory.SizeOf(record.ID) + memory.SizeOf(record.Data)
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tungpsit/ez-file-db/pkg/memory"
+)
+
+func TestCachedEngine(t *testing.T) {
+	cache := NewCachedEngine(NewMemoryStorage(), 2, 0, nil)
+
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, cache.Write("items", &Record{ID: i, Data: map[string]interface{}{"n": i}}))
+	}
+
+	t.Run("Hits And Misses", func(t *testing.T) {
+		_, err := cache.Read("items", 1)
+		assert.NoError(t, err)
+		record, err := cache.Read("items", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, record.Data["n"])
+
+		stats := cache.Stats()
+		assert.Equal(t, uint64(1), stats.Hits)
+		assert.Equal(t, uint64(1), stats.Misses)
+		assert.Equal(t, 1, stats.Records)
+	})
+
+	t.Run("Copies Are Isolated", func(t *testing.T) {
+		record, _ := cache.Read("items", 1)
+		record.Data["n"] = 100
+		record, _ = cache.Read("items", 1)
+		assert.Equal(t, 1, record.Data["n"])
+	})
+
+	t.Run("Invalidated On Write", func(t *testing.T) {
+		assert.NoError(t, cache.Write("items", &Record{ID: 1, Data: map[string]interface{}{"n": 10}}))
+		record, _ := cache.Read("items", 1)
+		assert.Equal(t, 10, record.Data["n"])
+
+		assert.NoError(t, cache.Batch([]Op{{Type: OpWrite, Table: "items", Record: &Record{ID: 1, Data: map[string]interface{}{"n": 20}}}}))
+		record, _ = cache.Read("items", 1.0)
+		assert.Equal(t, 20, record.Data["n"])
+
+		assert.NoError(t, cache.Delete("items", 1))
+		record, _ = cache.Read("items", 1)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Evicts Least Recently Used", func(t *testing.T) {
+		before := cache.Stats().Evictions
+		cache.Read("items", 2)
+		cache.Read("items", 3)
+		cache.Read("items", 2)
+		assert.NoError(t, cache.Write("items", &Record{ID: 4, Data: map[string]interface{}{}}))
+		cache.Read("items", 4)
+
+		stats := cache.Stats()
+		assert.Equal(t, 2, stats.Records)
+		assert.Equal(t, before+1, stats.Evictions)
+
+		hits := stats.Hits
+		cache.Read("items", 2)
+		assert.Equal(t, hits+1, cache.Stats().Hits)
+	})
+
+	t.Run("Byte Limit", func(t *testing.T) {
+		small := NewCachedEngine(NewMemoryStorage(), 100, 1, nil)
+		assert.NoError(t, small.Write("items", &Record{ID: 1, Data: map[string]interface{}{"n": 1}}))
+		small.Read("items", 1)
+		assert.Equal(t, 0, small.Stats().Records)
+	})
+
+	t.Run("Memory Budget", func(t *testing.T) {
+		budget := memory.NewBudget(400)
+		bounded := NewCachedEngine(NewMemoryStorage(), 100, 0, budget)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, bounded.Write("items", &Record{ID: i, Data: map[string]interface{}{"n": i}}))
+			_, err := bounded.Read("items", i)
+			assert.NoError(t, err)
+		}
+
+		stats := bounded.Stats()
+		assert.Less(t, stats.Records, 10)
+		assert.Equal(t, stats.Bytes, budget.Stats().Used)
+		assert.LessOrEqual(t, budget.Stats().Used, int64(400))
+
+		assert.NoError(t, bounded.Close())
+		assert.Equal(t, int64(0), budget.Stats().Used)
+	})
+}
@@ -0,0 +1,59 @@
+package storage
+
+import "errors"
+
+// ErrInvalidOp is returned by Batch for malformed operations
+var ErrInvalidOp = errors.New("invalid batch operation")
+
+// Engine is the interface implemented by storage backends.
+//
+// Records are addressed by table name and primary key. Keys are
+// canonicalized with EncodeKey, so integral floats and ints name the same
+// record, and records returned by Read and Scan carry the decoded key.
+// Engines that serialize records return numbers in Data as json.Number and
+// other values as encoding/json decodes them; restoring Go types is left to
+// the caller, which knows the schema. Engines that can keep large values
+// out of line also implement BlobStore.
+type Engine interface {
+	// Write creates or replaces a record
+	Write(tableName string, record *Record) error
+	// Read returns a record, or nil if it does not exist
+	Read(tableName string, id interface{}) (*Record, error)
+	// Delete removes a record; deleting a missing record is not an error
+	Delete(tableName string, id interface{}) error
+	// Scan calls fn for every record in a table until fn returns an error.
+	// Implementations must not hold locks that block writers while fn runs,
+	// so fn may itself read and write records.
+	Scan(tableName string, fn func(*Record) error) error
+	// Batch applies a group of writes and deletes. An error leaves the
+	// records as they were before the batch, unless undoing the operations
+	// already applied fails too.
+	Batch(ops []Op) error
+	// Close flushes pending writes and releases resources
+	Close() error
+}
+
+// Record represents a single data record
+type Record struct {
+	ID      interface{}            `json:"id"`
+	Data    map[string]interface{} `json:"data"`
+	Version int64                  `json:"version"`
+	// Schema is the version of the table schema Data was written under
+	Schema int64 `json:"schema,omitempty"`
+}
+
+// OpType is the kind of a batch operation
+type OpType int
+
+const (
+	OpWrite OpType = iota
+	OpDelete
+)
+
+// Op is a single operation of a Batch. Writes use Record, deletes use ID.
+type Op struct {
+	Type   OpType
+	Table  string
+	Record *Record
+	ID     interface{}
+}
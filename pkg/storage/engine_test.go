@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngines(t *testing.T) {
+	engines := map[string]func(t *testing.T) Engine{
+		"File": func(t *testing.T) Engine {
+			fs, err := NewFileStorage(t.TempDir(), 1024*1024)
+			assert.NoError(t, err)
+			return fs
+		},
+		"Memory": func(t *testing.T) Engine {
+			return NewMemoryStorage()
+		},
+	}
+
+	for name, newEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			engine := newEngine(t)
+			defer engine.Close()
+
+			// Write and read back with a canonical key
+			assert.NoError(t, engine.Write("items", &Record{ID: 1, Data: map[string]interface{}{"name": "one"}}))
+			record, err := engine.Read("items", 1.0)
+			assert.NoError(t, err)
+			if assert.NotNil(t, record) {
+				assert.Equal(t, 1, record.ID)
+				assert.Equal(t, "one", record.Data["name"])
+			}
+
+			// Missing records read as nil
+			record, err = engine.Read("items", 2)
+			assert.NoError(t, err)
+			assert.Nil(t, record)
+
+			// Batch writes and deletes
+			assert.NoError(t, engine.Batch([]Op{
+				{Type: OpWrite, Table: "items", Record: &Record{ID: 2, Data: map[string]interface{}{}}},
+				{Type: OpWrite, Table: "items", Record: &Record{ID: 3, Data: map[string]interface{}{}}},
+				{Type: OpDelete, Table: "items", ID: 1},
+				{Type: OpDelete, Table: "items", ID: 99},
+			}))
+			assert.Error(t, engine.Batch([]Op{{Type: OpWrite, Table: "items"}}))
+
+			var ids []interface{}
+			assert.NoError(t, engine.Scan("items", func(r *Record) error {
+				ids = append(ids, r.ID)
+				return nil
+			}))
+			assert.ElementsMatch(t, []interface{}{2, 3}, ids)
+
+			assert.NoError(t, engine.Delete("items", 2))
+			assert.NoError(t, engine.Delete("items", 2))
+			assert.ErrorIs(t, engine.Write("../x", &Record{ID: 1}), ErrInvalidTableName)
+		})
+	}
+}
+
+func TestMemoryStorageIsolation(t *testing.T) {
+	ms := NewMemoryStorage()
+	data := map[string]interface{}{"tags": []interface{}{"a"}}
+	assert.NoError(t, ms.Write("items", &Record{ID: "x", Data: data}))
+
+	// Mutating the caller's or a returned copy must not change stored data
+	data["tags"].([]interface{})[0] = "changed"
+	record, _ := ms.Read("items", "x")
+	record.Data["tags"] = nil
+
+	record, _ = ms.Read("items", "x")
+	assert.Equal(t, []interface{}{"a"}, record.Data["tags"])
+
+	assert.NoError(t, ms.Close())
+	_, err := ms.Read("items", "x")
+	assert.ErrorIs(t, err, ErrClosed)
+}
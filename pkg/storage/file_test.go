@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Atomic Write", func(t *testing.T) {
+		fs, err := NewFileStorage(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		record := &Record{ID: "a", Data: map[string]interface{}{"name": "first"}}
+		assert.NoError(t, fs.Write("items", record))
+		record.Data["name"] = "second"
+		assert.NoError(t, fs.Write("items", record))
+
+		got, err := fs.Read("items", "a")
+		assert.NoError(t, err)
+		assert.Equal(t, "second", got.Data["name"])
+
+		temps, _ := filepath.Glob(filepath.Join(dir, "items", "*"+tempFileExt))
+		assert.Empty(t, temps)
+	})
+
+	t.Run("Stale Temp Files Removed On Open", func(t *testing.T) {
+		stale := filepath.Join(dir, "items", ".a.json.123"+tempFileExt)
+		assert.NoError(t, os.WriteFile(stale, []byte(`{"id":"a"`), 0644))
+
+		fs, err := NewFileStorage(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		_, err = os.Stat(stale)
+		assert.True(t, os.IsNotExist(err))
+
+		count := 0
+		assert.NoError(t, fs.Scan("items", func(*Record) error {
+			count++
+			return nil
+		}))
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Concurrent Writes", func(t *testing.T) {
+		fs, err := NewFileStorage(t.TempDir(), 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				table := fmt.Sprintf("t%d", w%2)
+				for i := 0; i < 25; i++ {
+					assert.NoError(t, fs.Write(table, &Record{ID: w*100 + i, Data: map[string]interface{}{}}))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		count := 0
+		for _, table := range []string{"t0", "t1"} {
+			assert.NoError(t, fs.Scan(table, func(*Record) error {
+				count++
+				return nil
+			}))
+		}
+		assert.Equal(t, 100, count)
+	})
+
+	t.Run("Batched Sync", func(t *testing.T) {
+		fs, err := NewFileStorage(dir, 1024*1024, WithSyncMode(SyncBatched, 0))
+		assert.NoError(t, err)
+
+		assert.NoError(t, fs.Write("items", &Record{ID: "b", Data: map[string]interface{}{}}))
+		assert.NotEmpty(t, fs.dirtyFiles)
+		assert.NoError(t, fs.Close())
+		assert.Empty(t, fs.dirtyFiles)
+	})
+
+	t.Run("Failed Batch Rolls Back", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStorage(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		for _, id := range []int{1, 2} {
+			assert.NoError(t, fs.Write("items", &Record{ID: id, Data: map[string]interface{}{"n": "old"}}))
+		}
+
+		// A directory in the way of the last record makes its write fail
+		// after the earlier operations were applied
+		blocked, err := fs.getFilePath("items", 4)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Join(blocked, "x"), 0755))
+
+		err = fs.Batch([]Op{
+			{Type: OpWrite, Table: "items", Record: &Record{ID: 1, Data: map[string]interface{}{"n": "new"}}},
+			{Type: OpDelete, Table: "items", ID: 2},
+			{Type: OpWrite, Table: "items", Record: &Record{ID: 3, Data: map[string]interface{}{"n": "new"}}},
+			{Type: OpWrite, Table: "items", Record: &Record{ID: 4, Data: map[string]interface{}{"n": "new"}}},
+		})
+		assert.Error(t, err)
+
+		for _, id := range []int{1, 2} {
+			record, err := fs.Read("items", id)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "old", record.Data["n"])
+			}
+		}
+		record, err := fs.Read("items", 3)
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+		temps, _ := filepath.Glob(filepath.Join(dir, "items", "*"+tempFileExt))
+		assert.Empty(t, temps)
+	})
+}
+
+func TestKeyEncoding(t *testing.T) {
+	t.Run("Round Trip", func(t *testing.T) {
+		keys := []interface{}{0, -42, 1 << 40, uint64(1<<63 + 1), 1.5, "plain", "../../etc/x",
+			"a/b", "MixedCase", "with space%", "", "日本", true, false,
+			[]interface{}{1, "a,b", 2.5}, []interface{}{"x.y"}}
+		for _, key := range keys {
+			name, err := EncodeKey(key)
+			assert.NoError(t, err)
+			assert.NotContains(t, name, "/")
+			assert.NotContains(t, name, `\`)
+			assert.NotContains(t, name, ".")
+
+			decoded, err := DecodeKey(name)
+			assert.NoError(t, err)
+			assert.Equal(t, key, decoded)
+		}
+	})
+
+	t.Run("Integral Floats Match Ints", func(t *testing.T) {
+		a, _ := EncodeKey(7)
+		b, _ := EncodeKey(7.0)
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("Case Insensitive Distinct", func(t *testing.T) {
+		a, _ := EncodeKey("A")
+		b, _ := EncodeKey("a")
+		assert.NotEqual(t, strings.ToLower(a), strings.ToLower(b))
+	})
+
+	t.Run("Rejects Unsafe Input", func(t *testing.T) {
+		_, err := EncodeKey(strings.Repeat("x", 300))
+		assert.ErrorIs(t, err, ErrKeyTooLong)
+		_, err = EncodeKey([]byte("x"))
+		assert.ErrorIs(t, err, ErrInvalidKey)
+		_, err = DecodeKey("s../x")
+		assert.ErrorIs(t, err, ErrInvalidKey)
+		_, err = EncodeKey([]interface{}{1, []interface{}{2}})
+		assert.ErrorIs(t, err, ErrInvalidKey)
+		_, err = DecodeKey("ti1,,i2")
+		assert.ErrorIs(t, err, ErrInvalidKey)
+	})
+
+	t.Run("Paths Stay In Table Directory", func(t *testing.T) {
+		dir := t.TempDir()
+		fs, err := NewFileStorage(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		assert.NoError(t, fs.Write("items", &Record{ID: "../../escape", Data: map[string]interface{}{}}))
+		assert.NoError(t, fs.Write("items", &Record{ID: 12, Data: map[string]interface{}{}}))
+		assert.ErrorIs(t, fs.Write("../items", &Record{ID: 1}), ErrInvalidTableName)
+
+		var ids []interface{}
+		assert.NoError(t, fs.Scan("items", func(r *Record) error {
+			ids = append(ids, r.ID)
+			return nil
+		}))
+		assert.ElementsMatch(t, []interface{}{"../../escape", 12}, ids)
+
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			assert.True(t, e.Name() == "items" || e.Name() == layoutFileName, e.Name())
+		}
+	})
+}
+
+func TestLayoutMigration(t *testing.T) {
+	dir := t.TempDir()
+	table := filepath.Join(dir, "users")
+	assert.NoError(t, os.MkdirAll(table, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(table, "1.json"),
+		[]byte(`{"id":1,"data":{"id":1,"name":"one"},"version":1}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(table, "bob.json"),
+		[]byte(`{"id":"bob","data":{"id":"bob"},"version":1}`), 0644))
+
+	fs, err := NewFileStorage(dir, 1024*1024)
+	assert.NoError(t, err)
+	defer fs.Close()
+
+	record, err := fs.Read("users", 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+	assert.Equal(t, 1, record.ID)
+	assert.Equal(t, "one", record.Data["name"])
+
+	record, err = fs.Read("users", "bob")
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+
+	l, err := fs.readLayout()
+	assert.NoError(t, err)
+	assert.Equal(t, layoutVersion, l.Version)
+
+	_, err = os.Stat(filepath.Join(table, "1.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSharding(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir, 1024*1024, WithSharding(Sharding{Depth: 2, Width: 16}))
+	assert.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, fs.Write("items", &Record{ID: i, Data: map[string]interface{}{"n": i}}))
+	}
+
+	name, _ := EncodeKey(7)
+	_, err = os.Stat(filepath.Join(dir, "items", Sharding{Depth: 2, Width: 16}.dir(name), name+recordFileExt))
+	assert.NoError(t, err)
+
+	countRecords := func(fs *FileStorage) int {
+		count := 0
+		assert.NoError(t, fs.Scan("items", func(*Record) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+	assert.Equal(t, 50, countRecords(fs))
+
+	assert.NoError(t, fs.Delete("items", 7))
+	record, err := fs.Read("items", 7)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	t.Run("Reshard", func(t *testing.T) {
+		assert.NoError(t, fs.Reshard("items", Sharding{Depth: 1, Width: 4}))
+		assert.NoError(t, fs.Close())
+
+		// The table keeps its sharding across reopen regardless of the default
+		fs, err := NewFileStorage(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer fs.Close()
+
+		sharding, err := fs.TableSharding("items")
+		assert.NoError(t, err)
+		assert.Equal(t, Sharding{Depth: 1, Width: 4}, sharding)
+		assert.Equal(t, 49, countRecords(fs))
+
+		record, err := fs.Read("items", 8)
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+
+		entries, _ := os.ReadDir(filepath.Join(dir, "items"))
+		assert.LessOrEqual(t, len(entries), 4)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := NewFileStorage(t.TempDir(), 0, WithSharding(Sharding{Depth: 1, Width: 1}))
+		assert.ErrorIs(t, err, ErrInvalidSharding)
+	})
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidKey       = errors.New("invalid key")
+	ErrKeyTooLong       = errors.New("encoded key too long")
+	ErrInvalidTableName = errors.New("invalid table name")
+)
+
+// maxEncodedKeyLen keeps "<key>.json" below the common 255 byte name limit
+const maxEncodedKeyLen = 240
+
+// Key type tags used as the first byte of an encoded key
+const (
+	keyInt    = 'i'
+	keyUint   = 'u'
+	keyFloat  = 'f'
+	keyString = 's'
+	keyBool   = 'b'
+	keyTuple  = 't'
+)
+
+// tupleSeparator joins the elements of a tuple key. escapeKey escapes ',',
+// so encoded elements never contain it.
+const tupleSeparator = ","
+
+// EncodeKey converts a primary key into a reversible, filesystem-safe name.
+//
+// The first byte tags the key type and the rest holds its value. Bytes other
+// than lowercase letters, digits, '-' and '_' are escaped as %XX so names never
+// contain path separators, never collide on case-insensitive filesystems and
+// can never be "." or "..". Floats with an integral value are encoded as
+// integers because JSON does not distinguish the two. A []interface{} is a
+// tuple key, as used by composite primary keys; its elements are encoded in
+// order and may not be tuples themselves.
+func EncodeKey(id interface{}) (string, error) {
+	var encoded string
+	switch v := id.(type) {
+	case int:
+		encoded = string(keyInt) + strconv.FormatInt(int64(v), 10)
+	case int8:
+		encoded = string(keyInt) + strconv.FormatInt(int64(v), 10)
+	case int16:
+		encoded = string(keyInt) + strconv.FormatInt(int64(v), 10)
+	case int32:
+		encoded = string(keyInt) + strconv.FormatInt(int64(v), 10)
+	case int64:
+		encoded = string(keyInt) + strconv.FormatInt(v, 10)
+	case uint:
+		encoded = encodeUint(uint64(v))
+	case uint8:
+		encoded = encodeUint(uint64(v))
+	case uint16:
+		encoded = encodeUint(uint64(v))
+	case uint32:
+		encoded = encodeUint(uint64(v))
+	case uint64:
+		encoded = encodeUint(v)
+	case float32:
+		encoded = encodeFloat(float64(v))
+	case float64:
+		encoded = encodeFloat(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			encoded = string(keyInt) + strconv.FormatInt(n, 10)
+		} else if f, err := v.Float64(); err == nil {
+			encoded = encodeFloat(f)
+		} else {
+			return "", fmt.Errorf("%w: %s", ErrInvalidKey, v)
+		}
+	case string:
+		encoded = string(keyString) + escapeKey(v)
+	case bool:
+		if v {
+			encoded = string(keyBool) + "1"
+		} else {
+			encoded = string(keyBool) + "0"
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return "", fmt.Errorf("%w: empty tuple", ErrInvalidKey)
+		}
+		parts := make([]string, len(v))
+		for i, element := range v {
+			if _, nested := element.([]interface{}); nested {
+				return "", fmt.Errorf("%w: nested tuple", ErrInvalidKey)
+			}
+			part, err := EncodeKey(element)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		encoded = string(keyTuple) + strings.Join(parts, tupleSeparator)
+	default:
+		return "", fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, id)
+	}
+
+	if len(encoded) > maxEncodedKeyLen {
+		return "", fmt.Errorf("%w: %d bytes", ErrKeyTooLong, len(encoded))
+	}
+	return encoded, nil
+}
+
+// DecodeKey restores the typed primary key from a name produced by EncodeKey
+func DecodeKey(name string) (interface{}, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty name", ErrInvalidKey)
+	}
+
+	value := name[1:]
+	switch name[0] {
+	case keyInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, name)
+		}
+		if n >= math.MinInt && n <= math.MaxInt {
+			return int(n), nil
+		}
+		return n, nil
+	case keyUint:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, name)
+		}
+		return n, nil
+	case keyFloat:
+		s, err := unescapeKey(value)
+		if err != nil {
+			return nil, err
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, name)
+		}
+		return f, nil
+	case keyString:
+		return unescapeKey(value)
+	case keyBool:
+		switch value {
+		case "1":
+			return true, nil
+		case "0":
+			return false, nil
+		}
+	case keyTuple:
+		parts := strings.Split(value, tupleSeparator)
+		tuple := make([]interface{}, len(parts))
+		for i, part := range parts {
+			if part == "" || part[0] == keyTuple {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidKey, name)
+			}
+			element, err := DecodeKey(part)
+			if err != nil {
+				return nil, err
+			}
+			tuple[i] = element
+		}
+		return tuple, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInvalidKey, name)
+}
+
+// encodeUint encodes unsigned integers, sharing the int form when it fits
+func encodeUint(v uint64) string {
+	if v <= math.MaxInt64 {
+		return string(keyInt) + strconv.FormatUint(v, 10)
+	}
+	return string(keyUint) + strconv.FormatUint(v, 10)
+}
+
+// encodeFloat encodes floats, using the int form for integral values
+func encodeFloat(v float64) string {
+	if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+		return string(keyInt) + strconv.FormatInt(int64(v), 10)
+	}
+	return string(keyFloat) + escapeKey(strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// escapeKey percent-encodes every byte outside [a-z0-9_-]
+func escapeKey(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isSafeKeyByte(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+// unescapeKey reverses escapeKey
+func unescapeKey(s string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			if !isSafeKeyByte(c) {
+				return "", fmt.Errorf("%w: unexpected byte %q", ErrInvalidKey, c)
+			}
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("%w: truncated escape", ErrInvalidKey)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w: bad escape %q", ErrInvalidKey, s[i:i+3])
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isSafeKeyByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+// validateTableName rejects table names that would escape the storage
+// directory or clash with internal directories, which start with '.'
+func validateTableName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `/\`+"\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidTableName, name)
+	}
+	return nil
+}
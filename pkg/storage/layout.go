@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// layoutFileName records the on-disk layout version at the storage root
+	layoutFileName = ".layout"
+
+	// layoutVersion is the current layout. Version 1 named record files
+	// "<id>.json" verbatim, version 2 names them with EncodeKey and version 3
+	// records the directory sharding of every table.
+	layoutVersion = 3
+
+	// keyEncodingVersion is the first layout that uses EncodeKey
+	keyEncodingVersion = 2
+
+	migratePrefix = ".migrate-"
+	legacyPrefix  = ".legacy-"
+)
+
+// layout is the persisted description of the storage directory
+type layout struct {
+	Version int                    `json:"version"`
+	Tables  map[string]tableLayout `json:"tables"`
+}
+
+// tableLayout describes how the record files of one table are laid out
+type tableLayout struct {
+	Sharding Sharding `json:"sharding"`
+	// Target is set while the table is being resharded
+	Target *Sharding `json:"target,omitempty"`
+}
+
+// readLayout loads the layout file, treating a missing file as version 1
+func (fs *FileStorage) readLayout() (layout, error) {
+	data, err := os.ReadFile(filepath.Join(fs.basePath, layoutFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return layout{Version: 1, Tables: make(map[string]tableLayout)}, nil
+		}
+		return layout{}, fmt.Errorf("failed to read layout: %w", err)
+	}
+
+	var l layout
+	if err := json.Unmarshal(data, &l); err != nil {
+		return layout{}, fmt.Errorf("failed to unmarshal layout: %w", err)
+	}
+	if l.Tables == nil {
+		l.Tables = make(map[string]tableLayout)
+	}
+	return l, nil
+}
+
+// writeLayout persists the layout file
+func (fs *FileStorage) writeLayout(l layout) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal layout: %w", err)
+	}
+	if err := fs.writeFileAtomic(filepath.Join(fs.basePath, layoutFileName), data); err != nil {
+		return fmt.Errorf("failed to write layout: %w", err)
+	}
+	return nil
+}
+
+// migrateLayout loads the layout and upgrades data written by older versions.
+//
+// For the key encoding, each table is copied into a ".migrate-<table>"
+// directory under its encoded names and then swapped in place of the
+// original, so an interrupted migration either resumes from the untouched
+// original or finishes the swap. Tables that predate sharding stay flat.
+func (fs *FileStorage) migrateLayout() error {
+	l, err := fs.readLayout()
+	if err != nil {
+		return err
+	}
+	fs.layout = l
+	if l.Version >= layoutVersion {
+		return nil
+	}
+
+	tables, err := fs.listTableDirs()
+	if err != nil {
+		return err
+	}
+
+	if l.Version < keyEncodingVersion {
+		if err := fs.recoverMigration(); err != nil {
+			return err
+		}
+		if tables, err = fs.listTableDirs(); err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if err := fs.migrateTable(table); err != nil {
+				return fmt.Errorf("failed to migrate table %s: %w", table, err)
+			}
+		}
+	}
+
+	for _, table := range tables {
+		if _, ok := fs.layout.Tables[table]; !ok {
+			fs.layout.Tables[table] = tableLayout{}
+		}
+	}
+
+	fs.layout.Version = layoutVersion
+	return fs.writeLayout(fs.layout)
+}
+
+// listTableDirs returns the names of all table directories
+func (fs *FileStorage) listTableDirs() ([]string, error) {
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var tables []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			tables = append(tables, entry.Name())
+		}
+	}
+	return tables, nil
+}
+
+// tableLayoutFor returns the layout of a table, falling back to the default
+// sharding for tables that have not been written yet. Callers hold fs.mu.
+func (fs *FileStorage) tableLayoutFor(tableName string) tableLayout {
+	if tl, ok := fs.layout.Tables[tableName]; ok {
+		return tl
+	}
+	return tableLayout{Sharding: fs.sharding}
+}
+
+// registerTable persists the layout of a table on its first write. Callers
+// hold fs.mu exclusively.
+func (fs *FileStorage) registerTable(tableName string) error {
+	if _, ok := fs.layout.Tables[tableName]; ok {
+		return nil
+	}
+	fs.layout.Tables[tableName] = tableLayout{Sharding: fs.sharding}
+	if err := fs.writeLayout(fs.layout); err != nil {
+		delete(fs.layout.Tables, tableName)
+		return err
+	}
+	return nil
+}
+
+// ensureTables registers the layout of every table that has not been written
+// yet. Tables are never unregistered, so callers may then take fs.mu shared.
+func (fs *FileStorage) ensureTables(tableNames ...string) error {
+	var missing []string
+	fs.mu.RLock()
+	for _, tableName := range tableNames {
+		if _, ok := fs.layout.Tables[tableName]; !ok {
+			missing = append(missing, tableName)
+		}
+	}
+	fs.mu.RUnlock()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, tableName := range missing {
+		if err := validateTableName(tableName); err != nil {
+			return err
+		}
+		if err := fs.registerTable(tableName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTable rewrites the record files of one table under encoded names
+func (fs *FileStorage) migrateTable(tableName string) error {
+	src := filepath.Join(fs.basePath, tableName)
+	dst := filepath.Join(fs.basePath, migratePrefix+tableName)
+	old := filepath.Join(fs.basePath, legacyPrefix+tableName)
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != recordFileExt {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var record Record
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+
+		name, err := EncodeKey(record.ID)
+		if err != nil {
+			return fmt.Errorf("failed to encode key of %s: %w", path, err)
+		}
+		return fs.writeFileAtomic(filepath.Join(dst, name+recordFileExt), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, old); err != nil {
+		return err
+	}
+	if err := os.Rename(dst, src); err != nil {
+		return err
+	}
+	if err := syncPath(fs.basePath); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// recoverMigration cleans up after a migration that was interrupted
+func (fs *FileStorage) recoverMigration() error {
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(fs.basePath, name))
+		return err == nil
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(fs.basePath, name)
+		switch {
+		case strings.HasPrefix(name, migratePrefix):
+			table := strings.TrimPrefix(name, migratePrefix)
+			if exists(table) {
+				// The original is intact, start that table over
+				err = os.RemoveAll(path)
+			} else {
+				// The original was moved aside, finish the swap
+				err = os.Rename(path, filepath.Join(fs.basePath, table))
+			}
+		case strings.HasPrefix(name, legacyPrefix):
+			table := strings.TrimPrefix(name, legacyPrefix)
+			if exists(table) || exists(migratePrefix+table) {
+				err = os.RemoveAll(path)
+			} else {
+				err = os.Rename(path, filepath.Join(fs.basePath, table))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to recover migration of %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrClosed is returned by operations on a closed engine
+var ErrClosed = errors.New("storage closed")
+
+// MemoryStorage is an Engine that keeps every record in memory. It is meant
+// for unit tests and ephemeral caches; nothing survives the process.
+type MemoryStorage struct {
+	tables map[string]map[string]*Record
+	blobs  map[string][]byte
+	closed bool
+	mu     sync.RWMutex
+}
+
+var _ Engine = (*MemoryStorage)(nil)
+
+// NewMemoryStorage creates an empty in-memory engine
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		tables: make(map[string]map[string]*Record),
+		blobs:  make(map[string][]byte),
+	}
+}
+
+// Write writes a record to memory
+func (ms *MemoryStorage) Write(tableName string, record *Record) error {
+	key, err := memoryKey(tableName, record.ID)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.closed {
+		return ErrClosed
+	}
+	ms.put(tableName, key, record)
+	return nil
+}
+
+// Read reads a record from memory
+func (ms *MemoryStorage) Read(tableName string, id interface{}) (*Record, error) {
+	key, err := memoryKey(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.closed {
+		return nil, ErrClosed
+	}
+	record, ok := ms.tables[tableName][key]
+	if !ok {
+		return nil, nil
+	}
+	return cloneRecord(record), nil
+}
+
+// Delete removes a record from memory
+func (ms *MemoryStorage) Delete(tableName string, id interface{}) error {
+	key, err := memoryKey(tableName, id)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.closed {
+		return ErrClosed
+	}
+	delete(ms.tables[tableName], key)
+	return nil
+}
+
+// Scan calls fn for every record of a table in key order. It works on a
+// snapshot taken when the scan starts, so fn may modify the table.
+func (ms *MemoryStorage) Scan(tableName string, fn func(*Record) error) error {
+	if err := validateTableName(tableName); err != nil {
+		return err
+	}
+
+	ms.mu.RLock()
+	if ms.closed {
+		ms.mu.RUnlock()
+		return ErrClosed
+	}
+	table := ms.tables[tableName]
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]*Record, len(keys))
+	for i, key := range keys {
+		records[i] = table[key]
+	}
+	ms.mu.RUnlock()
+
+	for _, record := range records {
+		if err := fn(cloneRecord(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch applies a group of writes and deletes atomically
+func (ms *MemoryStorage) Batch(ops []Op) error {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		var err error
+		switch op.Type {
+		case OpWrite:
+			if op.Record == nil {
+				return fmt.Errorf("%w: write without record", ErrInvalidOp)
+			}
+			keys[i], err = memoryKey(op.Table, op.Record.ID)
+		case OpDelete:
+			keys[i], err = memoryKey(op.Table, op.ID)
+		default:
+			return fmt.Errorf("%w: unknown op type %d", ErrInvalidOp, op.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.closed {
+		return ErrClosed
+	}
+	for i, op := range ops {
+		if op.Type == OpWrite {
+			ms.put(op.Table, keys[i], op.Record)
+		} else {
+			delete(ms.tables[op.Table], keys[i])
+		}
+	}
+	return nil
+}
+
+// Close discards all records and blobs
+func (ms *MemoryStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.closed = true
+	ms.tables = nil
+	ms.blobs = nil
+	return nil
+}
+
+// put stores a copy of record. Callers hold ms.mu exclusively.
+func (ms *MemoryStorage) put(tableName, key string, record *Record) {
+	table, ok := ms.tables[tableName]
+	if !ok {
+		table = make(map[string]*Record)
+		ms.tables[tableName] = table
+	}
+	stored := cloneRecord(record)
+	stored.ID, _ = DecodeKey(key)
+	table[key] = stored
+}
+
+// memoryKey validates a table name and canonicalizes a key
+func memoryKey(tableName string, id interface{}) (string, error) {
+	if err := validateTableName(tableName); err != nil {
+		return "", err
+	}
+	return EncodeKey(id)
+}
+
+// cloneRecord deep copies a record so callers cannot alias stored data
+func cloneRecord(record *Record) *Record {
+	return &Record{
+		ID:      record.ID,
+		Data:    cloneValue(record.Data).(map[string]interface{}),
+		Version: record.Version,
+		Schema:  record.Schema,
+	}
+}
+
+// cloneValue deep copies maps, slices and byte slices
+func cloneValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return map[string]interface{}{}
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = cloneValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = cloneValue(item)
+		}
+		return out
+	case []byte:
+		out := make([]byte, len(v))
+		copy(out, v)
+		return out
+	default:
+		return value
+	}
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxShardDepth is the maximum number of nested shard directories
+	MaxShardDepth = 4
+	// MaxShardWidth is the maximum number of subdirectories per shard level
+	MaxShardWidth = 1 << 16
+)
+
+// ErrInvalidSharding is returned for out of range sharding parameters
+var ErrInvalidSharding = errors.New("invalid sharding")
+
+// Sharding fans the record files of a table out into hashed subdirectories.
+// Depth is the number of directory levels and Width the number of
+// directories per level; a zero Depth keeps every record in the table
+// directory itself.
+type Sharding struct {
+	Depth int `json:"depth"`
+	Width int `json:"width"`
+}
+
+// Validate checks that the sharding parameters are usable
+func (s Sharding) Validate() error {
+	if s.Depth < 0 || s.Depth > MaxShardDepth {
+		return fmt.Errorf("%w: depth must be between 0 and %d", ErrInvalidSharding, MaxShardDepth)
+	}
+	if s.Depth > 0 && (s.Width < 2 || s.Width > MaxShardWidth) {
+		return fmt.Errorf("%w: width must be between 2 and %d", ErrInvalidSharding, MaxShardWidth)
+	}
+	return nil
+}
+
+// dir returns the shard directory, relative to the table directory, for an
+// encoded key
+func (s Sharding) dir(name string) string {
+	if s.Depth == 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+
+	digits := len(fmt.Sprintf("%x", s.Width-1))
+	width := uint64(s.Width)
+	parts := make([]string, s.Depth)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%0*x", digits, sum%width)
+		sum /= width
+	}
+	return filepath.Join(parts...)
+}
+
+// WithSharding sets the sharding used for tables created by this storage
+func WithSharding(sharding Sharding) Option {
+	return func(fs *FileStorage) {
+		fs.sharding = sharding
+	}
+}
+
+// TableSharding returns the current sharding of a table
+func (fs *FileStorage) TableSharding(tableName string) (Sharding, error) {
+	if err := validateTableName(tableName); err != nil {
+		return Sharding{}, err
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.tableLayoutFor(tableName).Sharding, nil
+}
+
+// Reshard moves every record of a table into the directories of a new
+// sharding. The target is persisted before any file moves, so an
+// interrupted reshard is completed the next time the storage is opened.
+func (fs *FileStorage) Reshard(tableName string, sharding Sharding) error {
+	if err := validateTableName(tableName); err != nil {
+		return err
+	}
+	if err := sharding.Validate(); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.registerTable(tableName); err != nil {
+		return err
+	}
+
+	tl := fs.layout.Tables[tableName]
+	tl.Target = &sharding
+	fs.layout.Tables[tableName] = tl
+	if err := fs.writeLayout(fs.layout); err != nil {
+		return err
+	}
+
+	return fs.finishReshard(tableName)
+}
+
+// resumeReshards completes reshards interrupted by a crash
+func (fs *FileStorage) resumeReshards() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var pending []string
+	for name, tl := range fs.layout.Tables {
+		if tl.Target != nil {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+
+	for _, name := range pending {
+		if err := fs.finishReshard(name); err != nil {
+			return fmt.Errorf("failed to resume reshard of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// finishReshard moves records to the target sharding of a table and then
+// makes it current. Callers hold fs.mu exclusively.
+func (fs *FileStorage) finishReshard(tableName string) error {
+	tl := fs.layout.Tables[tableName]
+	target := *tl.Target
+	tableDir := filepath.Join(fs.basePath, tableName)
+
+	if _, err := os.Stat(tableDir); err == nil {
+		var files []string
+		err := filepath.Walk(tableDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && filepath.Ext(path) == recordFileExt {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list records: %w", err)
+		}
+
+		dirs := make(map[string]struct{})
+		for _, path := range files {
+			name := strings.TrimSuffix(filepath.Base(path), recordFileExt)
+			dir := filepath.Join(tableDir, target.dir(name))
+			newPath := filepath.Join(dir, filepath.Base(path))
+			if newPath == path {
+				continue
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create shard directory: %w", err)
+			}
+			if err := os.Rename(path, newPath); err != nil {
+				return fmt.Errorf("failed to move record: %w", err)
+			}
+			dirs[dir] = struct{}{}
+			dirs[filepath.Dir(path)] = struct{}{}
+		}
+
+		if fs.syncMode != SyncNone {
+			for dir := range dirs {
+				if err := syncPath(dir); err != nil {
+					return fmt.Errorf("failed to sync directory: %w", err)
+				}
+			}
+		}
+
+		if err := removeEmptyDirs(tableDir); err != nil {
+			return err
+		}
+	}
+
+	fs.layout.Tables[tableName] = tableLayout{Sharding: target}
+	return fs.writeLayout(fs.layout)
+}
+
+// removeEmptyDirs removes empty shard directories below root, keeping root
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list shard directories: %w", err)
+	}
+
+	// Deepest directories first so parents become empty before they are checked
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read shard directory: %w", err)
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return fmt.Errorf("failed to remove shard directory: %w", err)
+			}
+		}
+	}
+	return nil
+}